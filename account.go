@@ -0,0 +1,89 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"log"
+	"sync"
+)
+
+// AccountStore looks up the shared secret of the SP with sourceAddr,
+// it is used by the server to verify the connect requests, see
+// HandleAccounts.
+type AccountStore interface {
+	Secret(sourceAddr string) (string, bool)
+}
+
+// MemoryAccountStore is an AccountStore kept in memory. It is safe for
+// concurrent use, the accounts could be changed while the server is running.
+type MemoryAccountStore struct {
+	l        sync.RWMutex
+	accounts map[string]string
+}
+
+// NewMemoryAccountStore returns a MemoryAccountStore with accounts, which
+// maps the Source_Addr of the SPs to their shared secrets. accounts is
+// copied.
+func NewMemoryAccountStore(accounts map[string]string) *MemoryAccountStore {
+	s := &MemoryAccountStore{
+		accounts: make(map[string]string, len(accounts)),
+	}
+	for addr, secret := range accounts {
+		s.accounts[addr] = secret
+	}
+	return s
+}
+
+// Secret returns the shared secret of sourceAddr.
+func (s *MemoryAccountStore) Secret(sourceAddr string) (string, bool) {
+	s.l.RLock()
+	secret, ok := s.accounts[sourceAddr]
+	s.l.RUnlock()
+	return secret, ok
+}
+
+// Set adds or updates the account of sourceAddr.
+func (s *MemoryAccountStore) Set(sourceAddr, secret string) {
+	s.l.Lock()
+	s.accounts[sourceAddr] = secret
+	s.l.Unlock()
+}
+
+// Delete removes the account of sourceAddr, the established connections
+// are not affected.
+func (s *MemoryAccountStore) Delete(sourceAddr string) {
+	s.l.Lock()
+	delete(s.accounts, sourceAddr)
+	s.l.Unlock()
+}
+
+// HandleAccounts returns a Handler which answers the connect requests,
+// the AuthenticatorSource in the request is verified with the secret of
+// its Source_Addr in store. An unknown Source_Addr or a wrong
+// AuthenticatorSource is rejected with status 3(auth failed).
+// Other packets are passed to the next handler in the chain.
+func HandleAccounts(store AccountStore) Handler {
+	return HandlerFunc(func(r *Response, p *Packet, l *log.Logger) (bool, error) {
+		req, ok := p.Packer.(*CmppConnReqPkt)
+		if !ok {
+			return true, nil
+		}
+
+		secret, ok := store.Secret(req.SrcAddr)
+		if !ok || !VerifyAuthenticator(req, secret) {
+			return false, answerConnect(r, p, l, ErrnoConnAuthFailed, "")
+		}
+		return false, answerConnect(r, p, l, 0, secret)
+	})
+}
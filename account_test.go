@@ -0,0 +1,68 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestMemoryAccountStore(t *testing.T) {
+	s := cmpp.NewMemoryAccountStore(map[string]string{"900001": "888888"})
+
+	if secret, ok := s.Secret("900001"); !ok || secret != "888888" {
+		t.Fatalf("The secret is %q, %v, not equal to expected: %q, true\n", secret, ok, "888888")
+	}
+
+	s.Set("900002", "999999")
+	if secret, ok := s.Secret("900002"); !ok || secret != "999999" {
+		t.Fatalf("The secret is %q, %v, not equal to expected: %q, true\n", secret, ok, "999999")
+	}
+
+	s.Delete("900001")
+	if _, ok := s.Secret("900001"); ok {
+		t.Fatal("The deleted account is still found")
+	}
+}
+
+func TestHandleAccounts(t *testing.T) {
+	store := cmpp.NewMemoryAccountStore(map[string]string{
+		"900001": "888888",
+		"900002": "999999",
+	})
+	addr := startTestServer(t, cmpp.HandleAccounts(store))
+
+	cases := []struct {
+		user, password string
+		err            error
+	}{
+		{"900001", "888888", nil},
+		{"900002", "999999", nil},
+		{"900002", "888888", cmpp.ConnStatusAuthFailed},
+		{"900003", "888888", cmpp.ConnStatusAuthFailed},
+	}
+
+	for _, cs := range cases {
+		c := cmpp.NewClient(cmpp.V30)
+		err := c.Connect(addr, cs.user, cs.password, time.Second)
+		if err != cs.err {
+			t.Fatalf("The error of %s is %v, not equal to expected: %v\n", cs.user, err, cs.err)
+		}
+		if err == nil {
+			c.Disconnect()
+		}
+	}
+}
@@ -33,9 +33,18 @@ type CmppActiveTestRspPkt struct {
 
 // Pack packs the CmppActiveTestReqPkt to bytes stream for client side.
 func (p *CmppActiveTestReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppActiveTestReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppActiveTestReqPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen = CmppActiveTestReqPktLen
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -43,7 +52,7 @@ func (p *CmppActiveTestReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, seqId)
 	p.SeqId = seqId
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a CmppActiveTestReqPkt variable.
@@ -53,15 +62,24 @@ func (p *CmppActiveTestReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
-	return r.Error()
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+	return r.unpackError(CMPP_ACTIVE_TEST, p)
 }
 
 // Pack packs the CmppActiveTestRspPkt to bytes stream for client side.
 func (p *CmppActiveTestRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppActiveTestRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppActiveTestRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen = CmppActiveTestRspPktLen
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -70,7 +88,7 @@ func (p *CmppActiveTestRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.Reserved)
 	p.SeqId = seqId
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a CmppActiveTestRspPkt variable.
@@ -80,7 +98,21 @@ func (p *CmppActiveTestRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
-	p.Reserved = r.ReadByte()
-	return r.Error()
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+	p.Reserved = r.at("Reserved").ReadByte()
+	return r.unpackError(CMPP_ACTIVE_TEST_RESP, p)
+}
+
+// String returns the text form of p.
+func (p *CmppActiveTestReqPkt) String() string {
+	s := newPktString("CmppActiveTestReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	return s.String()
+}
+
+// String returns the text form of p.
+func (p *CmppActiveTestRspPkt) String() string {
+	s := newPktString("CmppActiveTestRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	return s.String()
 }
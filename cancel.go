@@ -0,0 +1,173 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import "encoding/binary"
+
+// Packet length const for cmpp cancel request and response packets.
+const (
+	CmppCancelReqPktLen  uint32 = 12 + 8 //20d, 0x14
+	Cmpp2CancelRspPktLen uint32 = 12 + 1 //13d, 0xd
+	Cmpp3CancelRspPktLen uint32 = 12 + 4 //16d, 0x10
+)
+
+// SuccessId in cancel resp.
+const (
+	CancelSucceeded = 0
+	CancelFailed    = 1
+)
+
+type CmppCancelReqPkt struct {
+	MsgId uint64 // the msg id of the message to cancel
+
+	// session info
+	SeqId uint32
+}
+
+type Cmpp2CancelRspPkt struct {
+	SuccessId uint8
+
+	// session info
+	SeqId uint32
+}
+
+type Cmpp3CancelRspPkt struct {
+	SuccessId uint32
+
+	// session info
+	SeqId uint32
+}
+
+// Pack packs the CmppCancelReqPkt to bytes stream for client side.
+func (p *CmppCancelReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppCancelReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppCancelReqPkt) pack(w *packetWriter, seqId uint32) error {
+	var pktLen = CmppCancelReqPktLen
+
+	w.Grow(pktLen)
+
+	// Pack header
+	w.WriteInt(binary.BigEndian, pktLen)
+	w.WriteInt(binary.BigEndian, CMPP_CANCEL)
+	w.WriteInt(binary.BigEndian, seqId)
+	p.SeqId = seqId
+
+	// Pack Body
+	w.WriteInt(binary.BigEndian, p.MsgId)
+
+	return w.Error()
+}
+
+// Unpack unpack the binary byte stream to a CmppCancelReqPkt variable.
+// Usually it is used in server side. After unpack, you will get all value of fields in
+// CmppCancelReqPkt struct.
+func (p *CmppCancelReqPkt) Unpack(data []byte) error {
+	var r = newPacketReader(data)
+
+	// Sequence Id
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	// Body
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	return r.unpackError(CMPP_CANCEL, p)
+}
+
+// Pack packs the Cmpp2CancelRspPkt to bytes stream for server side.
+func (p *Cmpp2CancelRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2CancelRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2CancelRspPkt) pack(w *packetWriter, seqId uint32) error {
+	var pktLen = Cmpp2CancelRspPktLen
+
+	w.Grow(pktLen)
+
+	// Pack header
+	w.WriteInt(binary.BigEndian, pktLen)
+	w.WriteInt(binary.BigEndian, CMPP_CANCEL_RESP)
+	w.WriteInt(binary.BigEndian, seqId)
+	p.SeqId = seqId
+
+	// Pack Body
+	w.WriteByte(p.SuccessId)
+
+	return w.Error()
+}
+
+// Unpack unpack the binary byte stream to a Cmpp2CancelRspPkt variable.
+// Usually it is used in client side. After unpack, you will get all value of fields in
+// Cmpp2CancelRspPkt struct.
+func (p *Cmpp2CancelRspPkt) Unpack(data []byte) error {
+	var r = newPacketReader(data)
+
+	// Sequence Id
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	// Body
+	p.SuccessId = r.at("SuccessId").ReadByte()
+	return r.unpackError(CMPP_CANCEL_RESP, p)
+}
+
+// Pack packs the Cmpp3CancelRspPkt to bytes stream for server side.
+func (p *Cmpp3CancelRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3CancelRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3CancelRspPkt) pack(w *packetWriter, seqId uint32) error {
+	var pktLen = Cmpp3CancelRspPktLen
+
+	w.Grow(pktLen)
+
+	// Pack header
+	w.WriteInt(binary.BigEndian, pktLen)
+	w.WriteInt(binary.BigEndian, CMPP_CANCEL_RESP)
+	w.WriteInt(binary.BigEndian, seqId)
+	p.SeqId = seqId
+
+	// Pack Body
+	w.WriteInt(binary.BigEndian, p.SuccessId)
+
+	return w.Error()
+}
+
+// Unpack unpack the binary byte stream to a Cmpp3CancelRspPkt variable.
+// Usually it is used in client side. After unpack, you will get all value of fields in
+// Cmpp3CancelRspPkt struct.
+func (p *Cmpp3CancelRspPkt) Unpack(data []byte) error {
+	var r = newPacketReader(data)
+
+	// Sequence Id
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	// Body
+	r.at("SuccessId").ReadInt(binary.BigEndian, &p.SuccessId)
+	return r.unpackError(CMPP_CANCEL_RESP, p)
+}
@@ -15,18 +15,66 @@ package cmpp
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 var ErrNotCompleted = errors.New("data not being handled completed")
 var ErrRespNotMatch = errors.New("the response is not matched with the request")
+var ErrVersionIncompatible = errors.New("the version of the server is incompatible with the client")
+var ErrAuthIsmgMismatch = errors.New("the AuthenticatorISMG of the connect response is mismatched")
+var ErrConnectTimeout = errors.New("no connect response returned in time")
 
 // Client stands for one client-side instance, just like a session.
 // It may connect to the server, send & recv cmpp packets and terminate the connection.
 type Client struct {
 	conn *Conn
 	typ  Type
+	opts []Option // for the Conn
+
+	textParams SubmitParams
+	textMsgFmt func(content string) uint8 // nil means ChooseMsgFmt
+
+	// for SubmitAsync
+	submitTimeout time.Duration
+	pmu           sync.Mutex
+	pending       *PendingTable // created by the first SubmitAsync
+	orphan        func(id CommandId, seqId uint32, resp interface{})
+	// packets received while SendText waits for the submit responses,
+	// they are returned by RecvAndUnpackPkt first.
+	blMu    sync.Mutex
+	backlog []interface{}
+}
+
+// maxBacklog is the max number of the packets kept by SendText for
+// RecvAndUnpackPkt, the oldest ones are dropped beyond it.
+const maxBacklog = 1024
+
+// pushBacklog keeps p for RecvAndUnpackPkt.
+func (cli *Client) pushBacklog(p interface{}) {
+	cli.blMu.Lock()
+	defer cli.blMu.Unlock()
+	if len(cli.backlog) >= maxBacklog {
+		cli.conn.log().Errorf("cmpp: drop the packet %T kept by SendText, more than %d are kept", cli.backlog[0], maxBacklog)
+		cli.backlog[0] = nil
+		cli.backlog = cli.backlog[1:]
+	}
+	cli.backlog = append(cli.backlog, p)
+}
+
+// popBacklog returns the first packet kept by SendText, if any.
+func (cli *Client) popBacklog() (interface{}, bool) {
+	cli.blMu.Lock()
+	defer cli.blMu.Unlock()
+	if len(cli.backlog) == 0 {
+		return nil, false
+	}
+	p := cli.backlog[0]
+	cli.backlog[0] = nil
+	cli.backlog = cli.backlog[1:]
+	return p, true
 }
 
 // New establishes a new cmpp client.
@@ -36,15 +84,35 @@ func NewClient(typ Type) *Client {
 	}
 }
 
+// NewClientWithOptions is like NewClient, but the connection of the
+// client is created with opts, see NewConnWithOptions.
+func NewClientWithOptions(typ Type, opts ...Option) *Client {
+	return &Client{
+		typ:  typ,
+		opts: opts,
+	}
+}
+
 // Connect connect to the cmpp server in block mode.
 // It sends login packet, receive and parse connect response packet.
+// A non-zero status in the response is returned as a ConnStatus error,
+// and an AuthenticatorISMG not computed from password, see
+// VerifyAuthenticatorISMG, as ErrAuthIsmgMismatch.
+//
+// The timeout limits the dialing, and the wait for the connect response
+// is limited by WithConnectTimeout.
+//
+// The client switches to the version in the response if it is lower
+// than the requested one, e.g. a cmpp30 client works in cmpp21 with a
+// cmpp21 server. A higher version returns ErrVersionIncompatible.
 func (cli *Client) Connect(servAddr, user, password string, timeout time.Duration) error {
 	var err error
 	conn, err := net.DialTimeout("tcp", servAddr, timeout)
 	if err != nil {
 		return err
 	}
-	cli.conn = NewConn(conn, cli.typ)
+	cli.conn = NewConnWithOptions(conn, cli.typ, cli.opts...)
+	cli.closePending()
 	defer func() {
 		if err != nil {
 			cli.conn.Close()
@@ -54,9 +122,10 @@ func (cli *Client) Connect(servAddr, user, password string, timeout time.Duratio
 
 	// Login to the server.
 	req := &CmppConnReqPkt{
-		SrcAddr: user,
-		Secret:  password,
-		Version: cli.typ,
+		SrcAddr:    user,
+		Secret:     password,
+		Version:    cli.typ,
+		SrcAddrPad: cli.conn.srcAddrPad,
 	}
 
 	err = cli.SendReqPkt(req)
@@ -64,44 +133,81 @@ func (cli *Client) Connect(servAddr, user, password string, timeout time.Duratio
 		return err
 	}
 
-	p, err := cli.conn.RecvAndUnpackPkt(0)
+	p, err := cli.conn.RecvAndUnpackPkt(cli.conn.connectTimeout)
 	if err != nil {
+		if isTimeout(err) {
+			err = fmt.Errorf("%w: %w", ErrConnectTimeout, err)
+		}
 		return err
 	}
 
-	var ok bool
 	var status uint8
-	if cli.typ == V20 || cli.typ == V21 {
-		var rsp *Cmpp2ConnRspPkt
-		rsp, ok = p.(*Cmpp2ConnRspPkt)
-		status = rsp.Status
-	} else {
-		var rsp *Cmpp3ConnRspPkt
-		rsp, ok = p.(*Cmpp3ConnRspPkt)
-		status = uint8(rsp.Status)
-	}
-
-	if !ok {
+	var version Type
+	switch rsp := p.(type) {
+	case *Cmpp2ConnRspPkt:
+		status, version = rsp.Status, rsp.Version
+		if version != V20 && version != V21 {
+			version = -1 // a cmpp2 response must be version 2.x
+		}
+	case *Cmpp3ConnRspPkt:
+		status, version = uint8(rsp.Status), rsp.Version
+		if version != V30 {
+			version = -1
+		}
+	default:
 		err = ErrRespNotMatch
 		return err
 	}
 
 	if status != 0 {
-		err = ConnRspStatusErrMap[status]
+		err = ConnStatus(status)
 		return err
 	}
 
+	// make sure it is the real gateway, which shares the password.
+	if !VerifyAuthenticatorISMG(p.(Packer), []byte(req.AuthSrc), password) {
+		err = ErrAuthIsmgMismatch
+		return err
+	}
+
+	// the server may choose a lower version than the client requests.
+	if version < 0 || version > cli.typ {
+		err = ErrVersionIncompatible
+		return err
+	}
+	cli.typ, cli.conn.Typ = version, version
+
 	cli.conn.SetState(CONN_AUTHOK)
 	return nil
 }
 
+// DefaultDialTimeout limits the dialing of Dial, and the wait for the
+// connect response unless WithConnectTimeout is given.
+const DefaultDialTimeout = 10 * time.Second
+
+// Dial connects to the cmpp server at addr and logins as spId with the
+// shared secret, and returns the Client ready to submit, see Connect. The
+// connection is created with opts, see NewConnWithOptions. If any step
+// fails, the connection is closed and the error is returned.
+func Dial(addr, spId, secret string, version Type, opts ...Option) (*Client, error) {
+	opts = append([]Option{WithConnectTimeout(DefaultDialTimeout)}, opts...)
+	cli := NewClientWithOptions(version, opts...)
+	if err := cli.Connect(addr, spId, secret, DefaultDialTimeout); err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+// Disconnect closes the connection without the terminate handshake.
+// The submits waiting for the responses get ErrConnIsClosed.
 func (cli *Client) Disconnect() {
 	cli.conn.Close()
+	cli.closePending()
 }
 
 // SendReqPkt pack the cmpp request packet structure and send it to the other peer.
 func (cli *Client) SendReqPkt(packet Packer) error {
-	return cli.conn.SendPkt(packet, <-cli.conn.SeqId)
+	return cli.conn.SendPkt(packet, cli.conn.NextSeqId())
 }
 
 // SendRspPkt pack the cmpp response packet structure and send it to the other peer.
@@ -110,6 +216,338 @@ func (cli *Client) SendRspPkt(packet Packer, seqId uint32) error {
 }
 
 // RecvAndUnpackPkt receives cmpp byte stream, and unpack it to some cmpp packet structure.
+// The packets received by SendText, other than its submit responses, are returned first.
+// The responses of the submits sent by SubmitAsync are passed to their channels rather
+// than returned.
 func (cli *Client) RecvAndUnpackPkt(timeout time.Duration) (interface{}, error) {
-	return cli.conn.RecvAndUnpackPkt(timeout)
+	if p, ok := cli.popBacklog(); ok {
+		return p, nil
+	}
+
+	for {
+		p, err := cli.conn.RecvAndUnpackPkt(timeout)
+		if err != nil || !cli.completeAsync(p) {
+			return p, err
+		}
+	}
+}
+
+// Submit sends the submit request packet p to the server, p should be
+// a *Cmpp2SubmitReqPkt or a *Cmpp3SubmitReqPkt according to the protocol
+// version of the client. It returns the seqId of the packet sent, the
+// corresponding submit response has the same seqId.
+func (cli *Client) Submit(p Packer) (uint32, error) {
+	if err := cli.checkSubmit(p); err != nil {
+		return 0, err
+	}
+
+	seqId := cli.conn.NextSeqId()
+	return seqId, cli.conn.SendPkt(p, seqId)
+}
+
+// checkSubmit checks that p is the submit request of the client version.
+func (cli *Client) checkSubmit(p Packer) error {
+	switch p.(type) {
+	case *Cmpp2SubmitReqPkt:
+		if cli.typ == V30 {
+			return ErrMethodParamsInvalid
+		}
+	case *Cmpp3SubmitReqPkt:
+		if cli.typ != V30 {
+			return ErrMethodParamsInvalid
+		}
+	default:
+		return ErrMethodParamsInvalid
+	}
+	return nil
+}
+
+// SubmitResult is the result of a submit sent by SubmitAsync. Err is set
+// if the response is not received, e.g. ErrPendingTimeout; otherwise
+// MsgId and Result are those in the response.
+type SubmitResult struct {
+	SeqId  uint32
+	MsgId  uint64
+	Result uint32
+	Err    error
+}
+
+// DefaultSubmitTimeout is the time SubmitAsync waits for a response
+// by default, see SetSubmitTimeout.
+const DefaultSubmitTimeout = 30 * time.Second
+
+// SetSubmitTimeout sets the time SubmitAsync waits for a response, it
+// takes effect on the next connection.
+func (cli *Client) SetSubmitTimeout(d time.Duration) {
+	cli.submitTimeout = d
+}
+
+// SubmitAsync sends the submit request p like Submit, but returns at once
+// with a channel which receives the result once the response is received,
+// or the submit times out. The responses are received by RecvAndUnpackPkt,
+// so some goroutine must keep calling it, and the submits share the submit
+// window of the connection, if any, see WithSubmitWindow.
+//
+// The channel is buffered, it is not needed to be drained.
+func (cli *Client) SubmitAsync(p Packer) (<-chan SubmitResult, error) {
+	if err := cli.checkSubmit(p); err != nil {
+		return nil, err
+	}
+
+	// the response may arrive before SendPkt returns, add the entry first.
+	seqId := cli.conn.NextSeqId()
+	ch := make(chan interface{}, 1)
+	pending := cli.addPending(seqId, ch)
+	out := make(chan SubmitResult, 1)
+	go func() {
+		r := SubmitResult{SeqId: seqId}
+		switch v := (<-ch).(type) {
+		case *Cmpp2SubmitRspPkt:
+			r.MsgId, r.Result = v.MsgId, uint32(v.Result)
+		case *Cmpp3SubmitRspPkt:
+			r.MsgId, r.Result = v.MsgId, v.Result
+		case error:
+			r.Err = v
+		}
+		out <- r
+	}()
+
+	if err := cli.conn.SendPkt(p, seqId); err != nil {
+		pending.Complete(seqId, err)
+		return nil, err
+	}
+	return out, nil
+}
+
+// addPending adds the entry of seqId to the PendingTable of SubmitAsync,
+// which is created if it does not exist, and returns the table. The entry
+// is added under pmu, so a concurrent closePending either sees and fails
+// it, or is done before and a new table is created.
+func (cli *Client) addPending(seqId uint32, ch chan interface{}) *PendingTable {
+	cli.pmu.Lock()
+	defer cli.pmu.Unlock()
+	if cli.pending == nil {
+		d := cli.submitTimeout
+		if d <= 0 {
+			d = DefaultSubmitTimeout
+		}
+		cli.pending = NewPendingTable(d)
+		cli.pending.OnOrphanResponse(cli.orphan)
+	}
+	cli.pending.Add(seqId, ch)
+	return cli.pending
+}
+
+// pendingTable returns the PendingTable of SubmitAsync, or nil if it
+// does not exist.
+func (cli *Client) pendingTable() *PendingTable {
+	cli.pmu.Lock()
+	defer cli.pmu.Unlock()
+	return cli.pending
+}
+
+// completeAsync passes p to the waiter of SubmitAsync if p is the
+// response of it, and reports whether it is.
+func (cli *Client) completeAsync(p interface{}) bool {
+	pending := cli.pendingTable()
+	if pending == nil {
+		return false
+	}
+
+	switch rsp := p.(type) {
+	case *Cmpp2SubmitRspPkt:
+		return pending.CompleteResponse(CMPP_SUBMIT_RESP, rsp.SeqId, rsp)
+	case *Cmpp3SubmitRspPkt:
+		return pending.CompleteResponse(CMPP_SUBMIT_RESP, rsp.SeqId, rsp)
+	}
+	return false
+}
+
+// OnOrphanResponse sets fn to be called with the submit responses received
+// once SubmitAsync is used, whose seqId is not of a SubmitAsync in flight,
+// e.g. a stray one after a reconnect or a late one of a timed out submit,
+// see PendingTable.OnOrphanResponse. Such responses are still returned by
+// RecvAndUnpackPkt as usual, so the responses of Submit are passed to fn too
+// if Submit is used along with SubmitAsync. It should be called before the
+// first SubmitAsync.
+func (cli *Client) OnOrphanResponse(fn func(id CommandId, seqId uint32, resp interface{})) {
+	cli.pmu.Lock()
+	defer cli.pmu.Unlock()
+	cli.orphan = fn
+	if cli.pending != nil {
+		cli.pending.OnOrphanResponse(fn)
+	}
+}
+
+// closePending fails the submits waiting for the responses, and
+// removes the PendingTable.
+func (cli *Client) closePending() {
+	cli.pmu.Lock()
+	pending := cli.pending
+	cli.pending = nil
+	cli.pmu.Unlock()
+
+	if pending != nil {
+		pending.CompleteAll(ErrConnIsClosed)
+		pending.Close()
+	}
+}
+
+// Terminate closes the connection with the terminate handshake,
+// see Conn.GracefulClose. Zero timeout means no deadline.
+func (cli *Client) Terminate(timeout time.Duration) error {
+	defer cli.closePending()
+	return cli.conn.GracefulClose(timeout)
+}
+
+// SetTextParams sets the params of the submit requests sent by SendText,
+// e.g. ServiceId, SrcId, MsgSrc and the billing fields. DestTerminalId,
+// MsgContent, MsgFmt, TpUdhi, PkTotal and PkNumber are set by SendText.
+func (cli *Client) SetTextParams(params SubmitParams) {
+	cli.textParams = params
+}
+
+// SetTextMsgFmt overrides the Msg_Fmt which SendText encodes the content
+// in, which is chosen by ChooseMsgFmt by default, e.g. to always send in
+// MsgFmtUCS2 to a gateway which does not support MsgFmtGBK. A nil msgFmt
+// restores the default.
+func (cli *Client) SetTextMsgFmt(msgFmt func(content string) uint8) {
+	cli.textMsgFmt = msgFmt
+}
+
+// SendText sends the utf8 text content to dest, and waits for the submit
+// responses. The content is encoded in ASCII if it is all 7-bit, or in GBK
+// if it can be, or else in UCS2, see ChooseMsgFmt and SetTextMsgFmt, and a
+// long content is split into segments with udh, see SplitLongMessage. The other params of the submit requests
+// are set by SetTextParams.
+//
+// It returns the MsgIds of the segments in order. If some segment is
+// rejected by the server, the MsgIds are returned with the error of the
+// first rejected one. If some segment fails to be sent, the error is a
+// *SendTextError with the seqIds of the segments sent before it. The active
+// test requests received meanwhile are answered, and the other packets
+// than the submit responses are kept for RecvAndUnpackPkt, up to 1024 of
+// them.
+func (cli *Client) SendText(dest []string, content string) ([]uint64, error) {
+	return cli.SendTextTimeout(dest, content, 0)
+}
+
+// SendTextTimeout is like SendText, but fails with a timeout error if the
+// submit responses do not arrive within timeout. Zero timeout means no
+// deadline. The MsgIds received so far are returned along with the error.
+func (cli *Client) SendTextTimeout(dest []string, content string, timeout time.Duration) ([]uint64, error) {
+	choose := cli.textMsgFmt
+	if choose == nil {
+		choose = ChooseMsgFmt
+	}
+	msgFmt := choose(content)
+	segments, err := SplitLongMessage(content, msgFmt)
+	if err != nil {
+		return nil, err
+	}
+
+	params := cli.textParams
+	params.DestTerminalId = dest
+	params.MsgFmt = msgFmt
+	params.TpUdhi, params.PkTotal, params.PkNumber = 0, 0, 0
+	if len(segments) > 1 {
+		params.TpUdhi = 1
+	}
+	pkts := make([]Packer, len(segments))
+	for i, seg := range segments {
+		params.MsgContent = string(seg)
+		if pkts[i], err = NewSubmit(cli.typ, params); err != nil {
+			return nil, err
+		}
+	}
+	if err = SetPkNumbers(pkts); err != nil {
+		return nil, err
+	}
+
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	msgIds := make([]uint64, len(pkts))
+	seqIds := make(map[uint32]int, len(pkts)) // seqId -> index of the segment
+	for i, p := range pkts {
+		seqId, err := cli.Submit(p)
+		if err != nil {
+			sent := make([]uint32, i)
+			for seqId, j := range seqIds {
+				sent[j] = seqId
+			}
+			return msgIds, &SendTextError{SeqIds: sent, Err: err}
+		}
+		seqIds[seqId] = i
+	}
+
+	var rspErr error
+	for len(seqIds) > 0 {
+		var d time.Duration
+		if timeout != 0 {
+			if d = time.Until(deadline); d <= 0 {
+				d = time.Nanosecond // time out at once.
+			}
+		}
+
+		id, seqId, p, err := cli.conn.RecvAndUnpackPktWithHeader(d)
+		if err != nil {
+			return msgIds, err
+		}
+
+		var msgId uint64
+		var result uint32
+		switch rsp := p.(type) {
+		case *Cmpp2SubmitRspPkt:
+			msgId, result = rsp.MsgId, uint32(rsp.Result)
+		case *Cmpp3SubmitRspPkt:
+			msgId, result = rsp.MsgId, rsp.Result
+		}
+
+		if id == CMPP_ACTIVE_TEST {
+			// answer it at once, the wait may be long.
+			if err = cli.conn.RespondActiveTest(seqId); err != nil {
+				return msgIds, err
+			}
+			continue
+		}
+		i, ok := seqIds[seqId]
+		if id != CMPP_SUBMIT_RESP || !ok {
+			if !cli.completeAsync(p) {
+				cli.pushBacklog(p)
+			}
+			continue
+		}
+		delete(seqIds, seqId)
+		msgIds[i] = msgId
+		if result != 0 && rspErr == nil {
+			rspErr = submitResultErr(result)
+		}
+	}
+	return msgIds, rspErr
+}
+
+// SendTextError is returned by SendText if a segment fails to be sent,
+// the segments sent before it may still be delivered.
+type SendTextError struct {
+	SeqIds []uint32 // of the segments sent, in order
+	Err    error    // of the segment failed
+}
+
+func (e *SendTextError) Error() string {
+	return fmt.Sprintf("send text: %d segments sent: %v", len(e.SeqIds), e.Err)
+}
+
+func (e *SendTextError) Unwrap() error {
+	return e.Err
+}
+
+// submitResultErr returns the error of the non-zero result in submit response.
+func submitResultErr(result uint32) error {
+	if err, ok := SubmitRspResultErrMap[uint8(result)]; ok && result <= 0xff {
+		return err
+	}
+	return fmt.Errorf("submit response status: unknown result %d", result)
 }
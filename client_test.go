@@ -0,0 +1,688 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+	"github.com/bigwhite/gocmpp/cmpptest"
+)
+
+// ismgFunc handles the packet p received by a fake ISMG on c, its side of
+// the nth connection accepted, counting from 0. It returns false to close
+// the connection.
+type ismgFunc func(n int, c *cmpp.Conn, p interface{}) bool
+
+// serveIsmg starts a fake ISMG in version typ, which accepts conns
+// connections one after another, and passes the packets received on each,
+// the connect request included, to handle. The connection is closed once
+// handle returns false, or nothing is received for a second.
+func serveIsmg(t *testing.T, typ cmpp.Type, conns int, handle ismgFunc) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	go func() {
+		defer l.Close()
+		for n := 0; n < conns; n++ {
+			rw, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c := cmpp.NewConn(rw, typ)
+			c.SetState(cmpp.CONN_CONNECTED)
+			for {
+				i, err := c.RecvAndUnpackPkt(time.Second)
+				if err != nil || !handle(n, c, i) {
+					break
+				}
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// connRsp returns the connect response of version typ to req with status,
+// whose AuthenticatorISMG is computed with the secret "888888".
+func connRsp(typ cmpp.Type, req *cmpp.CmppConnReqPkt, status uint32) cmpp.Packer {
+	if typ == cmpp.V30 {
+		return &cmpp.Cmpp3ConnRspPkt{Status: status, AuthSrc: req.AuthSrc, Secret: "888888", Version: typ}
+	}
+	return &cmpp.Cmpp2ConnRspPkt{Status: uint8(status), AuthSrc: req.AuthSrc, Secret: "888888", Version: typ}
+}
+
+// fakeIsmg accepts one connection, answers the connect request with status,
+// the submit requests with their seqIds as MsgId, and the terminate request.
+func fakeIsmg(t *testing.T, status uint32) string {
+	return serveIsmg(t, cmpp.V30, 1, func(_ int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			c.SendPkt(connRsp(cmpp.V30, p, status), p.SeqId)
+		case *cmpp.Cmpp3SubmitReqPkt:
+			c.SendPkt(&cmpp.Cmpp3SubmitRspPkt{MsgId: uint64(p.SeqId)}, p.SeqId)
+		case *cmpp.CmppTerminateReqPkt:
+			c.SendPkt(&cmpp.CmppTerminateRspPkt{}, p.SeqId)
+			return false
+		}
+		return true
+	})
+}
+
+func TestClient(t *testing.T) {
+	addr := fakeIsmg(t, 0)
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(addr, "900001", "888888", time.Second)
+	if err != nil {
+		t.Fatal("Connect error:", err)
+	}
+
+	_, err = c.Submit(&cmpp.Cmpp2SubmitReqPkt{})
+	if err != cmpp.ErrMethodParamsInvalid {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrMethodParamsInvalid)
+	}
+
+	seqId, err := c.Submit(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("Submit error:", err)
+	}
+
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+
+	rsp, ok := i.(*cmpp.Cmpp3SubmitRspPkt)
+	if !ok || rsp.SeqId != seqId || rsp.MsgId != uint64(seqId) {
+		t.Fatalf("The packet received is %#v, not the submit response of seqId %d\n", i, seqId)
+	}
+
+	err = c.Terminate(time.Second)
+	if err != nil {
+		t.Fatal("Terminate error:", err)
+	}
+}
+
+func TestClientAuthFailed(t *testing.T) {
+	addr := fakeIsmg(t, uint32(cmpp.ErrnoConnAuthFailed))
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(addr, "900001", "888888", time.Second)
+	if !errors.Is(err, cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnAuthFailed]) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnAuthFailed])
+	}
+
+	var status cmpp.ConnStatus
+	if !errors.As(err, &status) || status != cmpp.ConnStatusAuthFailed {
+		t.Fatalf("The status is %v, not equal to expected: %v\n", status, cmpp.ConnStatusAuthFailed)
+	}
+	if err.Error() != "cmpp: authentication failed (status 3)" {
+		t.Fatalf("The error message is %s, not equal to expected: %s\n", err, "cmpp: authentication failed (status 3)")
+	}
+}
+
+// fakeOldIsmg accepts one connection and works in version typ, it answers
+// the connect request and the cmpp2 submit requests.
+func fakeOldIsmg(t *testing.T, typ cmpp.Type) string {
+	return serveIsmg(t, typ, 1, func(_ int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			c.SendPkt(connRsp(typ, p, 0), p.SeqId)
+		case *cmpp.Cmpp2SubmitReqPkt:
+			c.SendPkt(&cmpp.Cmpp2SubmitRspPkt{MsgId: uint64(p.SeqId)}, p.SeqId)
+		}
+		return true
+	})
+}
+
+func TestClientVersionDowngrade(t *testing.T) {
+	addr := fakeOldIsmg(t, cmpp.V21)
+
+	c := cmpp.NewClient(cmpp.V30)
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	if _, err := c.Submit(&cmpp.Cmpp3SubmitReqPkt{}); err != cmpp.ErrMethodParamsInvalid {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrMethodParamsInvalid)
+	}
+
+	seqId, err := c.Submit(&cmpp.Cmpp2SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("Submit error:", err)
+	}
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	if rsp, ok := i.(*cmpp.Cmpp2SubmitRspPkt); !ok || rsp.MsgId != uint64(seqId) {
+		t.Fatalf("The packet received is %#v, not the cmpp2 submit response of seqId %d\n", i, seqId)
+	}
+}
+
+func TestClientVersionIncompatible(t *testing.T) {
+	addr := fakeOldIsmg(t, cmpp.V30)
+
+	c := cmpp.NewClient(cmpp.V21)
+	err := c.Connect(addr, "900001", "888888", time.Second)
+	if err != cmpp.ErrVersionIncompatible {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrVersionIncompatible)
+	}
+}
+
+// textIsmg accepts one connection, it sends an active test request
+// ahead of the first submit response, and answers the submit requests
+// with their seqIds as MsgId. The submit requests are sent to submits,
+// and the active test responses to answered.
+func textIsmg(t *testing.T, submits chan<- *cmpp.Cmpp3SubmitReqPkt, answered chan<- *cmpp.CmppActiveTestRspPkt) string {
+	first := true
+	return serveIsmg(t, cmpp.V30, 1, func(_ int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			c.SendPkt(connRsp(cmpp.V30, p, 0), p.SeqId)
+		case *cmpp.Cmpp3SubmitReqPkt:
+			submits <- p
+			if first {
+				first = false
+				c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 0x17)
+			}
+			c.SendPkt(cmpp.NewCmpp3SubmitRsp(p, uint64(p.SeqId), 0), p.SeqId)
+		case *cmpp.CmppActiveTestRspPkt:
+			answered <- p
+		}
+		return true
+	})
+}
+
+func TestClientSendText(t *testing.T) {
+	cases := []struct {
+		content  string
+		choose   func(string) uint8
+		msgFmt   uint8
+		segments int
+	}{
+		{"hello", nil, cmpp.MsgFmtASCII, 1},
+		{strings.Repeat("a", 160), nil, cmpp.MsgFmtASCII, 1},
+		{strings.Repeat("a", 161), nil, cmpp.MsgFmtASCII, 2},
+		{"你好", nil, cmpp.MsgFmtGBK, 1},
+		{strings.Repeat("你好", 50), nil, cmpp.MsgFmtGBK, 2},
+		{"你好😀", nil, cmpp.MsgFmtUCS2, 1},
+		{"hello", func(string) uint8 { return cmpp.MsgFmtUCS2 }, cmpp.MsgFmtUCS2, 1},
+	}
+
+	for _, cs := range cases {
+		submits := make(chan *cmpp.Cmpp3SubmitReqPkt, 8)
+		answered := make(chan *cmpp.CmppActiveTestRspPkt, 1)
+		addr := textIsmg(t, submits, answered)
+
+		c := cmpp.NewClient(cmpp.V30)
+		if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+			t.Fatal("Connect error:", err)
+		}
+		c.SetTextParams(cmpp.SubmitParams{FeeType: cmpp.FeeTypeFree, MsgSrc: "900001", SrcId: "900001"})
+		c.SetTextMsgFmt(cs.choose)
+
+		msgIds, err := c.SendTextTimeout([]string{"13500002696"}, cs.content, time.Second)
+		if err != nil {
+			t.Fatal("SendText error:", err)
+		}
+		if len(msgIds) != cs.segments {
+			t.Fatalf("The MsgIds are %v, not of %d segments\n", msgIds, cs.segments)
+		}
+
+		var segments [][]byte
+		for i := range msgIds {
+			p := <-submits
+			if p.MsgFmt != cs.msgFmt || uint64(p.SeqId) != msgIds[i] || int(p.PkNumber) != i+1 ||
+				int(p.PkTotal) != cs.segments || p.SrcId != "900001" {
+				t.Fatalf("The submit request is %v, not the segment %d of MsgId %d in msg_fmt %d\n",
+					p, i+1, msgIds[i], cs.msgFmt)
+			}
+			segments = append(segments, []byte(p.MsgContent))
+		}
+		s, err := cmpp.ReassembleLongMessage(segments, cs.msgFmt)
+		if err != nil || s != cs.content {
+			t.Fatalf("The content sent is %q(error %v), not equal to expected: %q\n", s, err, cs.content)
+		}
+
+		// the active test request is answered meanwhile.
+		select {
+		case p := <-answered:
+			if p.SeqId != 0x17 {
+				t.Fatalf("The seqId of the active test response is %d, not equal to expected: %d\n", p.SeqId, 0x17)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("The active test request is not answered")
+		}
+		c.Disconnect()
+	}
+}
+
+func TestClientSendTextPartial(t *testing.T) {
+	// the cmpp3 submits are never answered.
+	addr := fakeOldIsmg(t, cmpp.V30)
+
+	c := cmpp.NewClientWithOptions(cmpp.V30, cmpp.WithSubmitWindow(1, 0))
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	c.SetTextParams(cmpp.SubmitParams{FeeType: cmpp.FeeTypeFree, MsgSrc: "900001", SrcId: "900001"})
+
+	// the second segment waits for the window, till the connection is closed.
+	done := make(chan error, 1)
+	var msgIds []uint64
+	go func() {
+		var err error
+		msgIds, err = c.SendText([]string{"13500002696"}, strings.Repeat("a", 161))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Disconnect()
+
+	err := <-done
+	var te *cmpp.SendTextError
+	if !errors.As(err, &te) || len(te.SeqIds) != 1 || te.SeqIds[0] == 0 {
+		t.Fatalf("The error is %#v, not a SendTextError with the seqId of the first segment\n", err)
+	}
+	if len(msgIds) != 2 {
+		t.Fatalf("The MsgIds are %v, not of %d segments\n", msgIds, 2)
+	}
+}
+
+func TestClientSendTextBacklogLimit(t *testing.T) {
+	// the gateway sends more deliver requests than kept ahead of the
+	// submit response.
+	const n = 1100
+	addr := serveIsmg(t, cmpp.V30, 1, func(_ int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			c.SendPkt(connRsp(cmpp.V30, p, 0), p.SeqId)
+		case *cmpp.Cmpp3SubmitReqPkt:
+			for seqId := uint32(1); seqId <= n; seqId++ {
+				c.SendPkt(&cmpp.Cmpp3DeliverReqPkt{MsgId: uint64(seqId), MsgLength: 2, MsgContent: "mo"}, seqId)
+			}
+			c.SendPkt(cmpp.NewCmpp3SubmitRsp(p, uint64(p.SeqId), 0), p.SeqId)
+		}
+		return true
+	})
+
+	c := cmpp.NewClient(cmpp.V30)
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+	c.SetTextParams(cmpp.SubmitParams{FeeType: cmpp.FeeTypeFree, MsgSrc: "900001", SrcId: "900001"})
+
+	if _, err := c.SendTextTimeout([]string{"13500002696"}, "hello", time.Second); err != nil {
+		t.Fatal("SendText error:", err)
+	}
+
+	// the oldest ones are dropped, the latest 1024 are kept.
+	for seqId := uint32(n - 1024 + 1); seqId <= n; seqId++ {
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if p, ok := i.(*cmpp.Cmpp3DeliverReqPkt); err != nil || !ok || p.MsgId != uint64(seqId) {
+			t.Fatalf("The packet received is %#v(error %v), not the deliver request of MsgId %d\n", i, err, seqId)
+		}
+	}
+}
+
+// deliverIsmg accepts one connection, it sends a deliver request once the
+// client logins, and sends the deliver response received to rsps.
+func deliverIsmg(t *testing.T, rsps chan<- *cmpp.Cmpp3DeliverRspPkt) string {
+	return serveIsmg(t, cmpp.V30, 1, func(_ int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			c.SendPkt(connRsp(cmpp.V30, p, 0), p.SeqId)
+			c.SendPkt(&cmpp.Cmpp3DeliverReqPkt{MsgId: 12878564852733378560, DestId: "900001",
+				SrcTerminalId: "13500002696", MsgLength: 2, MsgContent: "hi"}, 0x20)
+		case *cmpp.Cmpp3DeliverRspPkt:
+			rsps <- p
+		}
+		return true
+	})
+}
+
+func TestClientAutoDeliverRsp(t *testing.T) {
+	cases := []struct {
+		result func(cmpp.Packer) uint32
+		status uint32
+	}{
+		{nil, 0},
+		{func(cmpp.Packer) uint32 { return 9 }, 9},
+	}
+
+	for _, cs := range cases {
+		rsps := make(chan *cmpp.Cmpp3DeliverRspPkt, 1)
+		addr := deliverIsmg(t, rsps)
+
+		c := cmpp.NewClientWithOptions(cmpp.V30, cmpp.WithAutoDeliverRsp(cs.result))
+		if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+			t.Fatal("Connect error:", err)
+		}
+
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if p, ok := i.(*cmpp.Cmpp3DeliverReqPkt); err != nil || !ok || p.MsgContent != "hi" {
+			t.Fatalf("The packet received is %#v(error %v), not the deliver request\n", i, err)
+		}
+
+		select {
+		case rsp := <-rsps:
+			if rsp.SeqId != 0x20 || rsp.MsgId != 12878564852733378560 || rsp.Result != cs.status {
+				t.Fatalf("The deliver response is %#v, not equal to expected: seqId 0x20, result %d\n", rsp, cs.status)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No deliver response is sent")
+		}
+		c.Disconnect()
+	}
+}
+
+func TestClientAutoDeliverRspInOrder(t *testing.T) {
+	// the fake gateway sends n deliver requests at once after the login.
+	const n = 50
+	rsps := make(chan uint32, n)
+	addr := serveIsmg(t, cmpp.V30, 1, func(_ int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			c.SendPkt(connRsp(cmpp.V30, p, 0), p.SeqId)
+			for seqId := uint32(1); seqId <= n; seqId++ {
+				c.SendPkt(&cmpp.Cmpp3DeliverReqPkt{MsgId: uint64(seqId), MsgLength: 2, MsgContent: "mo"}, seqId)
+			}
+		case *cmpp.Cmpp3DeliverRspPkt:
+			rsps <- p.SeqId
+		}
+		return true
+	})
+
+	c := cmpp.NewClientWithOptions(cmpp.V30, cmpp.WithAutoDeliverRsp(nil))
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	// the deliver requests are handled, and answered, in the order they arrive.
+	for seqId := uint32(1); seqId <= n; seqId++ {
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if p, ok := i.(*cmpp.Cmpp3DeliverReqPkt); err != nil || !ok || p.MsgId != uint64(seqId) {
+			t.Fatalf("The packet received is %#v(error %v), not the deliver request of MsgId %d\n", i, err, seqId)
+		}
+	}
+	for seqId := uint32(1); seqId <= n; seqId++ {
+		if got := <-rsps; got != seqId {
+			t.Fatalf("The deliver response is of seqId %d, not equal to expected: %d\n", got, seqId)
+		}
+	}
+}
+
+func TestClientSubmitAsync(t *testing.T) {
+	addr := fakeIsmg(t, 0)
+
+	c := cmpp.NewClient(cmpp.V30)
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	if _, err := c.SubmitAsync(&cmpp.Cmpp2SubmitReqPkt{}); err != cmpp.ErrMethodParamsInvalid {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrMethodParamsInvalid)
+	}
+
+	const n = 100
+	results := make(chan cmpp.SubmitResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, err := c.SubmitAsync(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}})
+			if err != nil {
+				results <- cmpp.SubmitResult{Err: err}
+				return
+			}
+			results <- <-ch
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[uint32]bool)
+	for r := range results {
+		if r.Err != nil || r.MsgId != uint64(r.SeqId) || seen[r.SeqId] {
+			t.Fatalf("The submit result is %#v, not the response of seqId %d\n", r, r.SeqId)
+		}
+		seen[r.SeqId] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("The number of submit results is %d, not equal to expected: %d\n", len(seen), n)
+	}
+}
+
+func TestClientSubmitAsyncTimeout(t *testing.T) {
+	// the cmpp3 submits are never answered.
+	addr := fakeOldIsmg(t, cmpp.V30)
+
+	c := cmpp.NewClient(cmpp.V30)
+	c.SetSubmitTimeout(50 * time.Millisecond)
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+
+	ch, err := c.SubmitAsync(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("SubmitAsync error:", err)
+	}
+	if r := <-ch; r.Err != cmpp.ErrPendingTimeout {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", r.Err, cmpp.ErrPendingTimeout)
+	}
+
+	ch, err = c.SubmitAsync(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("SubmitAsync error:", err)
+	}
+	c.Disconnect()
+	if r := <-ch; r.Err != cmpp.ErrConnIsClosed {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", r.Err, cmpp.ErrConnIsClosed)
+	}
+}
+
+func TestClientSubmitAsyncDisconnect(t *testing.T) {
+	// the cmpp3 submits are never answered.
+	addr := fakeOldIsmg(t, cmpp.V30)
+
+	c := cmpp.NewClient(cmpp.V30)
+	c.SetSubmitTimeout(time.Hour)
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+
+	// the submits racing Disconnect are failed, none of them waits for
+	// the submit timeout.
+	const n = 100
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			ch, err := c.SubmitAsync(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}})
+			if err != nil {
+				results <- err
+				return
+			}
+			results <- (<-ch).Err
+		}()
+	}
+	c.Disconnect()
+
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-results:
+			if err == nil {
+				t.Fatal("The submit succeeds after Disconnect")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("The submit racing Disconnect is never completed")
+		}
+	}
+}
+
+func TestClientAuthIsmgMismatch(t *testing.T) {
+	// the fake gateway shares the secret "888888".
+	addr := fakeOldIsmg(t, cmpp.V30)
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(addr, "900001", "123456", time.Second)
+	if err != cmpp.ErrAuthIsmgMismatch {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrAuthIsmgMismatch)
+	}
+}
+
+func TestClientConnectTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	defer l.Close()
+
+	// the gateway accepts the connection but never answers the login.
+	go func() {
+		rw, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer rw.Close()
+		io.Copy(io.Discard, rw)
+	}()
+
+	c := cmpp.NewClientWithOptions(cmpp.V30, cmpp.WithConnectTimeout(100*time.Millisecond))
+	start := time.Now()
+	err = c.Connect(l.Addr().String(), "900001", "888888", time.Second)
+	if !errors.Is(err, cmpp.ErrConnectTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnectTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Connect returns after %v, later than the connect timeout\n", d)
+	}
+}
+
+func TestClientSourceAddrPadding(t *testing.T) {
+	s := cmpptest.NewUnstartedServer(cmpp.V30, "888888")
+	s.Auth = func(req *cmpp.CmppConnReqPkt) (uint8, string) {
+		if req.SrcAddr != "9001  " {
+			return cmpp.ErrnoConnInvalidSrcAddr, ""
+		}
+		if !cmpp.VerifyAuthenticator(req, "888888") {
+			return cmpp.ErrnoConnAuthFailed, ""
+		}
+		return 0, "888888"
+	}
+	s.Start()
+	defer s.Close()
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(s.Addr, "9001", "888888", time.Second)
+	if err != cmpp.ConnStatus(cmpp.ErrnoConnInvalidSrcAddr) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ConnStatus(cmpp.ErrnoConnInvalidSrcAddr))
+	}
+
+	c = cmpp.NewClientWithOptions(cmpp.V30, cmpp.WithSourceAddrPadding(' '))
+	if err = c.Connect(s.Addr, "9001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	c.Disconnect()
+}
+
+func TestDial(t *testing.T) {
+	s := cmpptest.NewServer(cmpp.V30, "888888")
+	defer s.Close()
+
+	c, err := cmpp.Dial(s.Addr, "900001", "888888", cmpp.V30)
+	if err != nil {
+		t.Fatal("Dial error:", err)
+	}
+	defer c.Disconnect()
+
+	seqId, err := c.Submit(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("Submit error:", err)
+	}
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	if rsp, ok := i.(*cmpp.Cmpp3SubmitRspPkt); !ok || rsp.SeqId != seqId {
+		t.Fatalf("The packet received is %#v, not the submit response of seqId %d\n", i, seqId)
+	}
+
+	_, err = cmpp.Dial(s.Addr, "900001", "123456", cmpp.V30)
+	if err != cmpp.ConnStatus(cmpp.ErrnoConnAuthFailed) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ConnStatus(cmpp.ErrnoConnAuthFailed))
+	}
+}
+
+func TestDialClosedOnFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	defer l.Close()
+
+	// the fake gateway rejects the login, then waits for the client to close.
+	closed := make(chan error, 1)
+	go func() {
+		rw, err := l.Accept()
+		if err != nil {
+			closed <- err
+			return
+		}
+		c := cmpp.NewConn(rw, cmpp.V30)
+		defer c.Close()
+		c.SetState(cmpp.CONN_CONNECTED)
+
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			closed <- err
+			return
+		}
+		p := i.(*cmpp.CmppConnReqPkt)
+		c.SendPkt(&cmpp.Cmpp3ConnRspPkt{Status: uint32(cmpp.ErrnoConnAuthFailed), Version: cmpp.V30}, p.SeqId)
+
+		_, err = c.RecvAndUnpackPkt(time.Second)
+		closed <- err
+	}()
+
+	if _, err = cmpp.Dial(l.Addr().String(), "900001", "888888", cmpp.V30); err != cmpp.ConnStatus(cmpp.ErrnoConnAuthFailed) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ConnStatus(cmpp.ErrnoConnAuthFailed))
+	}
+	if err = <-closed; err != io.EOF {
+		t.Fatalf("The error of the gateway is %v, not equal to expected: %v\n", err, io.EOF)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cmpptest provides a fake ISMG for the tests of cmpp clients,
+// like net/http/httptest does for http.
+package cmpptest
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+// Server is a fake ISMG listening on a random port of the loopback
+// interface. It answers the connect requests by Auth, and the submit
+// requests with a zero result unless scripted by RespondSubmit. The
+// active test and terminate requests are answered as cmpp.Server does.
+type Server struct {
+	Addr string // host:port of the server, set by Start
+	Typ  cmpp.Type
+
+	// Secret is the shared secret of the SPs, which is used to verify
+	// the connect requests if Auth is nil.
+	Secret string
+
+	// Auth returns the status of the connect response to req, and the
+	// shared secret the AuthenticatorISMG is computed with. If it is nil,
+	// a request whose AuthenticatorSource is computed with Secret is
+	// accepted, and the others are rejected with status 3(auth failed).
+	// It should be set before Start.
+	Auth func(req *cmpp.CmppConnReqPkt) (status uint8, secret string)
+
+	l       net.Listener
+	srv     *cmpp.Server
+	handler cmpp.Handler // cmpp.HandlePackets(s)
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	submits []cmpp.Packer
+	results map[int]uint32 // see RespondSubmit
+	closed  bool
+}
+
+// NewServer starts and returns a Server for typ, the SPs login with the
+// shared secret. The caller should call Close when finished.
+func NewServer(typ cmpp.Type, secret string) *Server {
+	s := NewUnstartedServer(typ, secret)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a Server which is not started, so it could
+// be configured, e.g. with Auth, before Start is called.
+func NewUnstartedServer(typ cmpp.Type, secret string) *Server {
+	return &Server{
+		Typ:     typ,
+		Secret:  secret,
+		results: make(map[int]uint32),
+	}
+}
+
+// Start starts the server, it panics if the server is started already
+// or it fails to listen.
+func (s *Server) Start() {
+	if s.l != nil {
+		panic("cmpptest: Server is started already")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("cmpptest: failed to listen: " + err.Error())
+	}
+	s.l = &listener{Listener: l, s: s}
+	s.Addr = l.Addr().String()
+
+	s.handler = cmpp.HandlePackets(s)
+	s.srv = cmpp.NewServer(s.Addr, s.Typ, cmpp.HandlerFunc(s.serveCmpp))
+	s.srv.ErrorLog = log.New(io.Discard, "", 0)
+	go s.srv.Serve(s.l)
+}
+
+// Close shuts down the server, it closes the listener and all the
+// connections accepted.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+
+	if s.l != nil {
+		s.l.Close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// RespondSubmit scripts the response of the nth submit request received,
+// counting from 1 over all the connections, to be of result, e.g.
+// RespondSubmit(3, 8) answers the 3rd submit request with result 8(flow
+// control error).
+func (s *Server) RespondSubmit(n int, result uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[n] = result
+}
+
+// Submits returns the submit requests received so far, in the order they
+// are received. They are *cmpp.Cmpp2SubmitReqPkt or *cmpp.Cmpp3SubmitReqPkt
+// according to Typ.
+func (s *Server) Submits() []cmpp.Packer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]cmpp.Packer(nil), s.submits...)
+}
+
+// submit records the submit request p, and returns its sequence number
+// counting from 1 and the result scripted for it.
+func (s *Server) submit(p cmpp.Packer) (int, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.submits = append(s.submits, p)
+	n := len(s.submits)
+	return n, s.results[n]
+}
+
+// serveCmpp answers the cmpp2 submit requests, and passes the others to
+// cmpp.HandlePackets, which answers the connect and cmpp3 submit requests
+// by s.
+func (s *Server) serveCmpp(r *cmpp.Response, p *cmpp.Packet, l *log.Logger) (bool, error) {
+	if req, ok := p.Packer.(*cmpp.Cmpp2SubmitReqPkt); ok {
+		n, result := s.submit(req)
+		rsp := r.Packer.(*cmpp.Cmpp2SubmitRspPkt)
+		rsp.MsgId, rsp.Result = uint64(n), uint8(result)
+		return false, nil
+	}
+	return s.handler.ServeCmpp(r, p, l)
+}
+
+// OnConnect implements cmpp.PacketHandler.
+func (s *Server) OnConnect(req *cmpp.CmppConnReqPkt) (status uint8, secret string) {
+	if s.Auth != nil {
+		return s.Auth(req)
+	}
+	if !cmpp.VerifyAuthenticator(req, s.Secret) {
+		return cmpp.ErrnoConnAuthFailed, ""
+	}
+	return 0, s.Secret
+}
+
+// OnSubmit implements cmpp.PacketHandler, the MsgId of the nth submit
+// request is n.
+func (s *Server) OnSubmit(req *cmpp.Cmpp3SubmitReqPkt) (msgId uint64, status uint32) {
+	n, result := s.submit(req)
+	return uint64(n), result
+}
+
+// listener tracks the connections accepted, for Close.
+type listener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	if l.s.closed {
+		c.Close()
+	} else {
+		l.s.conns = append(l.s.conns, c)
+	}
+	return c, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpptest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+	"github.com/bigwhite/gocmpp/cmpptest"
+)
+
+func newSubmit(typ cmpp.Type) cmpp.Packer {
+	p, err := cmpp.NewSubmit(typ, cmpp.SubmitParams{
+		RegisteredDelivery: cmpp.Report,
+		FeeUserType:        2,
+		MsgFmt:             cmpp.MsgFmtASCII,
+		MsgSrc:             "900001",
+		FeeType:            cmpp.FeeTypeFree,
+		SrcId:              "900001",
+		DestTerminalId:     []string{"13500002696"},
+		MsgContent:         "hello gocmpp",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// submit sends a submit request by c, and returns the MsgId and the
+// result of its response.
+func submit(c *cmpp.Client, typ cmpp.Type) (uint64, uint32, error) {
+	if err := c.SendReqPkt(newSubmit(typ)); err != nil {
+		return 0, 0, err
+	}
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch rsp := i.(type) {
+	case *cmpp.Cmpp3SubmitRspPkt:
+		return rsp.MsgId, rsp.Result, nil
+	case *cmpp.Cmpp2SubmitRspPkt:
+		return rsp.MsgId, uint32(rsp.Result), nil
+	}
+	return 0, 0, fmt.Errorf("receive %T, not a submit response", i)
+}
+
+func ExampleServer() {
+	s := cmpptest.NewServer(cmpp.V30, "888888")
+	defer s.Close()
+
+	// the 3rd submit request is answered with result 8(flow control error).
+	s.RespondSubmit(3, 8)
+
+	c := cmpp.NewClient(cmpp.V30)
+	if err := c.Connect(s.Addr, "900001", "888888", time.Second); err != nil {
+		fmt.Println("connect error:", err)
+		return
+	}
+	defer c.Disconnect()
+
+	for i := 0; i < 3; i++ {
+		msgId, result, err := submit(c, cmpp.V30)
+		if err != nil {
+			fmt.Println("submit error:", err)
+			return
+		}
+		fmt.Printf("submit %d: result %d\n", msgId, result)
+	}
+	// Output:
+	// submit 1: result 0
+	// submit 2: result 0
+	// submit 3: result 8
+}
+
+func TestServerCmpp2(t *testing.T) {
+	s := cmpptest.NewServer(cmpp.V21, "888888")
+	defer s.Close()
+	s.RespondSubmit(2, 8)
+
+	c := cmpp.NewClient(cmpp.V21)
+	if err := c.Connect(s.Addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	for i, expected := range []uint32{0, 8} {
+		msgId, result, err := submit(c, cmpp.V21)
+		if err != nil {
+			t.Fatal("submit error:", err)
+		}
+		if msgId != uint64(i+1) || result != expected {
+			t.Fatalf("The submit response is of MsgId %d and result %d, not equal to expected: %d and %d\n",
+				msgId, result, i+1, expected)
+		}
+	}
+
+	submits := s.Submits()
+	if len(submits) != 2 {
+		t.Fatalf("The count of submits is %d, not equal to expected: %d\n", len(submits), 2)
+	}
+	if p, ok := submits[0].(*cmpp.Cmpp2SubmitReqPkt); !ok || p.MsgContent != "hello gocmpp" {
+		t.Fatalf("The submit received is %#v, not the one sent\n", submits[0])
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	s := cmpptest.NewServer(cmpp.V30, "888888")
+	defer s.Close()
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(s.Addr, "900001", "wrong", time.Second)
+	if err != cmpp.ConnStatus(cmpp.ErrnoConnAuthFailed) {
+		t.Fatalf("The error is %v, not the authentication failure\n", err)
+	}
+
+	s = cmpptest.NewUnstartedServer(cmpp.V30, "888888")
+	s.Auth = func(req *cmpp.CmppConnReqPkt) (uint8, string) {
+		if req.SrcAddr != "900001" {
+			return cmpp.ErrnoConnInvalidSrcAddr, ""
+		}
+		return 0, "secret"
+	}
+	s.Start()
+	defer s.Close()
+
+	c = cmpp.NewClient(cmpp.V30)
+	err = c.Connect(s.Addr, "900002", "secret", time.Second)
+	if err != cmpp.ConnStatus(cmpp.ErrnoConnInvalidSrcAddr) {
+		t.Fatalf("The error is %v, not the invalid source address\n", err)
+	}
+
+	c = cmpp.NewClient(cmpp.V30)
+	if err = c.Connect(s.Addr, "900001", "secret", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	c.Disconnect()
+}
@@ -14,11 +14,16 @@
 package cmpp
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,11 +31,28 @@ type State uint8
 
 // Errors for conn operations
 var (
-	ErrConnIsClosed = errors.New("connection is closed")
+	// ErrConnIsClosed is returned by the I/O methods of a Conn in the
+	// CONN_CLOSED state, e.g. after Close, before the socket is touched.
+	ErrConnIsClosed         = errors.New("connection is closed")
+	ErrConnectionClosed     = ErrConnIsClosed // an alias of ErrConnIsClosed
+	ErrActiveTestStarted    = errors.New("active test is already started")
+	ErrActiveTestNoResponse = errors.New("no active test response returned")
 )
 
 var noDeadline = time.Time{}
 
+// aLongTimeAgo is a deadline in the past, which is used
+// to abort the blocking I/O at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// closeFlushTimeout bounds the flush of the packets buffered by Close,
+// see WithFlushInterval.
+const closeFlushTimeout = 100 * time.Millisecond
+
+// deliverRspTimeout bounds the write of a deliver response sent by
+// WithAutoDeliverRsp, if no write timeout is set.
+const deliverRspTimeout = time.Second
+
 // Conn States
 const (
 	CONN_CLOSED State = iota
@@ -40,24 +62,129 @@ const (
 
 type Conn struct {
 	net.Conn
-	State State
+	State State // set it by SetState, and read it by GetState once c is in use
 	Typ   Type
 
-	// for SeqId generator goroutine
+	// for SeqId generator goroutine, SeqId is nil if the Conn
+	// is created with WithAtomicSeqId.
 	SeqId <-chan uint32
 	done  chan<- struct{}
+
+	atomicSeqId bool
+	seq         atomic.Uint32
+
+	// options
+	opts               []Option // the Conn is created with, for ConfigClone
+	handedReader       bool     // br is set by WithReader, see ConfigClone
+	keepAlivePeriod    time.Duration
+	onHeartbeatFailure func(error)
+	onUnknownCommand   func(CommandId, []byte)
+	rawDump            func(string, []byte)
+	dumpSend           func([]byte) // rawDump with DumpSend, nil if not set
+	resyncOnError      bool
+	writeTimeout       time.Duration
+	connectTimeout     time.Duration
+	readChanSize       int // capacity of the packet channel of ReadLoop, 0 means readLoopBuffer
+	srcAddrPad         byte
+	autoDeliverRsp     bool
+	setNoDelay         bool
+	noDelay            bool
+	flushInterval      time.Duration
+	flushPending       bool        // a lazy flush is scheduled, guarded by wLock
+	flushClosed        atomic.Bool // set by Close, the packets are no longer buffered
+	onStateChange      func(old, new State)
+	deliverResult      func(Packer) uint32
+	logger             Logger
+	metrics            Metrics
+	window             *window
+	limiter            *rateLimiter
+
+	// submit requests in flight, for Drain.
+	drain drainer
+
+	// the packets enqueued by Enqueue.
+	queue sendQueue
+
+	// for active test goroutine
+	atLock sync.Mutex
+	at     *activeTest
+
+	// round-trip time of the active tests, in nanoseconds.
+	lastLatency atomic.Int64
+	avgLatency  atomic.Int64
+
+	// traffic counters, see BytesSent.
+	bytesSent   atomic.Uint64
+	bytesRecv   atomic.Uint64
+	packetsSent atomic.Uint64
+	packetsRecv atomic.Uint64
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// stateMu guards State, which is set by Close from any goroutine
+	// while the others are sending or receiving.
+	stateMu sync.Mutex
+
+	// closed is closed by Close, it is created on demand by closeNotify.
+	closedMu sync.Mutex
+	closed   chan struct{}
+
+	// wLock serializes the pack-and-write sequence of
+	// SendPkt among concurrent writers.
+	wLock sync.Mutex
+
+	// rLock is held by a read through br, so that Close returns br to
+	// pool only if no read is in progress.
+	rLock sync.Mutex
+
+	// rb holds a partially received packet when the last read
+	// timed out in the middle of it.
+	rb *readBuffer
+
+	// br buffers the incoming byte stream, it is created
+	// at the first read if not set by WithReaderSize.
+	br *bufio.Reader
+
+	// pool is the ConnPool br is borrowed from, if any.
+	pool *ConnPool
+
+	// bw is set by WithWriterSize.
+	bw *bufio.Writer
+
+	// pb is the buffer the packets are packed into if the Conn is
+	// created with WithPackBuffer, it is guarded by wLock.
+	pb []byte
 }
 
 func newSeqIdGenerator() (<-chan uint32, chan<- struct{}) {
+	return NewSeqIdGeneratorStartingAt(1)
+}
+
+// NewSeqIdGeneratorStartingAt returns a SeqId generator which yields
+// start, start+1, ... in order. Closing the returned done channel lets
+// the generator goroutine exit.
+//
+// The generator never yields 0: a start of 0 is treated as 1, and the
+// counter wraps from math.MaxUint32 back to 1. It is useful for a
+// reconnecting client which wants to resume its numbering.
+func NewSeqIdGeneratorStartingAt(start uint32) (<-chan uint32, chan<- struct{}) {
 	out := make(chan uint32)
 	done := make(chan struct{})
 
+	if start == 0 {
+		start = 1
+	}
+
 	go func() {
-		var i uint32
+		var i = start
 		for {
 			select {
 			case out <- i:
 				i++
+				if i == 0 {
+					i = 1 // skip 0 on wraparound
+				}
 			case <-done:
 				close(out)
 				return
@@ -69,63 +196,688 @@ func newSeqIdGenerator() (<-chan uint32, chan<- struct{}) {
 
 // New returns an abstract structure for successfully
 // established underlying net.Conn.
+//
+// Tcp keepalive is enabled with the period of the operating system,
+// use NewConnWithOptions for more control.
 func NewConn(conn net.Conn, typ Type) *Conn {
-	seqId, done := newSeqIdGenerator()
+	return NewConnWithOptions(conn, typ)
+}
+
+// Option sets an optional parameter of a Conn created by
+// NewConnWithOptions.
+type Option func(*Conn)
+
+// WithKeepAlivePeriod sets the tcp keepalive period of the underlying
+// net.Conn. Zero means the default of the operating system (often 2 hours).
+//
+// Tcp keepalive only detects a dead peer host or network; it can not tell
+// whether the peer's cmpp service still works. The application-level
+// CMPP_ACTIVE_TEST heartbeat is still needed for that, and its interval is
+// usually much shorter than the keepalive period.
+func WithKeepAlivePeriod(d time.Duration) Option {
+	return func(c *Conn) {
+		c.keepAlivePeriod = d
+	}
+}
+
+// OnHeartbeatFailure sets a callback which is called once the active test
+// started by StartActiveTest fails, e.g. to log it or to trigger a reconnection.
+// The connection has already been closed when f is called.
+func OnHeartbeatFailure(f func(error)) Option {
+	return func(c *Conn) {
+		c.onHeartbeatFailure = f
+	}
+}
+
+// OnUnknownCommand sets a callback which is called with the command id
+// and the data following the Command_Id of a packet which is not supported
+// by this package, e.g. the vendor-specific ones. With the callback set,
+// RecvAndUnpackPkt skips such packets and goes on reading the next one
+// rather than returning ErrCommandIdNotSupported. data is only valid
+// during the call.
+func OnUnknownCommand(f func(id CommandId, data []byte)) Option {
+	return func(c *Conn) {
+		c.onUnknownCommand = f
+	}
+}
+
+// Directions passed to the callback of WithRawDump.
+const (
+	DumpSend = "send"
+	DumpRecv = "recv"
+)
+
+// WithRawDump sets a callback which is called with the whole frame(with
+// header) of every packet sent or received, dir is DumpSend or DumpRecv.
+// A received frame is dumped before it is unpacked, so the bytes of a
+// packet failing to be unpacked are dumped too. A received header with
+// invalid total_length or command_id is dumped alone. A frame sent is
+// dumped once it is packed, before it is written. b is only valid during
+// the call.
+func WithRawDump(f func(dir string, b []byte)) Option {
+	return func(c *Conn) {
+		c.rawDump, c.dumpSend = f, nil
+		if f != nil {
+			c.dumpSend = func(b []byte) { f(DumpSend, b) }
+		}
+	}
+}
+
+// WithResyncOnError makes RecvAndUnpackPkt recover from a corrupt packet
+// header by skipping the bytes until the next plausible header, i.e. one
+// with valid total_length and command_id, rather than returning the error.
+// The bytes of the corrupt packet may look like a plausible header too, the
+// packets following it may be lost or fail to be unpacked then.
+//
+// Without it, the invalid header is left unread and the same error is
+// returned by the following calls, the conn is supposed to be closed.
+func WithResyncOnError(resync bool) Option {
+	return func(c *Conn) {
+		c.resyncOnError = resync
+	}
+}
+
+// WithWriteTimeout sets the timeout of SendPkt, which blocks until the whole
+// packet is written by default. A slow peer makes SendPkt fail then, and
+// the returned *WriteError tells whether the packet is partially written.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		c.writeTimeout = d
+	}
+}
+
+// WithReadChannelSize sets the capacity of the packet channel of ReadLoop,
+// which is 64 by default, n less than 1 is raised to 1. See ReadLoop for the
+// backpressure a full channel applies.
+func WithReadChannelSize(n int) Option {
+	return func(c *Conn) {
+		c.readChanSize = max(n, 1)
+	}
+}
+
+// WithConnectTimeout limits the time Client.Connect waits for the connect
+// response after the connect request is sent, which fails with
+// ErrConnectTimeout once d is exceeded. It only applies to the login, other
+// reads and writes are not affected. Zero d, the default, means no deadline.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *Conn) {
+		c.connectTimeout = d
+	}
+}
+
+// WithSourceAddrPadding sets the byte which Client.Connect pads a user, the
+// Source_Addr of the connect request, shorter than 6 bytes with. The spec
+// pads it with binary zero, which is the default, but a few gateways expect
+// spaces(' ') instead, and reject the login with status 2(invalid source
+// address) or 3(auth failed) otherwise; ask the operator of the gateway
+// which one it takes. With a non-zero pad, the AuthenticatorSource is
+// computed from the padded Source_Addr, i.e. the same bytes as on the wire;
+// with zero, it is computed from the user unpadded, as before.
+func WithSourceAddrPadding(pad byte) Option {
+	return func(c *Conn) {
+		c.srcAddrPad = pad
+	}
+}
+
+// WithPackBuffer makes the Conn pack the packets into a buffer of its own,
+// which is reused by every send, rather than a buffer borrowed from the
+// package-level pool. The buffer is guarded by the send lock, so it is safe
+// with concurrent senders, but it is meant for a Conn with a single writer
+// goroutine, which never waits for the lock. The packets are packed into
+// the buffer directly, by PackInto, which saves the round trip to the pool
+// shared by all the Conns; both ways make no allocation and no copy per
+// packet, see BenchmarkSendPkt and BenchmarkPackInto.
+func WithPackBuffer() Option {
+	return func(c *Conn) {
+		c.pb = make([]byte, 0, minBufferSize)
+	}
+}
+
+// WithInflightTTL sets how long a submit request is tracked as in flight,
+// for Drain, until its response is received. It is DefaultSubmitTimeout by
+// default. A submit whose response is lost is given up after d, so that it
+// is neither kept for the life of the Conn, nor waited for by a later Drain.
+func WithInflightTTL(d time.Duration) Option {
+	return func(c *Conn) {
+		c.drain.ttl = d
+	}
+}
+
+// WithAutoDeliverRsp makes the Conn answer every deliver request received,
+// MO message or status report, before RecvAndUnpackPkt returns it. The
+// response echoes the MsgId and the sequence id of the request, and its
+// result is 0, or the one returned by result if it is not nil, e.g. to
+// reject a deliver the application can not handle.
+//
+// The response is written synchronously by RecvAndUnpackPkt, so that the
+// responses keep the order of the requests. The write is bounded by the
+// timeout of WithWriteTimeout, or one second if it is not set, so a peer
+// not reading holds the receive path that long at most; a response failing
+// to be written is logged and dropped, and the request is still returned.
+func WithAutoDeliverRsp(result func(req Packer) uint32) Option {
+	return func(c *Conn) {
+		c.autoDeliverRsp = true
+		c.deliverResult = result
+	}
+}
+
+// WithNoDelay sets the TCP_NODELAY option of the underlying tcp conn, which
+// is on by default in go. With it on, every packet is sent at once, which
+// suits the low-latency control traffic. With it off, the Nagle algorithm
+// coalesces the small packets sent in a row into fewer tcp segments, which
+// helps the throughput of bulk submits at the cost of latency, up to the
+// delayed ack timeout of the peer (often 40ms). Conns which are not tcp
+// are left untouched.
+func WithNoDelay(noDelay bool) Option {
+	return func(c *Conn) {
+		c.setNoDelay, c.noDelay = true, noDelay
+	}
+}
+
+// WithFlushInterval makes the buffered writer set by WithWriterSize flushed
+// lazily, at most d after a packet is written, or once the buffer fills,
+// rather than after every packet. Several packets are coalesced into one
+// write then, which saves syscalls for bulk submits, but every packet may
+// be delayed by up to d. It has no effect without WithWriterSize.
+//
+// With a lazy flush, SendPkt returns once the packet is buffered, and a
+// write error shows up in the later sends. The packets buffered are
+// flushed before the Conn is closed.
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *Conn) {
+		c.flushInterval = d
+	}
+}
+
+// WithAtomicSeqId makes the Conn generate the sequence ids with an atomic
+// counter rather than the SeqId generator goroutine, the SeqId channel of
+// the Conn is left nil and NextSeqId must be used instead.
+//
+// The generator goroutine costs a goroutine per Conn and two goroutine
+// switches per sequence id, which is noticeable only at very high submit
+// rates. See BenchmarkNextSeqId.
+func WithAtomicSeqId() Option {
+	return func(c *Conn) {
+		c.atomicSeqId = true
+	}
+}
+
+// minBufferSize is the least size of the read and write buffers,
+// a buffer holds a max-length cmpp3 packet at least.
+const minBufferSize = int(CMPP3_PACKET_MAX)
+
+// WithReaderSize sets the size of the buffer for reading packets,
+// which is 4096 by default. A size less than the max packet length
+// is raised to it.
+func WithReaderSize(n int) Option {
+	return func(c *Conn) {
+		if n < minBufferSize {
+			n = minBufferSize
+		}
+		c.br = bufio.NewReaderSize(c.Conn, n)
+	}
+}
+
+// WithReader makes the Conn read the packets from r, which must be a
+// buffered reader of the net.Conn the Conn is created with. It is used to
+// hand over a net.Conn which is already read through r, e.g. for a manual
+// handshake, so the bytes buffered in r are not lost but decoded in order.
+// A Conn cloned by ConfigClone gets a reader of its own, of the same size.
+func WithReader(r *bufio.Reader) Option {
+	return func(c *Conn) {
+		c.br, c.handedReader = r, true
+	}
+}
+
+// WithWriterSize makes the packets written through a buffer of n bytes,
+// which is flushed once a packet is written. By default the packets are
+// written to the net.Conn directly. A size less than the max packet length
+// is raised to it.
+func WithWriterSize(n int) Option {
+	return func(c *Conn) {
+		if n < minBufferSize {
+			n = minBufferSize
+		}
+		c.bw = bufio.NewWriterSize(c.Conn, n)
+	}
+}
+
+// NewConnWithOptions is like NewConn, but the Conn is configured with opts.
+func NewConnWithOptions(conn net.Conn, typ Type, opts ...Option) *Conn {
+	return newConn(conn, typ, slices.Clone(opts))
+}
+
+// newConn is NewConnWithOptions without copying opts, which are kept by
+// the Conn.
+func newConn(conn net.Conn, typ Type, opts []Option) *Conn {
 	c := &Conn{
-		Conn:  conn,
-		Typ:   typ,
-		SeqId: seqId,
-		done:  done,
+		Conn: conn,
+		Typ:  typ,
+		opts: opts,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if !c.atomicSeqId {
+		c.SeqId, c.done = newSeqIdGenerator()
+	}
+	setKeepAlive(c.Conn, c.keepAlivePeriod) //Keepalive as default
+	if c.setNoDelay {
+		setNoDelay(c.Conn, c.noDelay)
+	}
+	if c.window != nil {
+		c.window.reclaimed = c.drain.done
 	}
-	tc := c.Conn.(*net.TCPConn) // Always tcpconn
-	tc.SetKeepAlive(true)       //Keepalive as default
 	return c
 }
 
-func (c *Conn) Close() {
-	if c != nil {
-		if c.State == CONN_CLOSED {
-			return
+// ConfigClone returns a new Conn over conn, which is configured as c: it is
+// created with the same Type and Options as c, and with the logger, metrics
+// and state change callback currently set on c. It is useful to replace a
+// dead Conn when reconnecting.
+//
+// The per connection state is not shared with c: the new Conn has its own
+// SeqId generator, submit window and rate limiter, and is in CONN_CLOSED
+// state as returned by NewConn. The reader given by WithReader, which is
+// bound to the net.Conn of c, is not shared either.
+func (c *Conn) ConfigClone(conn net.Conn) *Conn {
+	n := NewConnWithOptions(conn, c.Typ, c.opts...)
+	if n.handedReader {
+		n.br, n.handedReader = bufio.NewReaderSize(conn, n.br.Size()), false
+	}
+	n.logger = c.logger
+	n.metrics = c.metrics
+	n.onStateChange = c.onStateChange
+	return n
+}
+
+// keepAliver is implemented by *net.TCPConn and any other
+// conn which supports tcp keepalive.
+type keepAliver interface {
+	SetKeepAlive(keepalive bool) error
+}
+
+// setKeepAlive enables keepalive on conn if it is possible, and sets
+// the keepalive period if period is not zero. Wrapped conns, such as
+// *tls.Conn, are unwrapped through their NetConn method.
+// Conns like net.Pipe are left untouched.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	switch c := conn.(type) {
+	case keepAliver:
+		c.SetKeepAlive(true)
+		if p, ok := c.(interface {
+			SetKeepAlivePeriod(d time.Duration) error
+		}); ok && period != 0 {
+			p.SetKeepAlivePeriod(period)
+		}
+	case interface {
+		NetConn() net.Conn
+	}:
+		setKeepAlive(c.NetConn(), period)
+	}
+}
+
+// setNoDelay sets TCP_NODELAY of conn if it is possible, wrapped conns are
+// unwrapped like setKeepAlive.
+func setNoDelay(conn net.Conn, noDelay bool) {
+	switch c := conn.(type) {
+	case interface {
+		SetNoDelay(noDelay bool) error
+	}:
+		c.SetNoDelay(noDelay)
+	case interface {
+		NetConn() net.Conn
+	}:
+		setNoDelay(c.NetConn(), noDelay)
+	}
+}
+
+// Close closes the connection. It is safe to be called more than once and
+// from several goroutines, the connection is only closed at the first call.
+// The error from closing the underlying net.Conn is returned to all callers.
+//
+// With WithFlushInterval, Close flushes the packets buffered within a short
+// deadline, and the flush error is returned ahead of the one from closing the
+// net.Conn. It does not wait for a SendPkt in progress, which may be stuck on
+// a peer that stopped reading: that SendPkt flushes its packet itself, and
+// fails once the net.Conn is closed.
+func (c *Conn) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.closeOnce.Do(func() {
+		c.stopActiveTest()
+		if c.window != nil {
+			c.window.close()
+		}
+		c.drain.close()
+		if c.done != nil {
+			close(c.done) // let the SeqId goroutine exit.
+		}
+		var flushErr error
+		if c.bw != nil && c.flushInterval > 0 {
+			c.flushClosed.Store(true)
+			if c.wLock.TryLock() {
+				// the packets buffered by lazy flush.
+				c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+				flushErr = c.bw.Flush()
+				c.wLock.Unlock()
+			}
+		}
+		close(c.closeNotify())
+		c.closeErr = c.Conn.Close() // close the underlying net.Conn
+		if flushErr != nil {
+			c.closeErr = flushErr
+		}
+		c.SetState(CONN_CLOSED)
+		if c.pool != nil && c.rLock.TryLock() {
+			// no read is in progress, and the later ones see CONN_CLOSED
+			// under rLock, they never touch br.
+			c.pool.putReader(c.br)
+			c.br, c.pool = nil, nil
+			c.rLock.Unlock()
+		}
+	})
+	return c.closeErr
+}
+
+// closeNotify returns a channel which is closed once c is closed.
+func (c *Conn) closeNotify() chan struct{} {
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	return c.closed
+}
+
+// GracefulClose terminates the connection with the terminate handshake.
+// It sends a terminate request, waits for the terminate response, then
+// closes the connection. Packets received meanwhile are dropped.
+//
+// Both peers may start the handshake at the same time, then the terminate
+// requests cross each other. The states of the handshake are:
+//
+//	waiting: the terminate request is being sent or has been sent.
+//	  a terminate response of the request -> done
+//	  a terminate request, which is answered -> crossed
+//	crossed: the peer is terminating too, the exchange is complete.
+//	  a terminate response of the request -> done
+//	  the connection is closed by the peer -> done
+//	done: the connection is closed.
+//
+// The packets are sent while the packets are being received, so the peers
+// never block each other writing their requests or responses.
+//
+// If the response does not arrive within timeout(zero means no deadline),
+// the connection is closed anyway and the read error is returned, unless
+// the handshake is crossed.
+func (c *Conn) GracefulClose(timeout time.Duration) error {
+	defer c.Close()
+
+	if c.GetState() == CONN_CLOSED {
+		return ErrConnIsClosed
+	}
+
+	if timeout != 0 {
+		deadline := time.Now().Add(timeout)
+		c.SetReadDeadline(deadline)
+		c.SetWriteDeadline(deadline)
+	}
+
+	// the packets are sent by goroutines, the first error of them
+	// aborts the receiving.
+	var wg sync.WaitGroup
+	var sendErr error
+	var once sync.Once
+	send := func(p Packer, seqId uint32) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.SendPkt(p, seqId); err != nil {
+				once.Do(func() { sendErr = err })
+				c.SetReadDeadline(aLongTimeAgo)
+			}
+		}()
+	}
+
+	seqId := c.NextSeqId()
+	send(&CmppTerminateReqPkt{}, seqId)
+
+	crossed := false
+	for {
+		p, err := c.RecvAndUnpackPkt(0)
+		if err != nil {
+			// abort the sending, and wait for it before closing.
+			c.SetWriteDeadline(aLongTimeAgo)
+			wg.Wait()
+			switch {
+			case crossed:
+				return nil // the request may be given up as the peer closes.
+			case sendErr != nil:
+				return sendErr
+			}
+			return err
+		}
+
+		switch p := p.(type) {
+		case *CmppTerminateRspPkt:
+			if p.SeqId == seqId {
+				wg.Wait() // the answer of a crossed request.
+				return nil
+			}
+		case *CmppTerminateReqPkt:
+			send(&CmppTerminateRspPkt{}, p.SeqId)
+			crossed = true
+		}
+	}
+}
+
+// NextSeqId returns the next sequence id of c, it never returns 0.
+func (c *Conn) NextSeqId() uint32 {
+	if c.SeqId != nil {
+		return <-c.SeqId
+	}
+
+	for {
+		if id := c.seq.Add(1); id != 0 {
+			return id
 		}
-		close(c.done)  // let the SeqId goroutine exit.
-		c.Conn.Close() // close the underlying net.Conn
-		c.State = CONN_CLOSED
 	}
 }
 
+// SetState sets the state of c, the callback set by OnStateChange is
+// called if the state changes.
 func (c *Conn) SetState(state State) {
+	c.stateMu.Lock()
+	old := c.State
 	c.State = state
+	c.stateMu.Unlock()
+
+	if c.onStateChange != nil && old != state {
+		c.onStateChange(old, state)
+	}
+}
+
+// GetState returns the state of c. Unlike reading the State field, it is
+// safe while another goroutine closes c.
+func (c *Conn) GetState() State {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.State
+}
+
+// OnStateChange sets a callback which is called with the old and the new
+// state once the state of c changes, by SetState or Close, e.g. from
+// CONN_CONNECTED to CONN_AUTHOK after the login. It should be set before c
+// is used. The callback is called synchronously by the goroutine changing
+// the state, so it must not block, nor call SetState or Close of c.
+func (c *Conn) OnStateChange(f func(old, new State)) {
+	c.onStateChange = f
 }
 
 // SendPkt pack the cmpp packet structure and send it to the other peer.
+// It blocks until the whole packet is written, or the timeout set by
+// WithWriteTimeout is exceeded.
+//
+// If the packet fails to be written, the error is a *WriteError.
 func (c *Conn) SendPkt(packet Packer, seqId uint32) error {
-	if c.State == CONN_CLOSED {
+	return c.SendPktTimeout(packet, seqId, c.writeTimeout)
+}
+
+// SendPktTimeout is like SendPkt, but fails with a timeout error if the
+// packet can not be written within timeout. Zero timeout means no deadline.
+//
+// It is safe to call SendPkt and SendPktTimeout from multiple goroutines.
+func (c *Conn) SendPktTimeout(packet Packer, seqId uint32, timeout time.Duration) error {
+	return c.sendPkt(packet, seqId, timeout, nil)
+}
+
+// sendPkt sends the packet, giving up once timeout(if not zero) is
+// exceeded or cancel is closed.
+func (c *Conn) sendPkt(packet Packer, seqId uint32, timeout time.Duration, cancel <-chan struct{}) (err error) {
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if c.GetState() == CONN_CLOSED {
 		return ErrConnIsClosed
 	}
 
-	data, err := packet.Pack(seqId)
+	if isSubmitReq(packet) {
+		if err = c.drain.add(seqId); err != nil {
+			return err
+		}
+		defer func() {
+			// a duplicate seqId leaves the one in flight alone.
+			if err != nil && err != ErrSeqIdInFlight {
+				c.drain.done(seqId)
+			}
+		}()
+	}
+
+	if c.window != nil && isSubmitReq(packet) {
+		if err = c.window.acquire(seqId, deadline, cancel); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				c.window.release(seqId)
+			}
+		}()
+	}
+
+	if c.limiter != nil && isSubmitReq(packet) {
+		if err = c.limiter.wait(deadline, cancel); err != nil {
+			return err
+		}
+	}
+
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if c.flushClosed.Load() {
+		return ErrConnIsClosed // nothing buffered now would be flushed.
+	}
+	if timeout != 0 {
+		c.SetWriteDeadline(deadline)
+		defer c.SetWriteDeadline(noDeadline)
+	}
+
+	id, n, err := c.writePkt(packet, seqId)
+	c.bytesSent.Add(uint64(n))
 	if err != nil {
+		c.metric().IncError(ErrKindSend)
 		return err
 	}
+	c.metric().IncSent(id)
+	c.packetsSent.Add(1)
+	return nil
+}
+
+// writePkt packs the packet and writes it to the net.Conn, through c.bw if
+// it is set. It returns the bytes of the packet written, those buffered in
+// c.bw included.
+func (c *Conn) writePkt(packet Packer, seqId uint32) (CommandId, int, error) {
+	if c.bw == nil {
+		return c.packTo(c.Conn, packet, seqId) //block write
+	}
 
-	_, err = c.Conn.Write(data) //block write
+	id, n, err := c.packTo(c.bw, packet, seqId)
 	if err != nil {
-		return err
+		if _, ok := err.(*WriteError); ok {
+			c.bw.Reset(c.Conn) // bufio.Writer keeps the error, reset it.
+		}
+		// a pack error writes nothing, the packets buffered are kept.
+		return id, 0, err
+	}
+	if c.flushInterval > 0 && !c.flushClosed.Load() {
+		if !c.flushPending {
+			c.flushPending = true
+			time.AfterFunc(c.flushInterval, c.lazyFlush)
+		}
+		return id, n, nil
 	}
+	total := c.bw.Buffered()
+	if err = c.bw.Flush(); err != nil {
+		written := total - c.bw.Buffered()
+		err = &WriteError{Written: written, Total: total, Err: err}
+		c.bw.Reset(c.Conn) // bufio.Writer keeps the error, reset it.
+		return id, written, err
+	}
+	return id, n, nil
+}
 
-	return nil
+// lazyFlush flushes the packets buffered, see WithFlushInterval.
+func (c *Conn) lazyFlush() {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	c.flushPending = false
+	if c.GetState() == CONN_CLOSED || c.bw.Buffered() == 0 {
+		return
+	}
+	if err := c.bw.Flush(); err != nil {
+		c.log().Errorf("cmpp: flush the buffered packets error: %s", err)
+	}
 }
 
-const (
-	defaultReadBufferSize = 4096
-)
+// packIntoer is implemented by the packets of this package.
+type packIntoer interface {
+	PackInto(buf []byte, seqId uint32) ([]byte, error)
+}
+
+// packTo is the same as the package-level packTo, but packs the packet
+// into c.pb if the Conn is created with WithPackBuffer. The frame packed
+// is passed to the rawDump callback once, however many writes it takes.
+func (c *Conn) packTo(w io.Writer, packet Packer, seqId uint32) (CommandId, int, error) {
+	pi, ok := packet.(packIntoer)
+	if !ok || c.pb == nil {
+		return packTo(w, packet, seqId, c.dumpSend)
+	}
+
+	var err error
+	c.pb, err = pi.PackInto(c.pb[:0], seqId)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c.dumpSend != nil {
+		c.dumpSend(c.pb)
+	}
+	n, err := writeFull(w, c.pb)
+	return commandIdOf(c.pb), n, err
+}
 
 // readBuffer is used to optimize the performance of
 // RecvAndUnpackPkt.
 type readBuffer struct {
 	totalLen  uint32
 	commandId CommandId
-	leftData  [defaultReadBufferSize]byte
+	n         int // bytes of current packet received so far
+	header    [8]byte
+	leftData  *[]byte // borrowed from the payload pools
 }
 
 var readBufferPool = sync.Pool{
@@ -134,10 +886,109 @@ var readBufferPool = sync.Pool{
 	},
 }
 
+func getReadBuffer() *readBuffer {
+	rb := readBufferPool.Get().(*readBuffer)
+	rb.n = 0
+	return rb
+}
+
+// putReadBuffer returns rb and its payload buffer to the pools.
+func putReadBuffer(rb *readBuffer) {
+	if rb.leftData != nil {
+		putPayload(rb.leftData)
+		rb.leftData = nil
+	}
+	readBufferPool.Put(rb)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
 // RecvAndUnpackPkt receives cmpp byte stream, and unpack it to some cmpp packet structure.
+// It is kept for compatibility and is the same as RecvAndUnpackPktTimeout.
 func (c *Conn) RecvAndUnpackPkt(timeout time.Duration) (interface{}, error) {
-	if c.State == CONN_CLOSED {
-		return nil, ErrConnIsClosed
+	return c.RecvAndUnpackPktTimeout(timeout)
+}
+
+// readLoopBuffer is the number of packets ReadLoop buffers by default.
+const readLoopBuffer = 64
+
+// ReadLoop starts a goroutine which keeps receiving the packets from c and
+// sends them on the returned packet channel, until the receive fails or c is
+// closed. The error ending the loop, ErrConnIsClosed if it is ended by Close,
+// is then sent on the returned error channel, and both channels are closed.
+// It should be called once, and no other goroutine should receive from c
+// meanwhile.
+//
+// The packets are sent in the order they arrive, e.g. the MO messages and
+// the status reports in the deliver requests, which are answered in that
+// order too with WithAutoDeliverRsp, before they are sent on the channel.
+//
+// The packet channel buffers up to 64 packets, see WithReadChannelSize.
+// Once it is full the loop blocks, so no more packets are read from the
+// connection until the caller catches up. This applies backpressure to the
+// peer naturally: the packets not read fill the TCP receive buffer, the
+// receive window shrinks to zero and the peer stalls in its writes, rather
+// than the packets piling up in memory. A caller which stops reading must
+// Close c to let the goroutine exit.
+func (c *Conn) ReadLoop() (<-chan interface{}, <-chan error) {
+	size := c.readChanSize
+	if size == 0 {
+		size = readLoopBuffer
+	}
+	pkts := make(chan interface{}, size)
+	errc := make(chan error, 1)
+	closed := c.closeNotify()
+
+	go func() {
+		defer close(errc)
+		defer close(pkts)
+		for {
+			p, err := c.RecvAndUnpackPkt(0)
+			if err != nil {
+				select {
+				case <-closed:
+					err = ErrConnIsClosed
+				default:
+				}
+				errc <- err
+				return
+			}
+
+			select {
+			case pkts <- p:
+			case <-closed:
+				errc <- ErrConnIsClosed
+				return
+			}
+		}
+	}()
+	return pkts, errc
+}
+
+// RecvAndUnpackPktTimeout receives cmpp byte stream, and unpack it to some
+// cmpp packet structure. Zero timeout means no deadline.
+//
+// If the deadline fires, the returned error is a net.Error whose Timeout()
+// is true (and errors.Is(err, os.ErrDeadlineExceeded) holds). The bytes of
+// a partially received packet are kept, and the next call resumes reading
+// that packet, so the caller may simply retry.
+func (c *Conn) RecvAndUnpackPktTimeout(timeout time.Duration) (interface{}, error) {
+	_, _, p, err := c.RecvAndUnpackPktWithHeader(timeout)
+	return p, err
+}
+
+// RecvAndUnpackPktWithHeader is like RecvAndUnpackPktTimeout, but it also
+// returns the command id and the sequence id read from the packet header.
+// The command id is returned even if the packet is not supported or
+// fails to be unpacked.
+func (c *Conn) RecvAndUnpackPktWithHeader(timeout time.Duration) (CommandId, uint32, interface{}, error) {
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	if c.GetState() == CONN_CLOSED {
+		return 0, 0, nil, ErrConnIsClosed
 	}
 
 	if timeout != 0 {
@@ -146,108 +997,499 @@ func (c *Conn) RecvAndUnpackPkt(timeout time.Duration) (interface{}, error) {
 		defer c.SetReadDeadline(noDeadline)
 	}
 
-	rb := readBufferPool.Get().(*readBuffer)
-	defer readBufferPool.Put(rb)
+	for {
+		id, seqId, p, err := c.recvPkt()
+		if err == ErrCommandIdNotSupported && c.onUnknownCommand != nil {
+			continue // the packet is passed to onUnknownCommand, read the next one.
+		}
+		return id, seqId, p, err
+	}
+}
+
+// recvPkt reads and unpacks a packet.
+func (c *Conn) recvPkt() (CommandId, uint32, interface{}, error) {
+	rb := c.rb
+	if rb == nil {
+		rb = getReadBuffer()
+	}
+	c.rb = nil
 
-	// Total_Length in packet
-	err := binary.Read(c.Conn, binary.BigEndian, &rb.totalLen)
+	err := c.readPkt(rb)
 	if err != nil {
-		return nil, err
+		if !isTimeout(err) {
+			c.metric().IncError(ErrKindRecv)
+		}
+		if rb.n > 0 && isTimeout(err) {
+			// keep the partial packet for the next call.
+			c.rb = rb
+		} else {
+			putReadBuffer(rb)
+		}
+		return 0, 0, nil, err
+	}
+	defer putReadBuffer(rb)
+
+	c.bytesRecv.Add(uint64(rb.totalLen))
+	c.packetsRecv.Add(1)
+
+	// The left packet data (start from seqId in header).
+	var leftData = *rb.leftData
+	var seqId uint32
+	if len(leftData) >= 4 {
+		seqId = binary.BigEndian.Uint32(leftData[0:4])
 	}
 
-	if c.Typ == V30 {
-		if rb.totalLen < CMPP3_PACKET_MIN || rb.totalLen > CMPP3_PACKET_MAX {
-			return nil, ErrTotalLengthInvalid
+	if c.rawDump != nil {
+		// the header is read separately, put it back in front of the left data.
+		frame := make([]byte, 0, int(rb.totalLen))
+		frame = append(frame, rb.header[:]...)
+		c.rawDump(DumpRecv, append(frame, leftData...))
+	}
+
+	p, err := unpackPacket(c.Typ, rb.commandId, leftData)
+	if err == ErrCommandIdNotSupported {
+		c.metric().IncError(ErrKindUnsupported)
+		if c.onUnknownCommand != nil {
+			c.log().Debugf("cmpp: receive a packet with unsupported command_id: %v[%d]", rb.commandId, seqId)
+			c.onUnknownCommand(rb.commandId, leftData)
+		} else {
+			c.log().Errorf("cmpp: receive a packet with unsupported command_id: %v[%d]", rb.commandId, seqId)
 		}
+		return rb.commandId, seqId, nil, err
 	}
+	if err != nil {
+		c.log().Errorf("cmpp: unpack %v[%d] packet error: %s", rb.commandId, seqId, err)
+		c.metric().IncError(ErrKindUnpack)
+		return rb.commandId, seqId, nil, err
+	}
+	c.log().Debugf("cmpp: receive a %v packet[%d]", rb.commandId, seqId)
+	c.metric().IncRecv(rb.commandId)
 
-	if c.Typ == V21 || c.Typ == V20 {
-		if rb.totalLen < CMPP2_PACKET_MIN || rb.totalLen > CMPP2_PACKET_MAX {
-			return nil, ErrTotalLengthInvalid
+	switch rsp := p.(type) {
+	case *CmppActiveTestRspPkt:
+		c.ackActiveTest(rsp.SeqId)
+	case *Cmpp2SubmitRspPkt, *Cmpp3SubmitRspPkt:
+		if c.window != nil {
+			c.window.release(seqId)
+		}
+		c.drain.done(seqId)
+	case *CmppTerminateRspPkt:
+		c.drain.ackTerminate(seqId)
+	case *Cmpp2DeliverReqPkt, *Cmpp3DeliverReqPkt:
+		if c.autoDeliverRsp {
+			c.answerDeliver(p)
 		}
 	}
+	return rb.commandId, seqId, p, nil
+}
 
-	// Command_Id
-	err = binary.Read(c.Conn, binary.BigEndian, &rb.commandId)
-	if err != nil {
-		return nil, err
+// answerDeliver sends the response of the deliver request p, see
+// WithAutoDeliverRsp. A failure is only logged, p is still returned
+// to the caller.
+func (c *Conn) answerDeliver(p Packer) {
+	var result uint32
+	if c.deliverResult != nil {
+		result = c.deliverResult(p)
+	}
+
+	var rsp Packer
+	var seqId uint32
+	switch req := p.(type) {
+	case *Cmpp2DeliverReqPkt:
+		rsp, seqId = NewCmpp2DeliverRsp(req, uint8(result)), req.SeqId
+	case *Cmpp3DeliverReqPkt:
+		rsp, seqId = NewCmpp3DeliverRsp(req, result), req.SeqId
+	}
+	timeout := c.writeTimeout
+	if timeout == 0 {
+		timeout = deliverRspTimeout
 	}
+	if err := c.SendPktTimeout(rsp, seqId, timeout); err != nil {
+		c.log().Errorf("cmpp: send the response of deliver packet[%d] error: %s", seqId, err)
+	}
+}
 
-	if !((rb.commandId > CMPP_REQUEST_MIN && rb.commandId < CMPP_REQUEST_MAX) ||
-		(rb.commandId > CMPP_RESPONSE_MIN && rb.commandId < CMPP_RESPONSE_MAX)) {
-		return nil, ErrCommandIdInvalid
+// readPkt reads the header and the left data of a packet into rb.
+// It continues from rb.n, so a packet interrupted by a timeout can
+// be resumed.
+func (c *Conn) readPkt(rb *readBuffer) error {
+	if rb.n < len(rb.header) {
+		if err := c.readHeader(rb); err != nil {
+			return err
+		}
 	}
 
 	// The left packet data (start from seqId in header).
-	var leftData = rb.leftData[0:(rb.totalLen - 8)]
-	_, err = io.ReadFull(c.Conn, leftData)
+	if rb.leftData == nil {
+		rb.leftData = getPayload(int(rb.totalLen - 8))
+	}
+	var leftData = *rb.leftData
+	n, err := io.ReadFull(c.reader(), leftData[rb.n-len(rb.header):])
+	rb.n += n
+	return err
+}
+
+// readHeader peeks the header of the next packet, and consumes it only
+// if it is valid, so an invalid header is left in the stream. With
+// WithResyncOnError, the bytes are skipped one by one until a valid
+// header shows up, rather than returning the error.
+func (c *Conn) readHeader(rb *readBuffer) error {
+	r := c.reader()
+	skipped := 0
+	for {
+		header, err := r.Peek(len(rb.header))
+		if err != nil {
+			if skipped > 0 {
+				c.log().Errorf("cmpp: skip %d bytes to resync the packets", skipped)
+			}
+			if err == io.EOF && len(header) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		totalLen := binary.BigEndian.Uint32(header[0:4])
+		id := CommandId(binary.BigEndian.Uint32(header[4:8]))
+		err = checkHeader(c.Typ, totalLen, id)
+		if err == nil {
+			if skipped > 0 {
+				c.log().Errorf("cmpp: skip %d bytes to resync the packets", skipped)
+			}
+			copy(rb.header[:], header)
+			rb.totalLen, rb.commandId = totalLen, id
+			rb.n = len(rb.header)
+			_, err = r.Discard(len(rb.header))
+			return err
+		}
+
+		if skipped == 0 {
+			switch err {
+			case ErrTotalLengthInvalid:
+				c.log().Errorf("cmpp: receive a packet with invalid total_length: %d", totalLen)
+			case ErrCommandIdInvalid:
+				c.log().Errorf("cmpp: receive a packet with invalid command_id: 0x%x", uint32(id))
+			default:
+				c.log().Errorf("cmpp: receive a %v packet with inconsistent total_length: %d", id, totalLen)
+			}
+			if c.rawDump != nil {
+				c.rawDump(DumpRecv, header)
+			}
+		}
+		if !c.resyncOnError {
+			return err
+		}
+		if skipped == 0 {
+			c.metric().IncError(ErrKindRecv)
+		}
+		r.Discard(1)
+		skipped++
+	}
+}
+
+// reader returns the buffered reader of c. All the reads of c go through
+// it, including Read, never through the net.Conn directly, so the bytes
+// buffered are consumed in order.
+func (c *Conn) reader() *bufio.Reader {
+	if c.br == nil {
+		c.br = bufio.NewReader(c.Conn)
+	}
+	return c.br
+}
+
+// Read reads the raw bytes from c, it overrides the Read of the net.Conn
+// to read through the buffer of c, see WithReaderSize, so the bytes which
+// are buffered but not unpacked yet by RecvAndUnpackPkt are returned first.
+// It should not be called while a packet is partially received after a
+// read timeout, whose bytes read so far are held by c. ErrConnIsClosed is
+// returned after Close.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	select {
+	case <-c.closeNotify():
+		return 0, ErrConnIsClosed
+	default:
+	}
+	return c.reader().Read(b)
+}
+
+// RecvAndUnpackBatch receives at most max packets at a time. It blocks until
+// the first packet is received, then goes on unpacking the packets already
+// buffered, and returns as soon as receiving one more packet would block.
+//
+// If an error occurs after some packets are received, those packets are
+// returned along with the error.
+func (c *Conn) RecvAndUnpackBatch(max int) ([]interface{}, error) {
+	if max <= 0 {
+		return nil, ErrMethodParamsInvalid
+	}
+
+	p, err := c.RecvAndUnpackPktTimeout(0)
 	if err != nil {
 		return nil, err
 	}
 
-	var p Packer
-	switch rb.commandId {
-	case CMPP_CONNECT:
-		p = &CmppConnReqPkt{}
-	case CMPP_CONNECT_RESP:
-		if c.Typ == V30 {
-			p = &Cmpp3ConnRspPkt{}
-		} else {
-			p = &Cmpp2ConnRspPkt{}
-		}
-	case CMPP_TERMINATE:
-		p = &CmppTerminateReqPkt{}
-	case CMPP_TERMINATE_RESP:
-		p = &CmppTerminateRspPkt{}
-	case CMPP_SUBMIT:
-		if c.Typ == V30 {
-			p = &Cmpp3SubmitReqPkt{}
-		} else {
-			p = &Cmpp2SubmitReqPkt{}
+	pkts := []interface{}{p}
+	for len(pkts) < max && c.buffered() {
+		p, err = c.RecvAndUnpackPktTimeout(0)
+		if err != nil {
+			return pkts, err
 		}
-	case CMPP_SUBMIT_RESP:
-		if c.Typ == V30 {
-			p = &Cmpp3SubmitRspPkt{}
-		} else {
-			p = &Cmpp2SubmitRspPkt{}
+		pkts = append(pkts, p)
+	}
+	return pkts, nil
+}
+
+// buffered reports whether a whole packet is buffered in c.br.
+func (c *Conn) buffered() bool {
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	n := c.reader().Buffered()
+	if n < 8 {
+		return false
+	}
+	header, _ := c.br.Peek(4)
+	return n >= int(binary.BigEndian.Uint32(header))
+}
+
+// SendPktContext is like SendPkt, but the write is aborted once ctx is done.
+// The error returned then wraps ctx.Err(). Note that a packet aborted in the
+// middle of writing leaves the peer with a broken byte stream, the conn
+// should be closed in that case.
+func (c *Conn) SendPktContext(ctx context.Context, packet Packer, seqId uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := watchContext(ctx, c.Conn.SetWriteDeadline)
+	err := c.sendPkt(packet, seqId, 0, ctx.Done())
+	if stop() && err != nil {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return err
+}
+
+// RecvAndUnpackPktContext is like RecvAndUnpackPkt, but the read is aborted
+// once ctx is done. The error returned then wraps ctx.Err(). Like a timeout,
+// the partially received packet is kept for the next call.
+func (c *Conn) RecvAndUnpackPktContext(ctx context.Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stop := watchContext(ctx, c.Conn.SetReadDeadline)
+	p, err := c.RecvAndUnpackPktTimeout(0)
+	if stop() && err != nil {
+		return nil, fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return p, err
+}
+
+// watchContext spawns a goroutine which calls setDeadline with a deadline in
+// the past once ctx is done, so that the blocking I/O returns at once.
+// The returned stop function makes the goroutine exit, restores the deadline
+// if it has been changed, and reports whether ctx fired.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func() bool) {
+	done := make(chan struct{})
+	fired := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+			fired <- true
+		case <-done:
+			fired <- false
 		}
-	case CMPP_DELIVER:
-		if c.Typ == V30 {
-			p = &Cmpp3DeliverReqPkt{}
-		} else {
-			p = &Cmpp2DeliverReqPkt{}
+	}()
+
+	return func() bool {
+		close(done)
+		if <-fired {
+			setDeadline(noDeadline)
+			return true
 		}
-	case CMPP_DELIVER_RESP:
-		if c.Typ == V30 {
-			p = &Cmpp3DeliverRspPkt{}
-		} else {
-			p = &Cmpp2DeliverRspPkt{}
+		return false
+	}
+}
+
+// activeTest holds the state of the active test goroutine.
+type activeTest struct {
+	sync.Mutex
+	pending map[uint32]time.Time // seqIds of unanswered active test requests and their sending time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func (at *activeTest) halt() {
+	at.once.Do(func() {
+		close(at.stop)
+	})
+}
+
+// StartActiveTest spawns a goroutine which sends a CMPP_ACTIVE_TEST request
+// to the peer every interval. The responses are matched by seqId when they
+// are received by RecvAndUnpackPkt, so some goroutine must keep reading
+// the conn. Once maxMiss requests in a row are not answered, the conn is
+// closed and the OnHeartbeatFailure callback, if any, is called.
+//
+// The goroutine exits when the conn is closed.
+func (c *Conn) StartActiveTest(interval time.Duration, maxMiss int) error {
+	if c.GetState() == CONN_CLOSED {
+		return ErrConnIsClosed
+	}
+
+	if interval <= 0 || maxMiss <= 0 {
+		return ErrMethodParamsInvalid
+	}
+
+	c.atLock.Lock()
+	defer c.atLock.Unlock()
+	if c.at != nil {
+		return ErrActiveTestStarted
+	}
+
+	at := &activeTest{
+		pending: make(map[uint32]time.Time),
+		stop:    make(chan struct{}),
+	}
+	c.at = at
+	go c.runActiveTest(at, interval, maxMiss)
+	return nil
+}
+
+func (c *Conn) runActiveTest(at *activeTest, interval time.Duration, maxMiss int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-at.stop:
+			return
+		case <-t.C:
 		}
-	case CMPP_FWD:
-		if c.Typ == V30 {
-			p = &Cmpp3FwdReqPkt{}
-		} else {
-			p = &Cmpp2FwdReqPkt{}
+
+		at.Lock()
+		missed := len(at.pending)
+		at.Unlock()
+		if missed >= maxMiss {
+			c.failActiveTest(at, ErrActiveTestNoResponse)
+			return
 		}
-	case CMPP_FWD_RESP:
-		if c.Typ == V30 {
-			p = &Cmpp3FwdRspPkt{}
-		} else {
-			p = &Cmpp2FwdRspPkt{}
+
+		seqId := c.NextSeqId()
+		at.Lock()
+		at.pending[seqId] = time.Now()
+		at.Unlock()
+
+		err := c.SendPktTimeout(&CmppActiveTestReqPkt{}, seqId, interval)
+		if err != nil {
+			c.failActiveTest(at, err)
+			return
 		}
-	case CMPP_ACTIVE_TEST:
-		p = &CmppActiveTestReqPkt{}
-	case CMPP_ACTIVE_TEST_RESP:
-		p = &CmppActiveTestRspPkt{}
+	}
+}
 
+func (c *Conn) failActiveTest(at *activeTest, err error) {
+	select {
+	case <-at.stop:
+		return // closed by the user, not a failure.
 	default:
-		p = nil
-		return nil, ErrCommandIdNotSupported
 	}
 
-	err = p.Unpack(leftData)
-	if err != nil {
-		return nil, err
+	c.Close()
+	if c.onHeartbeatFailure != nil {
+		c.onHeartbeatFailure(err)
+	}
+}
+
+// ackActiveTest marks the active test request with seqId, and
+// all the requests before it, as answered. The round-trip time
+// of the request is recorded.
+func (c *Conn) ackActiveTest(seqId uint32) {
+	c.atLock.Lock()
+	at := c.at
+	c.atLock.Unlock()
+	if at == nil {
+		return
+	}
+
+	at.Lock()
+	sent, ok := at.pending[seqId]
+	if ok {
+		clear(at.pending)
+	}
+	at.Unlock()
+
+	if ok {
+		c.recordLatency(time.Since(sent))
+	}
+}
+
+// recordLatency updates the latencies with the round-trip time d,
+// the average is an exponentially weighted moving average which
+// gives 1/8 weight to d, the same as the srtt of tcp.
+func (c *Conn) recordLatency(d time.Duration) {
+	c.lastLatency.Store(int64(d))
+	for {
+		avg := c.avgLatency.Load()
+		newAvg := int64(d)
+		if avg != 0 {
+			newAvg = avg + (int64(d)-avg)/8
+		}
+		if c.avgLatency.CompareAndSwap(avg, newAvg) {
+			return
+		}
+	}
+}
+
+// Latency returns the round-trip time of the last answered active
+// test request sent by StartActiveTest, or 0 if no one is answered
+// yet. The requests which are never answered are not counted in.
+func (c *Conn) Latency() time.Duration {
+	return time.Duration(c.lastLatency.Load())
+}
+
+// AvgLatency is like Latency, but returns the rolling average of the
+// round-trip times, in which the latest one weighs 1/8.
+func (c *Conn) AvgLatency() time.Duration {
+	return time.Duration(c.avgLatency.Load())
+}
+
+// BytesSent returns the bytes of the packets sent by c, a packet partially
+// written counted in. With WithWriterSize, the bytes buffered but not
+// flushed yet are counted too.
+func (c *Conn) BytesSent() uint64 {
+	return c.bytesSent.Load()
+}
+
+// BytesRecv returns the bytes of the packets received by c, the bytes
+// skipped by WithResyncOnError and a partially received packet are not
+// counted.
+func (c *Conn) BytesRecv() uint64 {
+	return c.bytesRecv.Load()
+}
+
+// PacketsSent returns the count of the packets sent by c successfully.
+func (c *Conn) PacketsSent() uint64 {
+	return c.packetsSent.Load()
+}
+
+// PacketsRecv returns the count of the packets received by c, including
+// those failed to be unpacked or of unsupported commands.
+func (c *Conn) PacketsRecv() uint64 {
+	return c.packetsRecv.Load()
+}
+
+// RespondActiveTest answers the CMPP_ACTIVE_TEST request with reqSeqId
+// received from the peer.
+func (c *Conn) RespondActiveTest(reqSeqId uint32) error {
+	return c.SendPkt(&CmppActiveTestRspPkt{}, reqSeqId)
+}
+
+func (c *Conn) stopActiveTest() {
+	c.atLock.Lock()
+	if c.at != nil {
+		c.at.halt()
 	}
-	return p, nil
+	c.atLock.Unlock()
 }
@@ -14,10 +14,19 @@
 package cmpp_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bigwhite/gocmpp"
 )
@@ -67,3 +76,1733 @@ func BenchmarkRecvAndUnpackPkt(b *testing.B) {
 		c.RecvAndUnpackPkt(0)
 	}
 }
+
+// streamConn serves n copies of the packet pkt repeatedly.
+type streamConn struct {
+	net.Conn
+	buf    []byte
+	reader *bytes.Reader
+}
+
+func newStreamConn(pkt []byte, n int) *streamConn {
+	buf := bytes.Repeat(pkt, n)
+	return &streamConn{buf: buf, reader: bytes.NewReader(buf)}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if c.reader.Len() == 0 {
+		c.reader.Reset(c.buf)
+	}
+	return c.reader.Read(b)
+}
+
+func BenchmarkRecvAndUnpackPktStream(b *testing.B) {
+	c := &cmpp.Conn{
+		Conn:  newStreamConn(data, 32),
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	for i := 0; i < b.N; i++ {
+		c.RecvAndUnpackPkt(0)
+	}
+}
+
+func BenchmarkRecvAndUnpackBatch(b *testing.B) {
+	c := &cmpp.Conn{
+		Conn:  newStreamConn(data, 32),
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	for i := 0; i < b.N; {
+		pkts, _ := c.RecvAndUnpackBatch(32)
+		i += len(pkts)
+	}
+}
+
+func TestRecvAndUnpackBatch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	c := &cmpp.Conn{
+		Conn:  c1,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// 3 packets and the header of the 4th one arrive in one write.
+	go c2.Write(append(bytes.Repeat(data, 3), data[:8]...))
+
+	pkts, err := c.RecvAndUnpackBatch(2)
+	if err != nil {
+		t.Fatal("RecvAndUnpackBatch error:", err)
+	}
+	if len(pkts) != 2 {
+		t.Fatalf("The count of packets is %d, not equal to expected: %d\n", len(pkts), 2)
+	}
+
+	pkts, err = c.RecvAndUnpackBatch(10)
+	if err != nil {
+		t.Fatal("RecvAndUnpackBatch error:", err)
+	}
+	if len(pkts) != 1 {
+		t.Fatalf("The count of packets is %d, not equal to expected: %d\n", len(pkts), 1)
+	}
+	if _, ok := pkts[0].(*cmpp.Cmpp3SubmitReqPkt); !ok {
+		t.Fatalf("The packet is %T, not equal to expected: *cmpp.Cmpp3SubmitReqPkt\n", pkts[0])
+	}
+
+	// the 4th packet is completed later.
+	go c2.Write(data[8:])
+	pkts, err = c.RecvAndUnpackBatch(10)
+	if err != nil {
+		t.Fatal("RecvAndUnpackBatch error:", err)
+	}
+	if len(pkts) != 1 {
+		t.Fatalf("The count of packets is %d, not equal to expected: %d\n", len(pkts), 1)
+	}
+}
+
+func TestRecvAndUnpackPktTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c := &cmpp.Conn{
+		Conn:  c1,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// cmpp active test request packet data:
+	data := []byte{
+		0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x17,
+	}
+
+	// only part of the packet arrives before the deadline.
+	go c2.Write(data[:5])
+	_, err := c.RecvAndUnpackPktTimeout(50 * time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, os.ErrDeadlineExceeded)
+	}
+
+	go c2.Write(data[5:])
+	i, err := c.RecvAndUnpackPktTimeout(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPktTimeout error:", err)
+	}
+
+	p, ok := i.(*cmpp.CmppActiveTestReqPkt)
+	if !ok {
+		t.Fatalf("The packet received is %#v, not a CmppActiveTestReqPkt\n", i)
+	}
+
+	if p.SeqId != 0x17 {
+		t.Fatalf("After unpack, seqId in packet is %x, not equal to the expected value: %x\n", p.SeqId, 0x17)
+	}
+}
+
+func TestSendPktTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c := &cmpp.Conn{
+		Conn:  c1,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// nobody reads from the other peer.
+	err := c.SendPktTimeout(&cmpp.CmppActiveTestReqPkt{}, 0x17, 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestSeqIdGeneratorWraparound(t *testing.T) {
+	seqId, done := cmpp.NewSeqIdGeneratorStartingAt(math.MaxUint32 - 2)
+	defer close(done)
+
+	expected := []uint32{math.MaxUint32 - 2, math.MaxUint32 - 1, math.MaxUint32, 1, 2}
+	for i, e := range expected {
+		id := <-seqId
+		if id == 0 {
+			t.Fatalf("The %dth seqId is 0, which should never be yielded\n", i)
+		}
+		if id != e {
+			t.Fatalf("The %dth seqId is %d, not equal to expected: %d\n", i, id, e)
+		}
+	}
+}
+
+func TestSeqIdGeneratorStartingAtZero(t *testing.T) {
+	seqId, done := cmpp.NewSeqIdGeneratorStartingAt(0)
+	defer close(done)
+
+	if id := <-seqId; id != 1 {
+		t.Fatalf("The first seqId is %d, not equal to expected: %d\n", id, 1)
+	}
+}
+
+func TestSendPktConcurrently(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sender := &cmpp.Conn{
+		Conn:  c1,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+	receiver := &cmpp.Conn{
+		Conn:  c2,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(seqId uint32) {
+			defer wg.Done()
+			err := sender.SendPkt(&cmpp.CmppActiveTestRspPkt{Reserved: uint8(seqId)}, seqId)
+			if err != nil {
+				t.Errorf("SendPkt error: %s\n", err)
+			}
+		}(uint32(i))
+	}
+
+	seen := make(map[uint32]bool)
+	for i := 0; i < n; i++ {
+		pkt, err := receiver.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			t.Fatal("RecvAndUnpackPkt error:", err)
+		}
+
+		p, ok := pkt.(*cmpp.CmppActiveTestRspPkt)
+		if !ok {
+			t.Fatalf("The packet received is %#v, not a CmppActiveTestRspPkt\n", pkt)
+		}
+
+		if uint32(p.Reserved) != p.SeqId || seen[p.SeqId] {
+			t.Fatalf("The packet received is malformed or duplicated: %#v\n", p)
+		}
+		seen[p.SeqId] = true
+	}
+	wg.Wait()
+}
+
+func TestNewConnWithNonTCPConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	defer c.Close()
+
+	if c.Typ != cmpp.V30 {
+		t.Fatalf("The Typ of conn is %v, not equal to expected: %v\n", c.Typ, cmpp.V30)
+	}
+}
+
+type keepAliveConn struct {
+	net.Conn
+	keepAlive bool
+	period    time.Duration
+}
+
+func (c *keepAliveConn) Close() error {
+	return nil
+}
+
+func (c *keepAliveConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestNewConnWithKeepAlivePeriod(t *testing.T) {
+	kc := &keepAliveConn{}
+	c := cmpp.NewConnWithOptions(kc, cmpp.V30, cmpp.WithKeepAlivePeriod(30*time.Second))
+	defer c.Close()
+
+	if !kc.keepAlive {
+		t.Fatal("The keepalive of conn is not enabled")
+	}
+
+	if kc.period != 30*time.Second {
+		t.Fatalf("The keepalive period is %v, not equal to expected: %v\n", kc.period, 30*time.Second)
+	}
+}
+
+func TestStartActiveTestNoResponse(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	failed := make(chan error, 1)
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.OnHeartbeatFailure(func(err error) {
+		failed <- err
+	}))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// the peer reads the active test requests, but never answers them.
+	go io.Copy(io.Discard, c2)
+
+	err := c.StartActiveTest(10*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal("StartActiveTest error:", err)
+	}
+
+	err = c.StartActiveTest(10*time.Millisecond, 2)
+	if err != cmpp.ErrActiveTestStarted {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrActiveTestStarted)
+	}
+
+	select {
+	case err = <-failed:
+		if err != cmpp.ErrActiveTestNoResponse {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrActiveTestNoResponse)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The heartbeat failure callback is not called")
+	}
+
+	if c.State != cmpp.CONN_CLOSED {
+		t.Fatalf("The state of conn is %v, not equal to expected: %v\n", c.State, cmpp.CONN_CLOSED)
+	}
+
+	if c.Latency() != 0 || c.AvgLatency() != 0 {
+		t.Fatalf("The latency is %v(avg %v), not equal to expected: 0\n", c.Latency(), c.AvgLatency())
+	}
+}
+
+func TestStartActiveTestNoResponseAmidIO(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	failed := make(chan error, 1)
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.OnHeartbeatFailure(func(err error) {
+		failed <- err
+	}))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// the heartbeat goroutine closes c while the application is still
+	// sending and receiving on it.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for c.SendPkt(&cmpp.CmppActiveTestRspPkt{}, c.NextSeqId()) == nil {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		c.RecvAndUnpackPkt(0)
+	}()
+
+	if err := c.StartActiveTest(10*time.Millisecond, 2); err != nil {
+		t.Fatal("StartActiveTest error:", err)
+	}
+
+	select {
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Fatal("The heartbeat failure callback is not called")
+	}
+	wg.Wait()
+
+	if s := c.GetState(); s != cmpp.CONN_CLOSED {
+		t.Fatalf("The state of conn is %v, not equal to expected: %v\n", s, cmpp.CONN_CLOSED)
+	}
+}
+
+func TestStartActiveTestWithResponse(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	failed := make(chan error, 1)
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.OnHeartbeatFailure(func(err error) {
+		failed <- err
+	}))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	peer := &cmpp.Conn{
+		Conn:  c2,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// the peer answers every active test request.
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if p, ok := i.(*cmpp.CmppActiveTestReqPkt); ok {
+				peer.RespondActiveTest(p.SeqId)
+			}
+		}
+	}()
+
+	// read the responses.
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := c.StartActiveTest(10*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal("StartActiveTest error:", err)
+	}
+
+	select {
+	case err = <-failed:
+		t.Fatal("The heartbeat fails:", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestActiveTestLatency(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	peer := &cmpp.Conn{
+		Conn:  c2,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// the peer answers the active test requests after a delay,
+	// the first one is never answered.
+	const delay = 20 * time.Millisecond
+	go func() {
+		first := true
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if p, ok := i.(*cmpp.CmppActiveTestReqPkt); ok {
+				if first {
+					first = false
+					continue
+				}
+				time.Sleep(delay)
+				peer.RespondActiveTest(p.SeqId)
+			}
+		}
+	}()
+
+	received := make(chan struct{}, 16)
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	if c.Latency() != 0 {
+		t.Fatalf("The latency is %v, not equal to expected: 0\n", c.Latency())
+	}
+
+	err := c.StartActiveTest(50*time.Millisecond, 5)
+	if err != nil {
+		t.Fatal("StartActiveTest error:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("No active test response received")
+		}
+	}
+
+	if l := c.Latency(); l < delay || l > time.Second {
+		t.Fatalf("The latency is %v, not in the expected range: [%v, %v]\n", l, delay, time.Second)
+	}
+	if l := c.AvgLatency(); l < delay || l > time.Second {
+		t.Fatalf("The average latency is %v, not in the expected range: [%v, %v]\n", l, delay, time.Second)
+	}
+}
+
+func TestRecvAndUnpackPktWithHeader(t *testing.T) {
+	c := &cmpp.Conn{
+		Conn: &fakeConn{
+			reader: bytes.NewBuffer(data),
+		},
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	id, seqId, i, err := c.RecvAndUnpackPktWithHeader(0)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPktWithHeader error:", err)
+	}
+
+	if id != cmpp.CMPP_SUBMIT {
+		t.Fatalf("The command id is %v, not equal to expected: %v\n", id, cmpp.CMPP_SUBMIT)
+	}
+
+	if seqId != 0x17 {
+		t.Fatalf("The seqId is %x, not equal to expected: %x\n", seqId, 0x17)
+	}
+
+	p, ok := i.(*cmpp.Cmpp3SubmitReqPkt)
+	if !ok {
+		t.Fatalf("The packet received is %#v, not a Cmpp3SubmitReqPkt\n", i)
+	}
+
+	if p.SeqId != seqId {
+		t.Fatalf("The seqId in packet is %x, not equal to expected: %x\n", p.SeqId, seqId)
+	}
+}
+
+func TestRecvAndUnpackPktContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c := &cmpp.Conn{
+		Conn:  c1,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := c.RecvAndUnpackPktContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, context.Canceled)
+	}
+
+	// the deadline is restored after cancellation.
+	go c2.Write([]byte{
+		0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x17,
+	})
+	i, err := c.RecvAndUnpackPktContext(context.Background())
+	if err != nil {
+		t.Fatal("RecvAndUnpackPktContext error:", err)
+	}
+
+	if _, ok := i.(*cmpp.CmppActiveTestReqPkt); !ok {
+		t.Fatalf("The packet received is %#v, not a CmppActiveTestReqPkt\n", i)
+	}
+}
+
+func TestSendPktContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c := &cmpp.Conn{
+		Conn:  c1,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// nobody reads from the other peer.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := c.SendPktContext(ctx, &cmpp.CmppActiveTestReqPkt{}, 0x17)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGracefulCloseTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2) // the peer never answers.
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	err := c.GracefulClose(50 * time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, os.ErrDeadlineExceeded)
+	}
+	if c.State != cmpp.CONN_CLOSED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", c.State, cmpp.CONN_CLOSED)
+	}
+}
+
+func TestGracefulCloseAnswered(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		i, err := peer.RecvAndUnpackPkt(0)
+		if err != nil {
+			return
+		}
+		if p, ok := i.(*cmpp.CmppTerminateReqPkt); ok {
+			peer.SendPkt(&cmpp.CmppTerminateRspPkt{}, p.SeqId)
+		}
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	err := c.GracefulClose(time.Second)
+	if err != nil {
+		t.Fatal("GracefulClose error:", err)
+	}
+}
+
+func TestGracefulCloseCrossed(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	a := cmpp.NewConn(c1, cmpp.V30)
+	a.SetState(cmpp.CONN_AUTHOK)
+	b := cmpp.NewConn(c2, cmpp.V30)
+	b.SetState(cmpp.CONN_AUTHOK)
+
+	// both peers terminate at the same time, over the unbuffered pipe
+	// neither of the requests is written until the other peer reads.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, c := range []*cmpp.Conn{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.GracefulClose(time.Second)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("GracefulClose of peer %d error: %v\n", i, err)
+		}
+	}
+	if a.State != cmpp.CONN_CLOSED || b.State != cmpp.CONN_CLOSED {
+		t.Fatalf("The states are %v, %v, not equal to expected: %v\n", a.State, b.State, cmpp.CONN_CLOSED)
+	}
+}
+
+func TestConnCloseTwice(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.Close()
+	if c.State != cmpp.CONN_CLOSED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", c.State, cmpp.CONN_CLOSED)
+	}
+	if c.Typ != cmpp.V30 {
+		t.Fatalf("The type is %v, not equal to expected: %v\n", c.Typ, cmpp.V30)
+	}
+	c.Close() // must not panic.
+
+	// a Conn not created by NewConn has no SeqId generator.
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	c = &cmpp.Conn{Conn: c3, State: cmpp.CONN_CONNECTED, Typ: cmpp.V30}
+	c.Close()
+	c.Close()
+}
+
+func TestConnCloseConcurrently(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(4, time.Second))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+	}
+	wg.Wait()
+
+	if c.State != cmpp.CONN_CLOSED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", c.State, cmpp.CONN_CLOSED)
+	}
+}
+
+func TestConnCloseAmidIO(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// Close from another goroutine while c is sending and receiving, the
+	// race detector catches any unguarded access to the state.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, c.NextSeqId()) == nil {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	wg.Wait()
+
+	if s := c.GetState(); s != cmpp.CONN_CLOSED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", s, cmpp.CONN_CLOSED)
+	}
+	if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 1); err != cmpp.ErrConnIsClosed {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnIsClosed)
+	}
+}
+
+var errClose = errors.New("close error")
+
+type closeErrConn struct {
+	net.Conn
+}
+
+func (c closeErrConn) Close() error {
+	c.Conn.Close()
+	return errClose
+}
+
+func TestConnCloseError(t *testing.T) {
+	var _ io.Closer = (*cmpp.Conn)(nil)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConn(closeErrConn{c1}, cmpp.V30)
+	if err := c.Close(); err != errClose {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, errClose)
+	}
+	if err := c.Close(); err != errClose {
+		t.Fatalf("The error of the second Close is %#v, not equal to expected: %#v\n", err, errClose)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	c = cmpp.NewConn(c3, cmpp.V30)
+	if err := c.Close(); err != nil {
+		t.Fatal("Close error:", err)
+	}
+}
+
+func TestConnWithSmallBufferSize(t *testing.T) {
+	c1, c2 := net.Pipe()
+	sender := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithWriterSize(1))
+	defer sender.Close()
+	receiver := cmpp.NewConnWithOptions(c2, cmpp.V30, cmpp.WithReaderSize(1))
+	defer receiver.Close()
+	sender.SetState(cmpp.CONN_AUTHOK)
+	receiver.SetState(cmpp.CONN_AUTHOK)
+
+	// a submit packet of 3311 bytes.
+	var dests []string
+	for i := 0; i < 94; i++ {
+		dests = append(dests, fmt.Sprintf("135%08d", i))
+	}
+	content := strings.Repeat("a", 140)
+	p := &cmpp.Cmpp3SubmitReqPkt{
+		FeeType:        "02",
+		DestUsrTl:      uint8(len(dests)),
+		DestTerminalId: dests,
+		MsgLength:      uint8(len(content)),
+		MsgContent:     content,
+	}
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			sender.SendPkt(p, uint32(i+1))
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		pkt, err := receiver.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			t.Fatal("RecvAndUnpackPkt error:", err)
+		}
+		rp, ok := pkt.(*cmpp.Cmpp3SubmitReqPkt)
+		if !ok {
+			t.Fatalf("The packet is %T, not equal to expected: *cmpp.Cmpp3SubmitReqPkt\n", pkt)
+		}
+		if rp.SeqId != uint32(i+1) || rp.MsgContent != content || rp.DestTerminalId[93] != dests[93] {
+			t.Fatalf("The packet received is malformed: %#v\n", rp)
+		}
+	}
+}
+
+func TestRecvAndUnpackPktInconsistentLength(t *testing.T) {
+	cases := []struct {
+		typ  cmpp.Type
+		data []byte
+	}{
+		// active test request of 13 bytes.
+		{cmpp.V30, []byte{0x00, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x17, 0x00}},
+		// cmpp2 submit response of cmpp3 length.
+		{cmpp.V21, []byte{0x00, 0x00, 0x00, 0x18, 0x80, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x17,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		// cmpp3 submit request shorter than its fixed fields.
+		{cmpp.V30, []byte{0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x17,
+			0x00, 0x00, 0x00, 0x00}},
+	}
+
+	for _, cs := range cases {
+		c := &cmpp.Conn{
+			Conn:  bufConn{buf: bytes.NewBuffer(cs.data)},
+			State: cmpp.CONN_AUTHOK,
+			Typ:   cs.typ,
+		}
+
+		_, err := c.RecvAndUnpackPkt(0)
+		if err != cmpp.ErrTotalLengthInconsistent {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrTotalLengthInconsistent)
+		}
+	}
+}
+
+func TestNextSeqId(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	for _, opts := range [][]cmpp.Option{nil, {cmpp.WithAtomicSeqId()}} {
+		c := cmpp.NewConnWithOptions(c1, cmpp.V30, opts...)
+		for i := uint32(1); i <= 3; i++ {
+			if id := c.NextSeqId(); id != i {
+				t.Fatalf("The seqId is %d, not equal to expected: %d\n", id, i)
+			}
+		}
+		c.Close()
+	}
+}
+
+func TestConnConfigClone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	var changes int
+	l := &testLogger{}
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithAtomicSeqId(), cmpp.WithSubmitWindow(1, 0))
+	c.SetLogger(l)
+	c.OnStateChange(func(old, new cmpp.State) { changes++ })
+	c.SetState(cmpp.CONN_AUTHOK)
+	defer c.Close()
+
+	// the window of c is full.
+	for i := 0; i < 3; i++ {
+		c.NextSeqId()
+	}
+	err := c.SendPkt(newSubmitReqPkt(), 3)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	go io.Copy(io.Discard, c4)
+	bad := []byte{0x00, 0x00, 0x00, 0x0b, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x17}
+	n := c.ConfigClone(bufConn{Conn: c3, buf: bytes.NewBuffer(bad)})
+	defer n.Close()
+
+	if n.Typ != cmpp.V30 || n.State != cmpp.CONN_CLOSED {
+		t.Fatalf("The clone is of %v in state %v, not equal to expected: %v in state %v\n",
+			n.Typ, n.State, cmpp.V30, cmpp.CONN_CLOSED)
+	}
+	if id := n.NextSeqId(); id != 1 {
+		t.Fatalf("The seqId is %d, not equal to expected: %d\n", id, 1)
+	}
+
+	n.SetState(cmpp.CONN_AUTHOK)
+	if changes != 2 {
+		t.Fatalf("The count of state changes is %d, not equal to expected: %d\n", changes, 2)
+	}
+
+	// the clone has its own window.
+	err = n.SendPktTimeout(newSubmitReqPkt(), 1, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	_, err = n.RecvAndUnpackPkt(0)
+	if err != cmpp.ErrTotalLengthInvalid || len(l.errors) != 1 {
+		t.Fatalf("The error is %#v(error logs %q), not equal to expected: %#v\n", err, l.errors, cmpp.ErrTotalLengthInvalid)
+	}
+}
+
+func TestConnWithReader(t *testing.T) {
+	rsp, _ := (&cmpp.Cmpp3ConnRspPkt{Version: cmpp.V30}).Pack(1)
+	at, _ := (&cmpp.CmppActiveTestReqPkt{}).Pack(2)
+	tail := []byte("tail")
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		b := append(append(append([]byte{}, rsp...), at...), tail...)
+		c2.Write(b)
+	}()
+
+	// the handshake is read manually, the next frame is buffered in r.
+	r := bufio.NewReader(c1)
+	frame := make([]byte, len(rsp))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatal("read the connect response error:", err)
+	}
+	if r.Buffered() != len(at)+len(tail) {
+		t.Fatalf("The bytes buffered are %d, not equal to expected: %d\n", r.Buffered(), len(at)+len(tail))
+	}
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithReader(r))
+	c.SetState(cmpp.CONN_AUTHOK)
+	defer c.Close()
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if p, ok := i.(*cmpp.CmppActiveTestReqPkt); err != nil || !ok || p.SeqId != 2 {
+		t.Fatalf("The packet received is %#v(error %v), not the active test request\n", i, err)
+	}
+
+	// Read consumes the buffered bytes too.
+	b := make([]byte, 16)
+	n, err := c.Read(b)
+	if err != nil || !bytes.Equal(b[:n], tail) {
+		t.Fatalf("The bytes read are %q(error %v), not equal to expected: %q\n", b[:n], err, tail)
+	}
+}
+
+func TestConnConfigCloneWithReader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithReader(bufio.NewReader(c1)))
+	c.Close() // the dead connection.
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	peer := cmpp.NewConn(c4, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 7)
+
+	// the clone reads from its own connection, not through the reader of c.
+	n := c.ConfigClone(c3)
+	defer n.Close()
+	n.SetState(cmpp.CONN_AUTHOK)
+	i, err := n.RecvAndUnpackPkt(time.Second)
+	if p, ok := i.(*cmpp.CmppActiveTestReqPkt); err != nil || !ok || p.SeqId != 7 {
+		t.Fatalf("The packet received is %#v(error %v), not the active test of seqId %d\n", i, err, 7)
+	}
+}
+
+func TestConnClosedIO(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	c.Close()
+
+	ioMethods := map[string]func() error{
+		"SendPkt": func() error { return c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 1) },
+		"SendPktTimeout": func() error {
+			return c.SendPktTimeout(&cmpp.CmppActiveTestReqPkt{}, 1, time.Second)
+		},
+		"SendPktContext": func() error {
+			return c.SendPktContext(context.Background(), &cmpp.CmppActiveTestReqPkt{}, 1)
+		},
+		"RespondActiveTest": func() error { return c.RespondActiveTest(1) },
+		"Enqueue": func() error {
+			_, err := c.Enqueue(&cmpp.CmppActiveTestReqPkt{})
+			return err
+		},
+		"RecvAndUnpackPkt": func() error {
+			_, err := c.RecvAndUnpackPkt(0)
+			return err
+		},
+		"RecvAndUnpackPktTimeout": func() error {
+			_, err := c.RecvAndUnpackPktTimeout(time.Second)
+			return err
+		},
+		"RecvAndUnpackPktWithHeader": func() error {
+			_, _, _, err := c.RecvAndUnpackPktWithHeader(0)
+			return err
+		},
+		"RecvAndUnpackPktContext": func() error {
+			_, err := c.RecvAndUnpackPktContext(context.Background())
+			return err
+		},
+		"RecvAndUnpackBatch": func() error {
+			_, err := c.RecvAndUnpackBatch(8)
+			return err
+		},
+		"ReadLoop": func() error {
+			_, errc := c.ReadLoop()
+			return <-errc
+		},
+		"Read": func() error {
+			_, err := c.Read(make([]byte, 8))
+			return err
+		},
+		"StartActiveTest": func() error { return c.StartActiveTest(time.Second, 3) },
+		"GracefulClose":   func() error { return c.GracefulClose(time.Second) },
+		"Drain":           func() error { return c.Drain(time.Second) },
+	}
+	for name, f := range ioMethods {
+		if err := f(); err != cmpp.ErrConnectionClosed {
+			t.Fatalf("%s: the error is %#v, not equal to expected: %#v\n", name, err, cmpp.ErrConnectionClosed)
+		}
+	}
+}
+
+func TestConnTrafficCounters(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if p, ok := i.(*cmpp.CmppActiveTestReqPkt); ok {
+				peer.SendPkt(&cmpp.CmppActiveTestRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	defer c.Close()
+
+	submit := newSubmitReqPkt()
+	data, _ := submit.Pack(1)
+	if err := c.SendPkt(submit, 1); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 2); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if _, err := c.RecvAndUnpackPkt(time.Second); err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+
+	// the active test request is 12 bytes, and the response is 13 bytes.
+	counters := []struct {
+		name          string
+		got, expected uint64
+	}{
+		{"BytesSent", c.BytesSent(), uint64(len(data) + 12)},
+		{"PacketsSent", c.PacketsSent(), 2},
+		{"BytesRecv", c.BytesRecv(), 13},
+		{"PacketsRecv", c.PacketsRecv(), 1},
+	}
+	for _, cs := range counters {
+		if cs.got != cs.expected {
+			t.Fatalf("%s is %d, not equal to expected: %d\n", cs.name, cs.got, cs.expected)
+		}
+	}
+}
+
+func BenchmarkNextSeqId(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []cmpp.Option
+	}{
+		{"channel", nil},
+		{"atomic", []cmpp.Option{cmpp.WithAtomicSeqId()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			c := cmpp.NewConnWithOptions(c1, cmpp.V30, bc.opts...)
+			defer c.Close()
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.NextSeqId()
+			}
+		})
+	}
+}
+
+func TestConnOnUnknownCommand(t *testing.T) {
+	unknown := []byte{0x00, 0x00, 0x00, 0x0e, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x17, 0xab, 0xcd}
+	activeTest, _ := (&cmpp.CmppActiveTestReqPkt{}).Pack(0x18)
+
+	var ids []cmpp.CommandId
+	var datas [][]byte
+	c := cmpp.NewConnWithOptions(newStreamConn(append(unknown, activeTest...), 1), cmpp.V30,
+		cmpp.OnUnknownCommand(func(id cmpp.CommandId, data []byte) {
+			ids = append(ids, id)
+			datas = append(datas, append([]byte(nil), data...))
+		}))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	i, err := c.RecvAndUnpackPkt(0)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	if p, ok := i.(*cmpp.CmppActiveTestReqPkt); !ok || p.SeqId != 0x18 {
+		t.Fatalf("The packet received is %#v, not the active test request of seqId 0x18\n", i)
+	}
+
+	if len(ids) != 1 || ids[0] != cmpp.CMPP_MT_ROUTE || !bytes.Equal(datas[0], unknown[8:]) {
+		t.Fatalf("The unknown command is %v %x, not equal to expected: %v %x\n", ids, datas, cmpp.CMPP_MT_ROUTE, unknown[8:])
+	}
+}
+
+func TestConnWithRawDump(t *testing.T) {
+	p := &cmpp.Cmpp3SubmitReqPkt{
+		FeeType:        "02",
+		DestTerminalId: []string{"13500002696"},
+		MsgLength:      5,
+		MsgContent:     "hello",
+	}
+	frame, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("Pack error:", err)
+	}
+	// the Msg_Length exceeds the frame, so the packet fails to be unpacked.
+	bad := append([]byte(nil), frame...)
+	bad[len(bad)-20-5-1] = 0x7f
+
+	type dump struct {
+		dir string
+		b   []byte
+	}
+	var dumps []dump
+	c := cmpp.NewConnWithOptions(bufConn{buf: bytes.NewBuffer(bad)}, cmpp.V30,
+		cmpp.WithRawDump(func(dir string, b []byte) {
+			dumps = append(dumps, dump{dir, append([]byte(nil), b...)})
+		}), cmpp.WithAtomicSeqId())
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	if _, err = c.RecvAndUnpackPkt(0); err == nil {
+		t.Fatal("RecvAndUnpackPkt of the bad frame returns no error")
+	}
+	if len(dumps) != 1 || dumps[0].dir != cmpp.DumpRecv || !bytes.Equal(dumps[0].b, bad) {
+		t.Fatalf("The dumps are %x, not equal to expected: %s %x\n", dumps, cmpp.DumpRecv, bad)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c = cmpp.NewConnWithOptions(c1, cmpp.V30,
+		cmpp.WithRawDump(func(dir string, b []byte) {
+			dumps = append(dumps, dump{dir, append([]byte(nil), b...)})
+		}))
+	c.SetState(cmpp.CONN_AUTHOK)
+	defer c.Close()
+
+	go io.Copy(io.Discard, c2)
+	if err = c.SendPkt(p, seqId); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if len(dumps) != 2 || dumps[1].dir != cmpp.DumpSend || !bytes.Equal(dumps[1].b, frame) {
+		t.Fatalf("The dumps are %x, not equal to expected: %s %x\n", dumps[1:], cmpp.DumpSend, frame)
+	}
+
+	// a frame taking several short writes is dumped once, as a whole.
+	dumps = nil
+	conn := &throttledConn{chunk: 5, limit: 1024}
+	c = cmpp.NewConnWithOptions(conn, cmpp.V30,
+		cmpp.WithRawDump(func(dir string, b []byte) {
+			dumps = append(dumps, dump{dir, append([]byte(nil), b...)})
+		}), cmpp.WithAtomicSeqId())
+	c.SetState(cmpp.CONN_AUTHOK)
+	if err = c.SendPkt(p, seqId); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if len(dumps) != 1 || dumps[0].dir != cmpp.DumpSend || !bytes.Equal(dumps[0].b, frame) {
+		t.Fatalf("The dumps are %x, not equal to expected: %s %x\n", dumps, cmpp.DumpSend, frame)
+	}
+}
+
+func TestConnWithResyncOnError(t *testing.T) {
+	garbage := []byte{0xff, 0xff, 0xff, 0xff, 0xff}
+	activeTest, _ := (&cmpp.CmppActiveTestReqPkt{}).Pack(0x18)
+	stream := append(garbage, activeTest...)
+
+	// without resync, the invalid header is left unread.
+	c := cmpp.NewConnWithOptions(bufConn{buf: bytes.NewBuffer(stream)}, cmpp.V30, cmpp.WithAtomicSeqId())
+	c.SetState(cmpp.CONN_AUTHOK)
+	for i := 0; i < 2; i++ {
+		_, err := c.RecvAndUnpackPkt(0)
+		if err != cmpp.ErrTotalLengthInvalid {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrTotalLengthInvalid)
+		}
+	}
+
+	c = cmpp.NewConnWithOptions(bufConn{buf: bytes.NewBuffer(stream)}, cmpp.V30,
+		cmpp.WithAtomicSeqId(), cmpp.WithResyncOnError(true))
+	c.SetState(cmpp.CONN_AUTHOK)
+	i, err := c.RecvAndUnpackPkt(0)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	if p, ok := i.(*cmpp.CmppActiveTestReqPkt); !ok || p.SeqId != 0x18 {
+		t.Fatalf("The packet received is %#v, not the active test request of seqId 0x18\n", i)
+	}
+
+	_, err = c.RecvAndUnpackPkt(0)
+	if err != io.EOF {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, io.EOF)
+	}
+}
+
+// throttledConn accepts at most chunk bytes per Write, reporting
+// io.ErrShortWrite, and fails once limit bytes are written.
+type throttledConn struct {
+	net.Conn
+	chunk, limit int
+	buf          bytes.Buffer
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.buf.Len() >= c.limit {
+		return 0, io.ErrClosedPipe
+	}
+	n := min(len(b), c.chunk, c.limit-c.buf.Len())
+	c.buf.Write(b[:n])
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func TestSendPktPartialWrite(t *testing.T) {
+	p := &cmpp.CmppActiveTestReqPkt{}
+	frame, _ := p.Pack(seqId)
+
+	cases := []struct {
+		chunk, limit int
+		written      int
+	}{
+		{5, 100, len(frame)}, // short writes are continued.
+		{5, 7, 7},
+		{5, 0, 0},
+	}
+
+	for _, cs := range cases {
+		conn := &throttledConn{chunk: cs.chunk, limit: cs.limit}
+		c := cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId())
+		c.SetState(cmpp.CONN_AUTHOK)
+
+		err := c.SendPkt(p, seqId)
+		if cs.written == len(frame) {
+			if err != nil || !bytes.Equal(conn.buf.Bytes(), frame) {
+				t.Fatalf("SendPkt writes %x(error %v), not equal to expected: %x\n", conn.buf.Bytes(), err, frame)
+			}
+			continue
+		}
+
+		var e *cmpp.WriteError
+		if !errors.As(err, &e) {
+			t.Fatalf("The error is %#v, not a WriteError\n", err)
+		}
+		if e.Written != cs.written || e.Total != len(frame) || !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("The WriteError is %#v, not equal to expected: %d of %d bytes written\n", e, cs.written, len(frame))
+		}
+	}
+}
+
+func TestConnWithWriteTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// nobody reads c2.
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithWriteTimeout(20*time.Millisecond))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, seqId)
+	var e *cmpp.WriteError
+	if !errors.As(err, &e) || e.Written != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %#v, not a WriteError of deadline exceeded with no byte written\n", err)
+	}
+}
+
+// discardConn discards all the bytes written.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkSendPkt(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []cmpp.Option
+	}{
+		{"pool", nil},
+		{"packbuffer", []cmpp.Option{cmpp.WithPackBuffer()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			opts := append([]cmpp.Option{cmpp.WithAtomicSeqId()}, bc.opts...)
+			c := cmpp.NewConnWithOptions(discardConn{}, cmpp.V30, opts...)
+			c.SetState(cmpp.CONN_AUTHOK)
+			p := &cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"},
+				MsgLength: 12, MsgContent: "hello gocmpp"}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.SendPkt(p, uint32(i))
+			}
+		})
+	}
+}
+
+func TestConnWithPackBuffer(t *testing.T) {
+	conn := &throttledConn{chunk: 1024, limit: 1 << 20}
+	c := cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId(), cmpp.WithPackBuffer())
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	var expected []byte
+	pkts := []cmpp.Packer{
+		&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}},
+		&cmpp.CmppActiveTestReqPkt{},
+	}
+	for i, p := range pkts {
+		if err := c.SendPkt(p, uint32(i+1)); err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+		data, _ := p.Pack(uint32(i + 1))
+		expected = append(expected, data...)
+	}
+	if !bytes.Equal(conn.buf.Bytes(), expected) {
+		t.Fatalf("The bytes sent are %x, not equal to expected: %x\n", conn.buf.Bytes(), expected)
+	}
+}
+
+// noDelayConn records the TCP_NODELAY set and the writes.
+type noDelayConn struct {
+	net.Conn
+	noDelay []bool
+	writes  chan []byte
+}
+
+func (c *noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return nil
+}
+
+func (c *noDelayConn) Write(b []byte) (int, error) {
+	c.writes <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *noDelayConn) Close() error {
+	return nil
+}
+
+func (c *noDelayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestConnWithNoDelay(t *testing.T) {
+	conn := &noDelayConn{}
+	cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId())
+	if len(conn.noDelay) != 0 {
+		t.Fatalf("The TCP_NODELAY is set to %v, not left untouched\n", conn.noDelay)
+	}
+
+	cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId(), cmpp.WithNoDelay(false))
+	if len(conn.noDelay) != 1 || conn.noDelay[0] {
+		t.Fatalf("The TCP_NODELAY is set to %v, not equal to expected: [false]\n", conn.noDelay)
+	}
+}
+
+func TestConnWithFlushInterval(t *testing.T) {
+	conn := &noDelayConn{writes: make(chan []byte, 8)}
+	c := cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId(),
+		cmpp.WithWriterSize(4096), cmpp.WithFlushInterval(20*time.Millisecond))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	var expected []byte
+	for i := uint32(1); i <= 3; i++ {
+		if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, i); err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+		data, _ := (&cmpp.CmppActiveTestReqPkt{}).Pack(i)
+		expected = append(expected, data...)
+	}
+
+	// the three packets are coalesced into one write.
+	select {
+	case b := <-conn.writes:
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("The bytes written are %x, not equal to expected: %x\n", b, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The packets are not flushed")
+	}
+
+	// the packets buffered are flushed by Close.
+	c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 4)
+	c.Close()
+	select {
+	case <-conn.writes:
+	default:
+		t.Fatal("The packets are not flushed by Close")
+	}
+}
+
+func TestConnWithFlushIntervalPackError(t *testing.T) {
+	conn := &noDelayConn{writes: make(chan []byte, 8)}
+	c := cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId(),
+		cmpp.WithWriterSize(4096), cmpp.WithFlushInterval(time.Hour))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	var expected []byte
+	for i := uint32(1); i <= 2; i++ {
+		if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, i); err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+		data, _ := (&cmpp.CmppActiveTestReqPkt{}).Pack(i)
+		expected = append(expected, data...)
+	}
+
+	// the invalid packet fails to be packed, the ones buffered are kept.
+	bad := newSubmitReqPkt()
+	bad.MsgSrc = "9001"
+	if err := c.SendPkt(bad, 3); err != cmpp.ErrMsgSrcInvalid {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrMsgSrcInvalid)
+	}
+
+	c.Close()
+	select {
+	case b := <-conn.writes:
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("The bytes written are %x, not equal to expected: %x\n", b, expected)
+		}
+	default:
+		t.Fatal("The packets are not flushed by Close")
+	}
+}
+
+type failWriteConn struct {
+	net.Conn
+}
+
+var errWrite = errors.New("write error")
+
+func (c *failWriteConn) Write(b []byte) (int, error) {
+	return 0, errWrite
+}
+
+func (c *failWriteConn) Close() error {
+	return nil
+}
+
+func (c *failWriteConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestConnCloseFlushError(t *testing.T) {
+	c := cmpp.NewConnWithOptions(&failWriteConn{}, cmpp.V30, cmpp.WithAtomicSeqId(),
+		cmpp.WithWriterSize(4096), cmpp.WithFlushInterval(time.Hour))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// the packet is only buffered, it fails to be flushed by Close.
+	if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 1); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if err := c.Close(); err != errWrite {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, errWrite)
+	}
+}
+
+func TestConnCloseStuckSender(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close() // the peer never reads.
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithAtomicSeqId(),
+		cmpp.WithWriterSize(4096), cmpp.WithFlushInterval(time.Hour))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// more packets than the buffer holds, the sender is stuck in the
+	// write once it fills.
+	sent := make(chan error, 1)
+	go func() {
+		for i := uint32(1); ; i++ {
+			if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, i); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Close does not wait for the sender, which fails then.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waits for the stuck sender")
+	}
+	select {
+	case err := <-sent:
+		if err == nil {
+			t.Fatal("The stuck SendPkt succeeds after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The stuck SendPkt does not return after Close")
+	}
+}
+
+func TestConnCloseFlushTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close() // the peer never reads.
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithAtomicSeqId(),
+		cmpp.WithWriterSize(4096), cmpp.WithFlushInterval(time.Hour))
+	c.SetState(cmpp.CONN_AUTHOK)
+	if err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 1); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	// the flush of the packet buffered gives up after a short deadline.
+	start := time.Now()
+	err := c.Close()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, os.ErrDeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Close returns after %v, later than expected\n", d)
+	}
+}
+
+func TestConnOnStateChange(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	var changes [][2]cmpp.State
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.OnStateChange(func(old, new cmpp.State) {
+		changes = append(changes, [2]cmpp.State{old, new})
+	})
+
+	c.SetState(cmpp.CONN_CONNECTED)
+	c.SetState(cmpp.CONN_CONNECTED) // not changed
+	c.SetState(cmpp.CONN_AUTHOK)
+	c.Close()
+	c.Close()
+
+	expected := [][2]cmpp.State{
+		{cmpp.CONN_CLOSED, cmpp.CONN_CONNECTED},
+		{cmpp.CONN_CONNECTED, cmpp.CONN_AUTHOK},
+		{cmpp.CONN_AUTHOK, cmpp.CONN_CLOSED},
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Fatalf("The state changes are %v, not equal to expected: %v\n", changes, expected)
+	}
+}
+
+func TestConnReadLoop(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for i := 1; i <= 3; i++ {
+			peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, uint32(i))
+		}
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	pkts, errc := c.ReadLoop()
+
+	for i := 1; i <= 3; i++ {
+		p, ok := (<-pkts).(*cmpp.CmppActiveTestReqPkt)
+		if !ok || p.SeqId != uint32(i) {
+			t.Fatalf("The packet received is %#v, not the active test of seqId %d\n", p, i)
+		}
+	}
+
+	c.Close()
+	if err := <-errc; err != cmpp.ErrConnIsClosed {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnIsClosed)
+	}
+	if _, ok := <-pkts; ok {
+		t.Fatal("The packet channel is not closed")
+	}
+}
+
+func TestConnReadLoopBlocked(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// more packets than the loop buffers, and nobody reads them.
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for i := 1; i <= 100; i++ {
+			if err := peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, uint32(i)); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	_, errc := c.ReadLoop()
+
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-errc:
+		if err != cmpp.ErrConnIsClosed {
+			t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnIsClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The read loop does not exit after Close")
+	}
+}
+
+func TestConnReadLoopBackpressure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	const n = 100
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for i := 1; i <= n; i++ {
+			if err := peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, uint32(i)); err != nil {
+				return
+			}
+		}
+	}()
+
+	const size = 4
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithReadChannelSize(size))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+	pkts, _ := c.ReadLoop()
+
+	// the slow consumer reads nothing for a while, the peer is stalled once
+	// the channel is full and the loop blocks with one more packet read.
+	time.Sleep(50 * time.Millisecond)
+	if sent := peer.PacketsSent(); sent > size+1 {
+		t.Fatalf("The packets sent by the peer are %d, more than expected: %d\n", sent, size+1)
+	}
+	if got := cap(pkts); got != size {
+		t.Fatalf("The capacity of the packet channel is %d, not equal to expected: %d\n", got, size)
+	}
+
+	for i := 1; i <= n; i++ {
+		p, ok := (<-pkts).(*cmpp.CmppActiveTestReqPkt)
+		if !ok || p.SeqId != uint32(i) {
+			t.Fatalf("The packet received is %#v, not the active test of seqId %d\n", p, i)
+		}
+	}
+}
+
+func TestConnReadLoopCloseAmidRead(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for i := uint32(1); peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, i) == nil; i++ {
+		}
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	pkts, errc := c.ReadLoop()
+
+	// Close from another goroutine while the loop is receiving, it must
+	// be clean under -race.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Close()
+	}()
+	for range pkts {
+	}
+
+	if err := <-errc; err != cmpp.ErrConnIsClosed {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnIsClosed)
+	}
+}
+
+func TestConnReadLoopError(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+	pkts, errc := c.ReadLoop()
+
+	c2.Close() // the peer goes away.
+	if err := <-errc; err != io.EOF {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, io.EOF)
+	}
+	if _, ok := <-pkts; ok {
+		t.Fatal("The packet channel is not closed")
+	}
+}
+
+func TestConnAutoDeliverRspPeerNotReading(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// no write timeout is set, the response write is still bounded.
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithAutoDeliverRsp(nil))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// the peer sends a deliver request, but never reads the response.
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go peer.SendPkt(&cmpp.Cmpp3DeliverReqPkt{MsgId: 1, MsgLength: 2, MsgContent: "mo"}, 0x20)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i, err := c.RecvAndUnpackPkt(0)
+		if p, ok := i.(*cmpp.Cmpp3DeliverReqPkt); err != nil || !ok || p.SeqId != 0x20 {
+			t.Errorf("The packet received is %#v(error %v), not the deliver request of seqId 0x20\n", i, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("RecvAndUnpackPkt is blocked by the write of the deliver response")
+	}
+}
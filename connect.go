@@ -16,6 +16,7 @@ package cmpp
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"strconv"
@@ -54,12 +55,99 @@ var (
 	errConnOthers         = errors.New("connect response status: other errors")
 )
 
+// ConnStatus is the status in connect response.
+type ConnStatus uint8
+
+// Connect response status.
+const (
+	ConnStatusOK ConnStatus = iota
+	ConnStatusInvalidStruct
+	ConnStatusInvalidSrcAddr
+	ConnStatusAuthFailed
+	ConnStatusVerTooHigh
+	ConnStatusOthers
+)
+
+func (s ConnStatus) String() string {
+	switch s {
+	case ConnStatusOK:
+		return "ok"
+	case ConnStatusInvalidStruct:
+		return "invalid message structure"
+	case ConnStatusInvalidSrcAddr:
+		return "illegal source address"
+	case ConnStatusAuthFailed:
+		return "authentication failed"
+	case ConnStatusVerTooHigh:
+		return "version too high"
+	default:
+		return "other error"
+	}
+}
+
+// Error makes a non-zero ConnStatus usable as an error, such as
+// "cmpp: authentication failed (status 3)".
+func (s ConnStatus) Error() string {
+	return "cmpp: " + s.String() + " (status " + strconv.Itoa(int(s)) + ")"
+}
+
+// Unwrap returns the error in ConnRspStatusErrMap for s, so
+// errors.Is(err, ConnRspStatusErrMap[status]) still holds.
+func (s ConnStatus) Unwrap() error {
+	if err, ok := ConnRspStatusErrMap[uint8(s)]; ok {
+		return err
+	}
+	if s != ConnStatusOK {
+		return errConnOthers
+	}
+	return nil
+}
+
 func now() (string, uint32) {
 	s := time.Now().Format("0102150405")
 	i, _ := strconv.Atoi(s)
 	return s, uint32(i)
 }
 
+// ErrConnTimestampInvalid is returned by ParseConnTimestamp if the timestamp
+// is not a valid MMDDHHMMSS time.
+var ErrConnTimestampInvalid = errors.New("timestamp of connect request is invalid")
+
+// ParseConnTimestamp returns the time of the Timestamp(MMDDHHMMSS) in connect
+// request, in the location of now. The year is missing in the timestamp, the
+// one which makes the time closest to now is chosen, e.g. 1231235959 is in
+// the last year if now is in January.
+func ParseConnTimestamp(ts uint32, now time.Time) (time.Time, error) {
+	month, day := int(ts/100000000), int(ts/1000000%100)
+	hour, min, sec := int(ts/10000%100), int(ts/100%100), int(ts%100)
+	if month < 1 || month > 12 || hour > 23 || min > 59 || sec > 59 {
+		return time.Time{}, ErrConnTimestampInvalid
+	}
+
+	var t time.Time
+	var found bool
+	for _, year := range []int{now.Year() - 1, now.Year(), now.Year() + 1} {
+		c := time.Date(year, time.Month(month), day, hour, min, sec, 0, now.Location())
+		if c.Month() != time.Month(month) || c.Day() != day {
+			continue // not a valid date in this year, e.g. 0229.
+		}
+		if !found || absDuration(c.Sub(now)) < absDuration(t.Sub(now)) {
+			t, found = c, true
+		}
+	}
+	if !found {
+		return time.Time{}, ErrConnTimestampInvalid
+	}
+	return t, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
 // CmppConnReqPkt represents a Cmpp2 or Cmpp3 connect request packet.
 //
 // when used in client side(pack), you should initialize it with
@@ -76,6 +164,26 @@ type CmppConnReqPkt struct {
 	Timestamp uint32
 	Secret    string
 	SeqId     uint32
+
+	// SrcAddrPad is the byte a SrcAddr shorter than 6 bytes is padded
+	// with by Pack, see WithSourceAddrPadding. Zero, the default, leaves
+	// SrcAddr as it is: it is zero-padded on the wire, but the
+	// AuthenticatorSource is computed from the SrcAddr unpadded.
+	SrcAddrPad byte
+}
+
+// padSourceAddr pads srcAddr to the 6 bytes of Source_Addr with a non-zero
+// pad. The AuthenticatorSource is computed from the padded Source_Addr then,
+// the same bytes as on the wire.
+func padSourceAddr(srcAddr string, pad byte) string {
+	if pad == 0 || len(srcAddr) >= 6 {
+		return srcAddr
+	}
+	b := []byte(srcAddr)
+	for len(b) < 6 {
+		b = append(b, pad)
+	}
+	return string(b)
 }
 
 // Cmpp2ConnRspPkt represents a Cmpp2 connect response packet.
@@ -112,11 +220,71 @@ type Cmpp3ConnRspPkt struct {
 	SeqId    uint32
 }
 
+// authenticatorSource computes the AuthenticatorSource:
+// MD5(Source_Addr + 9 bytes of 0 + shared secret + timestamp).
+func authenticatorSource(srcAddr, secret, ts string) [md5.Size]byte {
+	return md5.Sum(bytes.Join([][]byte{[]byte(srcAddr),
+		make([]byte, 9),
+		[]byte(secret),
+		[]byte(ts)},
+		nil))
+}
+
+// VerifyAuthenticator reports whether the AuthenticatorSource in req, which
+// is received by server side, is computed from the shared secret. The digests
+// are compared in constant time.
+//
+// The AuthenticatorSource is computed from SrcAddr as Unpack returns it, the
+// zero bytes trimmed; a SrcAddr padded with other bytes is kept as it is.
+func VerifyAuthenticator(req *CmppConnReqPkt, secret string) bool {
+	md5 := authenticatorSource(req.SrcAddr, secret, cmpputils.TimeStamp2Str(req.Timestamp))
+	return subtle.ConstantTimeCompare(md5[:], []byte(req.AuthSrc)) == 1
+}
+
+// authenticatorISMG computes the AuthenticatorISMG:
+// MD5(Status + AuthenticatorSource + shared secret).
+func authenticatorISMG(status []byte, authSrc, secret string) [md5.Size]byte {
+	return md5.Sum(bytes.Join([][]byte{status,
+		[]byte(authSrc),
+		[]byte(secret)},
+		nil))
+}
+
+// VerifyAuthenticatorISMG reports whether the AuthenticatorISMG in rsp, a
+// *Cmpp2ConnRspPkt or a *Cmpp3ConnRspPkt received by client side, is computed
+// from authSource, the AuthenticatorSource of the connect request, and the
+// shared secret, i.e. it is sent by the real gateway. The digests are
+// compared in constant time.
+func VerifyAuthenticatorISMG(rsp Packer, authSource []byte, secret string) bool {
+	var status []byte
+	var authIsmg string
+	switch rsp := rsp.(type) {
+	case *Cmpp2ConnRspPkt:
+		status, authIsmg = []byte{rsp.Status}, rsp.AuthIsmg
+	case *Cmpp3ConnRspPkt:
+		status, authIsmg = binary.BigEndian.AppendUint32(nil, rsp.Status), rsp.AuthIsmg
+	default:
+		return false
+	}
+
+	md5 := authenticatorISMG(status, string(authSource), secret)
+	return subtle.ConstantTimeCompare(md5[:], []byte(authIsmg)) == 1
+}
+
 // Pack packs the CmppConnReqPkt to bytes stream for client side.
 // Before calling Pack, you should initialize a CmppConnReqPkt variable
 // with correct SourceAddr(SrcAddr), Secret and Version.
 func (p *CmppConnReqPkt) Pack(seqId uint32) ([]byte, error) {
-	var w = newPacketWriter(CmppConnReqPktLen)
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppConnReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppConnReqPkt) pack(w *packetWriter, seqId uint32) error {
+	w.Grow(CmppConnReqPktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, CmppConnReqPktLen)
@@ -132,20 +300,17 @@ func (p *CmppConnReqPkt) Pack(seqId uint32) ([]byte, error) {
 	}
 
 	// Pack body
-	w.WriteString(p.SrcAddr)
+	srcAddr := padSourceAddr(p.SrcAddr, p.SrcAddrPad)
+	w.WriteFixedSizeString(srcAddr, 6)
 
-	md5 := md5.Sum(bytes.Join([][]byte{[]byte(p.SrcAddr),
-		make([]byte, 9),
-		[]byte(p.Secret),
-		[]byte(ts)},
-		nil))
+	md5 := authenticatorSource(srcAddr, p.Secret, ts)
 	p.AuthSrc = string(md5[:])
 
-	w.WriteString(p.AuthSrc)
+	w.WriteFixedSizeString(p.AuthSrc, 16)
 	w.WriteInt(binary.BigEndian, p.Version)
 	w.WriteInt(binary.BigEndian, p.Timestamp)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a CmppConnReqPkt variable.
@@ -155,31 +320,38 @@ func (p *CmppConnReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
 	// Body: Source_Addr
-	var sa = make([]byte, 6)
-	r.ReadBytes(sa)
-	p.SrcAddr = string(sa)
+	p.SrcAddr = r.at("SrcAddr").ReadString(6)
 
 	// Body: AuthSrc
 	var as = make([]byte, 16)
-	r.ReadBytes(as)
+	r.at("AuthSrc").ReadBytes(as)
 	p.AuthSrc = string(as)
 
 	// Body: Version
-	r.ReadInt(binary.BigEndian, &p.Version)
+	r.at("Version").ReadInt(binary.BigEndian, &p.Version)
 	// Body: timestamp
-	r.ReadInt(binary.BigEndian, &p.Timestamp)
+	r.at("Timestamp").ReadInt(binary.BigEndian, &p.Timestamp)
 
-	return r.Error()
+	return r.unpackError(CMPP_CONNECT, p)
 }
 
 // Pack packs the Cmpp2ConnRspPkt to bytes stream for server side.
 // Before calling Pack, you should initialize a Cmpp2ConnRspPkt variable
 // with correct Status,AuthenticatorSource, Secret and Version.
 func (p *Cmpp2ConnRspPkt) Pack(seqId uint32) ([]byte, error) {
-	var w = newPacketWriter(Cmpp2ConnRspPktLen)
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2ConnRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2ConnRspPkt) pack(w *packetWriter, seqId uint32) error {
+	w.Grow(Cmpp2ConnRspPktLen)
 
 	// pack header
 	w.WriteInt(binary.BigEndian, Cmpp2ConnRspPktLen)
@@ -190,16 +362,13 @@ func (p *Cmpp2ConnRspPkt) Pack(seqId uint32) ([]byte, error) {
 	// pack body
 	w.WriteInt(binary.BigEndian, p.Status)
 
-	md5 := md5.Sum(bytes.Join([][]byte{[]byte{p.Status},
-		[]byte(p.AuthSrc),
-		[]byte(p.Secret)},
-		nil))
+	md5 := authenticatorISMG([]byte{p.Status}, p.AuthSrc, p.Secret)
 	p.AuthIsmg = string(md5[:])
-	w.WriteString(p.AuthIsmg)
+	w.WriteFixedSizeString(p.AuthIsmg, 16)
 
 	w.WriteInt(binary.BigEndian, p.Version)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2ConnRspPkt variable.
@@ -210,26 +379,35 @@ func (p *Cmpp2ConnRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
 	// Body: Status
-	r.ReadInt(binary.BigEndian, &p.Status)
+	r.at("Status").ReadInt(binary.BigEndian, &p.Status)
 
 	// Body: AuthenticatorISMG
 	var s = make([]byte, 16)
-	r.ReadBytes(s)
+	r.at("AuthIsmg").ReadBytes(s)
 	p.AuthIsmg = string(s)
 
 	// Body: Version
-	r.ReadInt(binary.BigEndian, &p.Version)
-	return r.Error()
+	r.at("Version").ReadInt(binary.BigEndian, &p.Version)
+	return r.unpackError(CMPP_CONNECT_RESP, p)
 }
 
 // Pack packs the Cmpp3ConnRspPkt to bytes stream for server side.
 // Before calling Pack, you should initialize a Cmpp3ConnRspPkt variable
 // with correct Status,AuthenticatorSource, Secret and Version.
 func (p *Cmpp3ConnRspPkt) Pack(seqId uint32) ([]byte, error) {
-	var w = newPacketWriter(Cmpp3ConnRspPktLen)
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3ConnRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3ConnRspPkt) pack(w *packetWriter, seqId uint32) error {
+	w.Grow(Cmpp3ConnRspPktLen)
 
 	// pack header
 	w.WriteInt(binary.BigEndian, Cmpp3ConnRspPktLen)
@@ -240,22 +418,13 @@ func (p *Cmpp3ConnRspPkt) Pack(seqId uint32) ([]byte, error) {
 	// pack body
 	w.WriteInt(binary.BigEndian, p.Status)
 
-	var statusBuf = new(bytes.Buffer)
-	err := binary.Write(statusBuf, binary.BigEndian, p.Status)
-	if err != nil {
-		return nil, err
-	}
-
-	md5 := md5.Sum(bytes.Join([][]byte{statusBuf.Bytes(),
-		[]byte(p.AuthSrc),
-		[]byte(p.Secret)},
-		nil))
+	md5 := authenticatorISMG(binary.BigEndian.AppendUint32(nil, p.Status), p.AuthSrc, p.Secret)
 	p.AuthIsmg = string(md5[:])
-	w.WriteString(p.AuthIsmg)
+	w.WriteFixedSizeString(p.AuthIsmg, 16)
 
 	w.WriteInt(binary.BigEndian, p.Version)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp3ConnRspPkt variable.
@@ -266,17 +435,48 @@ func (p *Cmpp3ConnRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
 	// Body: Status
-	r.ReadInt(binary.BigEndian, &p.Status)
+	r.at("Status").ReadInt(binary.BigEndian, &p.Status)
 
 	// Body: AuthenticatorISMG
 	var s = make([]byte, 16)
-	r.ReadBytes(s)
+	r.at("AuthIsmg").ReadBytes(s)
 	p.AuthIsmg = string(s)
 
 	// Body: Version
-	r.ReadInt(binary.BigEndian, &p.Version)
-	return r.Error()
+	r.at("Version").ReadInt(binary.BigEndian, &p.Version)
+	return r.unpackError(CMPP_CONNECT_RESP, p)
+}
+
+// String returns the text form of p, the Secret is not included.
+func (p *CmppConnReqPkt) String() string {
+	s := newPktString("CmppConnReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.str("SrcAddr", p.SrcAddr)
+	s.hex("AuthSrc", p.AuthSrc)
+	s.version(p.Version)
+	s.uint("Timestamp", uint64(p.Timestamp))
+	return s.String()
+}
+
+// String returns the text form of p, the Secret is not included.
+func (p *Cmpp2ConnRspPkt) String() string {
+	s := newPktString("Cmpp2ConnRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("Status", uint64(p.Status))
+	s.hex("AuthIsmg", p.AuthIsmg)
+	s.version(p.Version)
+	return s.String()
+}
+
+// String returns the text form of p, the Secret is not included.
+func (p *Cmpp3ConnRspPkt) String() string {
+	s := newPktString("Cmpp3ConnRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("Status", uint64(p.Status))
+	s.hex("AuthIsmg", p.AuthIsmg)
+	s.version(p.Version)
+	return s.String()
 }
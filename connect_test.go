@@ -14,7 +14,10 @@
 package cmpp_test
 
 import (
+	"bytes"
+	"crypto/md5"
 	"testing"
+	"time"
 
 	"github.com/bigwhite/gocmpp"
 )
@@ -114,6 +117,70 @@ func TestCmppConnReqPktUnpack(t *testing.T) {
 	}
 }
 
+func TestVerifyAuthenticator(t *testing.T) {
+	// connect request packet data of a known-good login:
+	data := []byte{
+		0x00, 0x00, 0x00, 0x27, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x17, 0x39, 0x30, 0x30, 0x30,
+		0x30, 0x31, 0x90, 0xd0, 0x0c, 0x1d, 0x51, 0x7a, 0xbd, 0x0b, 0x4f, 0x65, 0xf6, 0xbc, 0xf8, 0x53,
+		0x5d, 0x16, 0x21, 0x3c, 0xdc, 0x73, 0xbe,
+	}
+
+	p := &cmpp.CmppConnReqPkt{}
+	err := p.Unpack(data[8:])
+	if err != nil {
+		t.Fatal("CmppConnReqPkt unpack error:", err)
+	}
+
+	if !cmpp.VerifyAuthenticator(p, connSecret) {
+		t.Fatal("The authenticator is not verified with the correct secret")
+	}
+
+	if cmpp.VerifyAuthenticator(p, "888889") {
+		t.Fatal("The authenticator is verified with a wrong secret")
+	}
+}
+
+func TestCmppConnReqPktSrcAddrPadding(t *testing.T) {
+	for _, pad := range []byte{0, ' '} {
+		p := &cmpp.CmppConnReqPkt{
+			SrcAddr:    "9001",
+			Secret:     connSecret,
+			Version:    connVersion1,
+			Timestamp:  connTimestamp,
+			SrcAddrPad: pad,
+		}
+		data, err := p.Pack(seqId)
+		if err != nil {
+			t.Fatal("CmppConnReqPkt pack error:", err)
+		}
+
+		srcAddr := []byte{'9', '0', '0', '1', pad, pad}
+		if !bytes.Equal(data[12:18], srcAddr) {
+			t.Fatalf("After pack, Source_Addr is %q, not equal to expected: %q\n", data[12:18], srcAddr)
+		}
+
+		// the authenticator is computed from the bytes on the wire with a
+		// pad, and from the SrcAddr unpadded without, as the baseline.
+		md5Src := data[12:18]
+		if pad == 0 {
+			md5Src = []byte("9001")
+		}
+		authSrc := md5.Sum(bytes.Join([][]byte{md5Src, make([]byte, 9),
+			[]byte(connSecret), []byte("1021080510")}, nil))
+		if !bytes.Equal(data[18:34], authSrc[:]) {
+			t.Fatalf("After pack, AuthenticatorSource is %x, not equal to expected: %x\n", data[18:34], authSrc)
+		}
+
+		p1 := &cmpp.CmppConnReqPkt{}
+		if err = p1.Unpack(data[8:]); err != nil {
+			t.Fatal("CmppConnReqPkt unpack error:", err)
+		}
+		if !cmpp.VerifyAuthenticator(p1, connSecret) {
+			t.Fatalf("The authenticator of Source_Addr %q is not verified\n", srcAddr)
+		}
+	}
+}
+
 func TestCmpp2ConnRspPktPack(t *testing.T) {
 	//AuthSrc: 90 d0 0c 1d 51 7a bd 0b  4f 65 f6 bc f8 53 5d 16
 	authSrc := []byte{
@@ -302,3 +369,95 @@ func BenchmarkCmppConnReqPktUnpack(b *testing.B) {
 		p.Unpack(data)
 	}
 }
+
+func TestConnStatus(t *testing.T) {
+	cases := []struct {
+		status   cmpp.ConnStatus
+		expected string
+	}{
+		{cmpp.ConnStatusOK, "ok"},
+		{cmpp.ConnStatusInvalidStruct, "invalid message structure"},
+		{cmpp.ConnStatusInvalidSrcAddr, "illegal source address"},
+		{cmpp.ConnStatusAuthFailed, "authentication failed"},
+		{cmpp.ConnStatusVerTooHigh, "version too high"},
+		{cmpp.ConnStatusOthers, "other error"},
+		{cmpp.ConnStatus(9), "other error"},
+	}
+
+	for _, cs := range cases {
+		if cs.status.String() != cs.expected {
+			t.Fatalf("The status string is %s, not equal to expected: %s\n", cs.status, cs.expected)
+		}
+	}
+
+	if cmpp.ConnStatus(9).Unwrap() != cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnOthers] {
+		t.Fatalf("The unwrapped error is %v, not equal to expected: %v\n", cmpp.ConnStatus(9).Unwrap(), cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnOthers])
+	}
+}
+
+func TestParseConnTimestamp(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.Local)
+	}
+
+	cases := []struct {
+		ts       uint32
+		now      time.Time
+		expected time.Time
+		err      error
+	}{
+		{1015123000, date(2026, 10, 15, 12, 30, 5), date(2026, 10, 15, 12, 30, 0), nil},
+		// the year rolls over.
+		{1231235959, date(2027, 1, 1, 0, 0, 10), date(2026, 12, 31, 23, 59, 59), nil},
+		{101000005, date(2026, 12, 31, 23, 59, 59), date(2027, 1, 1, 0, 0, 5), nil},
+		// Feb 29 is only valid in the leap year.
+		{229120000, date(2027, 3, 1, 0, 0, 0), date(2028, 2, 29, 12, 0, 0), nil},
+		{1301000000, date(2026, 10, 15, 0, 0, 0), time.Time{}, cmpp.ErrConnTimestampInvalid},
+		{1000000000, date(2026, 10, 15, 0, 0, 0), time.Time{}, cmpp.ErrConnTimestampInvalid},
+		{1015250000, date(2026, 10, 15, 0, 0, 0), time.Time{}, cmpp.ErrConnTimestampInvalid},
+	}
+
+	for _, cs := range cases {
+		ts, err := cmpp.ParseConnTimestamp(cs.ts, cs.now)
+		if err != cs.err || !ts.Equal(cs.expected) {
+			t.Fatalf("ParseConnTimestamp(%010d) is %v, %v, not equal to expected: %v, %v\n", cs.ts, ts, err, cs.expected, cs.err)
+		}
+	}
+}
+
+func TestVerifyAuthenticatorISMG(t *testing.T) {
+	//AuthSrc: 90 d0 0c 1d 51 7a bd 0b  4f 65 f6 bc f8 53 5d 16
+	authSrc := []byte{
+		0x90, 0xd0, 0x0c, 0x1d, 0x51, 0x7a, 0xbd, 0x0b,
+		0x4f, 0x65, 0xf6, 0xbc, 0xf8, 0x53, 0x5d, 0x16,
+	}
+
+	// MD5(Status + AuthSrc + "888888"), with 1 byte Status for cmpp2
+	// and 4 bytes Status for cmpp3.
+	rsp2 := &cmpp.Cmpp2ConnRspPkt{AuthIsmg: string([]byte{
+		0x6c, 0x0b, 0x84, 0x6e, 0x25, 0xba, 0xb6, 0xda,
+		0xa4, 0xed, 0x1c, 0x46, 0x6e, 0x0f, 0x4b, 0xd8,
+	})}
+	rsp3 := &cmpp.Cmpp3ConnRspPkt{AuthIsmg: string([]byte{
+		0x79, 0x42, 0x97, 0x72, 0x74, 0x09, 0x8c, 0xf2,
+		0x10, 0xab, 0x0c, 0x16, 0xc3, 0x67, 0xbc, 0x8d,
+	})}
+
+	for _, rsp := range []cmpp.Packer{rsp2, rsp3} {
+		if !cmpp.VerifyAuthenticatorISMG(rsp, authSrc, connSecret) {
+			t.Fatalf("The AuthenticatorISMG of %#v is not verified\n", rsp)
+		}
+		if cmpp.VerifyAuthenticatorISMG(rsp, authSrc, "888889") {
+			t.Fatalf("The AuthenticatorISMG of %#v is verified with a wrong secret\n", rsp)
+		}
+	}
+
+	// the Status is a part of the digest.
+	rsp3.Status = 1
+	if cmpp.VerifyAuthenticatorISMG(rsp3, authSrc, connSecret) {
+		t.Fatalf("The AuthenticatorISMG of %#v is verified with a wrong status\n", rsp3)
+	}
+	if cmpp.VerifyAuthenticatorISMG(&cmpp.CmppConnReqPkt{}, authSrc, connSecret) {
+		t.Fatal("A connect request is verified as a connect response")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"sync"
+)
+
+// ConnPool creates the Conns of a server accept loop, which reuse the read
+// buffers of the closed ones rather than allocating a new one for each
+// connection. It is safe for concurrent use.
+//
+// A Conn created by New borrows a read buffer from the pool, reset onto its
+// net.Conn, and returns it on Close if no read is in progress then, e.g. when
+// it is closed by the goroutine serving it after its read loop ends, as the
+// Server does. A buffer whose Conn is closed amid a read, by another goroutine,
+// is left to the garbage collector instead, so it is never shared with the
+// read in progress. The Conn must not be used after Close, as usual.
+//
+// The Conns created with WithReader or WithReaderSize keep their own read
+// buffers, and the ones of WithWriterSize are not pooled either. Create the
+// pool with WithAtomicSeqId to save the SeqId goroutine and its channels of
+// each Conn too, see BenchmarkConnPool.
+type ConnPool struct {
+	typ     Type
+	opts    []Option
+	readers sync.Pool // *bufio.Reader
+}
+
+// NewConnPool returns a ConnPool whose Conns are of typ and configured with
+// opts, see NewConnWithOptions.
+func NewConnPool(typ Type, opts ...Option) *ConnPool {
+	return &ConnPool{
+		typ:  typ,
+		opts: slices.Clone(opts),
+	}
+}
+
+// New returns a Conn over conn, like NewConnWithOptions does.
+func (p *ConnPool) New(conn net.Conn) *Conn {
+	c := newConn(conn, p.typ, p.opts)
+	if c.br == nil {
+		if br, ok := p.readers.Get().(*bufio.Reader); ok {
+			br.Reset(conn)
+			c.br = br
+		} else {
+			c.br = bufio.NewReader(conn)
+		}
+		c.pool = p
+	}
+	return c
+}
+
+// putReader returns br of a closed Conn to the pool.
+func (p *ConnPool) putReader(br *bufio.Reader) {
+	br.Reset(nil) // drop the net.Conn and the bytes buffered.
+	p.readers.Put(br)
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestConnPool(t *testing.T) {
+	pool := cmpp.NewConnPool(cmpp.V30, cmpp.WithAtomicSeqId())
+
+	for i := 1; i <= 3; i++ {
+		c1, c2 := net.Pipe()
+		peer := cmpp.NewConn(c2, cmpp.V30)
+		peer.SetState(cmpp.CONN_AUTHOK)
+		sent := make(chan struct{})
+		go func(seqId uint32) {
+			defer close(sent)
+			// the second packet is left in the read buffer when c is closed.
+			peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, seqId)
+			peer.SendPkt(&cmpp.CmppTerminateReqPkt{}, seqId)
+		}(uint32(i))
+
+		c := pool.New(c1)
+		c.SetState(cmpp.CONN_AUTHOK)
+		if next := c.NextSeqId(); next != 1 {
+			t.Fatalf("The first seqId is %d, not equal to expected: %d\n", next, 1)
+		}
+
+		// the conn reads its own packets only, whatever the buffer it reuses.
+		p, err := c.RecvAndUnpackPkt(time.Second)
+		if req, ok := p.(*cmpp.CmppActiveTestReqPkt); err != nil || !ok || req.SeqId != uint32(i) {
+			t.Fatalf("The packet received is %#v(error %v), not the active test of seqId %d\n", p, err, i)
+		}
+		if err = c.Close(); err != nil {
+			t.Fatal("Close error:", err)
+		}
+		if _, err = c.RecvAndUnpackPkt(0); err != cmpp.ErrConnIsClosed {
+			t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnIsClosed)
+		}
+		<-sent
+		peer.Close()
+	}
+}
+
+func TestConnPoolCloseAmidRead(t *testing.T) {
+	pool := cmpp.NewConnPool(cmpp.V30)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := pool.New(c1)
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	errc := make(chan error)
+	go func() {
+		_, err := c.RecvAndUnpackPkt(0) // blocks, the peer sends nothing.
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	if err := <-errc; err == nil {
+		t.Fatal("The read of a closed conn succeeds")
+	}
+
+	// a new conn of the pool is not disturbed by the read ended.
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	peer := cmpp.NewConn(c4, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go peer.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 7)
+
+	n := pool.New(c3)
+	defer n.Close()
+	n.SetState(cmpp.CONN_AUTHOK)
+	p, err := n.RecvAndUnpackPkt(time.Second)
+	if req, ok := p.(*cmpp.CmppActiveTestReqPkt); err != nil || !ok || req.SeqId != 7 {
+		t.Fatalf("The packet received is %#v(error %v), not the active test of seqId %d\n", p, err, 7)
+	}
+}
+
+func TestConnPoolCloseRace(t *testing.T) {
+	pool := cmpp.NewConnPool(cmpp.V30)
+
+	// the reads start before, amid and after Close, the race detector
+	// catches a read through the buffer returned to the pool.
+	for i := 0; i < 20; i++ {
+		c1, c2 := net.Pipe()
+		c := pool.New(c1)
+		c.SetState(cmpp.CONN_AUTHOK)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.RecvAndUnpackPkt(0)
+			}()
+		}
+		c.Close()
+		wg.Wait()
+		if _, err := c.RecvAndUnpackPkt(0); err != cmpp.ErrConnIsClosed {
+			t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnIsClosed)
+		}
+		c2.Close()
+	}
+}
+
+// churnConn is a short-lived connection, which sends one packet.
+type churnConn struct {
+	net.Conn
+	r bytes.Reader
+}
+
+func (c *churnConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *churnConn) Close() error {
+	return nil
+}
+
+func BenchmarkConnPool(b *testing.B) {
+	pkt, _ := (&cmpp.CmppActiveTestReqPkt{}).Pack(1)
+	pool := cmpp.NewConnPool(cmpp.V30, cmpp.WithAtomicSeqId())
+
+	for _, bc := range []struct {
+		name string
+		new  func(net.Conn) *cmpp.Conn
+	}{
+		{"NewConn", func(conn net.Conn) *cmpp.Conn { return cmpp.NewConn(conn, cmpp.V30) }},
+		{"NewConnAtomicSeqId", func(conn net.Conn) *cmpp.Conn {
+			return cmpp.NewConnWithOptions(conn, cmpp.V30, cmpp.WithAtomicSeqId())
+		}},
+		{"ConnPool", pool.New},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				conn := &churnConn{}
+				conn.r.Reset(pkt)
+				c := bc.new(conn)
+				c.SetState(cmpp.CONN_AUTHOK)
+				if _, err := c.RecvAndUnpackPkt(0); err != nil {
+					b.Fatal("RecvAndUnpackPkt error:", err)
+				}
+				c.Close()
+			}
+		})
+	}
+}
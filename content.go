@@ -0,0 +1,381 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bigwhite/gocmpp/utils"
+)
+
+// Msg_Fmt values of the message content.
+const (
+	MsgFmtASCII uint8 = 0  // ASCII
+	MsgFmtUCS2  uint8 = 8  // UCS2, encoded as UTF-16BE
+	MsgFmtGBK   uint8 = 15 // GBK
+)
+
+// Errors for message content encoding and decoding.
+var (
+	ErrMsgFmtNotSupported = errors.New("msg_fmt is not supported")
+	ErrNotASCII           = errors.New("content contains non-ascii bytes")
+	ErrInvalidUcs2Length  = errors.New("length of ucs2 content is odd")
+	ErrContentTooLong     = errors.New("content is too long to be split")
+	ErrInvalidSegments    = errors.New("segments of long message are invalid")
+	ErrMsgContentTooLong  = errors.New("msg_content is longer than 255 bytes")
+	ErrInvalidUcs2        = errors.New("content contains unpaired ucs2 surrogates")
+	ErrInvalidGBK         = errors.New("content contains invalid gbk sequences")
+	ErrNulInContent       = errors.New("content contains 0x00 bytes, which is likely ucs2")
+)
+
+// Limits of the message content in one cmpp submit packet.
+const (
+	MaxMsgContentLen      = 140 // max bytes of Msg_Content
+	MaxASCIIMsgContentLen = 160 // max bytes of Msg_Content in MsgFmtASCII
+	UdhConcatLen          = 6   // bytes of the udh concatenation header
+	MaxSegmentContentLen  = MaxMsgContentLen - UdhConcatLen
+)
+
+// maxMsgContentLen returns the max bytes of Msg_Content in msgFmt.
+func maxMsgContentLen(msgFmt uint8) int {
+	if msgFmt == MsgFmtASCII {
+		return MaxASCIIMsgContentLen
+	}
+	return MaxMsgContentLen
+}
+
+// SingleSegmentCapacity returns how much content in msgFmt fits in one
+// submit packet without being split: 160 characters in MsgFmtASCII, 70
+// in MsgFmtUCS2, counting each character outside the BMP as 2, and 140
+// bytes in the other formats, e.g. 70 double-byte characters in MsgFmtGBK.
+func SingleSegmentCapacity(msgFmt uint8) int {
+	switch msgFmt {
+	case MsgFmtASCII:
+		return MaxASCIIMsgContentLen
+	case MsgFmtUCS2:
+		return MaxMsgContentLen / 2
+	}
+	return MaxMsgContentLen
+}
+
+// WillSplit reports whether the utf8 content is split to more than one
+// segment by SplitLongMessage in msgFmt, i.e. it is sent and billed as a
+// long message. The content of a Msg_Fmt with no codec, e.g. 4(binary), is
+// taken as the raw bytes. It reports false for the content which can not
+// be encoded in msgFmt, as SplitLongMessage fails with it.
+func WillSplit(content string, msgFmt uint8) bool {
+	n := len(content)
+	b, err := EncodeMsgContent(content, msgFmt)
+	switch {
+	case err == nil:
+		n = len(b)
+	case err != ErrMsgFmtNotSupported:
+		return false
+	}
+	return n > maxMsgContentLen(msgFmt)
+}
+
+// ChooseMsgFmt returns the Msg_Fmt which takes the fewest bytes to encode
+// the utf8 content: MsgFmtASCII if it is all 7-bit, which takes one byte
+// per character and up to MaxASCIIMsgContentLen bytes in one packet, or
+// MsgFmtGBK if it can be encoded in GBK, or else MsgFmtUCS2. It is used by
+// Client.SendText unless overridden by Client.SetTextMsgFmt.
+func ChooseMsgFmt(content string) uint8 {
+	if isASCII(content) {
+		return MsgFmtASCII
+	}
+	if _, err := EncodeMsgContent(content, MsgFmtGBK); err == nil {
+		return MsgFmtGBK
+	}
+	return MsgFmtUCS2
+}
+
+// msgLength returns the Msg_Length of content. Msg_Content is a binary
+// field whose length is given by Msg_Length, rather than a C string, so
+// the packers derive Msg_Length from the content, which may contain 0x00.
+func msgLength(content string) (uint8, error) {
+	if len(content) > math.MaxUint8 {
+		return 0, ErrMsgContentTooLong
+	}
+	return uint8(len(content)), nil
+}
+
+// contentBytes returns a copy of the first n bytes of content, at most
+// 255 bytes, so the caller owns it.
+func contentBytes(content string, n uint8) []byte {
+	return []byte(content[:min(int(n), len(content))])
+}
+
+// msgCodec is a codec registered by RegisterMsgCodec.
+type msgCodec struct {
+	encode func(string) ([]byte, error)
+	decode func([]byte) (string, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[uint8]msgCodec)
+)
+
+// RegisterMsgCodec registers the codec of msgFmt, e.g. for a vendor-specific
+// Msg_Fmt, which is used by EncodeMsgContent and DecodeMsgContent and the
+// functions built on them. A codec registered for a built-in Msg_Fmt takes
+// the place of the built-in one, and nil encode and decode unregister it.
+// It is safe to be called concurrently with the encoding and decoding.
+func RegisterMsgCodec(msgFmt uint8, encode func(string) ([]byte, error), decode func([]byte) (string, error)) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if encode == nil && decode == nil {
+		delete(codecs, msgFmt)
+		return
+	}
+	codecs[msgFmt] = msgCodec{encode, decode}
+}
+
+func lookupMsgCodec(msgFmt uint8) (msgCodec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[msgFmt]
+	return c, ok
+}
+
+// EncodeMsgContent encodes the utf8 string s to the bytes of Msg_Content
+// according to msgFmt. The codecs registered by RegisterMsgCodec are
+// looked up first, then the built-in MsgFmtASCII, MsgFmtUCS2 and MsgFmtGBK,
+// ErrMsgFmtNotSupported is returned for the others.
+func EncodeMsgContent(s string, msgFmt uint8) ([]byte, error) {
+	if c, ok := lookupMsgCodec(msgFmt); ok && c.encode != nil {
+		return c.encode(s)
+	}
+
+	switch msgFmt {
+	case MsgFmtASCII:
+		if !isASCII(s) {
+			return nil, ErrNotASCII
+		}
+		return []byte(s), nil
+	case MsgFmtUCS2:
+		out, err := cmpputils.Utf8ToUcs2(s)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(out), nil
+	case MsgFmtGBK:
+		out, err := cmpputils.Utf8ToGBK(s)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(out), nil
+	default:
+		return nil, ErrMsgFmtNotSupported
+	}
+}
+
+// DecodeMsgContent decodes the bytes of Msg_Content in msgFmt to
+// an utf8 string. It supports the same Msg_Fmt values as EncodeMsgContent.
+func DecodeMsgContent(b []byte, msgFmt uint8) (string, error) {
+	if c, ok := lookupMsgCodec(msgFmt); ok && c.decode != nil {
+		return c.decode(b)
+	}
+
+	switch msgFmt {
+	case MsgFmtASCII:
+		s := string(b)
+		if !isASCII(s) {
+			return "", ErrNotASCII
+		}
+		return s, nil
+	case MsgFmtUCS2:
+		if len(b)%2 != 0 {
+			return "", ErrInvalidUcs2Length
+		}
+		return cmpputils.Ucs2ToUtf8(string(b))
+	case MsgFmtGBK:
+		return cmpputils.GBKToUtf8(string(b))
+	default:
+		return "", ErrMsgFmtNotSupported
+	}
+}
+
+// CheckMsgContent checks whether the bytes b of Msg_Content are in the
+// encoding of msgFmt, to catch a wrong Msg_Fmt which garbles the message:
+// MsgFmtASCII requires 7-bit bytes, MsgFmtUCS2 an even count of bytes
+// without unpaired surrogates, and MsgFmtGBK valid GBK sequences. 0x00 is
+// rejected in MsgFmtASCII and MsgFmtGBK, as it shows up in the ucs2 bytes
+// of most texts but never in a text encoded in them. The other Msg_Fmt
+// values are not checked.
+func CheckMsgContent(b []byte, msgFmt uint8) error {
+	switch msgFmt {
+	case MsgFmtASCII:
+		for _, c := range b {
+			if c >= 0x80 {
+				return ErrNotASCII
+			}
+			if c == 0 {
+				return ErrNulInContent
+			}
+		}
+	case MsgFmtUCS2:
+		if len(b)%2 != 0 {
+			return ErrInvalidUcs2Length
+		}
+		for i := 0; i < len(b); i += 2 {
+			switch u := uint16(b[i])<<8 | uint16(b[i+1]); {
+			case u >= 0xd800 && u < 0xdc00: // high surrogate, followed by a low one.
+				if i+3 >= len(b) || b[i+2] < 0xdc || b[i+2] >= 0xe0 {
+					return ErrInvalidUcs2
+				}
+				i += 2
+			case u >= 0xdc00 && u < 0xe000:
+				return ErrInvalidUcs2
+			}
+		}
+	case MsgFmtGBK:
+		for i := 0; i < len(b); i++ {
+			switch c := b[i]; {
+			case c == 0:
+				return ErrNulInContent
+			case c < 0x80:
+			case c == 0x80 || c == 0xff:
+				return ErrInvalidGBK
+			default: // lead byte, followed by a trail byte in 0x40-0xfe except 0x7f.
+				if i+1 >= len(b) || b[i+1] < 0x40 || b[i+1] == 0x7f || b[i+1] == 0xff {
+					return ErrInvalidGBK
+				}
+				i++
+			}
+		}
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// ref is the auto-incrementing reference number of the long messages.
+var ref uint32
+
+// SplitLongMessage encodes content according to msgFmt (see EncodeMsgContent)
+// and splits it to the Msg_Content payloads of cmpp submit packets.
+//
+// If the encoded content fits in one packet(MaxMsgContentLen bytes, or
+// MaxASCIIMsgContentLen bytes in MsgFmtASCII), it is returned as the only
+// segment, without udh. Otherwise, every segment starts
+// with a 6-byte udh concatenation header(0x05, 0x00, 0x03, reference number,
+// total parts, part index) and the packets carrying them should be sent with
+// TpUdhi set to 1, and PkTotal, PkNumber set to the total parts and the part index.
+// A character is never split across two segments.
+//
+// The reference number is allocated automatically, use
+// SplitLongMessageWithRef to set it explicitly.
+func SplitLongMessage(content string, msgFmt uint8) ([][]byte, error) {
+	return SplitLongMessageWithRef(content, msgFmt, uint8(atomic.AddUint32(&ref, 1)))
+}
+
+// SplitLongMessageWithRef is like SplitLongMessage, but uses
+// refNum as the reference number in the udh.
+func SplitLongMessageWithRef(content string, msgFmt uint8, refNum uint8) ([][]byte, error) {
+	b, err := EncodeMsgContent(content, msgFmt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) <= maxMsgContentLen(msgFmt) {
+		return [][]byte{b}, nil
+	}
+
+	// split the encoded content at the character boundaries.
+	var parts [][]byte
+	var part []byte
+	for _, r := range content {
+		eb, err := EncodeMsgContent(string(r), msgFmt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(part)+len(eb) > MaxSegmentContentLen {
+			parts = append(parts, part)
+			part = nil
+		}
+		part = append(part, eb...)
+	}
+	parts = append(parts, part)
+
+	if len(parts) > 255 {
+		return nil, ErrContentTooLong
+	}
+
+	segments := make([][]byte, len(parts))
+	for i, p := range parts {
+		seg := make([]byte, 0, UdhConcatLen+len(p))
+		seg = append(seg, 0x05, 0x00, 0x03, refNum, uint8(len(parts)), uint8(i+1))
+		segments[i] = append(seg, p...)
+	}
+	return segments, nil
+}
+
+// ReassembleLongMessage joins the Msg_Content payloads of a long message
+// split by SplitLongMessage, and decodes it according to msgFmt(see
+// DecodeMsgContent). The segments may be passed in any order, but all of
+// them must be present and share the same reference number.
+//
+// One segment without udh is accepted as a whole message.
+func ReassembleLongMessage(segments [][]byte, msgFmt uint8) (string, error) {
+	if len(segments) == 1 && !hasUdhConcat(segments[0]) {
+		return DecodeMsgContent(segments[0], msgFmt)
+	}
+
+	if len(segments) == 0 || len(segments) > 255 {
+		return "", ErrInvalidSegments
+	}
+
+	for _, seg := range segments {
+		if !hasUdhConcat(seg) {
+			return "", ErrInvalidSegments
+		}
+	}
+
+	var ordered = make([][]byte, len(segments))
+	var refNum = segments[0][3]
+	for _, seg := range segments {
+		if seg[3] != refNum || int(seg[4]) != len(segments) {
+			return "", ErrInvalidSegments
+		}
+
+		idx := int(seg[5])
+		if idx < 1 || idx > len(segments) || ordered[idx-1] != nil {
+			return "", ErrInvalidSegments
+		}
+		ordered[idx-1] = seg[UdhConcatLen:]
+	}
+
+	var b []byte
+	for _, p := range ordered {
+		b = append(b, p...)
+	}
+	return DecodeMsgContent(b, msgFmt)
+}
+
+func hasUdhConcat(seg []byte) bool {
+	return len(seg) >= UdhConcatLen && seg[0] == 0x05 && seg[1] == 0x00 && seg[2] == 0x03
+}
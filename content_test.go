@@ -0,0 +1,329 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestEncodeDecodeMsgContent(t *testing.T) {
+	cases := []struct {
+		s        string
+		msgFmt   uint8
+		expected []byte
+	}{
+		{"gocmpp", cmpp.MsgFmtASCII, []byte("gocmpp")},
+		{"测试", cmpp.MsgFmtUCS2, []byte{0x6d, 0x4b, 0x8b, 0xd5}},
+		{"😀", cmpp.MsgFmtUCS2, []byte{0xd8, 0x3d, 0xde, 0x00}},
+		{"测试", cmpp.MsgFmtGBK, []byte{0xb2, 0xe2, 0xca, 0xd4}},
+	}
+
+	for _, c := range cases {
+		b, err := cmpp.EncodeMsgContent(c.s, c.msgFmt)
+		if err != nil {
+			t.Fatalf("EncodeMsgContent(%s, %d) error: %s\n", c.s, c.msgFmt, err)
+		}
+
+		if !bytes.Equal(b, c.expected) {
+			t.Fatalf("EncodeMsgContent(%s, %d) is %x, not equal to expected: %x\n", c.s, c.msgFmt, b, c.expected)
+		}
+
+		s, err := cmpp.DecodeMsgContent(b, c.msgFmt)
+		if err != nil {
+			t.Fatalf("DecodeMsgContent(%x, %d) error: %s\n", b, c.msgFmt, err)
+		}
+
+		if s != c.s {
+			t.Fatalf("DecodeMsgContent(%x, %d) is %s, not equal to expected: %s\n", b, c.msgFmt, s, c.s)
+		}
+	}
+}
+
+func TestEncodeMsgContentErrors(t *testing.T) {
+	_, err := cmpp.EncodeMsgContent("测试", cmpp.MsgFmtASCII)
+	if err != cmpp.ErrNotASCII {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrNotASCII)
+	}
+
+	_, err = cmpp.EncodeMsgContent("gocmpp", 4)
+	if err != cmpp.ErrMsgFmtNotSupported {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrMsgFmtNotSupported)
+	}
+
+	_, err = cmpp.DecodeMsgContent([]byte{0x6d, 0x4b, 0x8b}, cmpp.MsgFmtUCS2)
+	if err != cmpp.ErrInvalidUcs2Length {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrInvalidUcs2Length)
+	}
+}
+
+func TestSplitLongMessage(t *testing.T) {
+	cases := []struct {
+		s       string
+		msgFmt  uint8
+		lengths []int // length of each segment, including udh
+	}{
+		{strings.Repeat("测", 70), cmpp.MsgFmtUCS2, []int{140}},
+		{strings.Repeat("测", 71), cmpp.MsgFmtUCS2, []int{140, 14}},
+		{strings.Repeat("a", 140), cmpp.MsgFmtASCII, []int{140}},
+		{strings.Repeat("a", 160), cmpp.MsgFmtASCII, []int{160}},
+		{strings.Repeat("a", 161), cmpp.MsgFmtASCII, []int{140, 33}},
+		{"a" + strings.Repeat("测", 70), cmpp.MsgFmtGBK, []int{139, 14}},
+	}
+
+	for _, c := range cases {
+		segs, err := cmpp.SplitLongMessageWithRef(c.s, c.msgFmt, 0x17)
+		if err != nil {
+			t.Fatal("SplitLongMessageWithRef error:", err)
+		}
+
+		if len(segs) != len(c.lengths) {
+			t.Fatalf("The count of segments is %d, not equal to expected: %d\n", len(segs), len(c.lengths))
+		}
+
+		for i, seg := range segs {
+			if len(seg) != c.lengths[i] {
+				t.Fatalf("The length of segment[%d] is %d, not equal to expected: %d\n", i, len(seg), c.lengths[i])
+			}
+
+			if len(segs) == 1 {
+				continue
+			}
+
+			udh := []byte{0x05, 0x00, 0x03, 0x17, uint8(len(segs)), uint8(i + 1)}
+			if !bytes.Equal(seg[:6], udh) {
+				t.Fatalf("The udh of segment[%d] is %x, not equal to expected: %x\n", i, seg[:6], udh)
+			}
+		}
+
+		s, err := cmpp.ReassembleLongMessage(segs, c.msgFmt)
+		if err != nil {
+			t.Fatal("ReassembleLongMessage error:", err)
+		}
+
+		if s != c.s {
+			t.Fatalf("The reassembled message is %s, not equal to expected: %s\n", s, c.s)
+		}
+	}
+}
+
+func TestChooseMsgFmt(t *testing.T) {
+	cases := []struct {
+		content string
+		msgFmt  uint8
+	}{
+		{"", cmpp.MsgFmtASCII},
+		{"your code is 123456", cmpp.MsgFmtASCII},
+		{"你好", cmpp.MsgFmtGBK},
+		{"你好😀", cmpp.MsgFmtUCS2},
+	}
+
+	for _, c := range cases {
+		if f := cmpp.ChooseMsgFmt(c.content); f != c.msgFmt {
+			t.Fatalf("The msg_fmt of %q is %d, not equal to expected: %d\n", c.content, f, c.msgFmt)
+		}
+	}
+}
+
+func TestSingleSegmentCapacity(t *testing.T) {
+	cases := map[uint8]int{
+		cmpp.MsgFmtASCII: 160,
+		cmpp.MsgFmtUCS2:  70,
+		cmpp.MsgFmtGBK:   140,
+		4:                140, // binary
+	}
+
+	for msgFmt, expected := range cases {
+		if n := cmpp.SingleSegmentCapacity(msgFmt); n != expected {
+			t.Fatalf("The capacity of msg_fmt %d is %d, not equal to expected: %d\n", msgFmt, n, expected)
+		}
+	}
+}
+
+func TestWillSplit(t *testing.T) {
+	cases := []struct {
+		msgFmt uint8
+		char   string
+		max    int // the most chars in one segment
+	}{
+		{cmpp.MsgFmtASCII, "a", 160},
+		{cmpp.MsgFmtUCS2, "中", 70},
+		{cmpp.MsgFmtUCS2, "😀", 35}, // a surrogate pair per character
+		{cmpp.MsgFmtGBK, "中", 70},
+		{cmpp.MsgFmtGBK, "a", 140},
+		{4, "\xff", 140}, // binary, taken as raw bytes
+	}
+
+	for _, c := range cases {
+		if cmpp.WillSplit(strings.Repeat(c.char, c.max), c.msgFmt) {
+			t.Fatalf("%d of %q in msg_fmt %d will split, not expected\n", c.max, c.char, c.msgFmt)
+		}
+		if !cmpp.WillSplit(strings.Repeat(c.char, c.max+1), c.msgFmt) {
+			t.Fatalf("%d of %q in msg_fmt %d will not split, not expected\n", c.max+1, c.char, c.msgFmt)
+		}
+	}
+
+	// the content which can not be encoded is rejected rather than split.
+	if cmpp.WillSplit(strings.Repeat("中", 100), cmpp.MsgFmtASCII) {
+		t.Fatal("The non-ascii content will split in msg_fmt 0, not expected")
+	}
+}
+
+func TestCheckMsgContent(t *testing.T) {
+	cases := []struct {
+		content string
+		msgFmt  uint8
+		err     error
+	}{
+		{"hello", cmpp.MsgFmtASCII, nil},
+		{"\x00h\x00i", cmpp.MsgFmtASCII, cmpp.ErrNulInContent},       // ucs2 "hi"
+		{"\xc4\xe3\xba\xc3", cmpp.MsgFmtASCII, cmpp.ErrNotASCII},     // gbk "你好"
+		{"\x4f\x60\x59\x7d", cmpp.MsgFmtUCS2, nil},                   // ucs2 "你好"
+		{"\xd8\x3d\xde\x00", cmpp.MsgFmtUCS2, nil},                   // ucs2 "😀"
+		{"\x4f\x60\x59", cmpp.MsgFmtUCS2, cmpp.ErrInvalidUcs2Length}, // odd bytes
+		{"\xd8\x3d\x00\x61", cmpp.MsgFmtUCS2, cmpp.ErrInvalidUcs2},   // high surrogate alone
+		{"\xde\x00\x00\x61", cmpp.MsgFmtUCS2, cmpp.ErrInvalidUcs2},   // low surrogate alone
+		{"\xc4\xe3\xba\xc3hi", cmpp.MsgFmtGBK, nil},                  // gbk "你好hi"
+		{"\x4f\x60\x00\x61", cmpp.MsgFmtGBK, cmpp.ErrNulInContent},   // ucs2 "你a"
+		{"\xc4\xe3\xba", cmpp.MsgFmtGBK, cmpp.ErrInvalidGBK},         // truncated
+		{"\xc4\x7f", cmpp.MsgFmtGBK, cmpp.ErrInvalidGBK},             // invalid trail byte
+		{"\x80\x40", cmpp.MsgFmtGBK, cmpp.ErrInvalidGBK},             // invalid lead byte
+		{"\x00\xff", 4, nil}, // binary is not checked
+	}
+
+	for _, c := range cases {
+		if err := cmpp.CheckMsgContent([]byte(c.content), c.msgFmt); err != c.err {
+			t.Fatalf("The error of %x in msg_fmt %d is %v, not equal to expected: %v\n", c.content, c.msgFmt, err, c.err)
+		}
+	}
+}
+
+func TestSplitLongMessageAutoRef(t *testing.T) {
+	s := strings.Repeat("测", 71)
+	segs1, err := cmpp.SplitLongMessage(s, cmpp.MsgFmtUCS2)
+	if err != nil {
+		t.Fatal("SplitLongMessage error:", err)
+	}
+
+	segs2, err := cmpp.SplitLongMessage(s, cmpp.MsgFmtUCS2)
+	if err != nil {
+		t.Fatal("SplitLongMessage error:", err)
+	}
+
+	if segs1[0][3] == segs2[0][3] {
+		t.Fatalf("The reference numbers of two long messages are both %d\n", segs1[0][3])
+	}
+}
+
+func TestReassembleLongMessageErrors(t *testing.T) {
+	segs, err := cmpp.SplitLongMessageWithRef(strings.Repeat("测", 150), cmpp.MsgFmtUCS2, 1)
+	if err != nil {
+		t.Fatal("SplitLongMessageWithRef error:", err)
+	}
+
+	// reversed order is ok.
+	_, err = cmpp.ReassembleLongMessage([][]byte{segs[2], segs[1], segs[0]}, cmpp.MsgFmtUCS2)
+	if err != nil {
+		t.Fatal("ReassembleLongMessage error:", err)
+	}
+
+	// missing one segment.
+	_, err = cmpp.ReassembleLongMessage(segs[:2], cmpp.MsgFmtUCS2)
+	if err != cmpp.ErrInvalidSegments {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrInvalidSegments)
+	}
+
+	// duplicated segment.
+	_, err = cmpp.ReassembleLongMessage([][]byte{segs[0], segs[0], segs[2]}, cmpp.MsgFmtUCS2)
+	if err != cmpp.ErrInvalidSegments {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrInvalidSegments)
+	}
+
+	// the first segment is too short for the udh, or empty.
+	for _, first := range [][]byte{{0x05, 0x00}, {}, nil} {
+		_, err = cmpp.ReassembleLongMessage([][]byte{first, segs[1], segs[2]}, cmpp.MsgFmtUCS2)
+		if err != cmpp.ErrInvalidSegments {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrInvalidSegments)
+		}
+	}
+}
+
+func TestRegisterMsgCodec(t *testing.T) {
+	const msgFmtXor uint8 = 0x19 // a vendor-specific Msg_Fmt
+	xor := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ 0x5a
+		}
+		return out
+	}
+
+	if _, err := cmpp.EncodeMsgContent("gocmpp", msgFmtXor); err != cmpp.ErrMsgFmtNotSupported {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrMsgFmtNotSupported)
+	}
+
+	cmpp.RegisterMsgCodec(msgFmtXor,
+		func(s string) ([]byte, error) { return xor([]byte(s)), nil },
+		func(b []byte) (string, error) { return string(xor(b)), nil })
+	defer cmpp.RegisterMsgCodec(msgFmtXor, nil, nil)
+
+	b, err := cmpp.EncodeMsgContent("gocmpp", msgFmtXor)
+	if err != nil || !bytes.Equal(b, xor([]byte("gocmpp"))) {
+		t.Fatalf("The content encoded is %x(error %v), not equal to expected: %x\n", b, err, xor([]byte("gocmpp")))
+	}
+	s, err := cmpp.DecodeMsgContent(b, msgFmtXor)
+	if err != nil || s != "gocmpp" {
+		t.Fatalf("The content decoded is %q(error %v), not equal to expected: %q\n", s, err, "gocmpp")
+	}
+
+	// the long message is split and reassembled with the codec too.
+	long := strings.Repeat("gocmpp", 30)
+	segments, err := cmpp.SplitLongMessage(long, msgFmtXor)
+	if err != nil || len(segments) != 2 {
+		t.Fatalf("SplitLongMessage returns %d segments(error %v), not equal to expected: 2\n", len(segments), err)
+	}
+	s, err = cmpp.ReassembleLongMessage(segments, msgFmtXor)
+	if err != nil || s != long {
+		t.Fatalf("The message reassembled is %q(error %v), not equal to expected: %q\n", s, err, long)
+	}
+}
+
+// BenchmarkSplitLongMessage compares the ASCII fast path with forcing UCS2
+// for a 7-bit content, which takes 1 packet in ASCII but 3 in UCS2.
+func BenchmarkSplitLongMessage(b *testing.B) {
+	content := strings.Repeat("your code is 123456. ", 8)[:160]
+	for _, bm := range []struct {
+		name   string
+		msgFmt uint8
+	}{
+		{"ASCII", cmpp.ChooseMsgFmt(content)},
+		{"UCS2", cmpp.MsgFmtUCS2},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var n int
+			for i := 0; i < b.N; i++ {
+				segments, err := cmpp.SplitLongMessageWithRef(content, bm.msgFmt, 1)
+				if err != nil {
+					b.Fatal("SplitLongMessage error:", err)
+				}
+				n = len(segments)
+			}
+			b.ReportMetric(float64(n), "packets/op")
+		})
+	}
+}
@@ -27,6 +27,12 @@ const (
 	Cmpp3DeliverRspPktLen    uint32 = 12 + 8 + 4 //24d, 0x18
 )
 
+// Values of RegisterDelivery in deliver request.
+const (
+	DeliverMsg    uint8 = 0 // a mobile originated message
+	DeliverReport uint8 = 1 // a status report
+)
+
 // Errors for result in deliver resp.
 
 var (
@@ -101,6 +107,7 @@ type Cmpp3DeliverReqPkt struct {
 	//session info
 	SeqId uint32
 }
+
 type Cmpp3DeliverRspPkt struct {
 	MsgId  uint64
 	Result uint32
@@ -111,9 +118,30 @@ type Cmpp3DeliverRspPkt struct {
 
 // Pack packs the Cmpp2DeliverReqPkt to bytes stream for client side.
 func (p *Cmpp2DeliverReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2DeliverReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2DeliverReqPkt) pack(w *packetWriter, seqId uint32) error {
+	if len(p.DestId) > 21 {
+		return ErrDestIdTooLong
+	}
+	if len(p.ServiceId) > 10 {
+		return ErrServiceIdTooLong
+	}
+
+	var err error
+	if p.MsgLength, err = msgLength(p.MsgContent); err != nil {
+		return err
+	}
+
 	var pktLen uint32 = CMPP_HEADER_LEN + 65 + uint32(p.MsgLength) + 8
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -134,7 +162,7 @@ func (p *Cmpp2DeliverReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteString(p.MsgContent)
 	w.WriteFixedSizeString(p.Reserve, 8)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2DeliverReqPkt variable.
@@ -144,42 +172,47 @@ func (p *Cmpp2DeliverReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
 	// Body
-	r.ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
 
-	destId := r.ReadCString(21)
-	p.DestId = string(destId)
+	p.DestId = r.at("DestId").ReadString(21)
 
-	serviceId := r.ReadCString(10)
-	p.ServiceId = string(serviceId)
+	p.ServiceId = r.at("ServiceId").ReadString(10)
 
-	p.TpPid = r.ReadByte()
-	p.TpUdhi = r.ReadByte()
-	p.MsgFmt = r.ReadByte()
+	p.TpPid = r.at("TpPid").ReadByte()
+	p.TpUdhi = r.at("TpUdhi").ReadByte()
+	p.MsgFmt = r.at("MsgFmt").ReadByte()
 
-	srcTerminalId := r.ReadCString(21)
-	p.SrcTerminalId = string(srcTerminalId)
+	p.SrcTerminalId = r.at("SrcTerminalId").ReadString(21)
 
-	p.RegisterDelivery = r.ReadByte()
-	p.MsgLength = r.ReadByte()
+	p.RegisterDelivery = r.at("RegisterDelivery").ReadByte()
+	p.MsgLength = r.at("MsgLength").ReadByte()
 
 	msgContent := make([]byte, p.MsgLength)
-	r.ReadBytes(msgContent)
+	r.at("MsgContent").ReadBytes(msgContent)
 	p.MsgContent = string(msgContent)
 
-	reserve := r.ReadCString(8)
-	p.Reserve = string(reserve)
+	p.Reserve = r.at("Reserve").ReadString(8)
 
-	return r.Error()
+	return r.unpackError(CMPP_DELIVER, p)
 }
 
 // Pack packs the Cmpp2DeliverRspPkt to bytes stream for client side.
 func (p *Cmpp2DeliverRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2DeliverRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2DeliverRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen uint32 = Cmpp2DeliverRspPktLen
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -191,7 +224,7 @@ func (p *Cmpp2DeliverRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, p.MsgId)
 	w.WriteByte(p.Result)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2DeliverRspPkt variable.
@@ -201,19 +234,43 @@ func (p *Cmpp2DeliverRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-	p.Result = r.ReadByte()
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	p.Result = r.at("Result").ReadByte()
 
-	return r.Error()
+	return r.unpackError(CMPP_DELIVER_RESP, p)
 }
 
 // Pack packs the Cmpp3DeliverReqPkt to bytes stream for client side.
 func (p *Cmpp3DeliverReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3DeliverReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3DeliverReqPkt) pack(w *packetWriter, seqId uint32) error {
+	if len(p.DestId) > 21 {
+		return ErrDestIdTooLong
+	}
+	if len(p.ServiceId) > 10 {
+		return ErrServiceIdTooLong
+	}
+	if len(p.LinkId) > 20 {
+		return ErrLinkIdTooLong
+	}
+
+	var err error
+	if p.MsgLength, err = msgLength(p.MsgContent); err != nil {
+		return err
+	}
+
 	var pktLen uint32 = CMPP_HEADER_LEN + 77 + uint32(p.MsgLength) + 20
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -235,7 +292,7 @@ func (p *Cmpp3DeliverReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteString(p.MsgContent)
 	w.WriteFixedSizeString(p.LinkId, 20)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp3DeliverReqPkt variable.
@@ -245,42 +302,47 @@ func (p *Cmpp3DeliverReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
 	// Body
-	r.ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
 
-	destId := r.ReadCString(21)
-	p.DestId = string(destId)
+	p.DestId = r.at("DestId").ReadString(21)
 
-	serviceId := r.ReadCString(10)
-	p.ServiceId = string(serviceId)
+	p.ServiceId = r.at("ServiceId").ReadString(10)
 
-	p.TpPid = r.ReadByte()
-	p.TpUdhi = r.ReadByte()
-	p.MsgFmt = r.ReadByte()
+	p.TpPid = r.at("TpPid").ReadByte()
+	p.TpUdhi = r.at("TpUdhi").ReadByte()
+	p.MsgFmt = r.at("MsgFmt").ReadByte()
 
-	srcTerminalId := r.ReadCString(32)
-	p.SrcTerminalId = string(srcTerminalId)
-	p.SrcTerminalType = r.ReadByte()
+	p.SrcTerminalId = r.at("SrcTerminalId").ReadString(32)
+	p.SrcTerminalType = r.at("SrcTerminalType").ReadByte()
 
-	p.RegisterDelivery = r.ReadByte()
-	p.MsgLength = r.ReadByte()
+	p.RegisterDelivery = r.at("RegisterDelivery").ReadByte()
+	p.MsgLength = r.at("MsgLength").ReadByte()
 
 	msgContent := make([]byte, p.MsgLength)
-	r.ReadBytes(msgContent)
+	r.at("MsgContent").ReadBytes(msgContent)
 	p.MsgContent = string(msgContent)
 
-	linkId := r.ReadCString(20)
-	p.LinkId = string(linkId)
+	p.LinkId = r.at("LinkId").ReadString(20)
 
-	return r.Error()
+	return r.unpackError(CMPP_DELIVER, p)
 }
 
 // Pack packs the Cmpp3DeliverRspPkt to bytes stream for client side.
 func (p *Cmpp3DeliverRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3DeliverRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3DeliverRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen uint32 = Cmpp3DeliverRspPktLen
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -292,7 +354,7 @@ func (p *Cmpp3DeliverRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, p.MsgId)
 	w.WriteInt(binary.BigEndian, p.Result)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp3DeliverRspPkt variable.
@@ -302,10 +364,116 @@ func (p *Cmpp3DeliverRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("Result").ReadInt(binary.BigEndian, &p.Result)
+
+	return r.unpackError(CMPP_DELIVER_RESP, p)
+}
+
+// IsReport reports whether p carries a status report rather
+// than a mobile originated message.
+func (p *Cmpp2DeliverReqPkt) IsReport() bool {
+	return p.RegisterDelivery == DeliverReport
+}
+
+// IsReport reports whether p carries a status report rather
+// than a mobile originated message.
+func (p *Cmpp3DeliverReqPkt) IsReport() bool {
+	return p.RegisterDelivery == DeliverReport
+}
+
+// RegisteredDelivery returns the Registered_Delivery flag of p, Report
+// if p carries a status report, or else NoReport.
+func (p *Cmpp2DeliverReqPkt) RegisteredDelivery() uint8 {
+	return p.RegisterDelivery
+}
+
+// RegisteredDelivery is like Cmpp2DeliverReqPkt.RegisteredDelivery.
+func (p *Cmpp3DeliverReqPkt) RegisteredDelivery() uint8 {
+	return p.RegisterDelivery
+}
+
+// Content returns the Msg_Content of p, exactly MsgLength bytes, like
+// Cmpp2SubmitReqPkt.Content.
+func (p *Cmpp2DeliverReqPkt) Content() []byte {
+	return contentBytes(p.MsgContent, p.MsgLength)
+}
+
+// Content returns the Msg_Content of p, exactly MsgLength bytes, like
+// Cmpp2SubmitReqPkt.Content.
+func (p *Cmpp3DeliverReqPkt) Content() []byte {
+	return contentBytes(p.MsgContent, p.MsgLength)
+}
+
+// String returns the text form of p, the MsgContent is hex encoded.
+func (p *Cmpp2DeliverReqPkt) String() string {
+	s := newPktString("Cmpp2DeliverReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.str("DestId", p.DestId)
+	s.str("ServiceId", p.ServiceId)
+	s.str("SrcTerminalId", p.SrcTerminalId)
+	s.uint("RegisterDelivery", uint64(p.RegisterDelivery))
+	s.uint("MsgFmt", uint64(p.MsgFmt))
+	s.uint("MsgLength", uint64(p.MsgLength))
+	s.hex("MsgContent", p.MsgContent)
+	return s.String()
+}
+
+// String returns the text form of p.
+func (p *Cmpp2DeliverRspPkt) String() string {
+	s := newPktString("Cmpp2DeliverRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.uint("Result", uint64(p.Result))
+	return s.String()
+}
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-	r.ReadInt(binary.BigEndian, &p.Result)
+// String returns the text form of p, the MsgContent is hex encoded.
+func (p *Cmpp3DeliverReqPkt) String() string {
+	s := newPktString("Cmpp3DeliverReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.str("DestId", p.DestId)
+	s.str("ServiceId", p.ServiceId)
+	s.str("SrcTerminalId", p.SrcTerminalId)
+	s.uint("RegisterDelivery", uint64(p.RegisterDelivery))
+	s.uint("MsgFmt", uint64(p.MsgFmt))
+	s.uint("MsgLength", uint64(p.MsgLength))
+	s.hex("MsgContent", p.MsgContent)
+	s.str("LinkId", p.LinkId)
+	return s.String()
+}
+
+// String returns the text form of p.
+func (p *Cmpp3DeliverRspPkt) String() string {
+	s := newPktString("Cmpp3DeliverRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.uint("Result", uint64(p.Result))
+	return s.String()
+}
 
-	return r.Error()
+// NewCmpp2DeliverRsp returns the response of req with result, its MsgId
+// and SeqId are the same as req. Send it with
+// conn.SendPkt(rsp, rsp.SeqId).
+func NewCmpp2DeliverRsp(req *Cmpp2DeliverReqPkt, result uint8) *Cmpp2DeliverRspPkt {
+	return &Cmpp2DeliverRspPkt{
+		MsgId:  req.MsgId,
+		Result: result,
+		SeqId:  req.SeqId,
+	}
+}
+
+// NewCmpp3DeliverRsp returns the response of req with result, its MsgId
+// and SeqId are the same as req. Send it with
+// conn.SendPkt(rsp, rsp.SeqId).
+func NewCmpp3DeliverRsp(req *Cmpp3DeliverReqPkt, result uint32) *Cmpp3DeliverRspPkt {
+	return &Cmpp3DeliverRspPkt{
+		MsgId:  req.MsgId,
+		Result: result,
+		SeqId:  req.SeqId,
+	}
 }
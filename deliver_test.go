@@ -382,3 +382,170 @@ func BenchmarkCmpp3DeliverReqPktUnpack(b *testing.B) {
 		p.Unpack(data)
 	}
 }
+
+func TestDeliverReqPktIsReport(t *testing.T) {
+	cases := []struct {
+		registerDelivery uint8
+		expected         bool
+	}{
+		{cmpp.DeliverMsg, false},
+		{cmpp.DeliverReport, true},
+	}
+
+	for _, cs := range cases {
+		p2 := &cmpp.Cmpp2DeliverReqPkt{RegisterDelivery: cs.registerDelivery}
+		if p2.IsReport() != cs.expected {
+			t.Fatalf("Cmpp2DeliverReqPkt IsReport is %v, not equal to expected: %v\n", p2.IsReport(), cs.expected)
+		}
+
+		p3 := &cmpp.Cmpp3DeliverReqPkt{RegisterDelivery: cs.registerDelivery}
+		if p3.IsReport() != cs.expected {
+			t.Fatalf("Cmpp3DeliverReqPkt IsReport is %v, not equal to expected: %v\n", p3.IsReport(), cs.expected)
+		}
+	}
+}
+
+func TestDeliverReqPktRegisteredDelivery(t *testing.T) {
+	// a receipt with stat DELIVRD.
+	receipt := &cmpp.CmppReceiptPkt{MsgId: 13025908756704198656, Stat: "DELIVRD",
+		SubmitTime: "1511120955", DoneTime: "1511120957", DestTerminalId: "13412340000"}
+	content, err := receipt.Pack()
+	if err != nil {
+		t.Fatal("Pack receipt error:", err)
+	}
+
+	for _, flag := range []uint8{cmpp.Report, cmpp.NoReport} {
+		p := &cmpp.Cmpp3DeliverReqPkt{RegisterDelivery: flag, MsgContent: string(content)}
+		data, err := p.Pack(seqId)
+		if err != nil {
+			t.Fatal("Cmpp3DeliverReqPkt pack error:", err)
+		}
+
+		var u cmpp.Cmpp3DeliverReqPkt
+		if err = u.Unpack(data[8:]); err != nil {
+			t.Fatal("Cmpp3DeliverReqPkt unpack error:", err)
+		}
+		if u.RegisteredDelivery() != flag {
+			t.Fatalf("After unpack, RegisteredDelivery is %d, not equal to expected: %d\n", u.RegisteredDelivery(), flag)
+		}
+
+		// the receipt is only parsed when the report flag is set,
+		// though the content looks like a receipt.
+		r, err := u.Receipt()
+		if flag == cmpp.NoReport {
+			if err != cmpp.ErrNotReceipt {
+				t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrNotReceipt)
+			}
+			continue
+		}
+		if err != nil || r.Stat != "DELIVRD" {
+			t.Fatalf("The receipt is %#v(%v), not the expected one of stat DELIVRD\n", r, err)
+		}
+	}
+}
+
+func TestDeliverReqPktFieldLength(t *testing.T) {
+	cases := []struct {
+		destId    string
+		serviceId string
+		err       error
+	}{
+		{"900001234567890123456", "abcdefghij", nil},
+		{"900001", "abc", nil},
+		{"9000012345678901234567", "abc", cmpp.ErrDestIdTooLong},
+		{"900001", "abcdefghijk", cmpp.ErrServiceIdTooLong},
+	}
+
+	for _, cs := range cases {
+		p2 := &cmpp.Cmpp2DeliverReqPkt{DestId: cs.destId, ServiceId: cs.serviceId}
+		if _, err := p2.Pack(seqId); err != cs.err {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cs.err)
+		}
+
+		p3 := &cmpp.Cmpp3DeliverReqPkt{DestId: cs.destId, ServiceId: cs.serviceId}
+		if _, err := p3.Pack(seqId); err != cs.err {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cs.err)
+		}
+	}
+}
+
+func TestCmpp3DeliverReqPktLinkId(t *testing.T) {
+	linkId := "12345678901234567890" // the full 20 bytes
+	p := &cmpp.Cmpp3DeliverReqPkt{MsgLength: 2, MsgContent: "mo", LinkId: linkId}
+	data, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp3DeliverReqPkt pack error:", err)
+	}
+
+	var p1 cmpp.Cmpp3DeliverReqPkt
+	if err = p1.Unpack(data[8:]); err != nil {
+		t.Fatal("Cmpp3DeliverReqPkt unpack error:", err)
+	}
+	if p1.LinkId != linkId || p1.MsgContent != "mo" {
+		t.Fatalf("After unpack, LinkId, MsgContent are %q, %q, not equal to expected: %q, %q\n",
+			p1.LinkId, p1.MsgContent, linkId, "mo")
+	}
+
+	p.LinkId = linkId + "1"
+	if _, err = p.Pack(seqId); err != cmpp.ErrLinkIdTooLong {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrLinkIdTooLong)
+	}
+}
+
+func TestNewDeliverRsp(t *testing.T) {
+	req2 := &cmpp.Cmpp2DeliverReqPkt{MsgId: 12878564852733378560, SeqId: seqId}
+	rsp2 := cmpp.NewCmpp2DeliverRsp(req2, 0)
+	if rsp2.SeqId != seqId || rsp2.MsgId != req2.MsgId || rsp2.Result != 0 {
+		t.Fatalf("The response is %#v, not matched with the request %#v\n", rsp2, req2)
+	}
+
+	req3 := &cmpp.Cmpp3DeliverReqPkt{MsgId: 12878564852733378560, SeqId: seqId}
+	rsp3 := cmpp.NewCmpp3DeliverRsp(req3, 0)
+	if rsp3.SeqId != seqId || rsp3.MsgId != req3.MsgId || rsp3.Result != 0 {
+		t.Fatalf("The response is %#v, not matched with the request %#v\n", rsp3, req3)
+	}
+}
+
+func TestDeliverReqPktMsgLength(t *testing.T) {
+	// Msg_Length is 1 byte in both versions, followed by exactly Msg_Length
+	// bytes of Msg_Content, then Reserved(8 bytes) of cmpp2 or LinkID(20
+	// bytes) of cmpp3.
+	cases := []struct {
+		p       cmpp.Packer
+		tailLen int
+	}{
+		{&cmpp.Cmpp2DeliverReqPkt{MsgContent: "mo", Reserve: "abc"}, 8},
+		{&cmpp.Cmpp3DeliverReqPkt{MsgContent: "mo", LinkId: "abc"}, 20},
+	}
+
+	for _, cs := range cases {
+		data, err := cs.p.Pack(seqId)
+		if err != nil {
+			t.Fatalf("%T pack error: %v\n", cs.p, err)
+		}
+		pos := len(data) - cs.tailLen - len("mo") - 1
+		if data[pos] != 2 || string(data[pos+1:pos+3]) != "mo" {
+			t.Fatalf("The Msg_Length and Msg_Content packed are %x, not equal to expected: %x\n",
+				data[pos:pos+3], "\x02mo")
+		}
+
+		var content, tail string
+		switch cs.p.(type) {
+		case *cmpp.Cmpp2DeliverReqPkt:
+			var p1 cmpp.Cmpp2DeliverReqPkt
+			err = p1.Unpack(data[8:])
+			content, tail = p1.MsgContent, p1.Reserve
+		case *cmpp.Cmpp3DeliverReqPkt:
+			var p1 cmpp.Cmpp3DeliverReqPkt
+			err = p1.Unpack(data[8:])
+			content, tail = p1.MsgContent, p1.LinkId
+		}
+		if err != nil {
+			t.Fatalf("%T unpack error: %v\n", cs.p, err)
+		}
+		if content != "mo" || tail != "abc" {
+			t.Fatalf("After unpack, the content and the field following it are %q, %q, not equal to expected: %q, %q\n",
+				content, tail, "mo", "abc")
+		}
+	}
+}
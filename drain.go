@@ -0,0 +1,254 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrConnDraining is returned by SendPkt for a submit request
+// once the Conn is being drained.
+var ErrConnDraining = errors.New("connection is draining")
+
+// drainer tracks the submit requests in flight, those have been sent
+// but the response of which has not been received, for Conn.Drain.
+// A request is given up once it is in flight for ttl, so a lost
+// response neither leaks nor holds up Drain.
+type drainer struct {
+	sync.Mutex
+	ttl      time.Duration // DefaultSubmitTimeout if zero, see WithInflightTTL
+	draining bool
+	closed   bool
+	inflight map[uint32]time.Time // the time each request is given up
+	pruned   time.Time            // the last time the expired ones are removed
+	idle     chan struct{}        // closed once inflight is empty, for Drain
+	expire   *time.Timer          // prunes the expired ones while Drain waits
+
+	termSeqId  uint32
+	termRsp    chan struct{} // closed once the terminate response is received or the Conn is closed
+	terminated bool
+}
+
+// add records the submit request with seqId as in flight, it fails
+// if the Conn is being drained.
+func (d *drainer) add(seqId uint32) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.draining {
+		return ErrConnDraining
+	}
+	if d.inflight == nil {
+		d.inflight = make(map[uint32]time.Time)
+	}
+	now := time.Now()
+	if now.Sub(d.pruned) >= d.lifetime() {
+		d.prune(now)
+	}
+	d.inflight[seqId] = now.Add(d.lifetime())
+	return nil
+}
+
+func (d *drainer) lifetime() time.Duration {
+	if d.ttl <= 0 {
+		return DefaultSubmitTimeout
+	}
+	return d.ttl
+}
+
+// prune removes the requests in flight for ttl, and returns the time the
+// next one expires, zero if none is left. d must be locked.
+func (d *drainer) prune(now time.Time) time.Time {
+	d.pruned = now
+	var next time.Time
+	for seqId, t := range d.inflight {
+		if !t.After(now) {
+			delete(d.inflight, seqId)
+		} else if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	d.wakeIdle()
+	return next
+}
+
+// wakeIdle wakes up Drain if no request is in flight. d must be locked.
+func (d *drainer) wakeIdle() {
+	if len(d.inflight) == 0 && d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+}
+
+// expired is run by the expire timer while Drain waits.
+func (d *drainer) expired() {
+	d.Lock()
+	defer d.Unlock()
+	if d.idle == nil {
+		return
+	}
+	if next := d.prune(time.Now()); !next.IsZero() {
+		d.expire.Reset(time.Until(next))
+	}
+}
+
+func (d *drainer) isDraining() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.draining
+}
+
+// done removes the submit request with seqId, whose response is received,
+// failed to be sent or given up by the submit window.
+func (d *drainer) done(seqId uint32) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.inflight, seqId)
+	d.wakeIdle()
+}
+
+// start stops accepting new submit requests, the returned channel
+// is closed once no submit request is in flight.
+func (d *drainer) start() <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	d.draining = true
+	ch := make(chan struct{})
+	next := d.prune(time.Now())
+	if len(d.inflight) == 0 || d.closed {
+		close(ch)
+	} else {
+		d.idle = ch
+		d.expire = time.AfterFunc(time.Until(next), d.expired)
+	}
+	return ch
+}
+
+func (d *drainer) pending() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.inflight)
+}
+
+// waitTerminate returns a channel which is closed once the terminate
+// response with seqId is received.
+func (d *drainer) waitTerminate(seqId uint32) <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	ch := make(chan struct{})
+	if d.closed {
+		close(ch)
+	} else {
+		d.termSeqId, d.termRsp = seqId, ch
+	}
+	return ch
+}
+
+func (d *drainer) ackTerminate(seqId uint32) {
+	d.Lock()
+	defer d.Unlock()
+	if d.termRsp != nil && d.termSeqId == seqId {
+		d.terminated = true
+		close(d.termRsp)
+		d.termRsp = nil
+	}
+}
+
+// close wakes up the waiting Drain as the Conn is closed.
+func (d *drainer) close() {
+	d.Lock()
+	defer d.Unlock()
+	d.closed = true
+	if d.expire != nil {
+		d.expire.Stop()
+	}
+	if d.idle != nil {
+		close(d.idle)
+		d.idle = nil
+	}
+	if d.termRsp != nil {
+		close(d.termRsp)
+		d.termRsp = nil
+	}
+}
+
+func (d *drainer) isTerminated() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.terminated
+}
+
+// Drain shuts down c without losing the submit requests in flight. It
+// stops new submit requests at once, SendPkt fails with ErrConnDraining for
+// them, waits until the responses of all the outstanding submit requests are
+// received, then terminates the connection with the terminate handshake and
+// closes it. Other packets, e.g. the deliver responses, can still be sent.
+//
+// Drain does not read from c: another goroutine must keep calling
+// RecvAndUnpackPkt meanwhile, which receives the submit responses and the
+// terminate response as usual. Submit requests whose slots are reclaimed
+// by the submit window, see WithSubmitWindow, and those in flight for longer
+// than the ttl of WithInflightTTL are not waited for.
+//
+// If it can not be done within timeout(zero means no deadline), c is closed
+// anyway and os.ErrDeadlineExceeded is returned.
+func (c *Conn) Drain(timeout time.Duration) error {
+	defer c.Close()
+
+	if c.GetState() == CONN_CLOSED {
+		return ErrConnIsClosed
+	}
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	deadline := time.Now().Add(timeout)
+
+	select {
+	case <-c.drain.start():
+	case <-expired:
+		c.log().Errorf("cmpp: drain timeout, %d submit responses are not received", c.drain.pending())
+		return os.ErrDeadlineExceeded
+	}
+	if c.drain.pending() != 0 {
+		return ErrConnIsClosed // woken up by Close.
+	}
+
+	seqId := c.NextSeqId()
+	rsp := c.drain.waitTerminate(seqId)
+	var err error
+	if timeout != 0 {
+		err = c.SendPktTimeout(&CmppTerminateReqPkt{}, seqId, time.Until(deadline))
+	} else {
+		err = c.SendPkt(&CmppTerminateReqPkt{}, seqId)
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-rsp:
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+	if !c.drain.isTerminated() {
+		return ErrConnIsClosed
+	}
+	return nil
+}
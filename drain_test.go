@@ -0,0 +1,267 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestConnDrain(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+
+	// the peer answers the submit requests late, and the terminate request.
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			switch p := i.(type) {
+			case *cmpp.Cmpp3SubmitReqPkt:
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					peer.SendPkt(&cmpp.Cmpp3SubmitRspPkt{}, p.SeqId)
+				}()
+			case *cmpp.CmppTerminateReqPkt:
+				peer.SendPkt(&cmpp.CmppTerminateRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(8, 0))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	var rsps atomic.Int32
+	go func() {
+		for {
+			i, err := c.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if _, ok := i.(*cmpp.Cmpp3SubmitRspPkt); ok {
+				rsps.Add(1)
+			}
+		}
+	}()
+
+	for i := 1; i <= 3; i++ {
+		err := c.SendPkt(newSubmitReqPkt(), uint32(i))
+		if err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- c.Drain(time.Second)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	err := c.SendPkt(newSubmitReqPkt(), 4)
+	if err != cmpp.ErrConnDraining {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrConnDraining)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal("Drain error:", err)
+	}
+	if n := rsps.Load(); n != 3 {
+		t.Fatalf("The count of submit responses is %d, not equal to expected: %d\n", n, 3)
+	}
+	if s := c.GetState(); s != cmpp.CONN_CLOSED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", s, cmpp.CONN_CLOSED)
+	}
+}
+
+func TestConnDrainTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2) // the peer never answers.
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := c.SendPkt(newSubmitReqPkt(), 1)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	err = c.Drain(50 * time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, os.ErrDeadlineExceeded)
+	}
+	if s := c.GetState(); s != cmpp.CONN_CLOSED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", s, cmpp.CONN_CLOSED)
+	}
+}
+
+func TestConnDrainWindowReclaimed(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+
+	// the peer drops the submit requests, but answers the terminate request.
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if p, ok := i.(*cmpp.CmppTerminateReqPkt); ok {
+				peer.SendPkt(&cmpp.CmppTerminateRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(2, 50*time.Millisecond))
+	c.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := c.SendPkt(newSubmitReqPkt(), 1)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	// the slot reclaimed by the window is not waited for.
+	err = c.Drain(time.Second)
+	if err != nil {
+		t.Fatal("Drain error:", err)
+	}
+}
+
+func TestConnDrainCloseAmidRecv(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			switch p := i.(type) {
+			case *cmpp.Cmpp3SubmitReqPkt:
+				peer.SendPkt(&cmpp.Cmpp3SubmitRspPkt{}, p.SeqId)
+			case *cmpp.CmppTerminateReqPkt:
+				peer.SendPkt(&cmpp.CmppTerminateRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(8, 0))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// the deferred Close of Drain runs while this goroutine is still in
+	// RecvAndUnpackPkt, it must be clean under -race.
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				recvErr <- err
+				return
+			}
+		}
+	}()
+
+	err := c.SendPkt(newSubmitReqPkt(), 1)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	err = c.Drain(time.Second)
+	if err != nil {
+		t.Fatal("Drain error:", err)
+	}
+
+	select {
+	case <-recvErr:
+	case <-time.After(time.Second):
+		t.Fatal("RecvAndUnpackPkt does not return after Drain")
+	}
+}
+
+func TestConnDrainInflightTTL(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+
+	// the peer drops the submit requests, but answers the terminate request.
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if p, ok := i.(*cmpp.CmppTerminateReqPkt); ok {
+				peer.SendPkt(&cmpp.CmppTerminateRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithInflightTTL(50*time.Millisecond))
+	c.SetState(cmpp.CONN_AUTHOK)
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	err := c.SendPkt(newSubmitReqPkt(), 1)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	// the submit whose response is lost is given up after the ttl.
+	start := time.Now()
+	err = c.Drain(time.Second)
+	if err != nil {
+		t.Fatal("Drain error:", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("Drain returns after %v, later than the ttl\n", d)
+	}
+}
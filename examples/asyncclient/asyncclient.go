@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+const (
+	user           string        = "900001"
+	password       string        = "888888"
+	connectTimeout time.Duration = time.Second * 2
+
+	submits = 1000
+)
+
+func main() {
+	log.Println("Async client example start!")
+
+	// at most 64 submits are in flight, the others wait for the window.
+	c := cmpp.NewClientWithOptions(cmpp.V30, cmpp.WithSubmitWindow(64, 10*time.Second))
+	err := c.Connect(":8888", user, password, connectTimeout)
+	if err != nil {
+		log.Printf("connect error: %s.", err)
+		return
+	}
+	defer c.Disconnect()
+	log.Printf("connect and auth ok")
+
+	// the submit responses are received here and passed to
+	// the channels returned by SubmitAsync.
+	go func() {
+		for {
+			i, err := c.RecvAndUnpackPkt(0)
+			if err != nil {
+				log.Printf("client read and unpack pkt error: %s.", err)
+				return
+			}
+
+			if p, ok := i.(*cmpp.CmppActiveTestReqPkt); ok {
+				c.SendRspPkt(&cmpp.CmppActiveTestRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var ok, failed int
+	start := time.Now()
+	for i := 0; i < submits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := &cmpp.Cmpp3SubmitReqPkt{
+				RegisteredDelivery: 1,
+				ServiceId:          "test",
+				FeeUserType:        2,
+				FeeTerminalId:      "13500002696",
+				MsgFmt:             cmpp.MsgFmtASCII,
+				MsgSrc:             "900001",
+				FeeType:            "02",
+				FeeCode:            "10",
+				SrcId:              "900001",
+				DestTerminalId:     []string{"13500002696"},
+				MsgLength:          12,
+				MsgContent:         "hello gocmpp",
+			}
+
+			ch, err := c.SubmitAsync(p)
+			if err != nil {
+				log.Printf("send a cmpp3 submit request error: %s.", err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+
+			r := <-ch
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Err != nil || r.Result != 0 {
+				log.Printf("the cmpp3 submit request[%d] fails: %v, result %d.", r.SeqId, r.Err, r.Result)
+				failed++
+				return
+			}
+			ok++
+		}()
+	}
+	wg.Wait()
+
+	log.Printf("%d submits ok, %d failed in %v.", ok, failed, time.Since(start))
+	log.Println("Async client example ends!")
+}
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
 	"log"
 	"time"
 
 	"github.com/bigwhite/gocmpp"
-	"github.com/bigwhite/gocmpp/utils"
 )
 
 const (
@@ -35,24 +32,14 @@ func handleLogin(r *cmpp.Response, p *cmpp.Packet, l *log.Logger) (bool, error)
 		return false, cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnInvalidSrcAddr]
 	}
 
-	tm := req.Timestamp
-	authSrc := md5.Sum(bytes.Join([][]byte{[]byte(userS),
-		make([]byte, 9),
-		[]byte(passwordS),
-		[]byte(cmpputils.TimeStamp2Str(tm))},
-		nil))
-
-	if req.AuthSrc != string(authSrc[:]) {
+	if !cmpp.VerifyAuthenticator(req, passwordS) {
 		l.Println("handleLogin error: ", cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnAuthFailed])
 		resp.Status = uint32(cmpp.ErrnoConnAuthFailed)
 		return false, cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnAuthFailed]
 	}
 
-	authIsmg := md5.Sum(bytes.Join([][]byte{[]byte{byte(resp.Status)},
-		authSrc[:],
-		[]byte(passwordS)},
-		nil))
-	resp.AuthIsmg = string(authIsmg[:])
+	resp.AuthSrc = req.AuthSrc
+	resp.Secret = passwordS
 	l.Printf("handleLogin: %s login ok\n", addr)
 
 	return false, nil
@@ -0,0 +1,117 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Values of Fee_UserType in submit request, which tells the user
+// to be charged for the message.
+const (
+	FeeUserDest     uint8 = 0 // the dest terminal
+	FeeUserSrc      uint8 = 1 // the src terminal
+	FeeUserSP       uint8 = 2 // the SP
+	FeeUserTerminal uint8 = 3 // the Fee_terminal_Id
+)
+
+// Values of FeeType in submit request.
+const (
+	FeeTypeFree    = "01" // free for the charged user
+	FeeTypeMessage = "02" // charged by message, Fee_Code per message
+	FeeTypeMonthly = "03" // charged monthly, Fee_Code per month
+	FeeTypeCapped  = "04" // charged by message and capped at Fee_Code
+	FeeTypeSP      = "05" // charged by the SP itself
+)
+
+// Values of Fee_terminal_type in cmpp3 submit request.
+const (
+	FeeTerminalReal   uint8 = 0 // Fee_terminal_Id is a real msisdn
+	FeeTerminalPseudo uint8 = 1 // Fee_terminal_Id is a pseudo code
+)
+
+// ErrFeeInfoInvalid is the cause of the OpError returned by FeeInfo.Validate.
+var ErrFeeInfoInvalid = errors.New("fee info is invalid")
+
+// FeeInfo is the billing fields of a submit request.
+//
+// The Fee_terminal_Id is used only when FeeUserType is FeeUserTerminal,
+// and then it is required. FeeCode is the fee in fen, up to 6 digits,
+// it must be zero or empty for FeeTypeFree, and not zero for
+// FeeTypeMessage, FeeTypeMonthly and FeeTypeCapped.
+// FeeTerminalType is supported by cmpp3 only.
+type FeeInfo struct {
+	FeeUserType     uint8
+	FeeType         string
+	FeeCode         string
+	FeeTerminalId   string
+	FeeTerminalType uint8 // cmpp3 only
+}
+
+func invalidFeeInfo(desc string) error {
+	return NewOpError(ErrFeeInfoInvalid, "FeeInfo: "+desc)
+}
+
+// Validate checks whether the fields of f are compatible with each other
+// and with the protocol version typ.
+func (f FeeInfo) Validate(typ Type) error {
+	termIdLen := 21
+	if typ == V30 {
+		termIdLen = 32
+	}
+
+	switch {
+	case f.FeeUserType > FeeUserTerminal:
+		return invalidFeeInfo("unknown FeeUserType " + strconv.Itoa(int(f.FeeUserType)))
+	case f.FeeUserType == FeeUserTerminal && f.FeeTerminalId == "":
+		return invalidFeeInfo("FeeTerminalId is required by FeeUserType 3")
+	case f.FeeUserType != FeeUserTerminal && f.FeeTerminalId != "":
+		return invalidFeeInfo("FeeTerminalId is set but FeeUserType is not 3")
+	case len(f.FeeTerminalId) > termIdLen:
+		return invalidFeeInfo("FeeTerminalId is too long for " + typ.String())
+	case typ != V30 && f.FeeTerminalType != FeeTerminalReal:
+		return invalidFeeInfo("FeeTerminalType is not supported by " + typ.String())
+	case f.FeeTerminalType > FeeTerminalPseudo:
+		return invalidFeeInfo("unknown FeeTerminalType " + strconv.Itoa(int(f.FeeTerminalType)))
+	case f.FeeTerminalType == FeeTerminalPseudo && f.FeeTerminalId == "":
+		return invalidFeeInfo("FeeTerminalId is required by the pseudo FeeTerminalType")
+	}
+
+	var fee uint64
+	if f.FeeCode != "" {
+		var err error
+		if len(f.FeeCode) > 6 {
+			return invalidFeeInfo("FeeCode is longer than 6 digits")
+		}
+		if fee, err = strconv.ParseUint(f.FeeCode, 10, 32); err != nil {
+			return invalidFeeInfo("FeeCode " + f.FeeCode + " is not a number")
+		}
+	}
+
+	switch f.FeeType {
+	case FeeTypeFree:
+		if fee != 0 {
+			return invalidFeeInfo("FeeCode of the free FeeType is not zero")
+		}
+	case FeeTypeMessage, FeeTypeMonthly, FeeTypeCapped:
+		if fee == 0 {
+			return invalidFeeInfo("FeeCode of FeeType " + f.FeeType + " is zero")
+		}
+	case FeeTypeSP:
+	default:
+		return invalidFeeInfo("unknown FeeType " + strconv.Quote(f.FeeType))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestFeeInfoValidate(t *testing.T) {
+	cases := []struct {
+		typ   cmpp.Type
+		f     cmpp.FeeInfo
+		valid bool
+	}{
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree}, true},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeCode: "000000"}, true},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeMessage, FeeCode: "10"}, true},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeMonthly, FeeCode: "500", FeeUserType: cmpp.FeeUserSP}, true},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeSP}, true},
+		{cmpp.V21, cmpp.FeeInfo{FeeType: cmpp.FeeTypeCapped, FeeCode: "100",
+			FeeUserType: cmpp.FeeUserTerminal, FeeTerminalId: "13500002696"}, true},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeMessage, FeeCode: "10",
+			FeeUserType: cmpp.FeeUserTerminal, FeeTerminalId: "pseudo", FeeTerminalType: cmpp.FeeTerminalPseudo}, true},
+
+		// contradictory combinations
+		{cmpp.V30, cmpp.FeeInfo{}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: "06"}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeCode: "10"}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeMessage}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeMessage, FeeCode: "1234567"}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeMessage, FeeCode: "1a"}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeUserType: 4}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeUserType: cmpp.FeeUserTerminal}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeTerminalId: "13500002696"}, false},
+		{cmpp.V21, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeUserType: cmpp.FeeUserTerminal,
+			FeeTerminalId: "1350000269613500002696"}, false},
+		{cmpp.V21, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeUserType: cmpp.FeeUserTerminal,
+			FeeTerminalId: "pseudo", FeeTerminalType: cmpp.FeeTerminalPseudo}, false},
+		{cmpp.V30, cmpp.FeeInfo{FeeType: cmpp.FeeTypeFree, FeeTerminalType: cmpp.FeeTerminalPseudo}, false},
+	}
+
+	for i, cs := range cases {
+		err := cs.f.Validate(cs.typ)
+		if cs.valid {
+			if err != nil {
+				t.Fatalf("case %d: Validate error: %v\n", i, err)
+			}
+			continue
+		}
+
+		e, ok := err.(*cmpp.OpError)
+		if !ok || e.Cause() != cmpp.ErrFeeInfoInvalid {
+			t.Fatalf("case %d: the error is %#v, not the expected OpError of ErrFeeInfoInvalid\n", i, err)
+		}
+	}
+}
+
+func TestNewSubmitFeeInfo(t *testing.T) {
+	params := cmpp.SubmitParams{
+		FeeType:        cmpp.FeeTypeFree,
+		FeeCode:        "10",
+		MsgSrc:         "900001",
+		DestTerminalId: []string{"13500002696"},
+	}
+
+	_, err := cmpp.NewSubmit(cmpp.V30, params)
+	if e, ok := err.(*cmpp.OpError); !ok || e.Cause() != cmpp.ErrFeeInfoInvalid {
+		t.Fatalf("The error is %#v, not the expected OpError of ErrFeeInfoInvalid\n", err)
+	}
+}
@@ -156,8 +156,17 @@ type Cmpp3FwdRspPkt struct {
 // Before calling Pack, you should initialize a Cmpp2FwdReqPkt variable
 // with correct field value.
 func (p *Cmpp2FwdReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2FwdReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2FwdReqPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen uint32 = CMPP_HEADER_LEN + 131 + uint32(p.DestUsrTl)*21 + 1 + uint32(p.MsgLength) + 8
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -186,8 +195,8 @@ func (p *Cmpp2FwdReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.TpPid)
 	w.WriteByte(p.TpUdhi)
 	w.WriteByte(p.MsgFmt)
-	w.WriteFixedSizeString(p.MsgSrc, 6)
-	w.WriteString(p.FeeType)
+	w.WriteFixedSizeString(p.MsgSrc, MsgSrcLen)
+	w.WriteFixedSizeString(p.FeeType, 2)
 	w.WriteFixedSizeString(p.FeeCode, 6)
 	w.WriteFixedSizeString(p.ValidTime, 17)
 	w.WriteFixedSizeString(p.AtTime, 17)
@@ -200,7 +209,7 @@ func (p *Cmpp2FwdReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteString(p.MsgContent)
 	w.WriteFixedSizeString(p.Reserve, 8)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2FwdReqPkt variable.
@@ -209,73 +218,69 @@ func (p *Cmpp2FwdReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
-
-	sourceId := r.ReadCString(6)
-	p.SourceId = string(sourceId)
-	destinationId := r.ReadCString(6)
-	p.DestinationId = string(destinationId)
-	p.NodesCount = r.ReadByte()
-	p.MsgFwdType = r.ReadByte()
-
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-
-	p.PkTotal = r.ReadByte()
-	p.PkNumber = r.ReadByte()
-	p.RegisteredDelivery = r.ReadByte()
-	p.MsgLevel = r.ReadByte()
-	serviceId := r.ReadCString(10)
-	p.ServiceId = string(serviceId)
-	p.FeeUserType = r.ReadByte()
-	feeTerminalId := r.ReadCString(21)
-	p.FeeTerminalId = string(feeTerminalId)
-	p.TpPid = r.ReadByte()
-	p.TpUdhi = r.ReadByte()
-	p.MsgFmt = r.ReadByte()
-
-	msgSrc := r.ReadCString(6)
-	p.MsgSrc = string(msgSrc)
-
-	feeType := make([]byte, 2)
-	r.ReadBytes(feeType)
-	p.FeeType = string(feeType)
-
-	feeCode := r.ReadCString(6)
-	p.FeeCode = string(feeCode)
-
-	validTime := r.ReadCString(17)
-	p.ValidTime = string(validTime)
-
-	atTime := r.ReadCString(17)
-	p.AtTime = string(atTime)
-
-	srcId := r.ReadCString(21)
-	p.SrcId = string(srcId)
-
-	p.DestUsrTl = r.ReadByte()
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	p.SourceId = r.at("SourceId").ReadString(6)
+	p.DestinationId = r.at("DestinationId").ReadString(6)
+	p.NodesCount = r.at("NodesCount").ReadByte()
+	p.MsgFwdType = r.at("MsgFwdType").ReadByte()
+
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+
+	p.PkTotal = r.at("PkTotal").ReadByte()
+	p.PkNumber = r.at("PkNumber").ReadByte()
+	p.RegisteredDelivery = r.at("RegisteredDelivery").ReadByte()
+	p.MsgLevel = r.at("MsgLevel").ReadByte()
+	p.ServiceId = r.at("ServiceId").ReadString(10)
+	p.FeeUserType = r.at("FeeUserType").ReadByte()
+	p.FeeTerminalId = r.at("FeeTerminalId").ReadString(21)
+	p.TpPid = r.at("TpPid").ReadByte()
+	p.TpUdhi = r.at("TpUdhi").ReadByte()
+	p.MsgFmt = r.at("MsgFmt").ReadByte()
+
+	p.MsgSrc = r.at("MsgSrc").ReadString(MsgSrcLen)
+
+	p.FeeType = r.at("FeeType").ReadString(2)
+
+	p.FeeCode = r.at("FeeCode").ReadString(6)
+
+	p.ValidTime = r.at("ValidTime").ReadString(17)
+
+	p.AtTime = r.at("AtTime").ReadString(17)
+
+	p.SrcId = r.at("SrcId").ReadString(21)
+
+	p.DestUsrTl = r.at("DestUsrTl").ReadByte()
 	for i := 0; i < int(p.DestUsrTl); i++ {
-		destId := r.ReadCString(21)
-		p.DestId = append(p.DestId, string(destId))
+		p.DestId = append(p.DestId, r.at("DestId").ReadString(21))
 	}
 
-	p.MsgLength = r.ReadByte()
+	p.MsgLength = r.at("MsgLength").ReadByte()
 
 	msgContent := make([]byte, p.MsgLength)
-	r.ReadBytes(msgContent)
+	r.at("MsgContent").ReadBytes(msgContent)
 	p.MsgContent = string(msgContent)
 
-	reserve := r.ReadCString(8)
-	p.Reserve = string(reserve)
+	p.Reserve = r.at("Reserve").ReadString(8)
 
-	return r.Error()
+	return r.unpackError(CMPP_FWD, p)
 }
 
 // Pack packs the Cmpp2FwdRspPkt to bytes stream for server side.
 // Before calling Pack, you should initialize a Cmpp2FwdRspPkt variable
 // with correct field value.
 func (p *Cmpp2FwdRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2FwdRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2FwdRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen = Cmpp2FwdRspPktLen
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -289,7 +294,7 @@ func (p *Cmpp2FwdRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.PkNumber)
 	w.WriteByte(p.Result)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2FwdRspPkt variable.
@@ -298,23 +303,32 @@ func (p *Cmpp2FwdRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-	p.PkTotal = r.ReadByte()
-	p.PkNumber = r.ReadByte()
-	p.Result = r.ReadByte()
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	p.PkTotal = r.at("PkTotal").ReadByte()
+	p.PkNumber = r.at("PkNumber").ReadByte()
+	p.Result = r.at("Result").ReadByte()
 
-	return r.Error()
+	return r.unpackError(CMPP_FWD_RESP, p)
 }
 
 // Pack packs the Cmpp3FwdReqPkt to bytes stream for client side.
 // Before calling Pack, you should initialize a Cmpp3FwdReqPkt variable
 // with correct field value.
 func (p *Cmpp3FwdReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3FwdReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3FwdReqPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen uint32 = CMPP_HEADER_LEN + 198 + uint32(p.DestUsrTl)*21 + 32 + 1 + 1 + uint32(p.MsgLength) + 20
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -344,8 +358,8 @@ func (p *Cmpp3FwdReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.TpPid)
 	w.WriteByte(p.TpUdhi)
 	w.WriteByte(p.MsgFmt)
-	w.WriteFixedSizeString(p.MsgSrc, 6)
-	w.WriteString(p.FeeType)
+	w.WriteFixedSizeString(p.MsgSrc, MsgSrcLen)
+	w.WriteFixedSizeString(p.FeeType, 2)
 	w.WriteFixedSizeString(p.FeeCode, 6)
 	w.WriteFixedSizeString(p.ValidTime, 17)
 	w.WriteFixedSizeString(p.AtTime, 17)
@@ -364,7 +378,7 @@ func (p *Cmpp3FwdReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteString(p.MsgContent)
 	w.WriteFixedSizeString(p.LinkId, 20)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp3FwdReqPkt variable.
@@ -373,88 +387,81 @@ func (p *Cmpp3FwdReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
 	// Body
-	sourceId := r.ReadCString(6)
-	p.SourceId = string(sourceId)
-	destinationId := r.ReadCString(6)
-	p.DestinationId = string(destinationId)
-	p.NodesCount = r.ReadByte()
-	p.MsgFwdType = r.ReadByte()
+	p.SourceId = r.at("SourceId").ReadString(6)
+	p.DestinationId = r.at("DestinationId").ReadString(6)
+	p.NodesCount = r.at("NodesCount").ReadByte()
+	p.MsgFwdType = r.at("MsgFwdType").ReadByte()
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
 
-	p.PkTotal = r.ReadByte()
-	p.PkNumber = r.ReadByte()
-	p.RegisteredDelivery = r.ReadByte()
-	p.MsgLevel = r.ReadByte()
+	p.PkTotal = r.at("PkTotal").ReadByte()
+	p.PkNumber = r.at("PkNumber").ReadByte()
+	p.RegisteredDelivery = r.at("RegisteredDelivery").ReadByte()
+	p.MsgLevel = r.at("MsgLevel").ReadByte()
 
-	serviceId := r.ReadCString(10)
-	p.ServiceId = string(serviceId)
+	p.ServiceId = r.at("ServiceId").ReadString(10)
 
-	p.FeeUserType = r.ReadByte()
+	p.FeeUserType = r.at("FeeUserType").ReadByte()
 
-	feeTerminalId := r.ReadCString(21)
-	p.FeeTerminalId = string(feeTerminalId)
-	feeTerminalPseudo := r.ReadCString(32)
-	p.FeeTerminalPseudo = string(feeTerminalPseudo)
-	p.FeeTerminalUserType = r.ReadByte()
+	p.FeeTerminalId = r.at("FeeTerminalId").ReadString(21)
+	p.FeeTerminalPseudo = r.at("FeeTerminalPseudo").ReadString(32)
+	p.FeeTerminalUserType = r.at("FeeTerminalUserType").ReadByte()
 
-	p.TpPid = r.ReadByte()
-	p.TpUdhi = r.ReadByte()
-	p.MsgFmt = r.ReadByte()
+	p.TpPid = r.at("TpPid").ReadByte()
+	p.TpUdhi = r.at("TpUdhi").ReadByte()
+	p.MsgFmt = r.at("MsgFmt").ReadByte()
 
-	msgSrc := r.ReadCString(6)
-	p.MsgSrc = string(msgSrc)
+	p.MsgSrc = r.at("MsgSrc").ReadString(MsgSrcLen)
 
-	feeType := make([]byte, 2)
-	r.ReadBytes(feeType)
-	p.FeeType = string(feeType)
+	p.FeeType = r.at("FeeType").ReadString(2)
 
-	feeCode := r.ReadCString(6)
-	p.FeeCode = string(feeCode)
+	p.FeeCode = r.at("FeeCode").ReadString(6)
 
-	validTime := r.ReadCString(17)
-	p.ValidTime = string(validTime)
+	p.ValidTime = r.at("ValidTime").ReadString(17)
 
-	atTime := r.ReadCString(17)
-	p.AtTime = string(atTime)
+	p.AtTime = r.at("AtTime").ReadString(17)
 
-	srcId := r.ReadCString(21)
-	p.SrcId = string(srcId)
+	p.SrcId = r.at("SrcId").ReadString(21)
 
-	srcPseudo := r.ReadCString(32)
-	p.SrcPseudo = string(srcPseudo)
-	p.SrcUserType = r.ReadByte()
-	p.SrcType = r.ReadByte()
+	p.SrcPseudo = r.at("SrcPseudo").ReadString(32)
+	p.SrcUserType = r.at("SrcUserType").ReadByte()
+	p.SrcType = r.at("SrcType").ReadByte()
 
-	p.DestUsrTl = r.ReadByte()
+	p.DestUsrTl = r.at("DestUsrTl").ReadByte()
 	for i := 0; i < int(p.DestUsrTl); i++ {
-		destId := r.ReadCString(21)
-		p.DestId = append(p.DestId, string(destId))
+		p.DestId = append(p.DestId, r.at("DestId").ReadString(21))
 	}
-	destPseudo := r.ReadCString(32)
-	p.DestPseudo = string(destPseudo)
-	p.DestUserType = r.ReadByte()
+	p.DestPseudo = r.at("DestPseudo").ReadString(32)
+	p.DestUserType = r.at("DestUserType").ReadByte()
 
-	p.MsgLength = r.ReadByte()
+	p.MsgLength = r.at("MsgLength").ReadByte()
 	msgContent := make([]byte, p.MsgLength)
-	r.ReadBytes(msgContent)
+	r.at("MsgContent").ReadBytes(msgContent)
 	p.MsgContent = string(msgContent)
 
-	linkId := r.ReadCString(20)
-	p.LinkId = string(linkId)
+	p.LinkId = r.at("LinkId").ReadString(20)
 
-	return r.Error()
+	return r.unpackError(CMPP_FWD, p)
 }
 
 // Pack packs the Cmpp3FwdRspPkt to bytes stream for server side.
 // Before calling Pack, you should initialize a Cmpp3FwdRspPkt variable
 // with correct field value.
 func (p *Cmpp3FwdRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3FwdRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3FwdRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen = Cmpp3FwdRspPktLen
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -468,7 +475,7 @@ func (p *Cmpp3FwdRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.PkNumber)
 	w.WriteInt(binary.BigEndian, p.Result)
 
-	return w.Bytes()
+	return w.Error()
 
 }
 
@@ -478,12 +485,12 @@ func (p *Cmpp3FwdRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-	p.PkTotal = r.ReadByte()
-	p.PkNumber = r.ReadByte()
-	r.ReadInt(binary.BigEndian, &p.Result)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	p.PkTotal = r.at("PkTotal").ReadByte()
+	p.PkNumber = r.at("PkNumber").ReadByte()
+	r.at("Result").ReadInt(binary.BigEndian, &p.Result)
 
-	return r.Error()
+	return r.unpackError(CMPP_FWD_RESP, p)
 }
@@ -0,0 +1,46 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+// Logger is the interface used by Conn to report the malformed packets
+// and other unexpected behavior of the peer.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// WithLogger sets the logger of the Conn, see Conn.SetLogger.
+func WithLogger(l Logger) Option {
+	return func(c *Conn) {
+		c.logger = l
+	}
+}
+
+// SetLogger sets the logger of c. It should be called before c is used
+// by other goroutines. A nil l discards the logs, which is the default.
+func (c *Conn) SetLogger(l Logger) {
+	c.logger = l
+}
+
+func (c *Conn) log() Logger {
+	if c.logger == nil {
+		return nopLogger{}
+	}
+	return c.logger
+}
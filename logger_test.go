@@ -0,0 +1,80 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+type testLogger struct {
+	debugs, errors []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.debugs = append(l.debugs, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+// bufConn reads from the inner buffer.
+type bufConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c bufConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
+
+func TestConnLogger(t *testing.T) {
+	cases := []struct {
+		data     []byte
+		err      error
+		expected string
+	}{
+		{[]byte{0x00, 0x00, 0x00, 0x0b, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x17},
+			cmpp.ErrTotalLengthInvalid, "invalid total_length: 11"},
+		{[]byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x30, 0x00, 0x00, 0x00, 0x17},
+			cmpp.ErrCommandIdInvalid, "invalid command_id: 0x30"},
+		{[]byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x17},
+			cmpp.ErrCommandIdNotSupported, "unsupported command_id: CMPP_MT_ROUTE[23]"},
+	}
+
+	for _, cs := range cases {
+		l := &testLogger{}
+		c := &cmpp.Conn{
+			Conn:  bufConn{buf: bytes.NewBuffer(cs.data)},
+			State: cmpp.CONN_AUTHOK,
+			Typ:   cmpp.V30,
+		}
+		c.SetLogger(l)
+
+		_, err := c.RecvAndUnpackPkt(0)
+		if err != cs.err {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cs.err)
+		}
+
+		if len(l.errors) != 1 || !strings.Contains(l.errors[0], cs.expected) {
+			t.Fatalf("The error logs are %q, not contain the expected: %s\n", l.errors, cs.expected)
+		}
+	}
+}
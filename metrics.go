@@ -0,0 +1,128 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Kinds of errors counted by Metrics.IncError.
+const (
+	ErrKindSend        = "send"        // failed to write a packet
+	ErrKindRecv        = "recv"        // failed to read or frame a packet, timeouts excluded
+	ErrKindUnsupported = "unsupported" // received a packet of unsupported command id
+	ErrKindUnpack      = "unpack"      // failed to unpack a received packet
+)
+
+// Metrics is the interface used by Conn to count the packets sent and
+// received, by their command ids, and the errors, by their kinds. It is
+// called by the sending and receiving goroutines, so it must be safe for
+// concurrent use. Adapt it to export the counters to a monitoring system.
+type Metrics interface {
+	IncSent(id CommandId)
+	IncRecv(id CommandId)
+	IncError(errKind string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncSent(id CommandId)    {}
+func (nopMetrics) IncRecv(id CommandId)    {}
+func (nopMetrics) IncError(errKind string) {}
+
+// WithMetrics sets the metrics of the Conn, see Conn.SetMetrics.
+func WithMetrics(m Metrics) Option {
+	return func(c *Conn) {
+		c.metrics = m
+	}
+}
+
+// SetMetrics sets the metrics of c. It should be called before c is used
+// by other goroutines. A nil m counts nothing, which is the default.
+func (c *Conn) SetMetrics(m Metrics) {
+	c.metrics = m
+}
+
+func (c *Conn) metric() Metrics {
+	if c.metrics == nil {
+		return nopMetrics{}
+	}
+	return c.metrics
+}
+
+// numCommandIds is the number of request command ids.
+const numCommandIds = int(CMPP_REQUEST_MAX)
+
+// Counters is a Metrics which keeps the counters in memory.
+type Counters struct {
+	sent [2][numCommandIds]uint64 // [0] for requests, [1] for responses
+	recv [2][numCommandIds]uint64
+	errs sync.Map // errKind -> *uint64
+}
+
+func counterOf(a *[2][numCommandIds]uint64, id CommandId) *uint64 {
+	i, n := 0, int(id)
+	if id > CMPP_RESPONSE_MIN {
+		i, n = 1, int(id-CMPP_RESPONSE_MIN)
+	}
+	if n <= 0 || n >= numCommandIds {
+		return nil
+	}
+	return &a[i][n]
+}
+
+func (m *Counters) IncSent(id CommandId) {
+	if p := counterOf(&m.sent, id); p != nil {
+		atomic.AddUint64(p, 1)
+	}
+}
+
+func (m *Counters) IncRecv(id CommandId) {
+	if p := counterOf(&m.recv, id); p != nil {
+		atomic.AddUint64(p, 1)
+	}
+}
+
+func (m *Counters) IncError(errKind string) {
+	v, ok := m.errs.Load(errKind)
+	if !ok {
+		v, _ = m.errs.LoadOrStore(errKind, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// Sent returns the number of packets of id sent.
+func (m *Counters) Sent(id CommandId) uint64 {
+	if p := counterOf(&m.sent, id); p != nil {
+		return atomic.LoadUint64(p)
+	}
+	return 0
+}
+
+// Recv returns the number of packets of id received.
+func (m *Counters) Recv(id CommandId) uint64 {
+	if p := counterOf(&m.recv, id); p != nil {
+		return atomic.LoadUint64(p)
+	}
+	return 0
+}
+
+// Errors returns the number of errors of errKind.
+func (m *Counters) Errors(errKind string) uint64 {
+	if v, ok := m.errs.Load(errKind); ok {
+		return atomic.LoadUint64(v.(*uint64))
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestConnMetrics(t *testing.T) {
+	c1, c2 := net.Pipe()
+	sm, rm := &cmpp.Counters{}, &cmpp.Counters{}
+	sender := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithMetrics(sm))
+	defer sender.Close()
+	receiver := cmpp.NewConnWithOptions(c2, cmpp.V30, cmpp.WithMetrics(rm))
+	defer receiver.Close()
+	sender.SetState(cmpp.CONN_AUTHOK)
+	receiver.SetState(cmpp.CONN_AUTHOK)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sender.SendPkt(newSubmitReqPkt(), 1)
+		sender.SendPkt(newSubmitReqPkt(), 2)
+		sender.SendPkt(&cmpp.CmppActiveTestRspPkt{}, 3)
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := receiver.RecvAndUnpackPkt(0); err != nil {
+			t.Fatal("RecvAndUnpackPkt error:", err)
+		}
+	}
+	<-done
+
+	cases := []struct {
+		name     string
+		n        uint64
+		expected uint64
+	}{
+		{"sent submit", sm.Sent(cmpp.CMPP_SUBMIT), 2},
+		{"sent active test resp", sm.Sent(cmpp.CMPP_ACTIVE_TEST_RESP), 1},
+		{"sent deliver", sm.Sent(cmpp.CMPP_DELIVER), 0},
+		{"recv submit", rm.Recv(cmpp.CMPP_SUBMIT), 2},
+		{"recv active test resp", rm.Recv(cmpp.CMPP_ACTIVE_TEST_RESP), 1},
+		{"recv unknown", rm.Recv(cmpp.CommandId(0x1234)), 0},
+	}
+	for _, cs := range cases {
+		if cs.n != cs.expected {
+			t.Fatalf("The count of %s is %d, not equal to expected: %d\n", cs.name, cs.n, cs.expected)
+		}
+	}
+}
+
+func TestConnMetricsErrors(t *testing.T) {
+	m := &cmpp.Counters{}
+	c := &cmpp.Conn{
+		// a CMPP_MT_ROUTE packet, which is not supported.
+		Conn:  bufConn{buf: bytes.NewBuffer([]byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x17})},
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+	c.SetMetrics(m)
+
+	_, err := c.RecvAndUnpackPkt(0)
+	if err != cmpp.ErrCommandIdNotSupported {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrCommandIdNotSupported)
+	}
+	if n := m.Errors(cmpp.ErrKindUnsupported); n != 1 {
+		t.Fatalf("The count of unsupported errors is %d, not equal to expected: %d\n", n, 1)
+	}
+
+	// EOF
+	c.RecvAndUnpackPkt(0)
+	if n := m.Errors(cmpp.ErrKindRecv); n != 1 {
+		t.Fatalf("The count of recv errors is %d, not equal to expected: %d\n", n, 1)
+	}
+	if n := m.Errors(cmpp.ErrKindSend); n != 0 {
+		t.Fatalf("The count of send errors is %d, not equal to expected: %d\n", n, 0)
+	}
+}
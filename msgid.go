@@ -0,0 +1,112 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"sync"
+	"time"
+)
+
+// MsgId represents the structured 8-byte Msg_Id generated by ISMG.
+//
+// From the most significant bit, Msg_Id is made up of:
+//
+//	month(4 bits), day(5 bits), hour(5 bits), minute(6 bits), second(6 bits),
+//	gateway code(22 bits) and sequence id(16 bits).
+type MsgId struct {
+	Month       uint8
+	Day         uint8
+	Hour        uint8
+	Minute      uint8
+	Second      uint8
+	GatewayCode uint32
+	SequenceId  uint16
+}
+
+// ParseMsgId parses the uint64 Msg_Id in cmpp packets, such as
+// Cmpp3SubmitRspPkt and CmppReceiptPkt, to a MsgId.
+func ParseMsgId(id uint64) MsgId {
+	return MsgId{
+		Month:       uint8(id >> 60 & 0xf),
+		Day:         uint8(id >> 55 & 0x1f),
+		Hour:        uint8(id >> 50 & 0x1f),
+		Minute:      uint8(id >> 44 & 0x3f),
+		Second:      uint8(id >> 38 & 0x3f),
+		GatewayCode: uint32(id >> 16 & 0x3fffff),
+		SequenceId:  uint16(id & 0xffff),
+	}
+}
+
+// Uint64 returns the uint64 form of m. The fields are truncated to
+// their bit widths.
+func (m MsgId) Uint64() uint64 {
+	return uint64(m.Month&0xf)<<60 |
+		uint64(m.Day&0x1f)<<55 |
+		uint64(m.Hour&0x1f)<<50 |
+		uint64(m.Minute&0x3f)<<44 |
+		uint64(m.Second&0x3f)<<38 |
+		uint64(m.GatewayCode&0x3fffff)<<16 |
+		uint64(m.SequenceId)
+}
+
+// MsgIdGenerator generates the Msg_Id of the submit requests accepted by
+// an ISMG. It is safe for concurrent use.
+//
+// The sequence id starts from 0 in each second. When more than 65536
+// Msg_Ids are generated in one second, the generator borrows the next
+// second, so the generated Msg_Ids are always unique and increasing.
+type MsgIdGenerator struct {
+	gatewayCode uint32
+
+	l   sync.Mutex
+	sec int64 // unix time of the last generated Msg_Id
+	seq uint16
+}
+
+// NewMsgIdGenerator returns a MsgIdGenerator with gatewayCode, only the
+// lower 22 bits of gatewayCode are used.
+func NewMsgIdGenerator(gatewayCode uint32) *MsgIdGenerator {
+	return &MsgIdGenerator{
+		gatewayCode: gatewayCode & 0x3fffff,
+		sec:         -1,
+	}
+}
+
+// Next returns a new Msg_Id.
+func (g *MsgIdGenerator) Next() uint64 {
+	now := time.Now().Unix()
+
+	g.l.Lock()
+	switch {
+	case now > g.sec:
+		g.sec, g.seq = now, 0
+	case g.seq == 0xffff:
+		g.sec, g.seq = g.sec+1, 0
+	default:
+		g.seq++
+	}
+	sec, seq := g.sec, g.seq
+	g.l.Unlock()
+
+	t := time.Unix(sec, 0)
+	return MsgId{
+		Month:       uint8(t.Month()),
+		Day:         uint8(t.Day()),
+		Hour:        uint8(t.Hour()),
+		Minute:      uint8(t.Minute()),
+		Second:      uint8(t.Second()),
+		GatewayCode: g.gatewayCode,
+		SequenceId:  seq,
+	}.Uint64()
+}
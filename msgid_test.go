@@ -0,0 +1,81 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestParseMsgId(t *testing.T) {
+	var id uint64 = 12878564852733378560 //0xb2, 0xb9, 0xda, 0x80, 0x00, 0x01, 0x00, 0x00
+	m := cmpp.ParseMsgId(id)
+
+	expected := cmpp.MsgId{
+		Month:       11,
+		Day:         5,
+		Hour:        14,
+		Minute:      29,
+		Second:      42,
+		GatewayCode: 1,
+		SequenceId:  0,
+	}
+
+	if m != expected {
+		t.Fatalf("The result of ParseMsgId is %#v, not equal to expected: %#v\n", m, expected)
+	}
+
+	if m.Uint64() != id {
+		t.Fatalf("The result of Uint64 is %d, not equal to expected: %d\n", m.Uint64(), id)
+	}
+}
+
+func TestMsgIdUint64(t *testing.T) {
+	m := cmpp.MsgId{
+		Month:       12,
+		Day:         31,
+		Hour:        23,
+		Minute:      59,
+		Second:      59,
+		GatewayCode: 0x3fffff,
+		SequenceId:  0x1234,
+	}
+
+	if m1 := cmpp.ParseMsgId(m.Uint64()); m1 != m {
+		t.Fatalf("The result of round trip is %#v, not equal to expected: %#v\n", m1, m)
+	}
+}
+
+func TestMsgIdGenerator(t *testing.T) {
+	g := cmpp.NewMsgIdGenerator(0x12345)
+
+	var last uint64
+	seen := make(map[uint64]bool)
+	for i := 0; i < 0x10000+10; i++ {
+		id := g.Next()
+		if seen[id] {
+			t.Fatalf("The Msg_Id %x is generated twice\n", id)
+		}
+		if id <= last {
+			t.Fatalf("The Msg_Id %x is not greater than the last one: %x\n", id, last)
+		}
+		seen[id] = true
+		last = id
+
+		if m := cmpp.ParseMsgId(id); m.GatewayCode != 0x12345 {
+			t.Fatalf("The GatewayCode is %x, not equal to expected: %x\n", m.GatewayCode, 0x12345)
+		}
+	}
+}
@@ -16,11 +16,21 @@ package cmpp
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// Type is the version of the cmpp protocol.
+//
+// CMPP 2.1 revises the documents of CMPP 2.0 without any change on the
+// wire, all the commands have the same layout in the two versions, so
+// they share the Cmpp2* packets. The only visible difference is the
+// Version field of the connect request and response.
 type Type int8
 
 const (
@@ -57,6 +67,24 @@ var ErrMethodParamsInvalid = errors.New("params passed to method is invalid")
 var ErrTotalLengthInvalid = errors.New("total_length in Packet data is invalid")
 var ErrCommandIdInvalid = errors.New("command_Id in Packet data is invalid")
 var ErrCommandIdNotSupported = errors.New("command_Id in Packet data is not supported")
+var ErrTotalLengthInconsistent = errors.New("total_length in Packet data is inconsistent with command_Id")
+var ErrShortPacket = errors.New("packet data is too short")
+
+// Errors for the fixed size fields longer than their sizes.
+var (
+	ErrServiceIdTooLong = errors.New("service_Id is longer than 10 bytes")
+	ErrSrcIdTooLong     = errors.New("src_Id is longer than 21 bytes")
+	ErrDestIdTooLong    = errors.New("dest_Id is longer than 21 bytes")
+	ErrLinkIdTooLong    = errors.New("linkID is longer than 20 bytes")
+)
+
+// ErrMsgSrcInvalid is returned for a Msg_src which is not exactly 6 bytes,
+// the SP id the carriers reconcile the messages with. An empty Msg_src is
+// still packed as zeros by the packers, but rejected by NewSubmit.
+var ErrMsgSrcInvalid = errors.New("msg_src is not 6 bytes")
+
+// MsgSrcLen is the size of the Msg_src field.
+const MsgSrcLen = 6
 
 type CommandId uint32
 
@@ -135,6 +163,75 @@ func (id CommandId) String() string {
 	return "unknown"
 }
 
+// pktLen is the length of the packets of a command id. For the packets of
+// variable length, it is the length when all the variable fields are empty.
+type pktLen struct {
+	n        uint32
+	variable bool
+}
+
+var cmpp2PktLens = map[CommandId]pktLen{
+	CMPP_CONNECT:          {CmppConnReqPktLen, false},
+	CMPP_CONNECT_RESP:     {Cmpp2ConnRspPktLen, false},
+	CMPP_TERMINATE:        {CmppTerminateReqPktLen, false},
+	CMPP_TERMINATE_RESP:   {CmppTerminateRspPktLen, false},
+	CMPP_SUBMIT:           {CMPP_HEADER_LEN + 117 + 1 + 8, true},
+	CMPP_SUBMIT_RESP:      {Cmpp2SubmitRspPktLen, false},
+	CMPP_DELIVER:          {CMPP_HEADER_LEN + 65 + 8, true},
+	CMPP_DELIVER_RESP:     {Cmpp2DeliverRspPktLen, false},
+	CMPP_QUERY:            {CmppQueryReqPktLen, false},
+	CMPP_QUERY_RESP:       {CmppQueryRspPktLen, false},
+	CMPP_CANCEL:           {CmppCancelReqPktLen, false},
+	CMPP_CANCEL_RESP:      {Cmpp2CancelRspPktLen, false},
+	CMPP_ACTIVE_TEST:      {CmppActiveTestReqPktLen, false},
+	CMPP_ACTIVE_TEST_RESP: {CmppActiveTestRspPktLen, false},
+	CMPP_FWD:              {CMPP_HEADER_LEN + 131 + 1 + 8, true},
+	CMPP_FWD_RESP:         {Cmpp2FwdRspPktLen, false},
+}
+
+var cmpp3PktLens = map[CommandId]pktLen{
+	CMPP_CONNECT:          {CmppConnReqPktLen, false},
+	CMPP_CONNECT_RESP:     {Cmpp3ConnRspPktLen, false},
+	CMPP_TERMINATE:        {CmppTerminateReqPktLen, false},
+	CMPP_TERMINATE_RESP:   {CmppTerminateRspPktLen, false},
+	CMPP_SUBMIT:           {CMPP_HEADER_LEN + 129 + 1 + 1 + 20, true},
+	CMPP_SUBMIT_RESP:      {Cmpp3SubmitRspPktLen, false},
+	CMPP_DELIVER:          {CMPP_HEADER_LEN + 77 + 20, true},
+	CMPP_DELIVER_RESP:     {Cmpp3DeliverRspPktLen, false},
+	CMPP_QUERY:            {CmppQueryReqPktLen, false},
+	CMPP_QUERY_RESP:       {CmppQueryRspPktLen, false},
+	CMPP_CANCEL:           {CmppCancelReqPktLen, false},
+	CMPP_CANCEL_RESP:      {Cmpp3CancelRspPktLen, false},
+	CMPP_ACTIVE_TEST:      {CmppActiveTestReqPktLen, false},
+	CMPP_ACTIVE_TEST_RESP: {CmppActiveTestRspPktLen, false},
+	CMPP_FWD:              {CMPP_HEADER_LEN + 198 + 32 + 1 + 1 + 20, true},
+	CMPP_FWD_RESP:         {Cmpp3FwdRspPktLen, false},
+}
+
+// isTotalLenConsistent reports whether totalLen is the fixed length, or is
+// not less than the min length, of the packets of id in version typ.
+// Unknown command ids are not checked.
+func isTotalLenConsistent(typ Type, id CommandId, totalLen uint32) bool {
+	lens := cmpp2PktLens
+	if typ == V30 {
+		lens = cmpp3PktLens
+	}
+
+	l, ok := lens[id]
+	if !ok {
+		return true
+	}
+	if l.variable {
+		return totalLen >= l.n
+	}
+	return totalLen == l.n
+}
+
+// Packer is implemented by all the cmpp packets.
+//
+// The data passed to Unpack by Conn is borrowed from a pool and is reused
+// once Unpack returns, so Unpack must copy out the fields it keeps and
+// must not retain data or any sub-slice of it.
 type Packer interface {
 	Pack(seqId uint32) ([]byte, error)
 	Unpack(data []byte) error
@@ -174,9 +271,178 @@ func (e *OpError) Op() string {
 	return e.op
 }
 
+// UnpackError is the error returned by the Unpack methods of the
+// packets, it tells which field of the packet is failed to unpack.
+type UnpackError struct {
+	CommandId CommandId
+	Packet    string // the type name of the packet, such as Cmpp3SubmitReqPkt
+	Field     string // the name of the field in the packet struct
+	Offset    int    // the byte offset of the field in the packet, from Total_Length
+	Err       error
+}
+
+func (e *UnpackError) Error() string {
+	return fmt.Sprintf("unpack %s field %s at offset %d: %v", e.Packet, e.Field, e.Offset, e.Err)
+}
+
+func (e *UnpackError) Unwrap() error {
+	return e.Err
+}
+
+// packer is implemented by the packets of this package, which
+// pack themselves into a packetWriter.
+type packer interface {
+	pack(w *packetWriter, seqId uint32) error
+}
+
+// pack packs p into a newly allocated slice.
+func pack(p packer, seqId uint32) ([]byte, error) {
+	w := newPacketWriter(0)
+	if err := p.pack(w, seqId); err != nil {
+		return nil, err
+	}
+	return w.Bytes()
+}
+
+// packInto packs p right after the bytes of buf, no allocation is made if
+// buf has enough capacity. A pooled packetWriter is borrowed with its inner
+// buffer swapped for buf, so the packet is not copied.
+func packInto(p packer, buf []byte, seqId uint32) ([]byte, error) {
+	pw := packetWriterPool.Get().(*packetWriter)
+	own := *pw.wb
+	*pw.wb = *bytes.NewBuffer(buf)
+	defer func() {
+		*pw.wb = own
+		pw.Reset()
+		packetWriterPool.Put(pw)
+	}()
+
+	if err := p.pack(pw, seqId); err != nil {
+		return buf, err
+	}
+	data, err := pw.Bytes()
+	if err != nil {
+		return buf, err
+	}
+	return data, nil
+}
+
+var packetWriterPool = sync.Pool{
+	New: func() interface{} {
+		return newPacketWriter(CMPP3_PACKET_MAX)
+	},
+}
+
+// PackTo packs the packet p with seqId and writes it to w.
+// Unlike Pack, the packets of this package are packed into a pooled
+// buffer, so no allocation is made for the bytes stream per packet.
+// Other Packers fall back to Pack.
+func PackTo(w io.Writer, p Packer, seqId uint32) error {
+	_, _, err := packTo(w, p, seqId, nil)
+	return err
+}
+
+// packTo is like PackTo, but it also returns the command id of p and the
+// bytes written to w. If dump is not nil, it is called with the packed
+// frame once before the frame is written.
+func packTo(w io.Writer, p Packer, seqId uint32, dump func([]byte)) (CommandId, int, error) {
+	pp, ok := p.(packer)
+	if !ok {
+		data, err := p.Pack(seqId)
+		if err != nil {
+			return 0, 0, err
+		}
+		if dump != nil {
+			dump(data)
+		}
+		n, err := writeFull(w, data)
+		return commandIdOf(data), n, err
+	}
+
+	pw := packetWriterPool.Get().(*packetWriter)
+	defer func() {
+		pw.Reset()
+		packetWriterPool.Put(pw)
+	}()
+
+	if err := pp.pack(pw, seqId); err != nil {
+		return 0, 0, err
+	}
+	data := pw.wb.Bytes()
+	if dump != nil {
+		dump(data)
+	}
+	n, err := writeFull(w, data)
+	return commandIdOf(data), n, err
+}
+
+// checkPack packs p into a pooled buffer and drops the bytes, to report
+// an invalid packet before it is queued.
+func checkPack(p Packer) error {
+	pp, ok := p.(packer)
+	if !ok {
+		_, err := p.Pack(0)
+		return err
+	}
+
+	pw := packetWriterPool.Get().(*packetWriter)
+	defer func() {
+		pw.Reset()
+		packetWriterPool.Put(pw)
+	}()
+	return pp.pack(pw, 0)
+}
+
+// WriteError is returned when a packed packet fails to be written,
+// Written tells how many bytes of the packet made it out. If it is 0,
+// the peer has received nothing of the packet and it is safe to send
+// the packet again; otherwise the byte stream is broken and the conn
+// should be closed.
+type WriteError struct {
+	Written int // bytes written before the error
+	Total   int // bytes of the whole packet
+	Err     error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write packet: %d of %d bytes written: %v", e.Written, e.Total, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// writeFull writes the whole b to w, and returns the bytes written. A short
+// write reported with io.ErrShortWrite is continued with the left bytes,
+// any other error is returned as a *WriteError.
+func writeFull(w io.Writer, b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := w.Write(b[written:])
+		written += n
+		if err == io.ErrShortWrite || (err == nil && n > 0) {
+			continue
+		}
+		if err == nil {
+			err = io.ErrShortWrite // no progress is made.
+		}
+		return written, &WriteError{Written: written, Total: len(b), Err: err}
+	}
+	return written, nil
+}
+
+// commandIdOf returns the command id in the header of the packed data.
+func commandIdOf(data []byte) CommandId {
+	if len(data) < 8 {
+		return 0
+	}
+	return CommandId(binary.BigEndian.Uint32(data[4:8]))
+}
+
 type packetWriter struct {
 	wb  *bytes.Buffer
 	err *OpError
+	b   [8]byte // scratch for WriteInt
 }
 
 func newPacketWriter(initSize uint32) *packetWriter {
@@ -186,6 +452,25 @@ func newPacketWriter(initSize uint32) *packetWriter {
 	}
 }
 
+// Grow makes room for another n bytes in the inner buffer.
+func (w *packetWriter) Grow(n uint32) {
+	w.wb.Grow(int(n))
+}
+
+// Reset empties the writer, so it can be reused.
+func (w *packetWriter) Reset() {
+	w.wb.Reset()
+	w.err = nil
+}
+
+// Error returns the first error occurred while writing.
+func (w *packetWriter) Error() error {
+	if w.err != nil {
+		return w.err
+	}
+	return nil
+}
+
 // Bytes returns a slice of the contents of the inner buffer;
 // If the caller changes the contents of the
 // returned slice, the contents of the buffer will change provided there
@@ -220,19 +505,18 @@ func (w *packetWriter) WriteFixedSizeString(s string, size int) {
 		return
 	}
 
-	l1 := len(s)
-	l2 := l1
-	if l2 > 10 {
-		l2 = 10
-	}
-
-	if l1 > size {
-		w.err = NewOpError(ErrMethodParamsInvalid,
-			fmt.Sprintf("packetWriter.WriteFixedSizeString writes: %s", s[0:l2]))
+	w.wb.Grow(size)
+	b := w.wb.AvailableBuffer()[:size]
+	if err := packString(b, s); err != nil {
+		l := len(s)
+		if l > 10 {
+			l = 10
+		}
+		w.err = NewOpError(err,
+			fmt.Sprintf("packetWriter.WriteFixedSizeString writes: %s", s[0:l]))
 		return
 	}
-
-	w.WriteString(strings.Join([]string{s, string(make([]byte, size-l1))}, ""))
+	w.wb.Write(b)
 }
 
 // WriteString appends the contents of s to the inner buffer, growing the buffer as
@@ -269,6 +553,29 @@ func (w *packetWriter) WriteInt(order binary.ByteOrder, data interface{}) {
 		return
 	}
 
+	// fast path for the common types, binary.Write allocates.
+	switch v := data.(type) {
+	case uint8:
+		w.wb.WriteByte(v)
+		return
+	case uint16:
+		order.PutUint16(w.b[:], v)
+		w.wb.Write(w.b[:2])
+		return
+	case uint32:
+		order.PutUint32(w.b[:], v)
+		w.wb.Write(w.b[:4])
+		return
+	case CommandId:
+		order.PutUint32(w.b[:], uint32(v))
+		w.wb.Write(w.b[:4])
+		return
+	case uint64:
+		order.PutUint64(w.b[:], v)
+		w.wb.Write(w.b[:8])
+		return
+	}
+
 	err := binary.Write(w.wb, order, data)
 	if err != nil {
 		w.err = NewOpError(err,
@@ -283,11 +590,51 @@ type packetReader struct {
 	rb   *bytes.Buffer
 	err  *OpError
 	cbuf [maxCStringSize]byte
+
+	// for UnpackError
+	size  int    // the length of the data
+	base  int    // the offset of the data in the packet
+	field string // the field being read
+	off   int    // the offset of field in the data
 }
 
+// newPacketReader returns a packetReader reading the data following the
+// Total_Length and Command_Id of a packet.
 func newPacketReader(data []byte) *packetReader {
 	return &packetReader{
-		rb: bytes.NewBuffer(data),
+		rb:   bytes.NewBuffer(data),
+		size: len(data),
+		base: 8,
+	}
+}
+
+// at records that the next read is for the field name, so that it
+// could be reported in the UnpackError. It returns r for chaining.
+func (r *packetReader) at(name string) *packetReader {
+	if r.err == nil {
+		r.field = name
+		r.off = r.size - r.rb.Len()
+	}
+	return r
+}
+
+// unpackError returns the inner err as an UnpackError of the packet p
+// with command id id, or nil if no error occurs.
+func (r *packetReader) unpackError(id CommandId, p interface{}) error {
+	if r.err == nil {
+		return nil
+	}
+
+	err := r.err.Cause()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: %w", ErrShortPacket, err)
+	}
+	return &UnpackError{
+		CommandId: id,
+		Packet:    strings.TrimPrefix(fmt.Sprintf("%T", p), "*cmpp."),
+		Field:     r.field,
+		Offset:    r.base + r.off,
+		Err:       err,
 	}
 }
 
@@ -317,6 +664,30 @@ func (r *packetReader) ReadInt(order binary.ByteOrder, data interface{}) {
 		return
 	}
 
+	// fast path for the common types, binary.Read allocates.
+	switch v := data.(type) {
+	case *uint8:
+		if b := r.next(1); b != nil {
+			*v = b[0]
+		}
+		return
+	case *uint16:
+		if b := r.next(2); b != nil {
+			*v = order.Uint16(b)
+		}
+		return
+	case *uint32:
+		if b := r.next(4); b != nil {
+			*v = order.Uint32(b)
+		}
+		return
+	case *uint64:
+		if b := r.next(8); b != nil {
+			*v = order.Uint64(b)
+		}
+		return
+	}
+
 	err := binary.Read(r.rb, order, data)
 	if err != nil {
 		r.err = NewOpError(err,
@@ -325,6 +696,21 @@ func (r *packetReader) ReadInt(order binary.ByteOrder, data interface{}) {
 	}
 }
 
+// next returns the next n bytes of the inner buffer, it returns nil
+// and stores an OpError in r.err if there are less than n bytes.
+func (r *packetReader) next(n int) []byte {
+	if r.rb.Len() < n {
+		err := io.ErrUnexpectedEOF
+		if r.rb.Len() == 0 {
+			err = io.EOF
+		}
+		r.rb.Next(n)
+		r.err = NewOpError(err, "packetReader.ReadInt")
+		return nil
+	}
+	return r.rb.Next(n)
+}
+
 // ReadBytes reads the next len(s) bytes from the inner buffer to s.
 // If the buffer has no data to return, an OpError would be stored in r.err.
 func (r *packetReader) ReadBytes(s []byte) {
@@ -340,7 +726,7 @@ func (r *packetReader) ReadBytes(s []byte) {
 	}
 
 	if n != len(s) {
-		r.err = NewOpError(fmt.Errorf("ReadBytes reads %d bytes, not equal to %d we expected", n, len(s)),
+		r.err = NewOpError(fmt.Errorf("ReadBytes reads %d bytes, not equal to %d we expected: %w", n, len(s), io.ErrUnexpectedEOF),
 			"packetWriter.ReadBytes")
 		return
 	}
@@ -349,11 +735,28 @@ func (r *packetReader) ReadBytes(s []byte) {
 // ReadCString read bytes from packerReader's inner buffer,
 // it would trim the tail-zero byte and the bytes after that.
 func (r *packetReader) ReadCString(length int) []byte {
+	return cstring(r.readField(length))
+}
+
+// ReadString reads a fixed-size octet field of length bytes and returns
+// it as a string, see unpackString.
+func (r *packetReader) ReadString(length int) string {
+	return unpackString(r.readField(length))
+}
+
+// readField returns the next length bytes of the inner buffer, the
+// returned slice is only valid until the next read.
+func (r *packetReader) readField(length int) []byte {
 	if r.err != nil {
 		return nil
 	}
 
-	var tmp = r.cbuf[:length]
+	var tmp []byte
+	if length <= maxCStringSize {
+		tmp = r.cbuf[:length]
+	} else {
+		tmp = make([]byte, length)
+	}
 	n, err := r.rb.Read(tmp)
 	if err != nil {
 		r.err = NewOpError(err,
@@ -362,17 +765,40 @@ func (r *packetReader) ReadCString(length int) []byte {
 	}
 
 	if n != length {
-		r.err = NewOpError(fmt.Errorf("ReadCString reads %d bytes, not equal to %d we expected", n, length),
+		r.err = NewOpError(fmt.Errorf("ReadCString reads %d bytes, not equal to %d we expected: %w", n, length, io.ErrUnexpectedEOF),
 			"packetWriter.ReadCString")
 		return nil
 	}
 
-	i := bytes.IndexByte(tmp, 0)
-	if i == -1 {
-		return tmp
-	} else {
-		return tmp[:i]
+	return tmp
+}
+
+// packString copies s to the fixed-size octet field dst and pads the
+// left bytes of dst with binary zero. ErrMethodParamsInvalid is returned
+// and dst is unchanged if s is longer than dst.
+func packString(dst []byte, s string) error {
+	if len(s) > len(dst) {
+		return ErrMethodParamsInvalid
+	}
+
+	n := copy(dst, s)
+	clear(dst[n:])
+	return nil
+}
+
+// unpackString returns the string in the fixed-size octet field src, the
+// first zero byte and the bytes after that are trimmed. It is for the
+// c-string fields only, the binary fields like Msg_Content should be
+// converted with string() directly to keep the zero bytes in them.
+func unpackString(src []byte) string {
+	return string(cstring(src))
+}
+
+func cstring(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		return b[:i]
 	}
+	return b
 }
 
 // Error return the inner err.
@@ -382,3 +808,61 @@ func (r *packetReader) Error() error {
 	}
 	return nil
 }
+
+// pktString builds the one-line text form of a packet for debugging,
+// such as "Cmpp3SubmitRspPkt{SeqId: 1, MsgId: 2, Result: 0}". The
+// binary fields are hex encoded and the secrets are never written.
+type pktString struct {
+	b []byte
+}
+
+func newPktString(name string) *pktString {
+	s := &pktString{b: make([]byte, 0, 256)}
+	s.b = append(s.b, name...)
+	s.b = append(s.b, '{')
+	return s
+}
+
+func (s *pktString) name(name string) {
+	if s.b[len(s.b)-1] != '{' {
+		s.b = append(s.b, ", "...)
+	}
+	s.b = append(s.b, name...)
+	s.b = append(s.b, ": "...)
+}
+
+func (s *pktString) uint(name string, v uint64) {
+	s.name(name)
+	s.b = strconv.AppendUint(s.b, v, 10)
+}
+
+func (s *pktString) str(name string, v string) {
+	s.name(name)
+	s.b = strconv.AppendQuote(s.b, v)
+}
+
+func (s *pktString) strs(name string, v []string) {
+	s.name(name)
+	s.b = append(s.b, '[')
+	for i := range v {
+		if i > 0 {
+			s.b = append(s.b, ' ')
+		}
+		s.b = strconv.AppendQuote(s.b, v[i])
+	}
+	s.b = append(s.b, ']')
+}
+
+func (s *pktString) hex(name string, v string) {
+	s.name(name)
+	s.b = hex.AppendEncode(s.b, []byte(v))
+}
+
+func (s *pktString) version(v Type) {
+	s.name("Version")
+	s.b = append(s.b, v.String()...)
+}
+
+func (s *pktString) String() string {
+	return string(append(s.b, '}'))
+}
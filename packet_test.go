@@ -14,9 +14,12 @@
 package cmpp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -253,3 +256,288 @@ func TestPacketReader(t *testing.T) {
 		t.Fatalf("packetReader's err : actual [%s], wanted [%s]\n", string(d4), "hello")
 	}
 }
+
+func BenchmarkPack(b *testing.B) {
+	p := newBenchSubmitPkt()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, _ := p.Pack(uint32(i))
+		io.Discard.Write(data)
+	}
+}
+
+func BenchmarkPackTo(b *testing.B) {
+	p := newBenchSubmitPkt()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		PackTo(io.Discard, p, uint32(i))
+	}
+}
+
+func BenchmarkPackInto(b *testing.B) {
+	p := newBenchSubmitPkt()
+	buf := make([]byte, 0, CMPP3_PACKET_MAX)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, _ = p.PackInto(buf[:0], uint32(i))
+		io.Discard.Write(buf)
+	}
+}
+
+func TestPackInto(t *testing.T) {
+	p := newBenchSubmitPkt()
+	data, err := p.Pack(0x17)
+	if err != nil {
+		t.Fatal("Pack error:", err)
+	}
+
+	prefix := []byte("prefix")
+	buf, err := p.PackInto(append([]byte(nil), prefix...), 0x17)
+	if err != nil {
+		t.Fatal("PackInto error:", err)
+	}
+	if !bytes.Equal(buf, append(prefix, data...)) {
+		t.Fatalf("PackInto returns %x, not equal to expected: %x\n", buf, append(prefix, data...))
+	}
+
+	// the fields are validated as Pack.
+	p.LinkId = strings.Repeat("l", 21)
+	if buf, err = p.PackInto(prefix, 0x17); err != ErrLinkIdTooLong || !bytes.Equal(buf, prefix) {
+		t.Fatalf("PackInto returns %x, %v, not equal to expected: %x, %v\n", buf, err, prefix, ErrLinkIdTooLong)
+	}
+}
+
+func newBenchSubmitPkt() *Cmpp3SubmitReqPkt {
+	return &Cmpp3SubmitReqPkt{
+		FeeUserType:        2,
+		MsgSrc:             "900001",
+		FeeType:            "02",
+		FeeCode:            "10",
+		SrcId:              "900001",
+		DestUsrTl:          1,
+		DestTerminalId:     []string{"13500002696"},
+		MsgLength:          12,
+		MsgContent:         "hello gocmpp",
+		RegisteredDelivery: 1,
+	}
+}
+
+func TestPackTo(t *testing.T) {
+	pkts := []Packer{
+		newBenchSubmitPkt(),
+		&CmppActiveTestReqPkt{},
+		&Cmpp2SubmitRspPkt{MsgId: 12878564852733378560, Result: 0},
+	}
+
+	for _, p := range pkts {
+		expected, err := p.Pack(0x17)
+		if err != nil {
+			t.Fatal("Pack error:", err)
+		}
+
+		var buf bytes.Buffer
+		err = PackTo(&buf, p, 0x17)
+		if err != nil {
+			t.Fatal("PackTo error:", err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("PackTo writes %v, not equal to expected: %v\n", buf.Bytes(), expected)
+		}
+	}
+}
+
+func TestPackString(t *testing.T) {
+	dst := []byte{1, 2, 3, 4, 5, 6}
+	if err := packString(dst, "abc"); err != nil {
+		t.Fatal("packString error:", err)
+	}
+	if !bytes.Equal(dst, []byte{'a', 'b', 'c', 0, 0, 0}) {
+		t.Fatalf("packString result: actual [%#v], wanted [%#v]\n", dst, []byte{'a', 'b', 'c', 0, 0, 0})
+	}
+
+	if err := packString(dst, "abcdef"); err != nil {
+		t.Fatal("packString error:", err)
+	}
+	if string(dst) != "abcdef" {
+		t.Fatalf("packString result: actual [%s], wanted [%s]\n", dst, "abcdef")
+	}
+
+	if err := packString(dst, "abcdefg"); err != ErrMethodParamsInvalid {
+		t.Fatalf("packString err: actual [%#v], wanted [%#v]\n", err, ErrMethodParamsInvalid)
+	}
+	if string(dst) != "abcdef" {
+		t.Fatalf("packString changes dst on error: actual [%s], wanted [%s]\n", dst, "abcdef")
+	}
+}
+
+func TestUnpackString(t *testing.T) {
+	cases := []struct {
+		src      []byte
+		expected string
+	}{
+		{[]byte{'a', 'b', 'c', 0, 0, 0}, "abc"},
+		{[]byte{'a', 'b', 'c'}, "abc"},
+		{[]byte{'a', 0, 'c', 0}, "a"},
+		{[]byte{0, 'b', 'c'}, ""},
+		{nil, ""},
+	}
+
+	for _, c := range cases {
+		if s := unpackString(c.src); s != c.expected {
+			t.Fatalf("unpackString(%#v): actual [%q], wanted [%q]\n", c.src, s, c.expected)
+		}
+	}
+}
+
+func TestPacketReaderBinaryField(t *testing.T) {
+	data := []byte{'0', '1', 'h', 0, 'i', 0}
+	r := newPacketReader(data)
+
+	feeType := r.ReadString(2)
+	content := make([]byte, 4)
+	r.ReadBytes(content)
+	if r.Error() != nil {
+		t.Fatal("packetReader error:", r.Error())
+	}
+
+	if feeType != "01" {
+		t.Fatalf("packetReader's ReadString: actual [%s], wanted [%s]\n", feeType, "01")
+	}
+	if string(content) != "h\x00i\x00" {
+		t.Fatalf("packetReader's ReadBytes: actual [%q], wanted [%q]\n", content, "h\x00i\x00")
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	cases := []struct {
+		p        fmt.Stringer
+		expected string
+	}{
+		{&Cmpp3SubmitRspPkt{SeqId: 1, MsgId: 2, Result: 0},
+			"Cmpp3SubmitRspPkt{SeqId: 1, MsgId: 2, Result: 0}"},
+		{&CmppConnReqPkt{SeqId: 1, SrcAddr: "900001", AuthSrc: "\x01\x02", Version: V30, Timestamp: 1021080510, Secret: "888888"},
+			`CmppConnReqPkt{SeqId: 1, SrcAddr: "900001", AuthSrc: 0102, Version: cmpp30, Timestamp: 1021080510}`},
+		{&Cmpp3DeliverReqPkt{SeqId: 3, SrcTerminalId: "13500002696", MsgLength: 3, MsgContent: "a\x00b", LinkId: "link"},
+			`Cmpp3DeliverReqPkt{SeqId: 3, MsgId: 0, DestId: "", ServiceId: "", SrcTerminalId: "13500002696", ` +
+				`RegisterDelivery: 0, MsgFmt: 0, MsgLength: 3, MsgContent: 610062, LinkId: "link"}`},
+	}
+
+	for _, c := range cases {
+		if s := c.p.String(); s != c.expected {
+			t.Fatalf("The String is %s, not equal to expected: %s\n", s, c.expected)
+		}
+	}
+
+	s := fmt.Sprintf("%v", &Cmpp3SubmitReqPkt{DestTerminalId: []string{"13500002696", "13500002697"}})
+	if !strings.Contains(s, `DestTerminalId: ["13500002696" "13500002697"]`) {
+		t.Fatalf("The String is %s, not contains the DestTerminalId\n", s)
+	}
+}
+
+func BenchmarkPacketString(b *testing.B) {
+	p := newBenchSubmitPkt()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.String()
+	}
+}
+
+func TestPacketByteOrder(t *testing.T) {
+	const (
+		seqId uint32 = 0x01020304
+		v32   uint32 = 0x0a0b0c0d
+		v64   uint64 = 0x1112131415161718
+	)
+
+	// field is a multi-byte field of size bytes at off in a packed packet.
+	type field struct {
+		off, size int
+		v         uint64
+	}
+	dest := []string{"13500002696"}
+	cases := []struct {
+		typ    Type
+		p      Packer
+		fields []field
+	}{
+		{V30, &CmppConnReqPkt{SrcAddr: "900001", Secret: "888888", Version: V30, Timestamp: v32},
+			[]field{{35, 4, uint64(v32)}}},
+		{V21, &Cmpp2ConnRspPkt{Version: V21}, nil},
+		{V30, &Cmpp3ConnRspPkt{Status: v32, Version: V30}, []field{{12, 4, uint64(v32)}}},
+		{V30, &CmppTerminateReqPkt{}, nil},
+		{V30, &CmppTerminateRspPkt{}, nil},
+		{V21, &Cmpp2SubmitReqPkt{MsgId: v64, FeeType: "02", DestTerminalId: dest}, []field{{12, 8, v64}}},
+		{V21, &Cmpp2SubmitRspPkt{MsgId: v64}, []field{{12, 8, v64}}},
+		{V30, &Cmpp3SubmitReqPkt{MsgId: v64, FeeType: "02", DestTerminalId: dest}, []field{{12, 8, v64}}},
+		{V30, &Cmpp3SubmitRspPkt{MsgId: v64, Result: v32}, []field{{12, 8, v64}, {20, 4, uint64(v32)}}},
+		{V21, &Cmpp2DeliverReqPkt{MsgId: v64}, []field{{12, 8, v64}}},
+		{V21, &Cmpp2DeliverRspPkt{MsgId: v64}, []field{{12, 8, v64}}},
+		{V30, &Cmpp3DeliverReqPkt{MsgId: v64}, []field{{12, 8, v64}}},
+		{V30, &Cmpp3DeliverRspPkt{MsgId: v64, Result: v32}, []field{{12, 8, v64}, {20, 4, uint64(v32)}}},
+		{V21, &Cmpp2FwdReqPkt{MsgId: v64}, []field{{26, 8, v64}}},
+		{V21, &Cmpp2FwdRspPkt{MsgId: v64}, []field{{12, 8, v64}}},
+		{V30, &Cmpp3FwdReqPkt{MsgId: v64}, []field{{26, 8, v64}}},
+		{V30, &Cmpp3FwdRspPkt{MsgId: v64, Result: v32}, []field{{12, 8, v64}, {22, 4, uint64(v32)}}},
+		{V30, &CmppQueryReqPkt{}, nil},
+		{V30, &CmppQueryRspPkt{MtTlMsg: v32, MoFl: v32 + 1}, []field{{31, 4, uint64(v32)}, {59, 4, uint64(v32 + 1)}}},
+		{V30, &CmppCancelReqPkt{MsgId: v64}, []field{{12, 8, v64}}},
+		{V21, &Cmpp2CancelRspPkt{}, nil},
+		{V30, &Cmpp3CancelRspPkt{SuccessId: v32}, []field{{12, 4, uint64(v32)}}},
+		{V30, &CmppActiveTestReqPkt{}, nil},
+		{V30, &CmppActiveTestRspPkt{}, nil},
+	}
+
+	be := func(b []byte) uint64 {
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v
+	}
+
+	for _, c := range cases {
+		data, err := c.p.Pack(seqId)
+		if err != nil {
+			t.Fatalf("%T pack error: %v\n", c.p, err)
+		}
+
+		// the header: Total_Length, Command_Id and Sequence_Id.
+		id := commandIdOf(data)
+		if got := be(data[0:4]); got != uint64(len(data)) {
+			t.Fatalf("%T: the Total_Length is %#x, not equal to expected: %#x\n", c.p, got, len(data))
+		}
+		if !isTotalLenConsistent(c.typ, id, uint32(len(data))) {
+			t.Fatalf("%T: the Command_Id %#x is inconsistent with the length %d\n", c.p, uint32(id), len(data))
+		}
+		if got := be(data[8:12]); got != uint64(seqId) {
+			t.Fatalf("%T: the Sequence_Id is %#x, not equal to expected: %#x\n", c.p, got, seqId)
+		}
+		for _, f := range c.fields {
+			if got := be(data[f.off : f.off+f.size]); got != f.v {
+				t.Fatalf("%T: the field at %d is %#x, not equal to expected: %#x\n", c.p, f.off, got, f.v)
+			}
+		}
+
+		// and back.
+		gotId, gotSeqId, p, err := UnpackPacket(c.typ, data)
+		if err != nil {
+			t.Fatalf("%T unpack error: %v\n", c.p, err)
+		}
+		if gotId != id || gotSeqId != seqId || fmt.Sprintf("%T", p) != fmt.Sprintf("%T", c.p) {
+			t.Fatalf("%T: unpacked as %T of %v[%#x], not equal to expected: %v[%#x]\n", c.p, p, gotId, gotSeqId, id, seqId)
+		}
+	}
+
+	// the status report in the Msg_Content of a deliver request.
+	r := &CmppReceiptPkt{MsgId: v64, Stat: "DELIVRD", SmscSequence: v32}
+	data, err := r.Pack()
+	if err != nil {
+		t.Fatal("CmppReceiptPkt pack error:", err)
+	}
+	if got := be(data[0:8]); got != v64 {
+		t.Fatalf("The Msg_Id of the report is %#x, not equal to expected: %#x\n", got, v64)
+	}
+	if got := be(data[len(data)-4:]); got != uint64(v32) {
+		t.Fatalf("The SMSC_sequence of the report is %#x, not equal to expected: %#x\n", got, v32)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPendingTimeout is delivered to the waiter of a request whose
+// response does not arrive within the ttl of the PendingTable.
+var ErrPendingTimeout = errors.New("response is not received in time")
+
+type pendingEntry struct {
+	ch       chan interface{}
+	deadline time.Time
+}
+
+// PendingTable correlates the responses with the requests by seqId.
+// A waiter adds the seqId of a request with a channel, the response
+// passed to Complete with the same seqId is sent to the channel. If the
+// response is not completed within the ttl, ErrPendingTimeout is sent
+// instead. It is safe for concurrent use.
+type PendingTable struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uint32]pendingEntry
+	orphan  func(id CommandId, seqId uint32, resp interface{}) // see OnOrphanResponse
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewPendingTable returns a PendingTable whose entries expire after ttl,
+// and starts the goroutine sweeping the expired entries. Call Close to
+// stop the goroutine.
+func NewPendingTable(ttl time.Duration) *PendingTable {
+	t := &PendingTable{
+		ttl:     ttl,
+		entries: make(map[uint32]pendingEntry),
+		stop:    make(chan struct{}),
+	}
+
+	interval := ttl / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	go t.sweep(interval)
+	return t
+}
+
+// Add adds the entry of seqId. The response or ErrPendingTimeout is sent
+// to ch without blocking, so ch should be buffered. An entry of the same
+// seqId is replaced.
+func (t *PendingTable) Add(seqId uint32, ch chan interface{}) {
+	t.mu.Lock()
+	t.entries[seqId] = pendingEntry{ch: ch, deadline: time.Now().Add(t.ttl)}
+	t.mu.Unlock()
+}
+
+// Complete sends resp to the waiter of seqId and removes the entry.
+// It reports whether seqId is found.
+func (t *PendingTable) Complete(seqId uint32, resp interface{}) bool {
+	t.mu.Lock()
+	e, ok := t.entries[seqId]
+	delete(t.entries, seqId)
+	t.mu.Unlock()
+
+	if ok {
+		deliver(e.ch, resp)
+	}
+	return ok
+}
+
+// OnOrphanResponse sets fn to be called with the responses passed to
+// CompleteResponse whose seqId is not found, e.g. a stray submit response
+// after a reconnect, or a late one of an expired entry, so that they could
+// be logged or counted. fn is called in the goroutine of CompleteResponse.
+func (t *PendingTable) OnOrphanResponse(fn func(id CommandId, seqId uint32, resp interface{})) {
+	t.mu.Lock()
+	t.orphan = fn
+	t.mu.Unlock()
+}
+
+// CompleteResponse is like Complete, but the response resp of command id
+// whose seqId is not found is passed to the callback of OnOrphanResponse.
+func (t *PendingTable) CompleteResponse(id CommandId, seqId uint32, resp interface{}) bool {
+	if t.Complete(seqId, resp) {
+		return true
+	}
+
+	t.mu.Lock()
+	orphan := t.orphan
+	t.mu.Unlock()
+	if orphan != nil {
+		orphan(id, seqId, resp)
+	}
+	return false
+}
+
+// CompleteAll sends resp to all the waiters and removes the entries,
+// e.g. to fail them once the connection is closed.
+func (t *PendingTable) CompleteAll(resp interface{}) {
+	t.mu.Lock()
+	entries := t.entries
+	t.entries = make(map[uint32]pendingEntry)
+	t.mu.Unlock()
+
+	for _, e := range entries {
+		deliver(e.ch, resp)
+	}
+}
+
+// Len returns the number of the pending entries.
+func (t *PendingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+// Close stops the sweeping goroutine, the entries left are not
+// completed any more.
+func (t *PendingTable) Close() {
+	t.once.Do(func() {
+		close(t.stop)
+	})
+}
+
+func (t *PendingTable) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			var expired []chan interface{}
+			t.mu.Lock()
+			for seqId, e := range t.entries {
+				if !now.Before(e.deadline) {
+					expired = append(expired, e.ch)
+					delete(t.entries, seqId)
+				}
+			}
+			t.mu.Unlock()
+
+			for _, ch := range expired {
+				deliver(ch, ErrPendingTimeout)
+			}
+		}
+	}
+}
+
+func deliver(ch chan interface{}, v interface{}) {
+	select {
+	case ch <- v:
+	default:
+	}
+}
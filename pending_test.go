@@ -0,0 +1,106 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestPendingTableComplete(t *testing.T) {
+	pt := cmpp.NewPendingTable(time.Second)
+	defer pt.Close()
+
+	var wg sync.WaitGroup
+	for i := uint32(1); i <= 50; i++ {
+		wg.Add(1)
+		go func(seqId uint32) {
+			defer wg.Done()
+			ch := make(chan interface{}, 1)
+			pt.Add(seqId, ch)
+			go pt.Complete(seqId, &cmpp.Cmpp3SubmitRspPkt{SeqId: seqId})
+
+			rsp := (<-ch).(*cmpp.Cmpp3SubmitRspPkt)
+			if rsp.SeqId != seqId {
+				t.Errorf("The response is of seqId %d, not equal to expected: %d\n", rsp.SeqId, seqId)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if pt.Len() != 0 {
+		t.Fatalf("The pending entries are %d, not equal to expected: %d\n", pt.Len(), 0)
+	}
+	if pt.Complete(1, nil) {
+		t.Fatal("Complete a completed entry returns true")
+	}
+}
+
+func TestPendingTableTimeout(t *testing.T) {
+	pt := cmpp.NewPendingTable(50 * time.Millisecond)
+	defer pt.Close()
+
+	ch := make(chan interface{}, 1)
+	pt.Add(0x17, ch)
+
+	select {
+	case v := <-ch:
+		if v != cmpp.ErrPendingTimeout {
+			t.Fatalf("The value received is %#v, not equal to expected: %#v\n", v, cmpp.ErrPendingTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The pending entry does not time out")
+	}
+
+	// a late response is dropped.
+	if pt.Complete(0x17, &cmpp.Cmpp3SubmitRspPkt{}) {
+		t.Fatal("Complete a timed out entry returns true")
+	}
+}
+
+func TestPendingTableOrphanResponse(t *testing.T) {
+	pt := cmpp.NewPendingTable(time.Second)
+	defer pt.Close()
+
+	type orphan struct {
+		id    cmpp.CommandId
+		seqId uint32
+		resp  interface{}
+	}
+	var orphans []orphan
+	pt.OnOrphanResponse(func(id cmpp.CommandId, seqId uint32, resp interface{}) {
+		orphans = append(orphans, orphan{id, seqId, resp})
+	})
+
+	ch := make(chan interface{}, 1)
+	pt.Add(1, ch)
+	if !pt.CompleteResponse(cmpp.CMPP_SUBMIT_RESP, 1, &cmpp.Cmpp3SubmitRspPkt{SeqId: 1}) {
+		t.Fatal("CompleteResponse a pending entry returns false")
+	}
+
+	// a response of an unknown seqId.
+	rsp := &cmpp.Cmpp3SubmitRspPkt{SeqId: 0x17}
+	if pt.CompleteResponse(cmpp.CMPP_SUBMIT_RESP, 0x17, rsp) {
+		t.Fatal("CompleteResponse an unknown seqId returns true")
+	}
+
+	expected := []orphan{{cmpp.CMPP_SUBMIT_RESP, 0x17, rsp}}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Fatalf("The orphan responses are %v, not equal to expected: %v\n", orphans, expected)
+	}
+}
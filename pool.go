@@ -0,0 +1,51 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import "sync"
+
+// payloadSizeClasses are the capacities of the pooled payload buffers,
+// the last one holds the largest packet of all versions.
+var payloadSizeClasses = [...]int{64, 256, 1024, 4096}
+
+var payloadPools [len(payloadSizeClasses)]sync.Pool
+
+// getPayload borrows a buffer of n bytes from the pool of the smallest
+// size class which fits n. The buffer should be returned by putPayload
+// once it is no longer used.
+func getPayload(n int) *[]byte {
+	for i, size := range payloadSizeClasses {
+		if n <= size {
+			if b, ok := payloadPools[i].Get().(*[]byte); ok {
+				*b = (*b)[:n]
+				return b
+			}
+			b := make([]byte, n, size)
+			return &b
+		}
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+// putPayload returns the buffer borrowed by getPayload to its pool.
+func putPayload(b *[]byte) {
+	c := cap(*b)
+	for i, size := range payloadSizeClasses {
+		if c == size {
+			payloadPools[i].Put(b)
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func newDeliverStreamConn(b testing.TB, n int) *streamConn {
+	p := &cmpp.Cmpp3DeliverReqPkt{
+		MsgId:            13025908756704198656,
+		DestId:           "900001",
+		SrcTerminalId:    "13412340000",
+		MsgLength:        18,
+		MsgContent:       "This is a test MO.",
+		RegisterDelivery: 0,
+	}
+	pkt, err := p.Pack(seqId)
+	if err != nil {
+		b.Fatal("Pack error:", err)
+	}
+	return newStreamConn(pkt, n)
+}
+
+func TestRecvDeliverStream(t *testing.T) {
+	c := &cmpp.Conn{
+		Conn:  newDeliverStreamConn(t, 16),
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	for i := 0; i < 100; i++ {
+		p, err := c.RecvAndUnpackPkt(0)
+		if err != nil {
+			t.Fatal("RecvAndUnpackPkt error:", err)
+		}
+		d, ok := p.(*cmpp.Cmpp3DeliverReqPkt)
+		if !ok {
+			t.Fatalf("The packet is %T, not equal to expected: *cmpp.Cmpp3DeliverReqPkt\n", p)
+		}
+		if d.MsgContent != "This is a test MO." {
+			t.Fatalf("The MsgContent is %s, not equal to expected: %s\n", d.MsgContent, "This is a test MO.")
+		}
+	}
+}
+
+// BenchmarkRecv10kDeliverPkts receives a stream of 10k deliver packets per op.
+func BenchmarkRecv10kDeliverPkts(b *testing.B) {
+	c := &cmpp.Conn{
+		Conn:  newDeliverStreamConn(b, 10000),
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 10000; j++ {
+			c.RecvAndUnpackPkt(0)
+		}
+	}
+}
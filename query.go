@@ -0,0 +1,192 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import "encoding/binary"
+
+// Packet length const for cmpp query request and response packets.
+const (
+	CmppQueryReqPktLen uint32 = 12 + 8 + 1 + 10 + 8   //39d, 0x27
+	CmppQueryRspPktLen uint32 = 12 + 8 + 1 + 10 + 4*8 //63d, 0x3f
+)
+
+// Query types in query request.
+const (
+	QueryTypeTotal   uint8 = 0 // query the total statistics
+	QueryTypeService uint8 = 1 // query the statistics of the service in QueryCode
+)
+
+type CmppQueryReqPkt struct {
+	Time      string // YYYYMMDD
+	QueryType uint8
+	QueryCode string
+	Reserve   string
+
+	// session info
+	SeqId uint32
+}
+
+type CmppQueryRspPkt struct {
+	Time      string // YYYYMMDD
+	QueryType uint8
+	QueryCode string
+	MtTlMsg   uint32 // total messages from SP
+	MtTlUsr   uint32 // total users from SP
+	MtScs     uint32 // messages forwarded successfully
+	MtWt      uint32 // messages waiting for forwarding
+	MtFl      uint32 // messages failed to forward
+	MoScs     uint32 // messages delivered to SP successfully
+	MoWt      uint32 // messages waiting for delivering to SP
+	MoFl      uint32 // messages failed to deliver to SP
+
+	// session info
+	SeqId uint32
+}
+
+// Pack packs the CmppQueryReqPkt to bytes stream for client side.
+func (p *CmppQueryReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppQueryReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppQueryReqPkt) pack(w *packetWriter, seqId uint32) error {
+	var pktLen = CmppQueryReqPktLen
+
+	w.Grow(pktLen)
+
+	// Pack header
+	w.WriteInt(binary.BigEndian, pktLen)
+	w.WriteInt(binary.BigEndian, CMPP_QUERY)
+	w.WriteInt(binary.BigEndian, seqId)
+	p.SeqId = seqId
+
+	// Pack Body
+	w.WriteFixedSizeString(p.Time, 8)
+	w.WriteByte(p.QueryType)
+	w.WriteFixedSizeString(p.QueryCode, 10)
+	w.WriteFixedSizeString(p.Reserve, 8)
+
+	return w.Error()
+}
+
+// Unpack unpack the binary byte stream to a CmppQueryReqPkt variable.
+// Usually it is used in server side. After unpack, you will get all value of fields in
+// CmppQueryReqPkt struct.
+func (p *CmppQueryReqPkt) Unpack(data []byte) error {
+	var r = newPacketReader(data)
+
+	// Sequence Id
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	// Body
+	p.Time = r.at("Time").ReadString(8)
+	p.QueryType = r.at("QueryType").ReadByte()
+	p.QueryCode = r.at("QueryCode").ReadString(10)
+	p.Reserve = r.at("Reserve").ReadString(8)
+
+	return r.unpackError(CMPP_QUERY, p)
+}
+
+// Pack packs the CmppQueryRspPkt to bytes stream for server side.
+func (p *CmppQueryRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppQueryRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppQueryRspPkt) pack(w *packetWriter, seqId uint32) error {
+	var pktLen = CmppQueryRspPktLen
+
+	w.Grow(pktLen)
+
+	// Pack header
+	w.WriteInt(binary.BigEndian, pktLen)
+	w.WriteInt(binary.BigEndian, CMPP_QUERY_RESP)
+	w.WriteInt(binary.BigEndian, seqId)
+	p.SeqId = seqId
+
+	// Pack Body
+	w.WriteFixedSizeString(p.Time, 8)
+	w.WriteByte(p.QueryType)
+	w.WriteFixedSizeString(p.QueryCode, 10)
+	w.WriteInt(binary.BigEndian, p.MtTlMsg)
+	w.WriteInt(binary.BigEndian, p.MtTlUsr)
+	w.WriteInt(binary.BigEndian, p.MtScs)
+	w.WriteInt(binary.BigEndian, p.MtWt)
+	w.WriteInt(binary.BigEndian, p.MtFl)
+	w.WriteInt(binary.BigEndian, p.MoScs)
+	w.WriteInt(binary.BigEndian, p.MoWt)
+	w.WriteInt(binary.BigEndian, p.MoFl)
+
+	return w.Error()
+}
+
+// Unpack unpack the binary byte stream to a CmppQueryRspPkt variable.
+// Usually it is used in client side. After unpack, you will get all value of fields in
+// CmppQueryRspPkt struct.
+func (p *CmppQueryRspPkt) Unpack(data []byte) error {
+	var r = newPacketReader(data)
+
+	// Sequence Id
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	// Body
+	p.Time = r.at("Time").ReadString(8)
+	p.QueryType = r.at("QueryType").ReadByte()
+	p.QueryCode = r.at("QueryCode").ReadString(10)
+	r.at("MtTlMsg").ReadInt(binary.BigEndian, &p.MtTlMsg)
+	r.at("MtTlUsr").ReadInt(binary.BigEndian, &p.MtTlUsr)
+	r.at("MtScs").ReadInt(binary.BigEndian, &p.MtScs)
+	r.at("MtWt").ReadInt(binary.BigEndian, &p.MtWt)
+	r.at("MtFl").ReadInt(binary.BigEndian, &p.MtFl)
+	r.at("MoScs").ReadInt(binary.BigEndian, &p.MoScs)
+	r.at("MoWt").ReadInt(binary.BigEndian, &p.MoWt)
+	r.at("MoFl").ReadInt(binary.BigEndian, &p.MoFl)
+
+	return r.unpackError(CMPP_QUERY_RESP, p)
+}
+
+// QueryTotals holds the statistics counters of a CmppQueryRspPkt.
+type QueryTotals struct {
+	MtMessages  uint32 // MT_TLMsg, total messages from SP
+	MtUsers     uint32 // MT_Tlusr, total users from SP
+	MtSucceeded uint32 // MT_Scs, messages forwarded successfully
+	MtWaiting   uint32 // MT_WT, messages waiting for forwarding
+	MtFailed    uint32 // MT_FL, messages failed to forward
+	MoSucceeded uint32 // MO_Scs, messages delivered to SP successfully
+	MoWaiting   uint32 // MO_WT, messages waiting for delivering to SP
+	MoFailed    uint32 // MO_FL, messages failed to deliver to SP
+}
+
+// Totals returns the statistics counters of p, e.g. to reconcile the daily
+// volume of the SP against them.
+func (p *CmppQueryRspPkt) Totals() QueryTotals {
+	return QueryTotals{
+		MtMessages:  p.MtTlMsg,
+		MtUsers:     p.MtTlUsr,
+		MtSucceeded: p.MtScs,
+		MtWaiting:   p.MtWt,
+		MtFailed:    p.MtFl,
+		MoSucceeded: p.MoScs,
+		MoWaiting:   p.MoWt,
+		MoFailed:    p.MoFl,
+	}
+}
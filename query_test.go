@@ -0,0 +1,145 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestCmppQueryReqPktPack(t *testing.T) {
+	p := &cmpp.CmppQueryReqPkt{
+		Time:      "20161014",
+		QueryType: cmpp.QueryTypeService,
+		QueryCode: "cmpp",
+	}
+
+	data, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("CmppQueryReqPkt pack error:", err)
+	}
+
+	if p.SeqId != seqId {
+		t.Fatalf("After pack, seqId is %d, not equal to expected: %d\n", p.SeqId, seqId)
+	}
+
+	// data after pack expected:
+	dataExpected := []byte{
+		0x00, 0x00, 0x00, 0x27, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x17,
+		0x32, 0x30, 0x31, 0x36, 0x31, 0x30, 0x31, 0x34, 0x01, 0x63, 0x6d, 0x70,
+		0x70, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+	}
+
+	if !bytes.Equal(data, dataExpected) {
+		t.Fatalf("After pack, data is %x, not equal to dataExpected: %x\n", data, dataExpected)
+	}
+
+	p1 := &cmpp.CmppQueryReqPkt{}
+	err = p1.Unpack(data[8:])
+	if err != nil {
+		t.Fatal("CmppQueryReqPkt unpack error:", err)
+	}
+	if *p1 != *p {
+		t.Fatalf("After unpack, packet is %#v, not equal to expected: %#v\n", *p1, *p)
+	}
+}
+
+func TestCmppQueryRspPktPackUnpack(t *testing.T) {
+	p := &cmpp.CmppQueryRspPkt{
+		Time:      "20161014",
+		QueryType: cmpp.QueryTypeTotal,
+		MtTlMsg:   100,
+		MtTlUsr:   10,
+		MtScs:     90,
+		MtWt:      6,
+		MtFl:      4,
+		MoScs:     30,
+		MoWt:      2,
+		MoFl:      1,
+	}
+
+	data, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("CmppQueryRspPkt pack error:", err)
+	}
+	if uint32(len(data)) != cmpp.CmppQueryRspPktLen {
+		t.Fatalf("After pack, data length is %d, not equal to length expected: %d\n", len(data), cmpp.CmppQueryRspPktLen)
+	}
+
+	c := &cmpp.Conn{
+		Conn: &fakeConn{
+			reader: bytes.NewBuffer(data),
+		},
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+	i, err := c.RecvAndUnpackPkt(0)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	p1, ok := i.(*cmpp.CmppQueryRspPkt)
+	if !ok {
+		t.Fatalf("The packet is %T, not equal to expected: *cmpp.CmppQueryRspPkt\n", i)
+	}
+	if *p1 != *p {
+		t.Fatalf("After unpack, packet is %#v, not equal to expected: %#v\n", *p1, *p)
+	}
+}
+
+func TestCmppQueryRspPktTotals(t *testing.T) {
+	// a response to the query of the service "cmpp" on 20161014.
+	data := []byte{
+		0x00, 0x00, 0x00, 0x3f, 0x80, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x17,
+		0x32, 0x30, 0x31, 0x36, 0x31, 0x30, 0x31, 0x34, 0x01, 0x63, 0x6d, 0x70,
+		0x70, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xe2, 0x40, 0x00,
+		0x00, 0x1e, 0xd2, 0x00, 0x01, 0xd4, 0xc0, 0x00, 0x00, 0x05, 0xb0, 0x00,
+		0x00, 0x07, 0xd0, 0x00, 0x00, 0x87, 0x07, 0x00, 0x00, 0x00, 0x0c, 0x00,
+		0x00, 0x00, 0x03,
+	}
+
+	p := &cmpp.CmppQueryRspPkt{}
+	err := p.Unpack(data[8:])
+	if err != nil {
+		t.Fatal("CmppQueryRspPkt unpack error:", err)
+	}
+	if p.Time != "20161014" || p.QueryType != cmpp.QueryTypeService || p.QueryCode != "cmpp" {
+		t.Fatalf("After unpack, packet is %#v, not the query of service cmpp on 20161014\n", *p)
+	}
+
+	totals := p.Totals()
+	totalsExpected := cmpp.QueryTotals{
+		MtMessages:  123456,
+		MtUsers:     7890,
+		MtSucceeded: 120000,
+		MtWaiting:   1456,
+		MtFailed:    2000,
+		MoSucceeded: 34567,
+		MoWaiting:   12,
+		MoFailed:    3,
+	}
+	if totals != totalsExpected {
+		t.Fatalf("The totals are %+v, not equal to expected: %+v\n", totals, totalsExpected)
+	}
+
+	data1, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("CmppQueryRspPkt pack error:", err)
+	}
+	if !bytes.Equal(data1, data) {
+		t.Fatalf("After pack, data is %x, not equal to dataExpected: %x\n", data1, data)
+	}
+}
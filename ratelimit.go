@@ -0,0 +1,90 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var errRateLimitCanceled = errors.New("rate limit wait is canceled")
+
+// rateLimiter is a token bucket, which is refilled with one token
+// every interval and holds burst tokens at most.
+type rateLimiter struct {
+	interval time.Duration
+	burst    float64
+
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+		burst:    float64(perSecond),
+		tokens:   float64(perSecond),
+		last:     time.Now(),
+	}
+}
+
+// wait takes a token from the bucket, it blocks until a token is available,
+// the deadline(if not zero) is exceeded, or cancel is closed.
+func (l *rateLimiter) wait(deadline time.Time, cancel <-chan struct{}) error {
+	for {
+		l.Lock()
+		now := time.Now()
+		l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.Unlock()
+			return nil
+		}
+		d := time.Duration((1 - l.tokens) * float64(l.interval))
+		l.Unlock()
+
+		if !deadline.IsZero() && now.Add(d).After(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-cancel:
+			t.Stop()
+			return errRateLimitCanceled
+		}
+	}
+}
+
+// WithRateLimit limits the submit requests sent on the Conn to perSecond
+// per second, a burst of perSecond requests is allowed. SendPkt blocks until
+// the request is permitted; SendPktTimeout and SendPktContext give up once
+// the timeout or the context fires. Packets other than submit requests,
+// such as active test, are not limited.
+func WithRateLimit(perSecond int) Option {
+	return func(c *Conn) {
+		if perSecond > 0 {
+			c.limiter = newRateLimiter(perSecond)
+		}
+	}
+}
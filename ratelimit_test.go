@@ -0,0 +1,77 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestRateLimit(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithRateLimit(10))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+	go io.Copy(io.Discard, c2)
+
+	// the burst is sent at once.
+	start := time.Now()
+	for i := 1; i <= 10; i++ {
+		err := c.SendPkt(newSubmitReqPkt(), uint32(i))
+		if err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("The burst of submits is sent after %v\n", d)
+	}
+
+	// active test bypasses the limiter.
+	err := c.SendPktTimeout(&cmpp.CmppActiveTestReqPkt{}, 11, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal("SendPktTimeout error:", err)
+	}
+
+	// the bucket is empty now.
+	err = c.SendPktTimeout(newSubmitReqPkt(), 12, 10*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, os.ErrDeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = c.SendPktContext(ctx, newSubmitReqPkt(), 13)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, context.DeadlineExceeded)
+	}
+
+	// wait for the next token.
+	start = time.Now()
+	err = c.SendPkt(newSubmitReqPkt(), 14)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("The submit is sent after %v, later than expected\n", d)
+	}
+}
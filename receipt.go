@@ -13,11 +13,21 @@
 
 package cmpp
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+)
 
 // Packet length const for cmpp receipt packet.
 const (
-	CmppReceiptPktLen uint32 = 60 //60d, 0x3c
+	CmppReceiptPktLen  uint32 = 60 //60d, 0x3c
+	Cmpp3ReceiptPktLen uint32 = 71 //71d, 0x47
+)
+
+// Errors for delivery receipt.
+var (
+	ErrReceiptLengthInvalid = errors.New("length of delivery receipt is invalid")
+	ErrNotReceipt           = errors.New("deliver packet is not a delivery receipt")
 )
 
 type CmppReceiptPkt struct {
@@ -45,26 +55,71 @@ func (p *CmppReceiptPkt) Pack() ([]byte, error) {
 	return w.Bytes()
 }
 
+// DeliveryReceipt is the status report carried in the Msg_Content
+// of a deliver packet whose Registered_Delivery is 1.
+type DeliveryReceipt = CmppReceiptPkt
+
+// ParseDeliveryReceipt parses the Msg_Content of a deliver packet to a
+// DeliveryReceipt. The cmpp2 layout(60 bytes) and the cmpp3 layout(71 bytes,
+// with a 32-byte Dest_terminal_Id) are told apart by the length of b,
+// any other length is rejected with ErrReceiptLengthInvalid.
+func ParseDeliveryReceipt(b []byte) (*DeliveryReceipt, error) {
+	var destLen int
+	switch uint32(len(b)) {
+	case CmppReceiptPktLen:
+		destLen = 21
+	case Cmpp3ReceiptPktLen:
+		destLen = 32
+	default:
+		return nil, ErrReceiptLengthInvalid
+	}
+
+	p := &DeliveryReceipt{}
+	if err := p.unpack(b, destLen); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Receipt parses the delivery receipt in the Msg_Content of p.
+// It returns ErrNotReceipt if p is not a delivery receipt.
+func (p *Cmpp2DeliverReqPkt) Receipt() (*DeliveryReceipt, error) {
+	if !p.IsReport() {
+		return nil, ErrNotReceipt
+	}
+	return ParseDeliveryReceipt([]byte(p.MsgContent))
+}
+
+// Receipt parses the delivery receipt in the Msg_Content of p.
+// It returns ErrNotReceipt if p is not a delivery receipt.
+func (p *Cmpp3DeliverReqPkt) Receipt() (*DeliveryReceipt, error) {
+	if !p.IsReport() {
+		return nil, ErrNotReceipt
+	}
+	return ParseDeliveryReceipt([]byte(p.MsgContent))
+}
+
 // Unpack unpack the binary byte stream to a CmppReceiptPkt variable.
 // After unpack, you will get all value of fields in
 // CmppReceiptPkt struct.
 func (p *CmppReceiptPkt) Unpack(data []byte) error {
+	return p.unpack(data, 21)
+}
+
+func (p *CmppReceiptPkt) unpack(data []byte, destLen int) error {
 	var r = newPacketReader(data)
+	r.base = 0 // the receipt is the Msg_Content of a deliver
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
 
-	stat := r.ReadCString(7)
-	p.Stat = string(stat)
+	p.Stat = r.at("Stat").ReadString(7)
 
-	submitTime := r.ReadCString(10)
-	p.SubmitTime = string(submitTime)
+	p.SubmitTime = r.at("SubmitTime").ReadString(10)
 
-	doneTime := r.ReadCString(10)
-	p.DoneTime = string(doneTime)
+	p.DoneTime = r.at("DoneTime").ReadString(10)
 
-	destTerminalId := r.ReadCString(21)
-	p.DestTerminalId = string(destTerminalId)
+	p.DestTerminalId = r.at("DestTerminalId").ReadString(destLen)
 
-	r.ReadInt(binary.BigEndian, &p.SmscSequence)
-	return r.Error()
+	r.at("SmscSequence").ReadInt(binary.BigEndian, &p.SmscSequence)
+	return r.unpackError(CMPP_DELIVER, p)
 }
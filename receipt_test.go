@@ -87,3 +87,67 @@ func TestCmppReceiptPktUnpack(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDeliveryReceipt(t *testing.T) {
+	data2 := []byte{
+		0xb4, 0xc5, 0x53, 0x00, 0x00, 0x01, 0x00, 0x00, 0x44, 0x45, 0x4c, 0x49, 0x56, 0x52, 0x44, 0x31,
+		0x35, 0x31, 0x31, 0x31, 0x32, 0x30, 0x39, 0x35, 0x35, 0x31, 0x35, 0x31, 0x31, 0x31, 0x32, 0x30,
+		0x39, 0x35, 0x37, 0x31, 0x33, 0x34, 0x31, 0x32, 0x33, 0x34, 0x30, 0x30, 0x30, 0x30, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x12, 0x34, 0x56, 0x78,
+	}
+
+	// cmpp3 receipt has a 32-byte Dest_terminal_Id.
+	data3 := append(append(append([]byte{}, data2[:56]...), make([]byte, 11)...), data2[56:]...)
+
+	for _, data := range [][]byte{data2, data3} {
+		p, err := cmpp.ParseDeliveryReceipt(data)
+		if err != nil {
+			t.Fatal("ParseDeliveryReceipt error:", err)
+		}
+
+		var resultSet = []struct {
+			name          string
+			value         interface{}
+			expectedValue interface{}
+		}{
+			{"MsgId", p.MsgId, uint64(13025908756704198656)},
+			{"Stat", p.Stat, "DELIVRD"},
+			{"SubmitTime", p.SubmitTime, "1511120955"},
+			{"DoneTime", p.DoneTime, "1511120957"},
+			{"DestTerminalId", p.DestTerminalId, "13412340000"},
+			{"SmscSequence", p.SmscSequence, uint32(0x12345678)},
+		}
+
+		for _, r := range resultSet {
+			if r.value != r.expectedValue {
+				t.Fatalf("After parse, %s in receipt is %#v, not equal to the expected value: %#v\n", r.name, r.value, r.expectedValue)
+			}
+		}
+	}
+
+	// truncated receipt
+	_, err := cmpp.ParseDeliveryReceipt(data2[:59])
+	if err != cmpp.ErrReceiptLengthInvalid {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrReceiptLengthInvalid)
+	}
+
+	// receipt in deliver packet
+	d := &cmpp.Cmpp3DeliverReqPkt{
+		RegisterDelivery: 1,
+		MsgLength:        uint8(len(data3)),
+		MsgContent:       string(data3),
+	}
+	p, err := d.Receipt()
+	if err != nil {
+		t.Fatal("Cmpp3DeliverReqPkt Receipt error:", err)
+	}
+	if p.Stat != "DELIVRD" {
+		t.Fatalf("The stat of receipt is %s, not equal to the expected value: %s\n", p.Stat, "DELIVRD")
+	}
+
+	d.RegisterDelivery = 0
+	_, err = d.Receipt()
+	if err != cmpp.ErrNotReceipt {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrNotReceipt)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned by ReconnectingClient when the
+// connection is down.
+var ErrNotConnected = errors.New("client is not connected")
+
+// ErrClientClosed is returned by ReconnectingClient after Close.
+var ErrClientClosed = errors.New("client is closed")
+
+// DownPolicy decides what Submit of ReconnectingClient does
+// when the connection is down.
+type DownPolicy int
+
+const (
+	// RejectWhenDown makes Submit return ErrNotConnected at once.
+	RejectWhenDown DownPolicy = iota
+	// WaitWhenDown makes Submit wait for the reconnection, until
+	// the wait timeout set by WithDownPolicy.
+	WaitWhenDown
+)
+
+// ReconnectOption sets an optional parameter of a ReconnectingClient.
+type ReconnectOption func(*ReconnectingClient)
+
+// WithBackoff sets the delays before re-dialing, the delay starts from min
+// and doubles after each failure up to max. A random jitter of up to half
+// of the delay is subtracted. The default is 1s and 30s.
+func WithBackoff(min, max time.Duration) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.minBackoff, rc.maxBackoff = min, max
+	}
+}
+
+// WithReconnectActiveTest starts the active test on every connection,
+// see Conn.StartActiveTest. A heartbeat failure triggers a reconnection.
+func WithReconnectActiveTest(interval time.Duration, maxMiss int) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.atInterval, rc.atMaxMiss = interval, maxMiss
+	}
+}
+
+// WithDownPolicy sets the DownPolicy, wait is the max time Submit waits
+// for the reconnection with WaitWhenDown, zero means no limit.
+func WithDownPolicy(policy DownPolicy, wait time.Duration) ReconnectOption {
+	return func(rc *ReconnectingClient) {
+		rc.policy, rc.wait = policy, wait
+	}
+}
+
+// ReconnectingClient is a client which keeps a connection to the server.
+// It re-dials with exponential backoff and logins again once the connection
+// is broken by a read error or a heartbeat failure.
+//
+// The packets received from all the connections are delivered by Packets,
+// except the active test requests, which are answered by the client itself.
+type ReconnectingClient struct {
+	typ                  Type
+	addr, user, password string
+	timeout              time.Duration
+
+	minBackoff, maxBackoff time.Duration
+	atInterval             time.Duration
+	atMaxMiss              int
+	policy                 DownPolicy
+	wait                   time.Duration
+
+	pkts   chan interface{}
+	closed chan struct{}
+	once   sync.Once
+
+	mu  sync.Mutex
+	cli *Client       // nil when the connection is down
+	up  chan struct{} // closed when cli is set
+}
+
+// NewReconnectingClient returns a ReconnectingClient of version typ, which
+// logins to the server at addr with user and password. The timeout is for
+// dialing and the login. Call Start to connect.
+func NewReconnectingClient(typ Type, addr, user, password string, timeout time.Duration, opts ...ReconnectOption) *ReconnectingClient {
+	rc := &ReconnectingClient{
+		typ:        typ,
+		addr:       addr,
+		user:       user,
+		password:   password,
+		timeout:    timeout,
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+		pkts:       make(chan interface{}, 64),
+		closed:     make(chan struct{}),
+		up:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(rc)
+	}
+	return rc
+}
+
+// Start starts the goroutine which connects and keeps reconnecting to
+// the server until Close is called.
+func (rc *ReconnectingClient) Start() {
+	go rc.run()
+}
+
+// Packets returns the channel of the packets received. It is closed
+// after Close.
+func (rc *ReconnectingClient) Packets() <-chan interface{} {
+	return rc.pkts
+}
+
+// Close stops reconnecting and closes the current connection.
+func (rc *ReconnectingClient) Close() {
+	rc.once.Do(func() {
+		close(rc.closed)
+		rc.mu.Lock()
+		if rc.cli != nil {
+			rc.cli.Disconnect()
+		}
+		rc.mu.Unlock()
+	})
+}
+
+// Submit sends the submit request packet p on the current connection,
+// see Client.Submit. When the connection is down, it acts as the
+// DownPolicy tells.
+func (rc *ReconnectingClient) Submit(p Packer) (uint32, error) {
+	cli, err := rc.client()
+	if err != nil {
+		return 0, err
+	}
+	return cli.Submit(p)
+}
+
+// SendRspPkt sends the response packet, e.g. the deliver response,
+// on the current connection.
+func (rc *ReconnectingClient) SendRspPkt(p Packer, seqId uint32) error {
+	cli, err := rc.client()
+	if err != nil {
+		return err
+	}
+	return cli.SendRspPkt(p, seqId)
+}
+
+// client returns the current client, waiting for it if the policy
+// is WaitWhenDown.
+func (rc *ReconnectingClient) client() (*Client, error) {
+	rc.mu.Lock()
+	cli, up := rc.cli, rc.up
+	rc.mu.Unlock()
+
+	select {
+	case <-rc.closed:
+		return nil, ErrClientClosed
+	default:
+	}
+	if cli != nil {
+		return cli, nil
+	}
+	if rc.policy == RejectWhenDown {
+		return nil, ErrNotConnected
+	}
+
+	var timeout <-chan time.Time
+	if rc.wait != 0 {
+		t := time.NewTimer(rc.wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-up:
+		return rc.client()
+	case <-timeout:
+		return nil, ErrNotConnected
+	case <-rc.closed:
+		return nil, ErrClientClosed
+	}
+}
+
+func (rc *ReconnectingClient) run() {
+	defer close(rc.pkts)
+
+	backoff := rc.minBackoff
+	for {
+		cli := NewClient(rc.typ)
+		err := cli.Connect(rc.addr, rc.user, rc.password, rc.timeout)
+		if err == nil {
+			backoff = rc.minBackoff
+			rc.serve(cli)
+		}
+
+		d := backoff - time.Duration(rand.Int63n(int64(backoff)/2+1))
+		select {
+		case <-rc.closed:
+			return
+		case <-time.After(d):
+		}
+
+		if err != nil {
+			if backoff *= 2; backoff > rc.maxBackoff {
+				backoff = rc.maxBackoff
+			}
+		}
+	}
+}
+
+// serve receives packets on cli until the connection is broken.
+func (rc *ReconnectingClient) serve(cli *Client) {
+	rc.mu.Lock()
+	select {
+	case <-rc.closed:
+		rc.mu.Unlock()
+		cli.Disconnect()
+		return
+	default:
+	}
+	rc.cli = cli
+	close(rc.up)
+	rc.mu.Unlock()
+
+	defer func() {
+		rc.mu.Lock()
+		rc.cli = nil
+		rc.up = make(chan struct{})
+		rc.mu.Unlock()
+		cli.Disconnect()
+	}()
+
+	if rc.atInterval > 0 {
+		cli.conn.StartActiveTest(rc.atInterval, rc.atMaxMiss)
+	}
+
+	for {
+		p, err := cli.RecvAndUnpackPkt(0)
+		if err != nil {
+			if err == ErrCommandIdNotSupported {
+				continue
+			}
+			return
+		}
+
+		if req, ok := p.(*CmppActiveTestReqPkt); ok {
+			cli.conn.RespondActiveTest(req.SeqId)
+			continue
+		}
+
+		select {
+		case rc.pkts <- p:
+		case <-rc.closed:
+			return
+		}
+	}
+}
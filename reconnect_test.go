@@ -0,0 +1,103 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+// flakyIsmg drops the first connection right after the login, and serves
+// the second one: it sends a deliver request, and answers the submits.
+func flakyIsmg(t *testing.T) string {
+	return serveIsmg(t, cmpp.V30, 2, func(n int, c *cmpp.Conn, i interface{}) bool {
+		switch p := i.(type) {
+		case *cmpp.CmppConnReqPkt:
+			if c.SendPkt(connRsp(cmpp.V30, p, 0), p.SeqId) != nil || n == 0 {
+				return false
+			}
+			c.SendPkt(&cmpp.Cmpp3DeliverReqPkt{MsgId: 1, MsgContent: "mo", MsgLength: 2}, c.NextSeqId())
+		case *cmpp.Cmpp3SubmitReqPkt:
+			c.SendPkt(&cmpp.Cmpp3SubmitRspPkt{MsgId: uint64(p.SeqId)}, p.SeqId)
+		}
+		return true
+	})
+}
+
+func TestReconnectingClient(t *testing.T) {
+	addr := flakyIsmg(t)
+
+	rc := cmpp.NewReconnectingClient(cmpp.V30, addr, "900001", "888888", time.Second,
+		cmpp.WithBackoff(10*time.Millisecond, 100*time.Millisecond),
+		cmpp.WithDownPolicy(cmpp.WaitWhenDown, 2*time.Second))
+	rc.Start()
+	defer rc.Close()
+
+	select {
+	case i := <-rc.Packets():
+		p, ok := i.(*cmpp.Cmpp3DeliverReqPkt)
+		if !ok || p.MsgContent != "mo" {
+			t.Fatalf("The packet received is %#v, not the deliver request expected\n", i)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No packet is received after the reconnection")
+	}
+
+	seqId, err := rc.Submit(newSubmitReqPkt())
+	if err != nil {
+		t.Fatal("Submit error:", err)
+	}
+	select {
+	case i := <-rc.Packets():
+		p, ok := i.(*cmpp.Cmpp3SubmitRspPkt)
+		if !ok || p.SeqId != seqId {
+			t.Fatalf("The packet received is %#v, not the submit response of seqId %d\n", i, seqId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No submit response is received")
+	}
+}
+
+func TestReconnectingClientRejectWhenDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	addr := l.Addr().String()
+	l.Close() // nobody listens.
+
+	rc := cmpp.NewReconnectingClient(cmpp.V30, addr, "900001", "888888", 100*time.Millisecond,
+		cmpp.WithBackoff(10*time.Millisecond, 20*time.Millisecond))
+	rc.Start()
+
+	if _, err := rc.Submit(newSubmitReqPkt()); err != cmpp.ErrNotConnected {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrNotConnected)
+	}
+
+	rc.Close()
+	if _, err := rc.Submit(newSubmitReqPkt()); err != cmpp.ErrClientClosed {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrClientClosed)
+	}
+	select {
+	case _, ok := <-rc.Packets():
+		if ok {
+			t.Fatal("The packets channel is not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The packets channel is not closed after Close")
+	}
+}
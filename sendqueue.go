@@ -0,0 +1,123 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"sync"
+)
+
+// sendQueueSize is the capacity of the send queue of Enqueue.
+const sendQueueSize = 64
+
+type queuedPkt struct {
+	pkt   Packer
+	seqId uint32
+}
+
+// sendQueue is the queue of the packets enqueued by Enqueue, which are
+// written by a single writer goroutine.
+type sendQueue struct {
+	sync.Mutex // serializes the enqueuing, so the seqIds are in the queue order
+	ch         chan queuedPkt
+
+	errMu sync.Mutex
+	err   error // the first write error of the writer
+}
+
+func (q *sendQueue) setErr(err error) {
+	q.errMu.Lock()
+	defer q.errMu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *sendQueue) getErr() error {
+	q.errMu.Lock()
+	defer q.errMu.Unlock()
+	return q.err
+}
+
+// Enqueue puts pkt into the send queue of c, and returns the seqId it is
+// sent with. The packets in the queue are written one by one by a writer
+// goroutine of c, in the order they are enqueued, so the callers need not
+// serialize their sends. Enqueue blocks only if the queue is full.
+//
+// The seqIds are taken from NextSeqId in the order of the queue too. An
+// invalid packet, which fails to be packed, and a submit request while c is
+// being drained are rejected by Enqueue at once. A write error, a *WriteError,
+// is returned by the following calls of Enqueue, with which the packets left
+// in the queue are dropped; ErrConnIsClosed is returned once c is closed.
+// Other errors of the writer only drop the packet with them, they are logged.
+// The packets sent by SendPkt directly may be interleaved with the queued ones.
+func (c *Conn) Enqueue(pkt Packer) (uint32, error) {
+	closed := c.closeNotify()
+	select {
+	case <-closed:
+		return 0, ErrConnIsClosed
+	default:
+	}
+
+	if err := checkPack(pkt); err != nil {
+		return 0, err
+	}
+	if isSubmitReq(pkt) && c.drain.isDraining() {
+		return 0, ErrConnDraining
+	}
+
+	q := &c.queue
+	q.Lock()
+	defer q.Unlock()
+	if err := q.getErr(); err != nil {
+		return 0, err
+	}
+	if q.ch == nil {
+		q.ch = make(chan queuedPkt, sendQueueSize)
+		go c.writeQueue(q.ch, closed)
+	}
+
+	seqId := c.NextSeqId()
+	select {
+	case q.ch <- queuedPkt{pkt: pkt, seqId: seqId}:
+		return seqId, nil
+	case <-closed:
+		return 0, ErrConnIsClosed
+	}
+}
+
+func isWriteError(err error) bool {
+	var we *WriteError
+	return errors.As(err, &we)
+}
+
+// writeQueue writes the packets in ch until c is closed.
+func (c *Conn) writeQueue(ch <-chan queuedPkt, closed <-chan struct{}) {
+	for {
+		select {
+		case p := <-ch:
+			if c.queue.getErr() != nil {
+				continue // drop the packets after a write error.
+			}
+			if err := c.SendPkt(p.pkt, p.seqId); err != nil {
+				c.log().Errorf("cmpp: send the queued packet[%d] error: %s", p.seqId, err)
+				if isWriteError(err) {
+					c.queue.setErr(err) // the connection is broken.
+				}
+			}
+		case <-closed:
+			return
+		}
+	}
+}
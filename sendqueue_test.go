@@ -0,0 +1,160 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestConnEnqueue(t *testing.T) {
+	const producers, count = 4, 250
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	received := make(chan *cmpp.Cmpp3SubmitReqPkt, producers*count)
+	go func() {
+		for i := 0; i < producers*count; i++ {
+			p, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- p.(*cmpp.Cmpp3SubmitReqPkt)
+		}
+		close(received)
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	defer c.Close()
+
+	// seqIds[g][i] is the seqId of the ith packet of the producer g.
+	var seqIds [producers][count]uint32
+	var wg sync.WaitGroup
+	for g := 0; g < producers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				p := newSubmitReqPkt()
+				p.MsgContent = fmt.Sprintf("%d-%d", g, i)
+				seqId, err := c.Enqueue(p)
+				if err != nil {
+					t.Error("Enqueue error:", err)
+					return
+				}
+				seqIds[g][i] = seqId
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the packets are written in the order of the queue, so are the seqIds
+	// and the packets of every producer.
+	var next [producers]int
+	var n uint32
+	for p := range received {
+		n++
+		if p.SeqId != n {
+			t.Fatalf("The seqId of the packet %d is %d, not equal to expected: %d\n", n, p.SeqId, n)
+		}
+		var g, i int
+		fmt.Sscanf(p.MsgContent, "%d-%d", &g, &i)
+		if i != next[g] || seqIds[g][i] != p.SeqId {
+			t.Fatalf("The packet %q[%d] is received, not equal to expected: \"%d-%d\"[%d]\n",
+				p.MsgContent, p.SeqId, g, next[g], seqIds[g][next[g]])
+		}
+		next[g]++
+	}
+	if n != producers*count {
+		t.Fatalf("The count of packets received is %d, not equal to expected: %d\n", n, producers*count)
+	}
+}
+
+func TestConnEnqueueError(t *testing.T) {
+	c1, c2 := net.Pipe()
+	c2.Close() // the writes fail.
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithWriteTimeout(time.Second))
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	if _, err := c.Enqueue(newSubmitReqPkt()); err != nil {
+		t.Fatal("Enqueue error:", err)
+	}
+
+	// the write error is returned by the following calls.
+	var err error
+	for start := time.Now(); err == nil && time.Since(start) < time.Second; {
+		_, err = c.Enqueue(newSubmitReqPkt())
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, io.ErrClosedPipe)
+	}
+
+	c.Close()
+	if _, err = c.Enqueue(newSubmitReqPkt()); err != cmpp.ErrConnIsClosed {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrConnIsClosed)
+	}
+}
+
+func TestConnEnqueueInvalid(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	peer := cmpp.NewConn(c2, cmpp.V30)
+	peer.SetState(cmpp.CONN_AUTHOK)
+	received := make(chan interface{}, 1)
+	go func() {
+		p, err := peer.RecvAndUnpackPkt(0)
+		if err == nil {
+			received <- p
+		}
+	}()
+
+	c := cmpp.NewConn(c1, cmpp.V30)
+	c.SetState(cmpp.CONN_AUTHOK)
+	defer c.Close()
+
+	// the invalid packet is rejected, the queue keeps working.
+	bad := newSubmitReqPkt()
+	bad.MsgSrc = "9001"
+	if _, err := c.Enqueue(bad); err != cmpp.ErrMsgSrcInvalid {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrMsgSrcInvalid)
+	}
+
+	seqId, err := c.Enqueue(newSubmitReqPkt())
+	if err != nil {
+		t.Fatal("Enqueue error:", err)
+	}
+	select {
+	case p := <-received:
+		if p, ok := p.(*cmpp.Cmpp3SubmitReqPkt); !ok || p.SeqId != seqId {
+			t.Fatalf("The packet received is %#v, not the submit request of seqId %d\n", p, seqId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The packet enqueued is not received")
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -34,6 +35,9 @@ var (
 type Packet struct {
 	Packer
 	*Conn
+
+	// CommandId is the command id in the header of the packet.
+	CommandId CommandId
 }
 
 type Response struct {
@@ -64,6 +68,125 @@ func (f HandlerFunc) ServeCmpp(r *Response, p *Packet, l *log.Logger) (bool, err
 	return f(r, p, l)
 }
 
+// PacketHandler is a simplified interface for a cmpp server, it is adapted to
+// a Handler by HandlePackets.
+//
+// OnConnect checks the connect request, and returns the status of the
+// connect response along with the shared secret of req.SrcAddr, which is used
+// to compute the AuthenticatorISMG. A non-zero status closes the connection.
+//
+// OnSubmit handles the cmpp3 submit request, and returns the MsgId and
+// the result of the submit response.
+type PacketHandler interface {
+	OnConnect(req *CmppConnReqPkt) (status uint8, secret string)
+	OnSubmit(req *Cmpp3SubmitReqPkt) (msgId uint64, status uint32)
+}
+
+// HandlePackets returns a Handler which dispatches the connect
+// and cmpp3 submit requests to h. Other packets are passed to
+// the next handler in the chain.
+func HandlePackets(h PacketHandler) Handler {
+	return HandlerFunc(func(r *Response, p *Packet, l *log.Logger) (bool, error) {
+		switch req := p.Packer.(type) {
+		case *CmppConnReqPkt:
+			status, secret := h.OnConnect(req)
+			return false, answerConnect(r, p, l, status, secret)
+		case *Cmpp3SubmitReqPkt:
+			rsp := r.Packer.(*Cmpp3SubmitRspPkt)
+			rsp.MsgId, rsp.Result = h.OnSubmit(req)
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+// A CommandHandler handles the request pkt of seqId received on c, and
+// sends back its response by itself, e.g. with c.SendPkt. A non-nil error
+// closes the connection.
+type CommandHandler func(c *Conn, seqId uint32, pkt interface{}) error
+
+// ServeMux is a Handler which dispatches the packets to the CommandHandlers
+// registered for their command ids, like http.ServeMux does for the paths.
+// The packets of other commands are passed to the next handler in the chain,
+// or answered with the default response, i.e. a zero status, if it is the
+// last one.
+//
+// A handler of CMPP_CONNECT should set the state of c to CONN_AUTHOK once the
+// login succeeds, see Conn.SetState.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[CommandId]CommandHandler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{m: make(map[CommandId]CommandHandler)}
+}
+
+// Handle registers the handler for the command id, it replaces the handler
+// registered before. A nil handler unregisters the command id.
+func (mux *ServeMux) Handle(id CommandId, handler CommandHandler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if handler == nil {
+		delete(mux.m, id)
+		return
+	}
+	mux.m[id] = handler
+}
+
+func (mux *ServeMux) handler(id CommandId) CommandHandler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	return mux.m[id]
+}
+
+// ServeCmpp dispatches the packet in p to the handler registered for its
+// command id, the default response in r is dropped as the handler answers
+// the packet by itself.
+func (mux *ServeMux) ServeCmpp(r *Response, p *Packet, l *log.Logger) (bool, error) {
+	h := mux.handler(p.CommandId)
+	if h == nil {
+		return true, nil
+	}
+
+	r.Packer = nil
+	return false, h(p.Conn, r.SeqId, p.Packer)
+}
+
+// answerConnect sets the connect response of the request in p with status
+// and secret. It returns the error of non-zero status.
+func answerConnect(r *Response, p *Packet, l *log.Logger, status uint8, secret string) error {
+	req := p.Packer.(*CmppConnReqPkt)
+	switch rsp := r.Packer.(type) {
+	case *Cmpp3ConnRspPkt:
+		rsp.Status, rsp.AuthSrc, rsp.Secret, rsp.Version = uint32(status), req.AuthSrc, secret, V30
+	case *Cmpp2ConnRspPkt:
+		rsp.Status, rsp.AuthSrc, rsp.Secret, rsp.Version = status, req.AuthSrc, secret, p.Conn.Typ
+	}
+
+	if status != 0 {
+		err, ok := ConnRspStatusErrMap[status]
+		if !ok {
+			err = errConnOthers
+		}
+		l.Printf("%s login error: %s\n", req.SrcAddr, err)
+		return err
+	}
+	p.Conn.SetState(CONN_AUTHOK)
+	return nil
+}
+
+// Server serves the cmpp connections of the SPs. The packets received on a
+// connection are handled one by one in the order they arrive: the handler
+// of a packet returns, and its response is sent, before the next packet is
+// read, so the handlers see and answer them strictly in order. The cost is
+// the throughput of a connection, which is bounded by the latency of the
+// handler, a slow one stalls the reading, and the peer once its window is
+// full. To handle them concurrently at the cost of the order, a handler may
+// set Response.Packer to nil, so no response is sent on its return, and hand
+// the packets over to goroutines of its own, which answer them later with
+// Packet.Conn.SendPkt.
 type Server struct {
 	Addr    string
 	Handler Handler
@@ -78,6 +201,79 @@ type Server struct {
 	// If nil, logging goes to os.Stderr via the log package's
 	// standard logger.
 	ErrorLog *log.Logger
+
+	idleTimeout time.Duration // see WithIdleTimeout
+	maxConns    int32         // see WithMaxConns
+	tsSkew      time.Duration // see WithTimestampSkew
+	mux         *ServeMux     // see Handle
+	pool        *ConnPool     // see WithConnPool
+	conns       int32         // the number of current connections
+}
+
+// ServerOption configures a Server created by NewServer.
+type ServerOption func(*Server)
+
+// WithIdleTimeout makes the server close the connections on which no
+// packet, including the active test, is received within d.
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.idleTimeout = d
+	}
+}
+
+// WithMaxConns limits the number of the simultaneous connections of the
+// server to n. The connect request on the connections exceeding the limit
+// is answered with status 5(other errors) and the connection is closed.
+func WithMaxConns(n int) ServerOption {
+	return func(srv *Server) {
+		srv.maxConns = int32(n)
+	}
+}
+
+// WithTimestampSkew makes the server reject the connect requests whose
+// Timestamp differs from the current time by more than d, which are likely
+// replayed, with status 3(authentication failed). The Timestamp is taken
+// in the local time zone of the server, see ParseConnTimestamp.
+func WithTimestampSkew(d time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.tsSkew = d
+	}
+}
+
+// WithConnPool makes the server create the Conns of the connections by a
+// ConnPool of the Type given to NewServer, so the read buffers of the closed
+// connections are reused by the new ones, which saves an allocation per
+// accepted connection for a server with many short-lived connections.
+func WithConnPool() ServerOption {
+	return func(srv *Server) {
+		srv.pool = NewConnPool(srv.Typ)
+	}
+}
+
+// NewServer returns a Server listening on addr for the typ protocol, the
+// active test is disabled until T and N are set.
+func NewServer(addr string, typ Type, handler Handler, opts ...ServerOption) *Server {
+	srv := &Server{
+		Addr:    addr,
+		Handler: handler,
+		Typ:     typ,
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// Handle registers the handler for the command id on srv, it should be
+// called before srv serves. The packets of the registered commands are
+// dispatched to their handlers before srv.Handler, which gets the others.
+// Handler may be nil then, and the packets of the commands not registered
+// are answered with the default response. See ServeMux.
+func (srv *Server) Handle(id CommandId, handler CommandHandler) {
+	if srv.mux == nil {
+		srv.mux = NewServeMux()
+	}
+	srv.mux.Handle(id, handler)
 }
 
 // A conn represents the server side of a Cmpp connection.
@@ -91,6 +287,9 @@ type conn struct {
 	done    chan struct{}
 	exceed  chan struct{}
 	counter int32
+
+	// terminated is set when the peer's terminate request is answered.
+	terminated bool
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
@@ -98,6 +297,10 @@ type conn struct {
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if srv.ErrorLog == nil {
+		srv.ErrorLog = log.New(os.Stderr, "cmppserver: ", log.LstdFlags)
+	}
+
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rw, e := l.Accept()
@@ -123,6 +326,14 @@ func (srv *Server) Serve(l net.Listener) error {
 			continue
 		}
 
+		if n := atomic.AddInt32(&srv.conns, 1); srv.maxConns > 0 && n > srv.maxConns {
+			// a rejected connection does not count, however slow the reject is.
+			atomic.AddInt32(&srv.conns, -1)
+			srv.ErrorLog.Printf("too many connections, reject the connection from %v\n", c.Conn.RemoteAddr())
+			go c.reject()
+			continue
+		}
+
 		srv.ErrorLog.Printf("accept a connection from %v\n", c.Conn.RemoteAddr())
 		go c.serve()
 	}
@@ -130,7 +341,10 @@ func (srv *Server) Serve(l net.Listener) error {
 
 func (c *conn) readPacket() (*Response, error) {
 	readTimeout := time.Second * 2
-	i, err := c.Conn.RecvAndUnpackPkt(readTimeout)
+	if d := c.server.idleTimeout; d > 0 && d < readTimeout {
+		readTimeout = d
+	}
+	id, seqId, i, err := c.Conn.RecvAndUnpackPktWithHeader(readTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -314,21 +528,48 @@ func (c *conn) readPacket() (*Response, error) {
 		return nil, NewOpError(ErrUnsupportedPkt,
 			fmt.Sprintf("readPacket: receive unsupported packet type: %#v", p))
 	}
+	pkt.CommandId, rsp.SeqId = id, seqId
 	return rsp, nil
 }
 
 // Close the connection.
 func (c *conn) close() {
-	p := &CmppTerminateReqPkt{}
+	if !c.terminated {
+		p := &CmppTerminateReqPkt{}
 
-	err := c.Conn.SendPkt(p, <-c.Conn.SeqId)
-	if err != nil {
-		c.server.ErrorLog.Printf("send cmpp terminate request packet to %v error: %v\n", c.Conn.RemoteAddr(), err)
+		err := c.Conn.SendPkt(p, c.Conn.NextSeqId())
+		if err != nil {
+			c.server.ErrorLog.Printf("send cmpp terminate request packet to %v error: %v\n", c.Conn.RemoteAddr(), err)
+		}
 	}
 
 	close(c.done)
 	c.server.ErrorLog.Printf("close connection with %v!\n", c.Conn.RemoteAddr())
 	c.Conn.Close()
+	atomic.AddInt32(&c.server.conns, -1)
+}
+
+// reject answers the connect request with status ErrnoConnOthers,
+// and then closes the connection.
+func (c *conn) reject() {
+	defer c.Conn.Close()
+
+	i, err := c.Conn.RecvAndUnpackPkt(2 * time.Second)
+	if err != nil {
+		return
+	}
+	req, ok := i.(*CmppConnReqPkt)
+	if !ok {
+		return
+	}
+
+	var rsp Packer = &Cmpp2ConnRspPkt{Status: ErrnoConnOthers, Version: c.server.Typ}
+	if c.server.Typ == V30 {
+		rsp = &Cmpp3ConnRspPkt{Status: uint32(ErrnoConnOthers), Version: V30}
+	}
+	if err = c.Conn.SendPkt(rsp, req.SeqId); err != nil {
+		c.server.ErrorLog.Printf("send cmpp connect response to %v error: %v\n", c.Conn.RemoteAddr(), err)
+	}
 }
 
 func (c *conn) finishPacket(r *Response) error {
@@ -351,6 +592,11 @@ func startActiveTest(c *conn) {
 	c.done = done
 	c.exceed = exceed
 
+	if c.t <= 0 {
+		// active test is disabled.
+		return
+	}
+
 	go func() {
 		t := time.NewTicker(c.t)
 		defer t.Stop()
@@ -369,7 +615,7 @@ func startActiveTest(c *conn) {
 				}
 				// send a active test packet to peer, increase the active test counter
 				p := &CmppActiveTestReqPkt{}
-				err := c.Conn.SendPkt(p, <-c.Conn.SeqId)
+				err := c.Conn.SendPkt(p, c.Conn.NextSeqId())
 				if err != nil {
 					c.server.ErrorLog.Printf("send cmpp active test request to %v error: %v", c.Conn.RemoteAddr(), err)
 				} else {
@@ -393,6 +639,7 @@ func (c *conn) serve() {
 	// start a goroutine for sending active test.
 	startActiveTest(c)
 
+	lastRecv := time.Now()
 	for {
 		select {
 		case <-c.exceed:
@@ -403,27 +650,90 @@ func (c *conn) serve() {
 		r, err := c.readPacket()
 		if err != nil {
 			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if d := c.server.idleTimeout; d > 0 && time.Since(lastRecv) >= d {
+					c.server.ErrorLog.Printf("no packet received from %v for %v, idle timeout\n",
+						c.Conn.RemoteAddr(), d)
+					break
+				}
 				continue
 			}
+			c.server.ErrorLog.Printf("read packet from %v error: %v\n", c.Conn.RemoteAddr(), err)
 			break
 		}
+		lastRecv = time.Now()
+
+		// answer the active test before the handlers, so that a busy
+		// handler never drops the heartbeats.
+		if p, ok := r.Packet.Packer.(*CmppActiveTestReqPkt); ok {
+			if err = c.Conn.RespondActiveTest(p.SeqId); err != nil {
+				c.server.ErrorLog.Printf("send cmpp active test response to %v error: %v\n", c.Conn.RemoteAddr(), err)
+				break
+			}
+			continue
+		}
 
-		_, err = c.server.Handler.ServeCmpp(r, r.Packet, c.server.ErrorLog)
+		if err = c.checkTimestamp(r); err != nil {
+			c.finishPacket(r)
+			break
+		}
+
+		err = c.handle(r)
 		if err1 := c.finishPacket(r); err1 != nil {
 			break
 		}
 
+		if _, ok := r.Packet.Packer.(*CmppTerminateReqPkt); ok {
+			// the terminate response is sent, close the connection.
+			c.terminated = true
+			break
+		}
+
 		if err != nil {
 			break
 		}
 	}
 }
 
+// handle passes the packet in r to the handlers registered by Handle,
+// then to the Handler of the server.
+func (c *conn) handle(r *Response) (err error) {
+	next := true
+	if mux := c.server.mux; mux != nil {
+		next, err = mux.ServeCmpp(r, r.Packet, c.server.ErrorLog)
+	}
+	if next && c.server.Handler != nil {
+		_, err = c.server.Handler.ServeCmpp(r, r.Packet, c.server.ErrorLog)
+	}
+	return err
+}
+
+// checkTimestamp rejects the connect request in r if its Timestamp is out
+// of the skew window set by WithTimestampSkew.
+func (c *conn) checkTimestamp(r *Response) error {
+	req, ok := r.Packet.Packer.(*CmppConnReqPkt)
+	if !ok || c.server.tsSkew <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	t, err := ParseConnTimestamp(req.Timestamp, now)
+	if err == nil && absDuration(t.Sub(now)) <= c.server.tsSkew {
+		return nil
+	}
+	c.server.ErrorLog.Printf("the timestamp %010d of the connect request from %v is out of the window %v\n",
+		req.Timestamp, c.Conn.RemoteAddr(), c.server.tsSkew)
+	return answerConnect(r, r.Packet, c.server.ErrorLog, ErrnoConnAuthFailed, "")
+}
+
 // Create new connection from rwc.
 func (srv *Server) newConn(rwc net.Conn) (c *conn, err error) {
 	c = new(conn)
 	c.server = srv
-	c.Conn = NewConn(rwc, srv.Typ)
+	if srv.pool != nil {
+		c.Conn = srv.pool.New(rwc)
+	} else {
+		c.Conn = NewConn(rwc, srv.Typ)
+	}
 	c.Conn.SetState(CONN_CONNECTED)
 	c.n = c.server.N
 	c.t = c.server.T
@@ -441,6 +751,12 @@ func (srv *Server) listenAndServe() error {
 	return srv.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
 }
 
+// ListenAndServe listens on the TCP network address srv.Addr
+// and then calls Serve to handle requests on incoming connections.
+func (srv *Server) ListenAndServe() error {
+	return srv.listenAndServe()
+}
+
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests.
 func ListenAndServe(addr string, typ Type, t time.Duration, n int32, logWriter io.Writer, handlers ...Handler) error {
@@ -0,0 +1,447 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+type testPacketHandler struct{}
+
+func (h testPacketHandler) OnConnect(req *cmpp.CmppConnReqPkt) (uint8, string) {
+	if req.SrcAddr != "900001" {
+		return cmpp.ErrnoConnInvalidSrcAddr, ""
+	}
+	return 0, "888888"
+}
+
+func (h testPacketHandler) OnSubmit(req *cmpp.Cmpp3SubmitReqPkt) (uint64, uint32) {
+	return 12878564852733378560, 0
+}
+
+func startTestServer(t *testing.T, h cmpp.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	srv := &cmpp.Server{
+		Handler:  h,
+		Typ:      cmpp.V30,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go srv.Serve(l)
+	return l.Addr().String()
+}
+
+func TestServerHandlePackets(t *testing.T) {
+	addr := startTestServer(t, cmpp.HandlePackets(testPacketHandler{}))
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(addr, "900001", "888888", time.Second)
+	if err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	seqId, err := c.Submit(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("Submit error:", err)
+	}
+
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+
+	rsp, ok := i.(*cmpp.Cmpp3SubmitRspPkt)
+	if !ok || rsp.SeqId != seqId {
+		t.Fatalf("The packet received is %#v, not the submit response of seqId %d\n", i, seqId)
+	}
+
+	if rsp.MsgId != 12878564852733378560 {
+		t.Fatalf("The MsgId is %d, not equal to expected: %d\n", rsp.MsgId, uint64(12878564852733378560))
+	}
+}
+
+func TestServerHandlePacketsLoginFailed(t *testing.T) {
+	addr := startTestServer(t, cmpp.HandlePackets(testPacketHandler{}))
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(addr, "900002", "888888", time.Second)
+	if !errors.Is(err, cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnInvalidSrcAddr]) {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ConnRspStatusErrMap[cmpp.ErrnoConnInvalidSrcAddr])
+	}
+}
+
+func TestServerAnswerTerminate(t *testing.T) {
+	addr := startTestServer(t, cmpp.HandlePackets(testPacketHandler{}))
+
+	c := cmpp.NewClient(cmpp.V30)
+	err := c.Connect(addr, "900001", "888888", time.Second)
+	if err != nil {
+		t.Fatal("Connect error:", err)
+	}
+
+	err = c.Terminate(time.Second)
+	if err != nil {
+		t.Fatal("Terminate error:", err)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	srv := cmpp.NewServer("", cmpp.V30, cmpp.HandlePackets(testPacketHandler{}),
+		cmpp.WithIdleTimeout(200*time.Millisecond))
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	go srv.Serve(l)
+
+	active := cmpp.NewClient(cmpp.V30)
+	if err = active.Connect(l.Addr().String(), "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer active.Disconnect()
+
+	silent := cmpp.NewClient(cmpp.V30)
+	if err = silent.Connect(l.Addr().String(), "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer silent.Disconnect()
+
+	// the silent client should be closed by the server.
+	silentErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := silent.RecvAndUnpackPkt(0); err != nil {
+				silentErr <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		if err = active.SendReqPkt(&cmpp.CmppActiveTestReqPkt{}); err != nil {
+			t.Fatal("SendReqPkt error:", err)
+		}
+		i, err := active.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			t.Fatal("the active client is closed:", err)
+		}
+		if _, ok := i.(*cmpp.CmppActiveTestRspPkt); !ok {
+			t.Fatalf("The packet received is %#v, not the active test response\n", i)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case <-silentErr:
+	case <-time.After(time.Second):
+		t.Fatal("the silent client is not closed by the server")
+	}
+}
+
+func TestServerAnswerActiveTest(t *testing.T) {
+	var seen int32
+	addr := startTestServer(t, cmpp.HandlerFunc(func(r *cmpp.Response, p *cmpp.Packet, l *log.Logger) (bool, error) {
+		switch p.Packer.(type) {
+		case *cmpp.CmppConnReqPkt:
+			return cmpp.HandlePackets(testPacketHandler{}).ServeCmpp(r, p, l)
+		case *cmpp.CmppActiveTestReqPkt:
+			atomic.AddInt32(&seen, 1)
+		}
+		return false, nil
+	}))
+
+	c := cmpp.NewClient(cmpp.V30)
+	if err := c.Connect(addr, "900001", "888888", time.Second); err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	req := &cmpp.CmppActiveTestReqPkt{}
+	if err := c.SendReqPkt(req); err != nil {
+		t.Fatal("SendReqPkt error:", err)
+	}
+
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	rsp, ok := i.(*cmpp.CmppActiveTestRspPkt)
+	if !ok || rsp.SeqId != req.SeqId {
+		t.Fatalf("The packet received is %#v, not the active test response of seqId %d\n", i, req.SeqId)
+	}
+
+	if n := atomic.LoadInt32(&seen); n != 0 {
+		t.Fatalf("The handler sees %d active test requests, not equal to expected: 0\n", n)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	const n = 2
+	srv := cmpp.NewServer("", cmpp.V30, cmpp.HandlePackets(testPacketHandler{}), cmpp.WithMaxConns(n))
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	go srv.Serve(l)
+
+	var clients []*cmpp.Client
+	for i := 0; i < n; i++ {
+		c := cmpp.NewClient(cmpp.V30)
+		if err = c.Connect(l.Addr().String(), "900001", "888888", time.Second); err != nil {
+			t.Fatal("Connect error:", err)
+		}
+		clients = append(clients, c)
+	}
+
+	c := cmpp.NewClient(cmpp.V30)
+	err = c.Connect(l.Addr().String(), "900001", "888888", time.Second)
+	if err != cmpp.ConnStatusOthers {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ConnStatusOthers)
+	}
+
+	// a connection being rejected, which sends nothing, does not count.
+	rw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial error:", err)
+	}
+	defer rw.Close()
+
+	// a closed connection is released.
+	clients[0].Disconnect()
+	defer clients[1].Disconnect()
+	for i := 0; ; i++ {
+		err = c.Connect(l.Addr().String(), "900001", "888888", time.Second)
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Connect error:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Disconnect()
+}
+
+func TestServerTimestampSkew(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	srv := cmpp.NewServer("", cmpp.V30, cmpp.HandlePackets(testPacketHandler{}), cmpp.WithTimestampSkew(time.Minute))
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	go srv.Serve(l)
+	defer l.Close()
+
+	cases := []struct {
+		offset time.Duration
+		status uint32
+	}{
+		{-30 * time.Second, 0},
+		{10 * time.Minute, uint32(cmpp.ErrnoConnAuthFailed)},  // in the future
+		{-10 * time.Minute, uint32(cmpp.ErrnoConnAuthFailed)}, // stale
+	}
+
+	for _, cs := range cases {
+		rw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("dial error:", err)
+		}
+		c := cmpp.NewConn(rw, cmpp.V30)
+		c.SetState(cmpp.CONN_CONNECTED)
+
+		ts, _ := strconv.Atoi(time.Now().Add(cs.offset).Format("0102150405"))
+		req := &cmpp.CmppConnReqPkt{SrcAddr: "900001", Secret: "888888", Version: cmpp.V30, Timestamp: uint32(ts)}
+		if err = c.SendPkt(req, c.NextSeqId()); err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			t.Fatal("RecvAndUnpackPkt error:", err)
+		}
+		if rsp, ok := i.(*cmpp.Cmpp3ConnRspPkt); !ok || rsp.Status != cs.status {
+			t.Fatalf("The packet received is %#v, not the connect response of status %d\n", i, cs.status)
+		}
+		c.Close()
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	srv := cmpp.NewServer("", cmpp.V30, cmpp.HandlePackets(testPacketHandler{}))
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Handle(cmpp.CMPP_SUBMIT, func(c *cmpp.Conn, seqId uint32, pkt interface{}) error {
+		req := pkt.(*cmpp.Cmpp3SubmitReqPkt)
+		return c.SendPkt(&cmpp.Cmpp3SubmitRspPkt{MsgId: uint64(len(req.DestTerminalId)), Result: 9}, seqId)
+	})
+	go srv.Serve(l)
+	defer l.Close()
+
+	c := cmpp.NewClient(cmpp.V30)
+	err = c.Connect(l.Addr().String(), "900001", "888888", time.Second)
+	if err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	seqId, err := c.Submit(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: []string{"13500002696"}})
+	if err != nil {
+		t.Fatal("Submit error:", err)
+	}
+
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+
+	// the registered handler takes precedence over srv.Handler.
+	rsp, ok := i.(*cmpp.Cmpp3SubmitRspPkt)
+	if !ok || rsp.SeqId != seqId {
+		t.Fatalf("The packet received is %#v, not the submit response of seqId %d\n", i, seqId)
+	}
+	if rsp.MsgId != 1 || rsp.Result != 9 {
+		t.Fatalf("The submit response is %#v, not equal to expected: MsgId 1, Result 9\n", rsp)
+	}
+
+	// the only response is the one sent by the handler.
+	_, err = c.RecvAndUnpackPkt(100 * time.Millisecond)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("The error is %#v, not a timeout\n", err)
+	}
+}
+
+func TestServeMuxDefaultResponse(t *testing.T) {
+	mux := cmpp.NewServeMux()
+	mux.Handle(cmpp.CMPP_SUBMIT, func(c *cmpp.Conn, seqId uint32, pkt interface{}) error {
+		return errors.New("unexpected")
+	})
+	mux.Handle(cmpp.CMPP_SUBMIT, nil)
+
+	rsp := &cmpp.Response{Packer: &cmpp.Cmpp3SubmitRspPkt{SeqId: 7}, SeqId: 7}
+	p := &cmpp.Packet{Packer: &cmpp.Cmpp3SubmitReqPkt{}, CommandId: cmpp.CMPP_SUBMIT}
+	rsp.Packet = p
+
+	next, err := mux.ServeCmpp(rsp, p, log.New(io.Discard, "", 0))
+	if !next || err != nil {
+		t.Fatalf("ServeCmpp returns %v, %v, not equal to expected: true, nil\n", next, err)
+	}
+	if rsp.Packer == nil {
+		t.Fatal("The default response is dropped")
+	}
+}
+
+func TestServerHandleInOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	const n = 50
+	handled := make(chan uint32, n)
+	srv := cmpp.NewServer("", cmpp.V30, cmpp.HandlePackets(testPacketHandler{}))
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Handle(cmpp.CMPP_SUBMIT, func(c *cmpp.Conn, seqId uint32, pkt interface{}) error {
+		if seqId%10 == 1 {
+			time.Sleep(5 * time.Millisecond) // a slow one does not let the next overtake it.
+		}
+		handled <- seqId
+		return c.SendPkt(&cmpp.Cmpp3SubmitRspPkt{MsgId: uint64(seqId)}, seqId)
+	})
+	go srv.Serve(l)
+	defer l.Close()
+
+	c := cmpp.NewClient(cmpp.V30)
+	err = c.Connect(l.Addr().String(), "900001", "888888", time.Second)
+	if err != nil {
+		t.Fatal("Connect error:", err)
+	}
+	defer c.Disconnect()
+
+	seqIds := make([]uint32, n)
+	for i := range seqIds {
+		seqIds[i], err = c.Submit(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: []string{"13500002696"}})
+		if err != nil {
+			t.Fatal("Submit error:", err)
+		}
+	}
+
+	for _, seqId := range seqIds {
+		if got := <-handled; got != seqId {
+			t.Fatalf("The submit handled is of seqId %d, not equal to expected: %d\n", got, seqId)
+		}
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			t.Fatal("RecvAndUnpackPkt error:", err)
+		}
+		if rsp, ok := i.(*cmpp.Cmpp3SubmitRspPkt); !ok || rsp.SeqId != seqId {
+			t.Fatalf("The packet received is %#v, not the submit response of seqId %d\n", i, seqId)
+		}
+	}
+}
+
+func TestServerConnPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+
+	srv := cmpp.NewServer("", cmpp.V30, cmpp.HandlePackets(testPacketHandler{}), cmpp.WithConnPool())
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	go srv.Serve(l)
+	defer l.Close()
+
+	// the connections one after another reuse the buffers of the closed ones.
+	for i := 0; i < 3; i++ {
+		c := cmpp.NewClient(cmpp.V30)
+		err = c.Connect(l.Addr().String(), "900001", "888888", time.Second)
+		if err != nil {
+			t.Fatal("Connect error:", err)
+		}
+
+		seqId, err := c.Submit(&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: []string{"13500002696"}})
+		if err != nil {
+			t.Fatal("Submit error:", err)
+		}
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if rsp, ok := i.(*cmpp.Cmpp3SubmitRspPkt); err != nil || !ok || rsp.SeqId != seqId {
+			t.Fatalf("The packet received is %#v(error %v), not the submit response of seqId %d\n", i, err, seqId)
+		}
+
+		if err = c.Terminate(time.Second); err != nil {
+			t.Fatal("Terminate error:", err)
+		}
+	}
+}
@@ -16,6 +16,8 @@ package cmpp
 import (
 	"encoding/binary"
 	"errors"
+	"strconv"
+	"strings"
 )
 
 // Packet length const for cmpp submit request and response packets.
@@ -27,6 +29,24 @@ const (
 	Cmpp3SubmitRspPktLen    uint32 = 12 + 8 + 4 //24d, 0x18
 )
 
+// Values of RegisteredDelivery in submit request.
+const (
+	SubmitNoReport   uint8 = 0 // no status report is required
+	SubmitNeedReport uint8 = 1 // a status report is required
+)
+
+// Values of Registered_Delivery, which tells in a submit request whether
+// the gateway returns a status report for the message, and in a deliver
+// request whether it carries a status report, see Cmpp3DeliverReqPkt.Receipt.
+const (
+	NoReport uint8 = 0
+	Report   uint8 = 1
+
+	// SmcBill is cmpp2 only in the submit request: a SMC bill is generated
+	// for the message, which is not sent to the terminals.
+	SmcBill uint8 = 2
+)
+
 // Errors for result in submit resp.
 var (
 	ErrnoSubmitInvalidStruct         uint8 = 1
@@ -74,6 +94,92 @@ var (
 	errSubmitInvalidDestTerminalId = errors.New("submit response status: invalid destTerminalId")
 )
 
+// ErrInvalidMsisdn is returned by ValidateMsisdn for an invalid phone number.
+var ErrInvalidMsisdn = errors.New("invalid msisdn")
+
+// ErrTooManyDestinations is returned by the submit packers if there are
+// more than MaxDestUsrTl DestTerminalIds.
+var ErrTooManyDestinations = errors.New("the number of DestTerminalId is more than 100")
+
+// MaxDestUsrTl is the max number of the dest terminals in a submit request.
+const MaxDestUsrTl = 100
+
+// ErrPkNumberInvalid is returned by the submit packers if PkNumber is not
+// in the range of [1, PkTotal]. Zero PkTotal and PkNumber are packed as 1/1.
+var ErrPkNumberInvalid = errors.New("pk_number is not in the range of [1, pk_total]")
+
+// checkPk returns PkTotal and PkNumber to be packed, see ErrPkNumberInvalid.
+func checkPk(total, number uint8) (uint8, uint8, error) {
+	if total == 0 && number == 0 {
+		return 1, 1, nil
+	}
+	if number < 1 || number > total {
+		return total, number, ErrPkNumberInvalid
+	}
+	return total, number, nil
+}
+
+// SetPkNumbers stamps the submit requests of a message which is split into
+// len(submits) parts, with PkTotal len(submits) and PkNumber 1, 2, ... in
+// order. Every submit must be a *Cmpp2SubmitReqPkt or a *Cmpp3SubmitReqPkt.
+func SetPkNumbers(submits []Packer) error {
+	if len(submits) == 0 || len(submits) > 255 {
+		return ErrMethodParamsInvalid
+	}
+
+	total := uint8(len(submits))
+	for i, p := range submits {
+		switch p := p.(type) {
+		case *Cmpp2SubmitReqPkt:
+			p.PkTotal, p.PkNumber = total, uint8(i+1)
+		case *Cmpp3SubmitReqPkt:
+			p.PkTotal, p.PkNumber = total, uint8(i+1)
+		default:
+			return ErrMethodParamsInvalid
+		}
+	}
+	return nil
+}
+
+// StrictMsisdnCheck makes the submit packers validate every DestTerminalId
+// with ValidateMsisdn before packing. It is off by default.
+var StrictMsisdnCheck = false
+
+// ValidateMsisdn checks whether number is a chinese mobile number:
+// 11 digits which start with 1, optionally led by the country code "86" or "+86".
+func ValidateMsisdn(number string) error {
+	n := strings.TrimPrefix(number, "+")
+	if len(n) == 13 && strings.HasPrefix(n, "86") {
+		n = n[2:]
+	} else if len(n) != len(number) {
+		return ErrInvalidMsisdn // "+" without country code 86
+	}
+
+	if len(n) != 11 || n[0] != '1' {
+		return ErrInvalidMsisdn
+	}
+
+	for i := 0; i < len(n); i++ {
+		if n[i] < '0' || n[i] > '9' {
+			return ErrInvalidMsisdn
+		}
+	}
+	return nil
+}
+
+func validateDestTerminalIds(ids []string) error {
+	if !StrictMsisdnCheck {
+		return nil
+	}
+
+	for _, d := range ids {
+		if err := ValidateMsisdn(d); err != nil {
+			return NewOpError(err, "validate DestTerminalId: "+d)
+		}
+	}
+	return nil
+}
+
 type Cmpp2SubmitReqPkt struct {
 	MsgId              uint64
 	PkTotal            uint8
@@ -89,8 +195,8 @@ type Cmpp2SubmitReqPkt struct {
 	MsgSrc             string
 	FeeType            string
 	FeeCode            string
-	ValidTime          string
-	AtTime             string
+	ValidTime          string // the validity period, see FormatSubmitTime
+	AtTime             string // the scheduled delivery time
 	SrcId              string
 	DestUsrTl          uint8
 	DestTerminalId     []string
@@ -126,8 +232,8 @@ type Cmpp3SubmitReqPkt struct {
 	MsgSrc             string
 	FeeType            string
 	FeeCode            string
-	ValidTime          string
-	AtTime             string
+	ValidTime          string // the validity period, see FormatSubmitTime
+	AtTime             string // the scheduled delivery time
 	SrcId              string
 	DestUsrTl          uint8
 	DestTerminalId     []string
@@ -150,11 +256,48 @@ type Cmpp3SubmitRspPkt struct {
 
 // Pack packs the Cmpp2SubmitReqPkt to bytes stream for client side.
 // Before calling Pack, you should initialize a Cmpp2SubmitReqPkt variable
-// with correct field value.
+// with correct field value. DestUsrTl is always set to len(DestTerminalId).
 func (p *Cmpp2SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2SubmitReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2SubmitReqPkt) pack(w *packetWriter, seqId uint32) error {
+	if len(p.ServiceId) > 10 {
+		return ErrServiceIdTooLong
+	}
+	if len(p.SrcId) > 21 {
+		return ErrSrcIdTooLong
+	}
+	if len(p.MsgSrc) != 0 && len(p.MsgSrc) != MsgSrcLen {
+		return ErrMsgSrcInvalid
+	}
+
+	if len(p.DestTerminalId) > MaxDestUsrTl {
+		return ErrTooManyDestinations
+	}
+	if err := validateDestTerminalIds(p.DestTerminalId); err != nil {
+		return err
+	}
+	if err := checkSubmitTimes(p.ValidTime, p.AtTime); err != nil {
+		return err
+	}
+	var err error
+	if p.PkTotal, p.PkNumber, err = checkPk(p.PkTotal, p.PkNumber); err != nil {
+		return err
+	}
+	p.DestUsrTl = uint8(len(p.DestTerminalId))
+	if p.MsgLength, err = msgLength(p.MsgContent); err != nil {
+		return err
+	}
+
 	var pktLen uint32 = CMPP_HEADER_LEN + 117 + uint32(p.DestUsrTl)*21 + 1 + uint32(p.MsgLength) + 8
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -165,9 +308,6 @@ func (p *Cmpp2SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
 	// Pack Body
 	w.WriteInt(binary.BigEndian, p.MsgId)
 
-	if p.PkTotal == 0 && p.PkNumber == 0 {
-		p.PkTotal, p.PkNumber = 1, 1
-	}
 	w.WriteByte(p.PkTotal)
 	w.WriteByte(p.PkNumber)
 	w.WriteByte(p.RegisteredDelivery)
@@ -178,8 +318,8 @@ func (p *Cmpp2SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.TpPid)
 	w.WriteByte(p.TpUdhi)
 	w.WriteByte(p.MsgFmt)
-	w.WriteFixedSizeString(p.MsgSrc, 6)
-	w.WriteString(p.FeeType)
+	w.WriteFixedSizeString(p.MsgSrc, MsgSrcLen)
+	w.WriteFixedSizeString(p.FeeType, 2)
 	w.WriteFixedSizeString(p.FeeCode, 6)
 	w.WriteFixedSizeString(p.ValidTime, 17)
 	w.WriteFixedSizeString(p.AtTime, 17)
@@ -193,7 +333,7 @@ func (p *Cmpp2SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteString(p.MsgContent)
 	w.WriteFixedSizeString(p.Reserve, 8)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2SubmitReqPkt variable.
@@ -203,72 +343,77 @@ func (p *Cmpp2SubmitReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
 
-	p.PkTotal = r.ReadByte()
-	p.PkNumber = r.ReadByte()
-	p.RegisteredDelivery = r.ReadByte()
-	p.MsgLevel = r.ReadByte()
+	p.PkTotal = r.at("PkTotal").ReadByte()
+	p.PkNumber = r.at("PkNumber").ReadByte()
+	p.RegisteredDelivery = r.at("RegisteredDelivery").ReadByte()
+	p.MsgLevel = r.at("MsgLevel").ReadByte()
 
-	serviceId := r.ReadCString(10)
-	p.ServiceId = string(serviceId)
+	p.ServiceId = r.at("ServiceId").ReadString(10)
 
-	p.FeeUserType = r.ReadByte()
+	p.FeeUserType = r.at("FeeUserType").ReadByte()
 
-	feeTerminalId := r.ReadCString(21)
-	p.FeeTerminalId = string(feeTerminalId)
+	p.FeeTerminalId = r.at("FeeTerminalId").ReadString(21)
 
-	p.TpPid = r.ReadByte()
-	p.TpUdhi = r.ReadByte()
-	p.MsgFmt = r.ReadByte()
+	p.TpPid = r.at("TpPid").ReadByte()
+	p.TpUdhi = r.at("TpUdhi").ReadByte()
+	p.MsgFmt = r.at("MsgFmt").ReadByte()
 
-	msgSrc := r.ReadCString(6)
-	p.MsgSrc = string(msgSrc)
+	p.MsgSrc = r.at("MsgSrc").ReadString(MsgSrcLen)
 
-	feeType := make([]byte, 2)
-	r.ReadBytes(feeType)
-	p.FeeType = string(feeType)
+	p.FeeType = r.at("FeeType").ReadString(2)
 
-	feeCode := r.ReadCString(6)
-	p.FeeCode = string(feeCode)
+	p.FeeCode = r.at("FeeCode").ReadString(6)
 
-	validTime := r.ReadCString(17)
-	p.ValidTime = string(validTime)
+	p.ValidTime = r.at("ValidTime").ReadString(17)
 
-	atTime := r.ReadCString(17)
-	p.AtTime = string(atTime)
+	p.AtTime = r.at("AtTime").ReadString(17)
 
-	srcId := r.ReadCString(21)
-	p.SrcId = string(srcId)
+	p.SrcId = r.at("SrcId").ReadString(21)
 
-	p.DestUsrTl = r.ReadByte()
+	p.DestUsrTl = r.at("DestUsrTl").ReadByte()
 
 	for i := 0; i < int(p.DestUsrTl); i++ {
-		destTerminalId := r.ReadCString(21)
-		p.DestTerminalId = append(p.DestTerminalId, string(destTerminalId))
+		p.DestTerminalId = append(p.DestTerminalId, r.at("DestTerminalId").ReadString(21))
 	}
 
-	p.MsgLength = r.ReadByte()
+	p.MsgLength = r.at("MsgLength").ReadByte()
 
 	msgContent := make([]byte, p.MsgLength)
-	r.ReadBytes(msgContent)
+	r.at("MsgContent").ReadBytes(msgContent)
 	p.MsgContent = string(msgContent)
 
-	reserve := r.ReadCString(8)
-	p.Reserve = string(reserve)
+	p.Reserve = r.at("Reserve").ReadString(8)
 
-	return r.Error()
+	return r.unpackError(CMPP_SUBMIT, p)
+}
+
+// Destinations returns the dest terminal ids of p. Unpack reads DestUsrTl
+// ids of 21 bytes and removes their zero padding, some gateways pad the
+// ids with spaces, which are removed too.
+func (p *Cmpp2SubmitReqPkt) Destinations() []string {
+	return trimDestinations(p.DestTerminalId)
 }
 
 // Pack packs the Cmpp2SubmitRspPkt to bytes stream for Server side.
 // Before calling Pack, you should initialize a Cmpp2SubmitRspPkt variable
 // with correct field value.
 func (p *Cmpp2SubmitRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp2SubmitRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp2SubmitRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen uint32 = CMPP_HEADER_LEN + 8 + 1
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -280,7 +425,7 @@ func (p *Cmpp2SubmitRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, p.MsgId)
 	w.WriteByte(p.Result)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp2SubmitRspPkt variable.
@@ -290,21 +435,61 @@ func (p *Cmpp2SubmitRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-	p.Result = r.ReadByte()
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	p.Result = r.at("Result").ReadByte()
 
-	return r.Error()
+	return r.unpackError(CMPP_SUBMIT_RESP, p)
 }
 
 // Pack packs the Cmpp3SubmitReqPkt to bytes stream for client side.
 // Before calling Pack, you should initialize a Cmpp3SubmitReqPkt variable
-// with correct field value.
+// with correct field value. DestUsrTl is always set to len(DestTerminalId).
 func (p *Cmpp3SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3SubmitReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3SubmitReqPkt) pack(w *packetWriter, seqId uint32) error {
+	if len(p.ServiceId) > 10 {
+		return ErrServiceIdTooLong
+	}
+	if len(p.SrcId) > 21 {
+		return ErrSrcIdTooLong
+	}
+	if len(p.MsgSrc) != 0 && len(p.MsgSrc) != MsgSrcLen {
+		return ErrMsgSrcInvalid
+	}
+	if len(p.LinkId) > 20 {
+		return ErrLinkIdTooLong
+	}
+
+	if len(p.DestTerminalId) > MaxDestUsrTl {
+		return ErrTooManyDestinations
+	}
+	if err := validateDestTerminalIds(p.DestTerminalId); err != nil {
+		return err
+	}
+	if err := checkSubmitTimes(p.ValidTime, p.AtTime); err != nil {
+		return err
+	}
+	var err error
+	if p.PkTotal, p.PkNumber, err = checkPk(p.PkTotal, p.PkNumber); err != nil {
+		return err
+	}
+	p.DestUsrTl = uint8(len(p.DestTerminalId))
+	if p.MsgLength, err = msgLength(p.MsgContent); err != nil {
+		return err
+	}
+
 	var pktLen uint32 = CMPP_HEADER_LEN + 129 + uint32(p.DestUsrTl)*32 + 1 + 1 + uint32(p.MsgLength) + 20
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -315,9 +500,6 @@ func (p *Cmpp3SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
 	// Pack Body
 	w.WriteInt(binary.BigEndian, p.MsgId)
 
-	if p.PkTotal == 0 && p.PkNumber == 0 {
-		p.PkTotal, p.PkNumber = 1, 1
-	}
 	w.WriteByte(p.PkTotal)
 	w.WriteByte(p.PkNumber)
 	w.WriteByte(p.RegisteredDelivery)
@@ -329,8 +511,8 @@ func (p *Cmpp3SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteByte(p.TpPid)
 	w.WriteByte(p.TpUdhi)
 	w.WriteByte(p.MsgFmt)
-	w.WriteFixedSizeString(p.MsgSrc, 6)
-	w.WriteString(p.FeeType)
+	w.WriteFixedSizeString(p.MsgSrc, MsgSrcLen)
+	w.WriteFixedSizeString(p.FeeType, 2)
 	w.WriteFixedSizeString(p.FeeCode, 6)
 	w.WriteFixedSizeString(p.ValidTime, 17)
 	w.WriteFixedSizeString(p.AtTime, 17)
@@ -345,7 +527,7 @@ func (p *Cmpp3SubmitReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteString(p.MsgContent)
 	w.WriteFixedSizeString(p.LinkId, 20)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp3SubmitReqPkt variable.
@@ -355,74 +537,98 @@ func (p *Cmpp3SubmitReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
 
-	p.PkTotal = r.ReadByte()
-	p.PkNumber = r.ReadByte()
-	p.RegisteredDelivery = r.ReadByte()
-	p.MsgLevel = r.ReadByte()
+	p.PkTotal = r.at("PkTotal").ReadByte()
+	p.PkNumber = r.at("PkNumber").ReadByte()
+	p.RegisteredDelivery = r.at("RegisteredDelivery").ReadByte()
+	p.MsgLevel = r.at("MsgLevel").ReadByte()
 
-	serviceId := r.ReadCString(10)
-	p.ServiceId = string(serviceId)
+	p.ServiceId = r.at("ServiceId").ReadString(10)
 
-	p.FeeUserType = r.ReadByte()
+	p.FeeUserType = r.at("FeeUserType").ReadByte()
 
-	feeTerminalId := r.ReadCString(32)
-	p.FeeTerminalId = string(feeTerminalId)
+	p.FeeTerminalId = r.at("FeeTerminalId").ReadString(32)
 
-	p.FeeTerminalType = r.ReadByte()
-	p.TpPid = r.ReadByte()
-	p.TpUdhi = r.ReadByte()
-	p.MsgFmt = r.ReadByte()
+	p.FeeTerminalType = r.at("FeeTerminalType").ReadByte()
+	p.TpPid = r.at("TpPid").ReadByte()
+	p.TpUdhi = r.at("TpUdhi").ReadByte()
+	p.MsgFmt = r.at("MsgFmt").ReadByte()
 
-	msgSrc := r.ReadCString(6)
-	p.MsgSrc = string(msgSrc)
+	p.MsgSrc = r.at("MsgSrc").ReadString(MsgSrcLen)
 
-	feeType := make([]byte, 2)
-	r.ReadBytes(feeType)
-	p.FeeType = string(feeType)
+	p.FeeType = r.at("FeeType").ReadString(2)
 
-	feeCode := r.ReadCString(6)
-	p.FeeCode = string(feeCode)
+	p.FeeCode = r.at("FeeCode").ReadString(6)
 
-	validTime := r.ReadCString(17)
-	p.ValidTime = string(validTime)
+	p.ValidTime = r.at("ValidTime").ReadString(17)
 
-	atTime := r.ReadCString(17)
-	p.AtTime = string(atTime)
+	p.AtTime = r.at("AtTime").ReadString(17)
 
-	srcId := r.ReadCString(21)
-	p.SrcId = string(srcId)
+	p.SrcId = r.at("SrcId").ReadString(21)
 
-	p.DestUsrTl = r.ReadByte()
+	p.DestUsrTl = r.at("DestUsrTl").ReadByte()
 
 	for i := 0; i < int(p.DestUsrTl); i++ {
-		destTerminalId := r.ReadCString(32)
-		p.DestTerminalId = append(p.DestTerminalId, string(destTerminalId))
+		p.DestTerminalId = append(p.DestTerminalId, r.at("DestTerminalId").ReadString(32))
 	}
 
-	p.DestTerminalType = r.ReadByte()
-	p.MsgLength = r.ReadByte()
+	p.DestTerminalType = r.at("DestTerminalType").ReadByte()
+	p.MsgLength = r.at("MsgLength").ReadByte()
 
 	msgContent := make([]byte, p.MsgLength)
-	r.ReadBytes(msgContent)
+	r.at("MsgContent").ReadBytes(msgContent)
 	p.MsgContent = string(msgContent)
 
-	linkId := r.ReadCString(20)
-	p.LinkId = string(linkId)
+	p.LinkId = r.at("LinkId").ReadString(20)
+
+	return r.unpackError(CMPP_SUBMIT, p)
+}
+
+// Destinations is like Cmpp2SubmitReqPkt.Destinations, but the
+// ids are of 32 bytes in cmpp3.
+func (p *Cmpp3SubmitReqPkt) Destinations() []string {
+	return trimDestinations(p.DestTerminalId)
+}
+
+// Content returns the Msg_Content of p, exactly MsgLength bytes including
+// the trailing 0x00s if any, e.g. of a binary content with udh. The bytes
+// are a copy, they may be modified freely.
+func (p *Cmpp2SubmitReqPkt) Content() []byte {
+	return contentBytes(p.MsgContent, p.MsgLength)
+}
 
-	return r.Error()
+// Content is like Cmpp2SubmitReqPkt.Content.
+func (p *Cmpp3SubmitReqPkt) Content() []byte {
+	return contentBytes(p.MsgContent, p.MsgLength)
+}
+
+func trimDestinations(ids []string) []string {
+	dests := make([]string, len(ids))
+	for i, id := range ids {
+		dests[i] = strings.TrimRight(id, " ")
+	}
+	return dests
 }
 
 // Pack packs the Cmpp3SubmitRspPkt to bytes stream for Server side.
 // Before calling Pack, you should initialize a Cmpp3SubmitRspPkt variable
 // with correct field value.
 func (p *Cmpp3SubmitRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *Cmpp3SubmitRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *Cmpp3SubmitRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen uint32 = CMPP_HEADER_LEN + 8 + 4
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -434,7 +640,7 @@ func (p *Cmpp3SubmitRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, p.MsgId)
 	w.WriteInt(binary.BigEndian, p.Result)
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a Cmpp3SubmitRspPkt variable.
@@ -444,10 +650,295 @@ func (p *Cmpp3SubmitRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+
+	r.at("MsgId").ReadInt(binary.BigEndian, &p.MsgId)
+	r.at("Result").ReadInt(binary.BigEndian, &p.Result)
+
+	return r.unpackError(CMPP_SUBMIT_RESP, p)
+}
+
+// SubmitParams are the fields of a submit request independent of the
+// protocol version, see NewSubmit. DestUsrTl and MsgLength are derived
+// from DestTerminalId and MsgContent.
+type SubmitParams struct {
+	PkTotal            uint8
+	PkNumber           uint8
+	RegisteredDelivery uint8
+	MsgLevel           uint8
+	ServiceId          string
+	FeeUserType        uint8
+	FeeTerminalId      string
+	FeeTerminalType    uint8 // cmpp3 only
+	TpPid              uint8
+	TpUdhi             uint8
+	MsgFmt             uint8
+	MsgSrc             string
+	FeeType            string
+	FeeCode            string
+	ValidTime          string // the validity period, see FormatSubmitTime
+	AtTime             string // the scheduled delivery time
+	SrcId              string
+	DestTerminalId     []string
+	DestTerminalType   uint8 // cmpp3 only
+	MsgContent         string
+	LinkId             string // cmpp3 only
 
-	r.ReadInt(binary.BigEndian, &p.MsgId)
-	r.ReadInt(binary.BigEndian, &p.Result)
+	// CheckMsgFmt makes NewSubmit check MsgContent, after the udh if
+	// TpUdhi is set, against MsgFmt with CheckMsgContent.
+	CheckMsgFmt bool
+}
 
-	return r.Error()
+// FeeInfo returns the billing fields of p.
+func (p SubmitParams) FeeInfo() FeeInfo {
+	return FeeInfo{
+		FeeUserType:     p.FeeUserType,
+		FeeType:         p.FeeType,
+		FeeCode:         p.FeeCode,
+		FeeTerminalId:   p.FeeTerminalId,
+		FeeTerminalType: p.FeeTerminalType,
+	}
+}
+
+// checkSubmitContent checks the MsgContent of params against its MsgFmt.
+func checkSubmitContent(params SubmitParams) error {
+	b := []byte(params.MsgContent)
+	if params.TpUdhi != 0 {
+		if len(b) == 0 || int(b[0]) >= len(b) {
+			return invalidSubmitParam("MsgContent is shorter than its udh")
+		}
+		b = b[b[0]+1:]
+	}
+	if err := CheckMsgContent(b, params.MsgFmt); err != nil {
+		return NewOpError(err, "NewSubmit: MsgContent does not match MsgFmt "+strconv.Itoa(int(params.MsgFmt)))
+	}
+	return nil
+}
+
+func invalidSubmitParam(desc string) error {
+	return NewOpError(ErrMethodParamsInvalid, "NewSubmit: "+desc)
+}
+
+// NewSubmit returns a *Cmpp2SubmitReqPkt or a *Cmpp3SubmitReqPkt according
+// to typ, the params are validated against the field sizes of the version.
+// The cmpp3 only fields must be zero for cmpp2, and the billing fields are
+// validated with FeeInfo.Validate. MsgSrc, the SP id, must be exactly
+// MsgSrcLen bytes. RegisteredDelivery must be NoReport or Report, or SmcBill
+// for cmpp2: a submit without Report gets no status report.
+//
+// If CheckMsgFmt is set, a MsgContent which is not in the encoding of
+// MsgFmt is rejected with an *OpError, whose Cause tells the mismatch.
+func NewSubmit(typ Type, params SubmitParams) (Packer, error) {
+	termIdLen := 21
+	if typ == V30 {
+		termIdLen = 32
+	} else if typ != V21 && typ != V20 {
+		return nil, invalidSubmitParam("unknown version " + typ.String())
+	}
+
+	switch {
+	case len(params.DestTerminalId) > MaxDestUsrTl:
+		return nil, ErrTooManyDestinations
+	case len(params.DestTerminalId) == 0:
+		return nil, invalidSubmitParam("no DestTerminalId")
+	case len(params.LinkId) > 20:
+		return nil, ErrLinkIdTooLong
+	case len(params.MsgSrc) != MsgSrcLen:
+		return nil, ErrMsgSrcInvalid
+	case params.RegisteredDelivery > SmcBill || typ == V30 && params.RegisteredDelivery == SmcBill:
+		return nil, invalidSubmitParam("RegisteredDelivery " + strconv.Itoa(int(params.RegisteredDelivery)) + " is not supported by " + typ.String())
+	case len(params.MsgContent) > maxMsgContentLen(params.MsgFmt):
+		return nil, invalidSubmitParam("MsgContent is longer than " + strconv.Itoa(maxMsgContentLen(params.MsgFmt)) + " bytes")
+	case typ != V30 && (params.DestTerminalType != 0 || params.LinkId != ""):
+		return nil, invalidSubmitParam("DestTerminalType and LinkId are not supported by " + typ.String())
+	}
+	if _, _, err := checkPk(params.PkTotal, params.PkNumber); err != nil {
+		return nil, err
+	}
+	if err := params.FeeInfo().Validate(typ); err != nil {
+		return nil, err
+	}
+	for _, d := range params.DestTerminalId {
+		if len(d) > termIdLen {
+			return nil, invalidSubmitParam("DestTerminalId " + d + " is too long for " + typ.String())
+		}
+	}
+	if err := checkSubmitTimes(params.ValidTime, params.AtTime); err != nil {
+		return nil, invalidSubmitParam(err.Error())
+	}
+	if params.CheckMsgFmt {
+		if err := checkSubmitContent(params); err != nil {
+			return nil, err
+		}
+	}
+
+	if typ != V30 {
+		return &Cmpp2SubmitReqPkt{
+			PkTotal:            params.PkTotal,
+			PkNumber:           params.PkNumber,
+			RegisteredDelivery: params.RegisteredDelivery,
+			MsgLevel:           params.MsgLevel,
+			ServiceId:          params.ServiceId,
+			FeeUserType:        params.FeeUserType,
+			FeeTerminalId:      params.FeeTerminalId,
+			TpPid:              params.TpPid,
+			TpUdhi:             params.TpUdhi,
+			MsgFmt:             params.MsgFmt,
+			MsgSrc:             params.MsgSrc,
+			FeeType:            params.FeeType,
+			FeeCode:            params.FeeCode,
+			ValidTime:          params.ValidTime,
+			AtTime:             params.AtTime,
+			SrcId:              params.SrcId,
+			DestUsrTl:          uint8(len(params.DestTerminalId)),
+			DestTerminalId:     params.DestTerminalId,
+			MsgLength:          uint8(len(params.MsgContent)),
+			MsgContent:         params.MsgContent,
+		}, nil
+	}
+
+	return &Cmpp3SubmitReqPkt{
+		PkTotal:            params.PkTotal,
+		PkNumber:           params.PkNumber,
+		RegisteredDelivery: params.RegisteredDelivery,
+		MsgLevel:           params.MsgLevel,
+		ServiceId:          params.ServiceId,
+		FeeUserType:        params.FeeUserType,
+		FeeTerminalId:      params.FeeTerminalId,
+		FeeTerminalType:    params.FeeTerminalType,
+		TpPid:              params.TpPid,
+		TpUdhi:             params.TpUdhi,
+		MsgFmt:             params.MsgFmt,
+		MsgSrc:             params.MsgSrc,
+		FeeType:            params.FeeType,
+		FeeCode:            params.FeeCode,
+		ValidTime:          params.ValidTime,
+		AtTime:             params.AtTime,
+		SrcId:              params.SrcId,
+		DestUsrTl:          uint8(len(params.DestTerminalId)),
+		DestTerminalId:     params.DestTerminalId,
+		DestTerminalType:   params.DestTerminalType,
+		MsgLength:          uint8(len(params.MsgContent)),
+		MsgContent:         params.MsgContent,
+		LinkId:             params.LinkId,
+	}, nil
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface, it
+// returns the whole packet packed with p.SeqId as the sequence id.
+func (p *Cmpp2SubmitReqPkt) MarshalBinary() ([]byte, error) {
+	return p.Pack(p.SeqId)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface,
+// data is a whole packet including the header, such as the one returned
+// by MarshalBinary.
+func (p *Cmpp2SubmitReqPkt) UnmarshalBinary(data []byte) error {
+	body, err := frameBody(data, CMPP_SUBMIT)
+	if err != nil {
+		return err
+	}
+	*p = Cmpp2SubmitReqPkt{}
+	return p.Unpack(body)
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface, it
+// returns the whole packet packed with p.SeqId as the sequence id.
+func (p *Cmpp3SubmitReqPkt) MarshalBinary() ([]byte, error) {
+	return p.Pack(p.SeqId)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface,
+// data is a whole packet including the header, such as the one returned
+// by MarshalBinary.
+func (p *Cmpp3SubmitReqPkt) UnmarshalBinary(data []byte) error {
+	body, err := frameBody(data, CMPP_SUBMIT)
+	if err != nil {
+		return err
+	}
+	*p = Cmpp3SubmitReqPkt{}
+	return p.Unpack(body)
+}
+
+// String returns the text form of p, the MsgContent is hex encoded.
+func (p *Cmpp2SubmitReqPkt) String() string {
+	s := newPktString("Cmpp2SubmitReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.uint("PkTotal", uint64(p.PkTotal))
+	s.uint("PkNumber", uint64(p.PkNumber))
+	s.uint("RegisteredDelivery", uint64(p.RegisteredDelivery))
+	s.str("ServiceId", p.ServiceId)
+	s.uint("FeeUserType", uint64(p.FeeUserType))
+	s.str("FeeTerminalId", p.FeeTerminalId)
+	s.str("FeeType", p.FeeType)
+	s.str("FeeCode", p.FeeCode)
+	s.str("SrcId", p.SrcId)
+	s.strs("DestTerminalId", p.DestTerminalId)
+	s.uint("MsgFmt", uint64(p.MsgFmt))
+	s.uint("MsgLength", uint64(p.MsgLength))
+	s.hex("MsgContent", p.MsgContent)
+	return s.String()
+}
+
+// String returns the text form of p.
+func (p *Cmpp2SubmitRspPkt) String() string {
+	s := newPktString("Cmpp2SubmitRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.uint("Result", uint64(p.Result))
+	return s.String()
+}
+
+// String returns the text form of p, the MsgContent is hex encoded.
+func (p *Cmpp3SubmitReqPkt) String() string {
+	s := newPktString("Cmpp3SubmitReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.uint("PkTotal", uint64(p.PkTotal))
+	s.uint("PkNumber", uint64(p.PkNumber))
+	s.uint("RegisteredDelivery", uint64(p.RegisteredDelivery))
+	s.str("ServiceId", p.ServiceId)
+	s.uint("FeeUserType", uint64(p.FeeUserType))
+	s.str("FeeTerminalId", p.FeeTerminalId)
+	s.str("FeeType", p.FeeType)
+	s.str("FeeCode", p.FeeCode)
+	s.str("SrcId", p.SrcId)
+	s.strs("DestTerminalId", p.DestTerminalId)
+	s.uint("MsgFmt", uint64(p.MsgFmt))
+	s.uint("MsgLength", uint64(p.MsgLength))
+	s.hex("MsgContent", p.MsgContent)
+	s.str("LinkId", p.LinkId)
+	return s.String()
+}
+
+// String returns the text form of p.
+func (p *Cmpp3SubmitRspPkt) String() string {
+	s := newPktString("Cmpp3SubmitRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	s.uint("MsgId", p.MsgId)
+	s.uint("Result", uint64(p.Result))
+	return s.String()
+}
+
+// NewCmpp2SubmitRsp returns the response of req with msgId and result,
+// its SeqId is the same as req. Send it with
+// conn.SendPkt(rsp, rsp.SeqId).
+func NewCmpp2SubmitRsp(req *Cmpp2SubmitReqPkt, msgId uint64, result uint8) *Cmpp2SubmitRspPkt {
+	return &Cmpp2SubmitRspPkt{
+		MsgId:  msgId,
+		Result: result,
+		SeqId:  req.SeqId,
+	}
+}
+
+// NewCmpp3SubmitRsp returns the response of req with msgId and result,
+// its SeqId is the same as req. Send it with
+// conn.SendPkt(rsp, rsp.SeqId).
+func NewCmpp3SubmitRsp(req *Cmpp3SubmitReqPkt, msgId uint64, result uint32) *Cmpp3SubmitRspPkt {
+	return &Cmpp3SubmitRspPkt{
+		MsgId:  msgId,
+		Result: result,
+		SeqId:  req.SeqId,
+	}
 }
@@ -14,7 +14,11 @@
 package cmpp_test
 
 import (
+	"bytes"
+	"encoding"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/bigwhite/gocmpp"
@@ -514,3 +518,598 @@ func BenchmarkCmpp3SubmitReqPktUnpack(b *testing.B) {
 		p.Unpack(data)
 	}
 }
+
+func TestValidateMsisdn(t *testing.T) {
+	cases := []struct {
+		number string
+		valid  bool
+	}{
+		{"13500002696", true},
+		{"8613500002696", true},
+		{"+8613500002696", true},
+		{"1350000269", false},   // too short
+		{"135000026960", false}, // too long
+		{"23500002696", false},
+		{"1350000269a", false}, // non-numeric
+		{"+13500002696", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		err := cmpp.ValidateMsisdn(c.number)
+		if (err == nil) != c.valid {
+			t.Fatalf("The result of ValidateMsisdn(%q) is %v, not equal to expected: valid=%v\n", c.number, err, c.valid)
+		}
+	}
+}
+
+func TestCmpp3SubmitReqPktPackStrictMsisdn(t *testing.T) {
+	p := &cmpp.Cmpp3SubmitReqPkt{
+		FeeType:        feeType,
+		DestUsrTl:      1,
+		DestTerminalId: []string{"1350000269a"},
+	}
+
+	// lax by default
+	_, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt pack error:", err)
+	}
+
+	cmpp.StrictMsisdnCheck = true
+	defer func() { cmpp.StrictMsisdnCheck = false }()
+	_, err = p.Pack(seqId)
+	if e, ok := err.(*cmpp.OpError); !ok || e.Cause() != cmpp.ErrInvalidMsisdn {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrInvalidMsisdn)
+	}
+}
+
+func TestSubmitReqPktMsgSrc(t *testing.T) {
+	const spId = "931010"
+
+	p3 := newSubmitReqPkt()
+	p3.MsgSrc = spId
+	data, err := p3.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt pack error:", err)
+	}
+	// Msg_src follows Msg_Fmt, at 12 + 8 + 4 + 10 + 1 + 32 + 1 + 3.
+	if got := string(data[71:77]); got != spId {
+		t.Fatalf("The Msg_src packed is %q, not equal to expected: %q\n", got, spId)
+	}
+	var u3 cmpp.Cmpp3SubmitReqPkt
+	if err = u3.Unpack(data[8:]); err != nil || u3.MsgSrc != spId {
+		t.Fatalf("After unpack, MsgSrc is %q(%v), not equal to expected: %q\n", u3.MsgSrc, err, spId)
+	}
+
+	p2 := &cmpp.Cmpp2SubmitReqPkt{FeeType: feeType, DestUsrTl: destUsrTl, DestTerminalId: destTerminalId, MsgSrc: spId}
+	if data, err = p2.Pack(seqId); err != nil {
+		t.Fatal("Cmpp2SubmitReqPkt pack error:", err)
+	}
+	if got := string(data[59:65]); got != spId {
+		t.Fatalf("The Msg_src packed is %q, not equal to expected: %q\n", got, spId)
+	}
+	var u2 cmpp.Cmpp2SubmitReqPkt
+	if err = u2.Unpack(data[8:]); err != nil || u2.MsgSrc != spId {
+		t.Fatalf("After unpack, MsgSrc is %q(%v), not equal to expected: %q\n", u2.MsgSrc, err, spId)
+	}
+
+	for _, msgSrc := range []string{"93101", "9310100"} {
+		p3.MsgSrc = msgSrc
+		if _, err = p3.Pack(seqId); err != cmpp.ErrMsgSrcInvalid {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrMsgSrcInvalid)
+		}
+	}
+
+	// NewSubmit requires Msg_src.
+	params := cmpp.SubmitParams{FeeType: "02", FeeCode: "10", DestTerminalId: []string{"13500002696"}}
+	if _, err = cmpp.NewSubmit(cmpp.V30, params); err != cmpp.ErrMsgSrcInvalid {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrMsgSrcInvalid)
+	}
+}
+
+func TestSubmitReqPktContent(t *testing.T) {
+	// udh of a concatenated message, then a binary payload ending with 0x00s.
+	content := []byte{0x05, 0x00, 0x03, 0x2a, 0x02, 0x01, 0xde, 0x00, 0xad, 0x00, 0x00}
+
+	p3 := newSubmitReqPkt()
+	p3.TpUdhi, p3.MsgFmt = 1, 4
+	p3.MsgContent, p3.MsgLength = string(content), 3 // Msg_Length is derived from the content.
+	data, err := p3.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt pack error:", err)
+	}
+
+	var u3 cmpp.Cmpp3SubmitReqPkt
+	if err = u3.Unpack(data[8:]); err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt unpack error:", err)
+	}
+	if int(u3.MsgLength) != len(content) || !bytes.Equal(u3.Content(), content) {
+		t.Fatalf("After unpack, content is %x(%d), not equal to expected: %x(%d)\n",
+			u3.Content(), u3.MsgLength, content, len(content))
+	}
+
+	p2 := &cmpp.Cmpp2SubmitReqPkt{FeeType: feeType, DestUsrTl: destUsrTl, DestTerminalId: destTerminalId,
+		MsgContent: string(content)}
+	if data, err = p2.Pack(seqId); err != nil {
+		t.Fatal("Cmpp2SubmitReqPkt pack error:", err)
+	}
+	var u2 cmpp.Cmpp2SubmitReqPkt
+	if err = u2.Unpack(data[8:]); err != nil {
+		t.Fatal("Cmpp2SubmitReqPkt unpack error:", err)
+	}
+	if !bytes.Equal(u2.Content(), content) {
+		t.Fatalf("After unpack, content is %x, not equal to expected: %x\n", u2.Content(), content)
+	}
+
+	// the content returned is a copy, modifying it leaves the packet alone.
+	b := u2.Content()
+	b[0] = 0xff
+	if !bytes.Equal(u2.Content(), content) {
+		t.Fatalf("After modified, content is %x, not equal to expected: %x\n", u2.Content(), content)
+	}
+
+	p3.MsgContent = string(make([]byte, 256))
+	if _, err = p3.Pack(seqId); err != cmpp.ErrMsgContentTooLong {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrMsgContentTooLong)
+	}
+}
+
+func TestSubmitReqPktFieldLength(t *testing.T) {
+	cases := []struct {
+		serviceId string
+		srcId     string
+		err       error
+	}{
+		{"abcdefghij", "900001234567890123456", nil}, // exact length
+		{"abc", "900001", nil},                       // short
+		{"abcdefghijk", "900001", cmpp.ErrServiceIdTooLong},
+		{"abc", "9000012345678901234567", cmpp.ErrSrcIdTooLong},
+	}
+
+	for _, cs := range cases {
+		p3 := newSubmitReqPkt()
+		p3.ServiceId, p3.SrcId = cs.serviceId, cs.srcId
+		data, err := p3.Pack(seqId)
+		if err != cs.err {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cs.err)
+		}
+		if err != nil {
+			continue
+		}
+
+		// Service_Id starts at 12 + 8 + 4, and is right-padded with zeros.
+		serviceId := data[24:34]
+		if !bytes.Equal(serviceId, append([]byte(cs.serviceId), make([]byte, 10-len(cs.serviceId))...)) {
+			t.Fatalf("The Service_Id packed is %x, not equal to expected: %q\n", serviceId, cs.serviceId)
+		}
+
+		p2 := &cmpp.Cmpp2SubmitReqPkt{
+			FeeType:        feeType,
+			DestUsrTl:      destUsrTl,
+			DestTerminalId: destTerminalId,
+			ServiceId:      cs.serviceId,
+			SrcId:          cs.srcId,
+		}
+		if _, err = p2.Pack(seqId); err != nil {
+			t.Fatal("Cmpp2SubmitReqPkt pack error:", err)
+		}
+	}
+}
+
+func TestNewSubmit(t *testing.T) {
+	params := cmpp.SubmitParams{
+		FeeType:        "02",
+		FeeCode:        "10",
+		MsgSrc:         msgSrc,
+		SrcId:          "900001",
+		DestTerminalId: []string{"13500002696"},
+		MsgContent:     "hello",
+	}
+
+	p, err := cmpp.NewSubmit(cmpp.V21, params)
+	if err != nil {
+		t.Fatal("NewSubmit error:", err)
+	}
+	p2, ok := p.(*cmpp.Cmpp2SubmitReqPkt)
+	if !ok {
+		t.Fatalf("The packet is %T, not equal to expected: *cmpp.Cmpp2SubmitReqPkt\n", p)
+	}
+	if p2.DestUsrTl != 1 || p2.MsgLength != 5 {
+		t.Fatalf("The DestUsrTl, MsgLength are %d, %d, not equal to expected: 1, 5\n", p2.DestUsrTl, p2.MsgLength)
+	}
+
+	params.LinkId = "link"
+	p, err = cmpp.NewSubmit(cmpp.V30, params)
+	if err != nil {
+		t.Fatal("NewSubmit error:", err)
+	}
+	if p3, ok := p.(*cmpp.Cmpp3SubmitReqPkt); !ok || p3.LinkId != "link" {
+		t.Fatalf("The packet is %#v, not the expected cmpp3 submit\n", p)
+	}
+	if _, err = p.Pack(seqId); err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt pack error:", err)
+	}
+}
+
+func TestNewSubmitInvalidParams(t *testing.T) {
+	long := "135000026961350000269613500002696" // 33 bytes
+	cases := []struct {
+		typ    cmpp.Type
+		modify func(p *cmpp.SubmitParams)
+	}{
+		{cmpp.V21, func(p *cmpp.SubmitParams) { p.LinkId = "link" }},
+		{cmpp.V21, func(p *cmpp.SubmitParams) { p.DestTerminalId = []string{long[:22]} }},
+		{cmpp.V30, func(p *cmpp.SubmitParams) { p.DestTerminalId = []string{long} }},
+		{cmpp.V30, func(p *cmpp.SubmitParams) { p.DestTerminalId = nil }},
+		{cmpp.V30, func(p *cmpp.SubmitParams) { p.MsgContent = string(make([]byte, 161)) }},
+		{cmpp.Type(0x10), func(p *cmpp.SubmitParams) {}},
+	}
+
+	for i, cs := range cases {
+		params := cmpp.SubmitParams{
+			FeeType:        "02",
+			FeeCode:        "10",
+			MsgSrc:         msgSrc,
+			DestTerminalId: []string{"13500002696"},
+		}
+		cs.modify(&params)
+
+		_, err := cmpp.NewSubmit(cs.typ, params)
+		e, ok := err.(*cmpp.OpError)
+		if !ok || e.Cause() != cmpp.ErrMethodParamsInvalid {
+			t.Fatalf("case %d: the error is %#v, not the expected OpError of ErrMethodParamsInvalid\n", i, err)
+		}
+	}
+
+	// an empty FeeType is rejected by the fee info validation.
+	params := cmpp.SubmitParams{FeeCode: "10", MsgSrc: msgSrc, DestTerminalId: []string{"13500002696"}}
+	_, err := cmpp.NewSubmit(cmpp.V30, params)
+	if e, ok := err.(*cmpp.OpError); !ok || e.Cause() != cmpp.ErrFeeInfoInvalid {
+		t.Fatalf("The error is %#v, not the expected OpError of ErrFeeInfoInvalid\n", err)
+	}
+}
+
+func TestSubmitReqPktDestUsrTl(t *testing.T) {
+	dests := make([]string, cmpp.MaxDestUsrTl+1)
+	for i := range dests {
+		dests[i] = "13500002696"
+	}
+
+	packers := []func(dests []string) (cmpp.Packer, *uint8){
+		func(dests []string) (cmpp.Packer, *uint8) {
+			p := &cmpp.Cmpp2SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: dests}
+			return p, &p.DestUsrTl
+		},
+		func(dests []string) (cmpp.Packer, *uint8) {
+			p := &cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestUsrTl: 1, DestTerminalId: dests}
+			return p, &p.DestUsrTl
+		},
+	}
+
+	for _, newPkt := range packers {
+		p, tl := newPkt(dests[:cmpp.MaxDestUsrTl])
+		if _, err := p.Pack(seqId); err != nil {
+			t.Fatalf("Pack with %d DestTerminalIds error: %v\n", cmpp.MaxDestUsrTl, err)
+		}
+		if *tl != cmpp.MaxDestUsrTl {
+			t.Fatalf("The DestUsrTl is %d, not equal to expected: %d\n", *tl, cmpp.MaxDestUsrTl)
+		}
+
+		p, _ = newPkt(dests)
+		if _, err := p.Pack(seqId); err != cmpp.ErrTooManyDestinations {
+			t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrTooManyDestinations)
+		}
+	}
+}
+
+func TestCmpp3SubmitReqPktMarshalBinary(t *testing.T) {
+	p := &cmpp.Cmpp3SubmitReqPkt{
+		FeeType:        "02",
+		SrcId:          "900001",
+		DestTerminalId: []string{"13500002696", "13500002697"},
+		MsgLength:      5,
+		MsgContent:     "hello",
+		LinkId:         "link",
+		SeqId:          seqId,
+	}
+
+	var m encoding.BinaryMarshaler = p
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal("MarshalBinary error:", err)
+	}
+
+	expected, _ := p.Pack(seqId)
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("The result of MarshalBinary is %x, not equal to expected: %x\n", data, expected)
+	}
+
+	var p1 cmpp.Cmpp3SubmitReqPkt
+	var u encoding.BinaryUnmarshaler = &p1
+	if err = u.UnmarshalBinary(data); err != nil {
+		t.Fatal("UnmarshalBinary error:", err)
+	}
+	if !reflect.DeepEqual(&p1, p) {
+		t.Fatalf("The result of UnmarshalBinary is %#v, not equal to expected: %#v\n", p1, p)
+	}
+
+	// not a submit.
+	data, _ = (&cmpp.CmppActiveTestReqPkt{}).Pack(seqId)
+	if err = p1.UnmarshalBinary(data); err != cmpp.ErrCommandIdInvalid {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrCommandIdInvalid)
+	}
+}
+
+func TestCmpp3SubmitReqPktLinkId(t *testing.T) {
+	linkId := "12345678901234567890" // the full 20 bytes
+	p := &cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"},
+		MsgLength: 2, MsgContent: "mt", LinkId: linkId}
+	data, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt pack error:", err)
+	}
+
+	var p1 cmpp.Cmpp3SubmitReqPkt
+	if err = p1.Unpack(data[8:]); err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt unpack error:", err)
+	}
+	if p1.LinkId != linkId || p1.MsgContent != "mt" {
+		t.Fatalf("After unpack, LinkId, MsgContent are %q, %q, not equal to expected: %q, %q\n",
+			p1.LinkId, p1.MsgContent, linkId, "mt")
+	}
+
+	p.LinkId = linkId + "1"
+	if _, err = p.Pack(seqId); err != cmpp.ErrLinkIdTooLong {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrLinkIdTooLong)
+	}
+	if _, err = cmpp.NewSubmit(cmpp.V30, cmpp.SubmitParams{FeeType: "02",
+		DestTerminalId: []string{"13500002696"}, LinkId: p.LinkId}); err != cmpp.ErrLinkIdTooLong {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrLinkIdTooLong)
+	}
+}
+
+func TestNewSubmitRsp(t *testing.T) {
+	req2 := &cmpp.Cmpp2SubmitReqPkt{SeqId: seqId}
+	rsp2 := cmpp.NewCmpp2SubmitRsp(req2, 12878564852733378560, 1)
+	if rsp2.SeqId != seqId || rsp2.MsgId != 12878564852733378560 || rsp2.Result != 1 {
+		t.Fatalf("The response is %#v, not matched with the request of seqId %d\n", rsp2, seqId)
+	}
+
+	req3 := &cmpp.Cmpp3SubmitReqPkt{SeqId: seqId}
+	rsp3 := cmpp.NewCmpp3SubmitRsp(req3, 12878564852733378560, 1)
+	if rsp3.SeqId != seqId || rsp3.MsgId != 12878564852733378560 || rsp3.Result != 1 {
+		t.Fatalf("The response is %#v, not matched with the request of seqId %d\n", rsp3, seqId)
+	}
+}
+
+func TestSubmitReqPktPkNumber(t *testing.T) {
+	cases := []struct {
+		total, number uint8
+		err           error
+	}{
+		{0, 0, nil}, // packed as 1/1
+		{1, 1, nil},
+		{3, 3, nil},
+		{3, 0, cmpp.ErrPkNumberInvalid},
+		{3, 4, cmpp.ErrPkNumberInvalid},
+		{0, 1, cmpp.ErrPkNumberInvalid},
+	}
+
+	for _, cs := range cases {
+		p := &cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"},
+			PkTotal: cs.total, PkNumber: cs.number}
+		data, err := p.Pack(seqId)
+		if err != cs.err {
+			t.Fatalf("Pack %d/%d: the error is %v, not equal to expected: %v\n", cs.number, cs.total, err, cs.err)
+		}
+
+		params := cmpp.SubmitParams{FeeType: "02", FeeCode: "10", MsgSrc: msgSrc, DestTerminalId: []string{"13500002696"},
+			PkTotal: cs.total, PkNumber: cs.number}
+		if _, err = cmpp.NewSubmit(cmpp.V21, params); err != cs.err {
+			t.Fatalf("NewSubmit %d/%d: the error is %v, not equal to expected: %v\n", cs.number, cs.total, err, cs.err)
+		}
+		if cs.err != nil {
+			continue
+		}
+
+		var p1 cmpp.Cmpp3SubmitReqPkt
+		if err = p1.Unpack(data[8:]); err != nil {
+			t.Fatal("Unpack error:", err)
+		}
+		total, number := max(cs.total, 1), max(cs.number, 1)
+		if p1.PkTotal != total || p1.PkNumber != number {
+			t.Fatalf("After unpack, pk is %d/%d, not equal to expected: %d/%d\n", p1.PkNumber, p1.PkTotal, number, total)
+		}
+	}
+}
+
+func TestSetPkNumbers(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		submits := make([]cmpp.Packer, n)
+		for i := range submits {
+			submits[i] = &cmpp.Cmpp3SubmitReqPkt{}
+		}
+		if err := cmpp.SetPkNumbers(submits); err != nil {
+			t.Fatal("SetPkNumbers error:", err)
+		}
+		for i, s := range submits {
+			p := s.(*cmpp.Cmpp3SubmitReqPkt)
+			if int(p.PkTotal) != n || int(p.PkNumber) != i+1 {
+				t.Fatalf("The pk of submit %d is %d/%d, not equal to expected: %d/%d\n", i, p.PkNumber, p.PkTotal, i+1, n)
+			}
+		}
+	}
+
+	err := cmpp.SetPkNumbers([]cmpp.Packer{&cmpp.Cmpp3SubmitReqPkt{}, &cmpp.CmppActiveTestReqPkt{}})
+	if err != cmpp.ErrMethodParamsInvalid {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrMethodParamsInvalid)
+	}
+}
+
+func TestSubmitReqPktDestinations(t *testing.T) {
+	dests := []string{"13500002696", "8613500002697", "13500002698"}
+
+	p2 := &cmpp.Cmpp2SubmitReqPkt{FeeType: "02", DestTerminalId: dests}
+	data2, err := p2.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp2SubmitReqPkt pack error:", err)
+	}
+	p3 := &cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: dests}
+	data3, err := p3.Pack(seqId)
+	if err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt pack error:", err)
+	}
+
+	var u2 cmpp.Cmpp2SubmitReqPkt
+	if err = u2.Unpack(data2[8:]); err != nil {
+		t.Fatal("Cmpp2SubmitReqPkt unpack error:", err)
+	}
+	var u3 cmpp.Cmpp3SubmitReqPkt
+	if err = u3.Unpack(data3[8:]); err != nil {
+		t.Fatal("Cmpp3SubmitReqPkt unpack error:", err)
+	}
+
+	for _, got := range [][]string{u2.Destinations(), u3.Destinations()} {
+		if strings.Join(got, ",") != strings.Join(dests, ",") {
+			t.Fatalf("The destinations are %q, not equal to expected: %q\n", got, dests)
+		}
+	}
+
+	// the ids padded with spaces.
+	u3.DestTerminalId = []string{"13500002696     "}
+	if got := u3.Destinations(); len(got) != 1 || got[0] != "13500002696" {
+		t.Fatalf("The destinations are %q, not equal to expected: %q\n", got, []string{"13500002696"})
+	}
+}
+
+func TestNewSubmitRegisteredDelivery(t *testing.T) {
+	cases := []struct {
+		typ      cmpp.Type
+		value    uint8
+		expected bool
+	}{
+		{cmpp.V30, cmpp.NoReport, true},
+		{cmpp.V30, cmpp.Report, true},
+		{cmpp.V30, cmpp.SmcBill, false},
+		{cmpp.V21, cmpp.SmcBill, true},
+		{cmpp.V21, 3, false},
+	}
+
+	for _, cs := range cases {
+		params := cmpp.SubmitParams{FeeType: "02", FeeCode: "10", MsgSrc: msgSrc,
+			DestTerminalId: []string{"13500002696"}, RegisteredDelivery: cs.value}
+		p, err := cmpp.NewSubmit(cs.typ, params)
+		if !cs.expected {
+			if e, ok := err.(*cmpp.OpError); !ok || e.Cause() != cmpp.ErrMethodParamsInvalid {
+				t.Fatalf("%v %d: the error is %#v, not the expected OpError of ErrMethodParamsInvalid\n", cs.typ, cs.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("NewSubmit error:", err)
+		}
+
+		data, err := p.Pack(seqId)
+		if err != nil {
+			t.Fatal("Pack error:", err)
+		}
+		var value uint8
+		if cs.typ == cmpp.V30 {
+			var u cmpp.Cmpp3SubmitReqPkt
+			err, value = u.Unpack(data[8:]), u.RegisteredDelivery
+		} else {
+			var u cmpp.Cmpp2SubmitReqPkt
+			err, value = u.Unpack(data[8:]), u.RegisteredDelivery
+		}
+		if err != nil || value != cs.value {
+			t.Fatalf("After unpack, RegisteredDelivery is %d(%v), not equal to expected: %d\n", value, err, cs.value)
+		}
+	}
+}
+
+func TestNewSubmitCheckMsgFmt(t *testing.T) {
+	udh := "\x05\x00\x03\x01\x02\x01"
+	cases := []struct {
+		msgFmt  uint8
+		tpUdhi  uint8
+		content string
+		err     error
+	}{
+		{cmpp.MsgFmtGBK, 0, "\xc4\xe3\xba\xc3", nil},
+		{cmpp.MsgFmtGBK, 0, "\x4f\x60\x00\x61", cmpp.ErrNulInContent},
+		{cmpp.MsgFmtUCS2, 0, "\x4f\x60\x59", cmpp.ErrInvalidUcs2Length},
+		{cmpp.MsgFmtASCII, 0, "\xc4\xe3", cmpp.ErrNotASCII},
+		{cmpp.MsgFmtUCS2, 1, udh + "\x4f\x60", nil},
+		{cmpp.MsgFmtUCS2, 1, udh + "\x4f", cmpp.ErrInvalidUcs2Length},
+		{cmpp.MsgFmtUCS2, 1, "\x05\x00\x03", cmpp.ErrMethodParamsInvalid},
+	}
+
+	for i, cs := range cases {
+		params := cmpp.SubmitParams{FeeType: "02", FeeCode: "10", MsgSrc: msgSrc, DestTerminalId: []string{"13500002696"},
+			MsgFmt: cs.msgFmt, TpUdhi: cs.tpUdhi, MsgContent: cs.content}
+
+		// the content is not checked by default.
+		if _, err := cmpp.NewSubmit(cmpp.V30, params); err != nil {
+			t.Fatalf("case %d: NewSubmit error: %v\n", i, err)
+		}
+
+		params.CheckMsgFmt = true
+		_, err := cmpp.NewSubmit(cmpp.V30, params)
+		if cs.err == nil {
+			if err != nil {
+				t.Fatalf("case %d: NewSubmit error: %v\n", i, err)
+			}
+			continue
+		}
+		if e, ok := err.(*cmpp.OpError); !ok || e.Cause() != cs.err {
+			t.Fatalf("case %d: the error is %#v, not the expected OpError of %v\n", i, err, cs.err)
+		}
+	}
+}
+
+func TestSubmitReqPktMsgLength(t *testing.T) {
+	// Msg_Length is 1 byte in both versions, followed by exactly Msg_Length
+	// bytes of Msg_Content, then Reserve(8 bytes) of cmpp2 or LinkID(20
+	// bytes) of cmpp3.
+	cases := []struct {
+		p       cmpp.Packer
+		tailLen int
+	}{
+		{&cmpp.Cmpp2SubmitReqPkt{FeeType: feeType, DestUsrTl: destUsrTl, DestTerminalId: destTerminalId,
+			MsgContent: "hello", Reserve: "abc"}, 8},
+		{&cmpp.Cmpp3SubmitReqPkt{FeeType: feeType, DestUsrTl: destUsrTl, DestTerminalId: destTerminalId,
+			MsgContent: "hello", LinkId: "abc"}, 20},
+	}
+
+	for _, cs := range cases {
+		data, err := cs.p.Pack(seqId)
+		if err != nil {
+			t.Fatalf("%T pack error: %v\n", cs.p, err)
+		}
+		pos := len(data) - cs.tailLen - len("hello") - 1
+		if data[pos] != 5 || string(data[pos+1:pos+6]) != "hello" {
+			t.Fatalf("The Msg_Length and Msg_Content packed are %x, not equal to expected: %x\n",
+				data[pos:pos+6], "\x05hello")
+		}
+
+		var content, tail string
+		switch cs.p.(type) {
+		case *cmpp.Cmpp2SubmitReqPkt:
+			var p1 cmpp.Cmpp2SubmitReqPkt
+			err = p1.Unpack(data[8:])
+			content, tail = p1.MsgContent, p1.Reserve
+		case *cmpp.Cmpp3SubmitReqPkt:
+			var p1 cmpp.Cmpp3SubmitReqPkt
+			err = p1.Unpack(data[8:])
+			content, tail = p1.MsgContent, p1.LinkId
+		}
+		if err != nil {
+			t.Fatalf("%T unpack error: %v\n", cs.p, err)
+		}
+		if content != "hello" || tail != "abc" {
+			t.Fatalf("After unpack, the content and the field following it are %q, %q, not equal to expected: %q, %q\n",
+				content, tail, "hello", "abc")
+		}
+	}
+}
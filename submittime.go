@@ -0,0 +1,126 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrSubmitTimeInvalid is returned for a ValidTime or AtTime of a submit
+// request which is not in the format of the spec.
+var ErrSubmitTimeInvalid = errors.New("submit time is invalid")
+
+// submitTimeLen is the length of ValidTime and AtTime without the
+// terminating zero byte of the 17-byte fields.
+const submitTimeLen = 16
+
+// maxRelativeSubmitTime is the longest duration FormatRelativeSubmitTime
+// formats, the days of a relative time have 2 digits.
+const maxRelativeSubmitTime = 100*24*time.Hour - time.Second
+
+// FormatSubmitTime formats t as an absolute ValidTime or AtTime of a submit
+// request: "YYMMDDhhmmsstnnp", where t is the tenth of the second, nn the
+// offset of the time zone of t from UTC in quarter-hours and p is '+' or '-'
+// for the sign of the offset, e.g. "161014153000032+" for 2016-10-14
+// 15:30:00 in UTC+8. The time is converted to UTC if its offset is not of
+// whole quarter-hours.
+func FormatSubmitTime(t time.Time) string {
+	_, offset := t.Zone()
+	if offset%(15*60) != 0 || offset > 48*15*60 || offset < -48*15*60 {
+		t, offset = t.UTC(), 0
+	}
+
+	sign := byte('+')
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("%s%d%02d%c", t.Format("060102150405"), t.Nanosecond()/1e8, offset/(15*60), sign)
+}
+
+// FormatRelativeSubmitTime formats d as a relative ValidTime or AtTime of a
+// submit request, which is the time from now by the gateway:
+// "YYMMDDhhmmss000R", e.g. "000002120000000R" for 2 days and 12 hours. The
+// duration is given in days, hours, minutes and seconds, ErrSubmitTimeInvalid
+// is returned for a negative d or one of 100 days or longer.
+func FormatRelativeSubmitTime(d time.Duration) (string, error) {
+	if d < 0 || d > maxRelativeSubmitTime {
+		return "", ErrSubmitTimeInvalid
+	}
+	s := int64(d / time.Second)
+	return fmt.Sprintf("0000%02d%02d%02d%02d000R", s/86400, s/3600%24, s/60%60, s%60), nil
+}
+
+// ParseSubmitTime parses the ValidTime or AtTime s of a submit request, see
+// FormatSubmitTime and FormatRelativeSubmitTime. A relative time is added to
+// now, and an absolute one is returned in the time zone given by s. An empty
+// s, which means the default of the gateway, returns the zero Time.
+func ParseSubmitTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if len(s) != submitTimeLen || !isDigits(s[:15]) {
+		return time.Time{}, ErrSubmitTimeInvalid
+	}
+
+	switch s[15] {
+	case 'R':
+		if s[12:15] != "000" {
+			return time.Time{}, ErrSubmitTimeInvalid
+		}
+		var f [6]int
+		for i := range f {
+			f[i], _ = strconv.Atoi(s[2*i : 2*i+2])
+		}
+		d := time.Duration(f[3])*time.Hour + time.Duration(f[4])*time.Minute + time.Duration(f[5])*time.Second
+		return now.AddDate(f[0], f[1], f[2]).Add(d), nil
+	case '+', '-':
+		nn, _ := strconv.Atoi(s[13:15])
+		if nn > 48 {
+			return time.Time{}, ErrSubmitTimeInvalid
+		}
+		offset := nn * 15 * 60
+		if s[15] == '-' {
+			offset = -offset
+		}
+		t, err := time.ParseInLocation("060102150405", s[:12], time.FixedZone("", offset))
+		if err != nil {
+			return time.Time{}, ErrSubmitTimeInvalid
+		}
+		return t.Add(time.Duration(s[12]-'0') * 100 * time.Millisecond), nil
+	}
+	return time.Time{}, ErrSubmitTimeInvalid
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSubmitTimes validates the ValidTime and AtTime of a submit request.
+func checkSubmitTimes(validTime, atTime string) error {
+	if _, err := ParseSubmitTime(validTime, time.Time{}); err != nil {
+		return fmt.Errorf("%w: ValidTime %q", err, validTime)
+	}
+	if _, err := ParseSubmitTime(atTime, time.Time{}); err != nil {
+		return fmt.Errorf("%w: AtTime %q", err, atTime)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestFormatParseSubmitTime(t *testing.T) {
+	cases := []struct {
+		t        time.Time
+		expected string
+	}{
+		{time.Date(2016, 10, 14, 15, 30, 0, 0, time.FixedZone("CST", 8*3600)), "161014153000032+"},
+		{time.Date(2016, 10, 14, 15, 30, 5, 7e8, time.FixedZone("", -(5*3600+30*60))), "161014153005722-"},
+		{time.Date(2016, 2, 29, 23, 59, 59, 0, time.UTC), "160229235959000+"},
+	}
+
+	for _, c := range cases {
+		s := cmpp.FormatSubmitTime(c.t)
+		if s != c.expected {
+			t.Fatalf("The time %v is formatted to %q, not equal to expected: %q\n", c.t, s, c.expected)
+		}
+		t1, err := cmpp.ParseSubmitTime(s, time.Now())
+		if err != nil || !t1.Equal(c.t) {
+			t.Fatalf("The time %q is parsed to %v(error %v), not equal to expected: %v\n", s, t1, err, c.t)
+		}
+		_, offset := t1.Zone()
+		_, expected := c.t.Zone()
+		if offset != expected {
+			t.Fatalf("The zone offset of %q is %d, not equal to expected: %d\n", s, offset, expected)
+		}
+	}
+
+	// the offset not of whole quarter-hours is converted to UTC.
+	tm := time.Date(2016, 10, 14, 15, 30, 0, 0, time.FixedZone("", 20*60))
+	if s := cmpp.FormatSubmitTime(tm); s != "161014151000000+" {
+		t.Fatalf("The time %v is formatted to %q, not equal to expected: %q\n", tm, s, "161014151000000+")
+	}
+}
+
+func TestFormatParseRelativeSubmitTime(t *testing.T) {
+	d := 2*24*time.Hour + 12*time.Hour + 30*time.Second
+	s, err := cmpp.FormatRelativeSubmitTime(d)
+	if err != nil || s != "000002120030000R" {
+		t.Fatalf("The duration %v is formatted to %q(error %v), not equal to expected: %q\n", d, s, err, "000002120030000R")
+	}
+
+	now := time.Date(2016, 10, 14, 15, 30, 0, 0, time.Local)
+	t1, err := cmpp.ParseSubmitTime(s, now)
+	if err != nil || !t1.Equal(now.Add(d)) {
+		t.Fatalf("The time %q is parsed to %v(error %v), not equal to expected: %v\n", s, t1, err, now.Add(d))
+	}
+
+	// the years and months of a relative time.
+	t1, err = cmpp.ParseSubmitTime("010200000000000R", now)
+	if err != nil || !t1.Equal(now.AddDate(1, 2, 0)) {
+		t.Fatalf("The time is parsed to %v(error %v), not equal to expected: %v\n", t1, err, now.AddDate(1, 2, 0))
+	}
+
+	for _, d := range []time.Duration{-time.Second, 100 * 24 * time.Hour} {
+		if _, err = cmpp.FormatRelativeSubmitTime(d); err != cmpp.ErrSubmitTimeInvalid {
+			t.Fatalf("The error of %v is %v, not equal to expected: %v\n", d, err, cmpp.ErrSubmitTimeInvalid)
+		}
+	}
+}
+
+func TestParseSubmitTimeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"16101415300003+",   // too short
+		"161014153000032+0", // too long
+		"1610141530000a2+",  // not digits
+		"161314153000032+",  // month 13
+		"161014153000049+",  // offset of 49 quarter-hours
+		"161014153000032*",  // unknown sign
+		"000002120000100R",  // tenths in relative time
+	} {
+		if _, err := cmpp.ParseSubmitTime(s, time.Now()); err != cmpp.ErrSubmitTimeInvalid {
+			t.Fatalf("The error of %q is %v, not equal to expected: %v\n", s, err, cmpp.ErrSubmitTimeInvalid)
+		}
+	}
+
+	// the zero time for the empty field.
+	if t1, err := cmpp.ParseSubmitTime("", time.Now()); err != nil || !t1.IsZero() {
+		t.Fatalf("The empty time is parsed to %v(error %v), not the zero time\n", t1, err)
+	}
+}
+
+func TestSubmitReqPktTimeInvalid(t *testing.T) {
+	p := newSubmitReqPkt()
+	p.ValidTime = "161014153000032+"
+	p.AtTime = "161014"
+	if _, err := p.Pack(seqId); !errors.Is(err, cmpp.ErrSubmitTimeInvalid) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrSubmitTimeInvalid)
+	}
+
+	p2 := &cmpp.Cmpp2SubmitReqPkt{DestTerminalId: []string{"13500002696"}, ValidTime: "bad"}
+	if _, err := p2.Pack(seqId); !errors.Is(err, cmpp.ErrSubmitTimeInvalid) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrSubmitTimeInvalid)
+	}
+
+	_, err := cmpp.NewSubmit(cmpp.V30, cmpp.SubmitParams{FeeType: "02", FeeCode: "10", MsgSrc: msgSrc,
+		DestTerminalId: []string{"13500002696"}, AtTime: "161014"})
+	if e, ok := err.(*cmpp.OpError); !ok || e.Cause() != cmpp.ErrMethodParamsInvalid {
+		t.Fatalf("The error is %#v, not the expected OpError of ErrMethodParamsInvalid\n", err)
+	}
+}
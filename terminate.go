@@ -32,9 +32,18 @@ type CmppTerminateRspPkt struct {
 
 // Pack packs the CmppTerminateReqPkt to bytes stream for client side.
 func (p *CmppTerminateReqPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppTerminateReqPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppTerminateReqPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen = CmppTerminateReqPktLen
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -42,7 +51,7 @@ func (p *CmppTerminateReqPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, seqId)
 	p.SeqId = seqId
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a CmppTerminateReqPkt variable.
@@ -52,15 +61,24 @@ func (p *CmppTerminateReqPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
-	return r.Error()
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+	return r.unpackError(CMPP_TERMINATE, p)
 }
 
 // Pack packs the CmppTerminateRspPkt to bytes stream for client side.
 func (p *CmppTerminateRspPkt) Pack(seqId uint32) ([]byte, error) {
+	return pack(p, seqId)
+}
+
+// PackInto is like Pack, but appends the packed bytes to buf.
+func (p *CmppTerminateRspPkt) PackInto(buf []byte, seqId uint32) ([]byte, error) {
+	return packInto(p, buf, seqId)
+}
+
+func (p *CmppTerminateRspPkt) pack(w *packetWriter, seqId uint32) error {
 	var pktLen = CmppTerminateRspPktLen
 
-	var w = newPacketWriter(pktLen)
+	w.Grow(pktLen)
 
 	// Pack header
 	w.WriteInt(binary.BigEndian, pktLen)
@@ -68,7 +86,7 @@ func (p *CmppTerminateRspPkt) Pack(seqId uint32) ([]byte, error) {
 	w.WriteInt(binary.BigEndian, seqId)
 	p.SeqId = seqId
 
-	return w.Bytes()
+	return w.Error()
 }
 
 // Unpack unpack the binary byte stream to a CmppTerminateRspPkt variable.
@@ -78,6 +96,20 @@ func (p *CmppTerminateRspPkt) Unpack(data []byte) error {
 	var r = newPacketReader(data)
 
 	// Sequence Id
-	r.ReadInt(binary.BigEndian, &p.SeqId)
-	return r.Error()
+	r.at("SeqId").ReadInt(binary.BigEndian, &p.SeqId)
+	return r.unpackError(CMPP_TERMINATE_RESP, p)
+}
+
+// String returns the text form of p.
+func (p *CmppTerminateReqPkt) String() string {
+	s := newPktString("CmppTerminateReqPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	return s.String()
+}
+
+// String returns the text form of p.
+func (p *CmppTerminateRspPkt) String() string {
+	s := newPktString("CmppTerminateRspPkt")
+	s.uint("SeqId", uint64(p.SeqId))
+	return s.String()
 }
@@ -0,0 +1,33 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import "crypto/tls"
+
+// DialTLS connects to the cmpp server at addr over TLS, performs the TLS
+// handshake, and returns a Conn in CONN_CONNECTED state, on which the
+// connect request can be sent.
+//
+// TLS does not replace the application-level heartbeat, the
+// CMPP_ACTIVE_TEST exchange is still required by the ISMG.
+func DialTLS(addr string, cfg *tls.Config, typ Type) (*Conn, error) {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewConn(conn, typ)
+	c.SetState(CONN_CONNECTED)
+	return c, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+// selfSignedCert generates a certificate for 127.0.0.1.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey error:", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gocmpp test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("CreateCertificate error:", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("ParseCertificate error:", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal("listen error:", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := cmpp.NewConn(conn, cmpp.V30)
+		defer c.Close()
+		c.SetState(cmpp.CONN_AUTHOK)
+
+		i, err := c.RecvAndUnpackPkt(time.Second)
+		if err != nil {
+			return
+		}
+		if p, ok := i.(*cmpp.CmppActiveTestReqPkt); ok {
+			c.SendPkt(&cmpp.CmppActiveTestRspPkt{}, p.SeqId)
+		}
+	}()
+
+	c, err := cmpp.DialTLS(l.Addr().String(), &tls.Config{RootCAs: pool}, cmpp.V30)
+	if err != nil {
+		t.Fatal("DialTLS error:", err)
+	}
+	defer c.Close()
+	if c.State != cmpp.CONN_CONNECTED {
+		t.Fatalf("The state is %v, not equal to expected: %v\n", c.State, cmpp.CONN_CONNECTED)
+	}
+
+	err = c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 0x17)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	i, err := c.RecvAndUnpackPkt(time.Second)
+	if err != nil {
+		t.Fatal("RecvAndUnpackPkt error:", err)
+	}
+	if p, ok := i.(*cmpp.CmppActiveTestRspPkt); !ok || p.SeqId != 0x17 {
+		t.Fatalf("The packet received is %#v, not the active test response of seqId %d\n", i, 0x17)
+	}
+}
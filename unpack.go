@@ -0,0 +1,181 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import "encoding/binary"
+
+// checkHeader validates the Total_Length and Command_Id in a packet header.
+func checkHeader(typ Type, totalLen uint32, id CommandId) error {
+	typ = connRspType(typ, id, totalLen)
+	switch typ {
+	case V30:
+		if totalLen < CMPP3_PACKET_MIN || totalLen > CMPP3_PACKET_MAX {
+			return ErrTotalLengthInvalid
+		}
+	case V21, V20:
+		if totalLen < CMPP2_PACKET_MIN || totalLen > CMPP2_PACKET_MAX {
+			return ErrTotalLengthInvalid
+		}
+	}
+
+	if !((id > CMPP_REQUEST_MIN && id < CMPP_REQUEST_MAX) ||
+		(id > CMPP_RESPONSE_MIN && id < CMPP_RESPONSE_MAX)) {
+		return ErrCommandIdInvalid
+	}
+
+	if !isTotalLenConsistent(typ, id, totalLen) {
+		return ErrTotalLengthInconsistent
+	}
+	return nil
+}
+
+// newPacket returns a new packet of command id in version typ,
+// or nil if the command id is not supported.
+func newPacket(typ Type, id CommandId) Packer {
+	switch id {
+	case CMPP_CONNECT:
+		return &CmppConnReqPkt{}
+	case CMPP_CONNECT_RESP:
+		if typ == V30 {
+			return &Cmpp3ConnRspPkt{}
+		}
+		return &Cmpp2ConnRspPkt{}
+	case CMPP_TERMINATE:
+		return &CmppTerminateReqPkt{}
+	case CMPP_TERMINATE_RESP:
+		return &CmppTerminateRspPkt{}
+	case CMPP_SUBMIT:
+		if typ == V30 {
+			return &Cmpp3SubmitReqPkt{}
+		}
+		return &Cmpp2SubmitReqPkt{}
+	case CMPP_SUBMIT_RESP:
+		if typ == V30 {
+			return &Cmpp3SubmitRspPkt{}
+		}
+		return &Cmpp2SubmitRspPkt{}
+	case CMPP_DELIVER:
+		if typ == V30 {
+			return &Cmpp3DeliverReqPkt{}
+		}
+		return &Cmpp2DeliverReqPkt{}
+	case CMPP_DELIVER_RESP:
+		if typ == V30 {
+			return &Cmpp3DeliverRspPkt{}
+		}
+		return &Cmpp2DeliverRspPkt{}
+	case CMPP_FWD:
+		if typ == V30 {
+			return &Cmpp3FwdReqPkt{}
+		}
+		return &Cmpp2FwdReqPkt{}
+	case CMPP_FWD_RESP:
+		if typ == V30 {
+			return &Cmpp3FwdRspPkt{}
+		}
+		return &Cmpp2FwdRspPkt{}
+	case CMPP_QUERY:
+		return &CmppQueryReqPkt{}
+	case CMPP_QUERY_RESP:
+		return &CmppQueryRspPkt{}
+	case CMPP_CANCEL:
+		return &CmppCancelReqPkt{}
+	case CMPP_CANCEL_RESP:
+		if typ == V30 {
+			return &Cmpp3CancelRspPkt{}
+		}
+		return &Cmpp2CancelRspPkt{}
+	case CMPP_ACTIVE_TEST:
+		return &CmppActiveTestReqPkt{}
+	case CMPP_ACTIVE_TEST_RESP:
+		return &CmppActiveTestRspPkt{}
+	}
+	return nil
+}
+
+// unpackPacket unpacks the left data (start from seqId in header) of
+// a packet of command id.
+func unpackPacket(typ Type, id CommandId, leftData []byte) (Packer, error) {
+	p := newPacket(connRspType(typ, id, uint32(len(leftData))+8), id)
+	if p == nil {
+		return nil, ErrCommandIdNotSupported
+	}
+
+	if err := p.Unpack(leftData); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UnpackPacket unpacks a whole packet frame(with header) of version typ,
+// e.g. captured from the network. It returns the command id and the
+// sequence id in the header along with the packet. The frame is checked
+// the same way as it is received by Conn.RecvAndUnpackPkt.
+func UnpackPacket(typ Type, frame []byte) (CommandId, uint32, interface{}, error) {
+	if len(frame) < 8 {
+		return 0, 0, nil, ErrTotalLengthInvalid
+	}
+
+	totalLen := binary.BigEndian.Uint32(frame[0:4])
+	id := CommandId(binary.BigEndian.Uint32(frame[4:8]))
+	if err := checkHeader(typ, totalLen, id); err != nil {
+		return id, 0, nil, err
+	}
+	if uint32(len(frame)) != totalLen {
+		return id, 0, nil, ErrTotalLengthInvalid
+	}
+
+	var seqId uint32
+	if len(frame) >= 12 {
+		seqId = binary.BigEndian.Uint32(frame[8:12])
+	}
+
+	p, err := unpackPacket(typ, id, frame[8:])
+	if err != nil {
+		return id, seqId, nil, err
+	}
+	return id, seqId, p, nil
+}
+
+// frameBody checks the Total_Length and Command_Id in the header of the
+// whole packet frame, and returns the data following them.
+func frameBody(frame []byte, id CommandId) ([]byte, error) {
+	if len(frame) < 8 || binary.BigEndian.Uint32(frame[0:4]) != uint32(len(frame)) {
+		return nil, ErrTotalLengthInvalid
+	}
+	if CommandId(binary.BigEndian.Uint32(frame[4:8])) != id {
+		return nil, ErrCommandIdInvalid
+	}
+	return frame[8:], nil
+}
+
+// connRspType returns the version of the packet with id and totalLen
+// received on a typ connection. The connect response is decoded
+// according to its length rather than typ, as a server may answer with
+// a lower version than the client requests.
+func connRspType(typ Type, id CommandId, totalLen uint32) Type {
+	if id != CMPP_CONNECT_RESP {
+		return typ
+	}
+
+	switch totalLen {
+	case Cmpp2ConnRspPktLen:
+		if typ == V30 {
+			return V21
+		}
+	case Cmpp3ConnRspPktLen:
+		return V30
+	}
+	return typ
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestUnpackPacket(t *testing.T) {
+	id, seq, i, err := cmpp.UnpackPacket(cmpp.V30, data)
+	if err != nil {
+		t.Fatal("UnpackPacket error:", err)
+	}
+	if id != cmpp.CMPP_SUBMIT {
+		t.Fatalf("The command id is %v, not equal to expected: %v\n", id, cmpp.CMPP_SUBMIT)
+	}
+	p, ok := i.(*cmpp.Cmpp3SubmitReqPkt)
+	if !ok {
+		t.Fatalf("The packet is %T, not equal to expected: *cmpp.Cmpp3SubmitReqPkt\n", i)
+	}
+	if p.SeqId != seq {
+		t.Fatalf("The seqId is %d, not equal to expected: %d\n", seq, p.SeqId)
+	}
+
+	// the same frame decoded as cmpp2 is a different packet.
+	_, _, i, _ = cmpp.UnpackPacket(cmpp.V21, []byte{
+		0x00, 0x00, 0x00, 0x15, 0x80, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x17,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	})
+	if _, ok := i.(*cmpp.Cmpp2SubmitRspPkt); !ok {
+		t.Fatalf("The packet is %T, not equal to expected: *cmpp.Cmpp2SubmitRspPkt\n", i)
+	}
+}
+
+func TestUnpackPacketErrors(t *testing.T) {
+	cases := []struct {
+		frame []byte
+		err   error
+	}{
+		{[]byte{0x00, 0x00, 0x00}, cmpp.ErrTotalLengthInvalid},
+		// frame shorter than its total_length.
+		{data[:len(data)-1], cmpp.ErrTotalLengthInvalid},
+		{[]byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x30, 0x00, 0x00, 0x00, 0x17},
+			cmpp.ErrCommandIdInvalid},
+		{[]byte{0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x17},
+			cmpp.ErrCommandIdNotSupported},
+		{[]byte{0x00, 0x00, 0x00, 0x0d, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x17, 0x00},
+			cmpp.ErrTotalLengthInconsistent},
+	}
+
+	for _, cs := range cases {
+		_, _, _, err := cmpp.UnpackPacket(cmpp.V30, cs.frame)
+		if err != cs.err {
+			t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cs.err)
+		}
+	}
+}
+
+func TestUnpackError(t *testing.T) {
+	p := &cmpp.Cmpp3SubmitReqPkt{
+		FeeType:        "02",
+		DestTerminalId: []string{"13500002696"},
+		MsgLength:      5,
+		MsgContent:     "hello",
+		LinkId:         "link",
+	}
+	frame, err := p.Pack(seqId)
+	if err != nil {
+		t.Fatal("Pack error:", err)
+	}
+
+	// the frame is truncated in the middle of the Msg_Content.
+	contentOffset := len(frame) - 20 - 5
+	var p1 cmpp.Cmpp3SubmitReqPkt
+	err = p1.Unpack(frame[8 : contentOffset+2])
+
+	var e *cmpp.UnpackError
+	if !errors.As(err, &e) {
+		t.Fatalf("The error is %#v, not an UnpackError\n", err)
+	}
+	if e.CommandId != cmpp.CMPP_SUBMIT || e.Packet != "Cmpp3SubmitReqPkt" ||
+		e.Field != "MsgContent" || e.Offset != contentOffset {
+		t.Fatalf("The UnpackError is %#v, not equal to expected: %v, %s, %s, %d\n",
+			e, cmpp.CMPP_SUBMIT, "Cmpp3SubmitReqPkt", "MsgContent", contentOffset)
+	}
+	if !errors.Is(err, cmpp.ErrShortPacket) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("The error is %v, not wraps: %v and %v\n", err, cmpp.ErrShortPacket, io.ErrUnexpectedEOF)
+	}
+
+	// a complete packet.
+	if err = p1.Unpack(frame[8:]); err != nil {
+		t.Fatal("Unpack error:", err)
+	}
+}
+
+func FuzzUnpackPacket(f *testing.F) {
+	seeds := []cmpp.Packer{
+		&cmpp.CmppConnReqPkt{SrcAddr: "900001", Version: cmpp.V30},
+		&cmpp.Cmpp3ConnRspPkt{Version: cmpp.V30},
+		&cmpp.Cmpp3SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}, MsgLength: 5, MsgContent: "hello"},
+		&cmpp.Cmpp3SubmitRspPkt{},
+		&cmpp.Cmpp3DeliverReqPkt{MsgLength: 5, MsgContent: "hello"},
+		&cmpp.Cmpp3DeliverRspPkt{},
+		&cmpp.Cmpp3FwdReqPkt{FeeType: "02", DestUsrTl: 1, DestId: []string{"13500002696"}, MsgLength: 5, MsgContent: "hello"},
+		&cmpp.CmppQueryReqPkt{},
+		&cmpp.CmppCancelReqPkt{},
+		&cmpp.CmppActiveTestReqPkt{},
+		&cmpp.CmppTerminateReqPkt{},
+	}
+	for _, p := range seeds {
+		frame, err := p.Pack(seqId)
+		if err != nil {
+			f.Fatalf("Pack %T error: %v", p, err)
+		}
+		f.Add(frame)
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		for _, typ := range []cmpp.Type{cmpp.V20, cmpp.V30} {
+			id, _, p, err := cmpp.UnpackPacket(typ, frame)
+			if err == nil && p == nil {
+				t.Fatalf("UnpackPacket returns neither a packet nor an error for command id %v", id)
+			}
+
+			// the receipt in the Msg_Content is decoded too.
+			if d, ok := p.(interface {
+				Receipt() (*cmpp.DeliveryReceipt, error)
+			}); ok {
+				d.Receipt()
+			}
+		}
+	})
+}
+
+func TestUnpackPacketCmpp2Versions(t *testing.T) {
+	for _, typ := range []cmpp.Type{cmpp.V20, cmpp.V21} {
+		pkts := []cmpp.Packer{
+			&cmpp.CmppConnReqPkt{SrcAddr: "900001", Secret: "888888", Version: typ, Timestamp: 1021080510},
+			&cmpp.Cmpp2ConnRspPkt{AuthSrc: "0123456789abcdef", Secret: "888888", Version: typ},
+			&cmpp.Cmpp2SubmitReqPkt{FeeType: "02", DestTerminalId: []string{"13500002696"}, MsgLength: 5, MsgContent: "hello"},
+			&cmpp.Cmpp2SubmitRspPkt{MsgId: 12878564852733378560, Result: 1},
+			&cmpp.Cmpp2DeliverReqPkt{DestId: "900001", SrcTerminalId: "13500002696", MsgLength: 2, MsgContent: "mo"},
+			&cmpp.Cmpp2DeliverRspPkt{MsgId: 12878564852733378560, Result: 1},
+			&cmpp.Cmpp2FwdReqPkt{FeeType: "02", DestUsrTl: 1, DestId: []string{"13500002696"}, MsgLength: 2, MsgContent: "mt"},
+			&cmpp.Cmpp2FwdRspPkt{MsgId: 12878564852733378560, Result: 1},
+			&cmpp.Cmpp2CancelRspPkt{SuccessId: cmpp.CancelSucceeded},
+		}
+
+		for _, p := range pkts {
+			frame, err := p.Pack(seqId)
+			if err != nil {
+				t.Fatalf("%v: pack %T error: %v\n", typ, p, err)
+			}
+
+			_, _, i, err := cmpp.UnpackPacket(typ, frame)
+			if err != nil {
+				t.Fatalf("%v: unpack %T error: %v\n", typ, p, err)
+			}
+			if fmt.Sprintf("%T", i) != fmt.Sprintf("%T", p) {
+				t.Fatalf("%v: the packet is %T, not equal to expected: %T\n", typ, i, p)
+			}
+
+			// the authenticators are computed from the secret when packing.
+			switch rsp := i.(type) {
+			case *cmpp.CmppConnReqPkt:
+				if rsp.Version != typ {
+					t.Fatalf("The Version is %v, not equal to expected: %v\n", rsp.Version, typ)
+				}
+				continue
+			case *cmpp.Cmpp2ConnRspPkt:
+				if rsp.Version != typ {
+					t.Fatalf("The Version is %v, not equal to expected: %v\n", rsp.Version, typ)
+				}
+				continue
+			}
+
+			frame1, err := i.(cmpp.Packer).Pack(seqId)
+			if err != nil || !bytes.Equal(frame1, frame) {
+				t.Fatalf("%v: %T is %x after round trip, not equal to expected: %x\n", typ, p, frame1, frame)
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"unicode/utf8"
 	"unsafe"
 
@@ -27,6 +28,7 @@ import (
 )
 
 var ErrInvalidUtf8Rune = errors.New("Not Invalid Utf8 runes")
+var ErrUnencodableRune = errors.New("Runes can not be encoded")
 
 func IsBigEndian() bool {
 	var i uint16 = 0x1234
@@ -89,3 +91,32 @@ func GB18030ToUtf8(in string) (string, error) {
 	}
 	return string(out), nil
 }
+
+func Utf8ToGBK(in string) (string, error) {
+	if !utf8.ValidString(in) {
+		return "", ErrInvalidUtf8Rune
+	}
+
+	r := bytes.NewReader([]byte(in))
+	t := transform.NewReader(r, simplifiedchinese.GBK.NewEncoder())
+	out, err := ioutil.ReadAll(t)
+	if err != nil {
+		return "", err
+	}
+
+	// The encoder replaces the runes not in gbk with 0x1a.
+	if bytes.Count(out, []byte{0x1a}) != strings.Count(in, "\x1a") {
+		return "", ErrUnencodableRune
+	}
+	return string(out), nil
+}
+
+func GBKToUtf8(in string) (string, error) {
+	r := bytes.NewReader([]byte(in))
+	t := transform.NewReader(r, simplifiedchinese.GBK.NewDecoder())
+	out, err := ioutil.ReadAll(t)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
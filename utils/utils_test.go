@@ -120,3 +120,41 @@ func TestGB18030ToUtf8(t *testing.T) {
 		t.Fatalf("The result is %s, not equal to our expected %s", s1, "中")
 	}
 }
+
+func TestUtf8ToGBK(t *testing.T) {
+	// invalid utf8 bytes sequences
+	b1 := []byte{0xe6, 0xb1, 0x89, 0xe6}
+	_, err := cmpputils.Utf8ToGBK(string(b1))
+	if err != cmpputils.ErrInvalidUtf8Rune {
+		t.Fatalf("The result is %#v, not equal to our expected %#v", err, cmpputils.ErrInvalidUtf8Rune)
+	}
+
+	// valid utf8 bytes sequences
+	s2, err := cmpputils.Utf8ToGBK("汉")
+	if err != nil {
+		t.Fatalf("The error is %#v, not to the result expected: nil", err)
+	}
+
+	if s2 != "\xba\xba" {
+		t.Fatalf("The result is %x, not equal to our expected %x", s2, "\xba\xba")
+	}
+
+	// emoji can not be encoded in gbk
+	_, err = cmpputils.Utf8ToGBK("😀")
+	if err != cmpputils.ErrUnencodableRune {
+		t.Fatalf("The result is %#v, not equal to our expected %#v", err, cmpputils.ErrUnencodableRune)
+	}
+}
+
+func TestGBKToUtf8(t *testing.T) {
+	u1 := []byte{0xd6, 0xd0}
+
+	s1, err := cmpputils.GBKToUtf8(string(u1))
+	if err != nil {
+		t.Fatalf("The error is %#v, not to the result expected: nil", err)
+	}
+
+	if s1 != "中" {
+		t.Fatalf("The result is %s, not equal to our expected %s", s1, "中")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// FrameInfo describes a packet frame found by ValidateStream.
+type FrameInfo struct {
+	Offset    int64 // offset of the frame in the stream
+	CommandId CommandId
+	SeqId     uint32
+	TotalLen  uint32
+	Err       error // the error of unpacking the frame, if any
+}
+
+// ValidateStream walks the packet frames of version typ in the byte stream
+// r, e.g. a capture of the traffic of a connection, and checks each of them
+// with UnpackPacket. The frames found are returned in order, with the
+// error of each one in its Err.
+//
+// A frame with an invalid Command_Id or a malformed body is skipped by
+// its Total_Length, and the walk goes on. If the Total_Length itself is out
+// of range, the following frames can not be located, so the walk stops and
+// ErrTotalLengthInvalid is returned along with the frames found so far, the
+// last of which is the bad one. A stream ending in the middle of a frame
+// returns io.ErrUnexpectedEOF, and other errors of r are returned as is.
+func ValidateStream(typ Type, r io.Reader) ([]FrameInfo, error) {
+	var frames []FrameInfo
+	var offset int64
+	for {
+		var header [8]byte
+		n, err := io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+
+		f := FrameInfo{
+			Offset:    offset,
+			TotalLen:  binary.BigEndian.Uint32(header[0:4]),
+			CommandId: CommandId(binary.BigEndian.Uint32(header[4:8])),
+		}
+		if err = checkHeader(typ, f.TotalLen, f.CommandId); err == ErrTotalLengthInvalid {
+			f.Err = err
+			return append(frames, f), err
+		}
+
+		frame := make([]byte, f.TotalLen)
+		copy(frame, header[:])
+		m, err := io.ReadFull(r, frame[n:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return frames, err
+		}
+		offset += int64(n + m)
+
+		f.SeqId = binary.BigEndian.Uint32(frame[8:12])
+		_, _, _, f.Err = UnpackPacket(typ, frame)
+		frames = append(frames, f)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func TestValidateStream(t *testing.T) {
+	var stream []byte
+	for i, p := range []cmpp.Packer{
+		&cmpp.CmppActiveTestReqPkt{},
+		&cmpp.Cmpp3SubmitRspPkt{MsgId: 12878564852733378560},
+	} {
+		data, err := p.Pack(uint32(i + 1))
+		if err != nil {
+			t.Fatal("Pack error:", err)
+		}
+		stream = append(stream, data...)
+	}
+	// a frame of an invalid command id.
+	stream = append(stream, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x30, 0x00, 0x00, 0x00, 0x17)
+	stream = append(stream, data...)
+
+	expected := []cmpp.FrameInfo{
+		{Offset: 0, CommandId: cmpp.CMPP_ACTIVE_TEST, SeqId: 1, TotalLen: 12},
+		{Offset: 12, CommandId: cmpp.CMPP_SUBMIT_RESP, SeqId: 2, TotalLen: 24},
+		{Offset: 36, CommandId: 0x30, SeqId: 0x17, TotalLen: 12, Err: cmpp.ErrCommandIdInvalid},
+		{Offset: 48, CommandId: cmpp.CMPP_SUBMIT, SeqId: 0x17, TotalLen: uint32(len(data))},
+	}
+
+	frames, err := cmpp.ValidateStream(cmpp.V30, bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal("ValidateStream error:", err)
+	}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("The frames are %+v, not equal to expected: %+v\n", frames, expected)
+	}
+
+	// the stream ends in the middle of the last frame.
+	frames, err = cmpp.ValidateStream(cmpp.V30, bytes.NewReader(stream[:len(stream)-1]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, io.ErrUnexpectedEOF)
+	}
+	if !reflect.DeepEqual(frames, expected[:3]) {
+		t.Fatalf("The frames are %+v, not equal to expected: %+v\n", frames, expected[:3])
+	}
+
+	// the frames following a bad total_length are lost.
+	bad := append([]byte{0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x02}, stream...)
+	frames, err = cmpp.ValidateStream(cmpp.V30, bytes.NewReader(bad))
+	if err != cmpp.ErrTotalLengthInvalid {
+		t.Fatalf("The error is %#v, not equal to expected: %#v\n", err, cmpp.ErrTotalLengthInvalid)
+	}
+	expected = []cmpp.FrameInfo{{CommandId: cmpp.CMPP_TERMINATE, TotalLen: 0xffff, Err: cmpp.ErrTotalLengthInvalid}}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("The frames are %+v, not equal to expected: %+v\n", frames, expected)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrSeqIdInFlight is returned when a submit request is sent with the seqId
+// of another one, the response of which has not been received.
+var ErrSeqIdInFlight = errors.New("seqId of the submit request is already in flight")
+
+var errWindowCanceled = errors.New("submit window wait is canceled")
+
+// window limits the count of outstanding submit requests, those
+// have been sent but the response of which has not been received.
+type window struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	sync.Mutex
+	pending map[uint32]*time.Timer // seqId -> timer for reclaiming the slot
+
+	closed chan struct{}
+	once   sync.Once
+
+	// reclaimed is called with the seqId whose slot is reclaimed
+	// after timeout, if it is set.
+	reclaimed func(seqId uint32)
+}
+
+func newWindow(size int, timeout time.Duration) *window {
+	return &window{
+		slots:   make(chan struct{}, size),
+		timeout: timeout,
+		pending: make(map[uint32]*time.Timer),
+		closed:  make(chan struct{}),
+	}
+}
+
+// acquire takes a slot for the submit request with seqId, it blocks until
+// a slot is available, the deadline(if not zero) is exceeded, cancel is
+// closed or the window is closed. A seqId which holds a slot already is
+// rejected with ErrSeqIdInFlight.
+func (w *window) acquire(seqId uint32, deadline time.Time, cancel <-chan struct{}) error {
+	if w.holds(seqId) {
+		return ErrSeqIdInFlight
+	}
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case w.slots <- struct{}{}:
+	case <-w.closed:
+		return ErrConnIsClosed
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-cancel:
+		return errWindowCanceled
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.pending[seqId]; ok {
+		<-w.slots // taken by a concurrent acquire with the same seqId.
+		return ErrSeqIdInFlight
+	}
+
+	var t *time.Timer
+	if w.timeout > 0 {
+		t = time.AfterFunc(w.timeout, func() {
+			if w.release(seqId) && w.reclaimed != nil {
+				w.reclaimed(seqId)
+			}
+		})
+	}
+	w.pending[seqId] = t
+	return nil
+}
+
+func (w *window) holds(seqId uint32) bool {
+	w.Lock()
+	defer w.Unlock()
+	_, ok := w.pending[seqId]
+	return ok
+}
+
+// release gives back the slot taken by the submit request with seqId.
+// It does nothing and returns false if the slot has been released.
+func (w *window) release(seqId uint32) bool {
+	w.Lock()
+	t, ok := w.pending[seqId]
+	if ok {
+		delete(w.pending, seqId)
+	}
+	w.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if t != nil {
+		t.Stop()
+	}
+	<-w.slots
+	return true
+}
+
+func (w *window) close() {
+	w.once.Do(func() {
+		close(w.closed)
+	})
+}
+
+// WithSubmitWindow limits the count of outstanding submit requests sent
+// on the Conn to size: once size submit requests are waiting for their
+// responses, SendPkt blocks until a submit response with a matching seqId
+// is received by RecvAndUnpackPkt. A slot whose response does not come back
+// within timeout is reclaimed, zero timeout means waiting forever.
+// SendPktTimeout and SendPktContext give up waiting for a slot once the
+// timeout or the context fires. A submit request sent with the seqId of
+// one still waiting for its response fails with ErrSeqIdInFlight.
+//
+// Packets other than submit requests are not limited.
+func WithSubmitWindow(size int, timeout time.Duration) Option {
+	return func(c *Conn) {
+		if size > 0 {
+			c.window = newWindow(size, timeout)
+		}
+	}
+}
+
+func isSubmitReq(p Packer) bool {
+	switch p.(type) {
+	case *Cmpp2SubmitReqPkt, *Cmpp3SubmitReqPkt:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Tony Bai.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmpp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bigwhite/gocmpp"
+)
+
+func newSubmitReqPkt() *cmpp.Cmpp3SubmitReqPkt {
+	return &cmpp.Cmpp3SubmitReqPkt{
+		FeeType:        feeType,
+		DestUsrTl:      destUsrTl,
+		DestTerminalId: destTerminalId,
+	}
+}
+
+func TestSubmitWindowTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(2, 100*time.Millisecond))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	// the peer never sends back the submit responses.
+	go io.Copy(io.Discard, c2)
+
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		err := c.SendPkt(newSubmitReqPkt(), uint32(i))
+		if err != nil {
+			t.Fatal("SendPkt error:", err)
+		}
+	}
+
+	// the 3rd submit waits for a slot to be reclaimed.
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("The 3rd submit is sent after %v, earlier than the slot timeout\n", d)
+	}
+
+	// other packets are not limited.
+	err := c.SendPkt(&cmpp.CmppActiveTestReqPkt{}, 4)
+	if err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+}
+
+func TestSubmitWindowRelease(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(1, 0))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	peer := &cmpp.Conn{
+		Conn:  c2,
+		State: cmpp.CONN_AUTHOK,
+		Typ:   cmpp.V30,
+	}
+
+	// the peer answers every submit request.
+	go func() {
+		for {
+			i, err := peer.RecvAndUnpackPkt(0)
+			if err != nil {
+				return
+			}
+			if p, ok := i.(*cmpp.Cmpp3SubmitReqPkt); ok {
+				peer.SendPkt(&cmpp.Cmpp3SubmitRspPkt{}, p.SeqId)
+			}
+		}
+	}()
+
+	// read the responses.
+	go func() {
+		for {
+			if _, err := c.RecvAndUnpackPkt(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= 10; i++ {
+			err := c.SendPkt(newSubmitReqPkt(), uint32(i))
+			if err != nil {
+				t.Error("SendPkt error:", err)
+				break
+			}
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The submits are blocked by the window")
+	}
+}
+
+func TestSubmitWindowWaitTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(1, 0))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	go io.Copy(io.Discard, c2)
+
+	if err := c.SendPkt(newSubmitReqPkt(), 1); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+
+	// the window is full, the waiting gives up with the timeout.
+	err := c.SendPktTimeout(newSubmitReqPkt(), 2, 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, os.ErrDeadlineExceeded)
+	}
+
+	// and with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.SendPktContext(ctx, newSubmitReqPkt(), 3)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSubmitWindowDuplicateSeqId(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	c := cmpp.NewConnWithOptions(c1, cmpp.V30, cmpp.WithSubmitWindow(2, 0))
+	defer c.Close()
+	c.SetState(cmpp.CONN_AUTHOK)
+
+	go io.Copy(io.Discard, c2)
+
+	if err := c.SendPkt(newSubmitReqPkt(), 1); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+	if err := c.SendPkt(newSubmitReqPkt(), 1); err != cmpp.ErrSeqIdInFlight {
+		t.Fatalf("The error is %v, not equal to expected: %v\n", err, cmpp.ErrSeqIdInFlight)
+	}
+
+	// the duplicate takes no slot, the second one is still free.
+	if err := c.SendPktTimeout(newSubmitReqPkt(), 2, 50*time.Millisecond); err != nil {
+		t.Fatal("SendPkt error:", err)
+	}
+}